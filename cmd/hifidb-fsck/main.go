@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+func main() {
+	dir := flag.String("dir", "./data", "database dir path")
+	repair := flag.Bool("repair", false, "repair the database dir")
+	flag.Parse()
+
+	var report *kv.VerifyReport
+	var err error
+	if *repair {
+		report, err = kv.Repair(*dir)
+	} else {
+		report, err = kv.Verify(*dir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hifidb-fsck: %v\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("checked %d data files, %d records\n", report.DataFiles, report.Records)
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	for _, action := range report.Repaired {
+		fmt.Println("repaired:", action)
+	}
+	if !report.OK() && !*repair {
+		os.Exit(1)
+	}
+}
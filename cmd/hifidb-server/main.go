@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/kv"
+	"github.com/kamijoucen/hifidb/pkg/server"
+)
+
+func main() {
+	// 默认只监听本机，对外提供服务时需要显式指定地址
+	addr := flag.String("addr", "127.0.0.1:6380", "listen address")
+	dir := flag.String("dir", "./data", "database dir path")
+	index := flag.String("index", "btree", "memory index type: btree, radix or bptree")
+	syncWrites := flag.Bool("sync", false, "sync every write to disk")
+	mergeInterval := flag.Duration("merge-interval", time.Minute, "background merge check interval, 0 to disable")
+	flag.Parse()
+
+	options := kv.GetDBDefaultOptions()
+	options.DirPath = *dir
+	options.SyncWrites = *syncWrites
+	options.MergeCheckInterval = *mergeInterval
+	switch strings.ToLower(*index) {
+	case "btree":
+		options.MemoryIndexType = kv.BTree
+	case "radix", "art":
+		options.MemoryIndexType = kv.RadixTree
+	case "bptree":
+		options.MemoryIndexType = kv.BPlusTree
+	default:
+		log.Fatalf("unknown index type: %s", *index)
+	}
+
+	db, err := kv.Open(options)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+
+	srv := server.NewServer(db)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		_ = srv.Close()
+	}()
+
+	log.Printf("hifidb server listening on %s", *addr)
+	if err := srv.ListenAndServe(*addr); err != nil {
+		_ = db.Close()
+		log.Fatalf("server error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Fatalf("failed to close database: %v", err)
+	}
+}
@@ -5,13 +5,17 @@ go 1.25
 require (
 	github.com/gofrs/flock v0.13.0
 	github.com/google/btree v1.1.3
-	github.com/plar/go-adaptive-radix-tree/v2 v2.0.4
+	github.com/hashicorp/go-immutable-radix/v2 v2.1.0
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.31
+	go.etcd.io/bbolt v1.4.0
+	golang.org/x/sys v0.40.0
 )
 
 require (
+	github.com/hashicorp/golang-lru/v2 v2.0.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 )
 
 require (
@@ -3,13 +3,43 @@ package errs
 import "errors"
 
 var (
-	ErrKeyIsEmpty        = errors.New("the key is empty")
-	ErrIndexUpdateFailed = errors.New("index update failed")
-	ErrKeyNotFound       = errors.New("key not found")
-	ErrDataFileNotFound  = errors.New("data file not found")
-	ErrDataDirCorrupted  = errors.New("data dir corrupted")
-	ErrInvalidCRC        = errors.New("invalid crc")
-	ErrExceedMaxFileSize = errors.New("exceed max file size")
-	ErrMergeIsProgress   = errors.New("merge is progress")
-	ErrDataBaseIsUsing   = errors.New("database is using")
+	ErrKeyIsEmpty              = errors.New("the key is empty")
+	ErrIndexUpdateFailed       = errors.New("index update failed")
+	ErrKeyNotFound             = errors.New("key not found")
+	ErrDataFileNotFound        = errors.New("data file not found")
+	ErrDataDirCorrupted        = errors.New("data dir corrupted")
+	ErrInvalidCRC              = errors.New("invalid crc")
+	ErrIncompleteRecord        = errors.New("incomplete log record")
+	ErrInvalidCompressedValue  = errors.New("invalid compressed value")
+	ErrEncryptionKeyRequired   = errors.New("encryption key required")
+	ErrEncryptionKeyNotFound   = errors.New("encryption key not found")
+	ErrDecryptFailed           = errors.New("decrypt failed")
+	ErrExceedMaxFileSize       = errors.New("exceed max file size")
+	ErrMergeIsProgress         = errors.New("merge is progress")
+	ErrDataBaseIsUsing         = errors.New("database is using")
+	ErrNoEnoughSpaceForMerge   = errors.New("no enough disk space for merge")
+	ErrBackupIsProgress        = errors.New("backup is progress")
+	ErrDirIsNotEmpty           = errors.New("dir is not empty")
+	ErrInvalidTTL              = errors.New("ttl must be positive")
+	ErrInvalidKeyRange         = errors.New("the start key must be less than the end key")
+	ErrIteratorKeysOnly        = errors.New("the iterator only reads keys")
+	ErrFileIsReadOnly          = errors.New("the data file is read only")
+	ErrTxnConflict             = errors.New("transaction conflict")
+	ErrTxnReadOnly             = errors.New("transaction is read only")
+	ErrColumnFamilyNameIsEmpty = errors.New("the column family name is empty")
+	ErrColumnFamilyExists      = errors.New("column family already exists")
+	ErrColumnFamilyNotFound    = errors.New("column family not found")
+	ErrDropDefaultColumnFamily = errors.New("cannot drop the default column family")
+	ErrReadOnlyReplica         = errors.New("database is a read only replica")
+	ErrReplicationOutOfSync    = errors.New("replica is out of sync with the primary")
+	ErrNotLeader               = errors.New("node is not the raft leader")
+	ErrLeadershipLost          = errors.New("leadership lost before the entry was applied")
+	ErrRaftTimeout             = errors.New("raft request timed out")
+	ErrRaftClosed              = errors.New("raft node is closed")
+	ErrMembershipChanging      = errors.New("another membership change is in progress")
+	ErrMemberExists            = errors.New("raft member already exists")
+	ErrMemberNotFound          = errors.New("raft member not found")
+	ErrVertexNotFound          = errors.New("vertex not found")
+	ErrEdgeNotFound            = errors.New("edge not found")
+	ErrWrongType               = errors.New("operation against a key holding the wrong kind of value")
 )
@@ -0,0 +1,140 @@
+package graph
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// 图数据的key布局，key都保存在图的列族中，key中的每个部分都带有长度前缀，保证前缀迭代不会匹配到其他顶点
+// 顶点    'v' | id                 -> label | 属性
+// 出边    'o' | from | label | to  -> 属性
+// 入边    'i' | to | label | from  -> 空
+// 按 'o' | id 或 'o' | id | label 前缀迭代即得到出边邻接表，入边同理
+const (
+	vertexKeyTag  byte = 'v'
+	outEdgeKeyTag byte = 'o'
+	inEdgeKeyTag  byte = 'i'
+)
+
+var errInvalidGraphData = errors.New("invalid graph data")
+
+// appendPart 追加一个带长度前缀的部分
+func appendPart(buf, part []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(part)))
+	return append(buf, part...)
+}
+
+// readPart 读取一个带长度前缀的部分，返回该部分与剩余的数据
+func readPart(buf []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || uint64(len(buf)-size) < n {
+		return nil, nil, errInvalidGraphData
+	}
+	end := size + int(n)
+	return buf[size:end], buf[end:], nil
+}
+
+func encodeKey(tag byte, parts ...[]byte) []byte {
+	buf := []byte{tag}
+	for _, part := range parts {
+		buf = appendPart(buf, part)
+	}
+	return buf
+}
+
+func vertexKey(id []byte) []byte {
+	return encodeKey(vertexKeyTag, id)
+}
+
+func outEdgeKey(from []byte, label string, to []byte) []byte {
+	return encodeKey(outEdgeKeyTag, from, []byte(label), to)
+}
+
+func inEdgeKey(to []byte, label string, from []byte) []byte {
+	return encodeKey(inEdgeKeyTag, to, []byte(label), from)
+}
+
+// edgeKeyPrefix 邻接表前缀，label为空时包含所有label的边
+func edgeKeyPrefix(tag byte, id []byte, label string) []byte {
+	if label == "" {
+		return encodeKey(tag, id)
+	}
+	return encodeKey(tag, id, []byte(label))
+}
+
+// decodeEdgeKey 解析边的key，返回起点所在部分、label与终点所在部分
+func decodeEdgeKey(key []byte) ([]byte, string, []byte, error) {
+	if len(key) == 0 {
+		return nil, "", nil, errInvalidGraphData
+	}
+	first, rest, err := readPart(key[1:])
+	if err != nil {
+		return nil, "", nil, err
+	}
+	label, rest, err := readPart(rest)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	second, _, err := readPart(rest)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return first, string(label), second, nil
+}
+
+// encodeProperties 属性按名称排序编码 count | name | value ...
+func encodeProperties(buf []byte, props Properties) []byte {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = appendPart(buf, []byte(name))
+		buf = appendPart(buf, props[name])
+	}
+	return buf
+}
+
+func decodeProperties(buf []byte) (Properties, error) {
+	count, size := binary.Uvarint(buf)
+	if size <= 0 {
+		return nil, errInvalidGraphData
+	}
+	buf = buf[size:]
+
+	props := make(Properties, count)
+	for range count {
+		name, rest, err := readPart(buf)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := readPart(rest)
+		if err != nil {
+			return nil, err
+		}
+		props[string(name)] = append([]byte(nil), value...)
+		buf = rest
+	}
+	return props, nil
+}
+
+func encodeVertex(label string, props Properties) []byte {
+	buf := appendPart(nil, []byte(label))
+	return encodeProperties(buf, props)
+}
+
+func decodeVertex(id, buf []byte) (*Vertex, error) {
+	label, rest, err := readPart(buf)
+	if err != nil {
+		return nil, err
+	}
+	props, err := decodeProperties(rest)
+	if err != nil {
+		return nil, err
+	}
+	return &Vertex{Id: id, Label: string(label), Props: props}, nil
+}
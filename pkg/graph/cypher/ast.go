@@ -0,0 +1,130 @@
+package cypher
+
+// 关系方向
+const (
+	directionBoth = iota // -[]-
+	directionOut         // -[]->
+	directionIn          // <-[]-
+)
+
+// Query 解析后的查询语句，可以重复执行
+type Query struct {
+	clauses []clause
+}
+
+type clause interface {
+	isClause()
+}
+
+type nodePattern struct {
+	variable string
+	label    string
+	props    map[string]expr
+}
+
+type relPattern struct {
+	variable  string
+	relType   string
+	props     map[string]expr
+	direction int
+}
+
+// pattern 路径模式，nodes 比 rels 多一个
+type pattern struct {
+	nodes []*nodePattern
+	rels  []*relPattern
+}
+
+type matchClause struct {
+	patterns []*pattern
+	where    expr
+}
+
+type createClause struct {
+	patterns []*pattern
+}
+
+type mergeClause struct {
+	pattern *pattern
+}
+
+type setItem struct {
+	variable string
+	property string
+	value    expr
+}
+
+type setClause struct {
+	items []*setItem
+}
+
+type deleteClause struct {
+	variables []string
+	detach    bool
+}
+
+type returnItem struct {
+	expr  expr
+	alias string
+}
+
+type returnClause struct {
+	items    []*returnItem
+	star     bool
+	distinct bool
+	skip     expr
+	limit    expr
+}
+
+func (*matchClause) isClause()  {}
+func (*createClause) isClause() {}
+func (*mergeClause) isClause()  {}
+func (*setClause) isClause()    {}
+func (*deleteClause) isClause() {}
+func (*returnClause) isClause() {}
+
+// 表达式
+type expr interface {
+	eval(ctx *evalContext) (any, error)
+}
+
+type literalExpr struct {
+	value any
+}
+
+type paramExpr struct {
+	name string
+}
+
+type variableExpr struct {
+	name string
+}
+
+type propertyExpr struct {
+	target expr
+	key    string
+}
+
+type funcExpr struct {
+	name string // 小写的函数名
+	args []expr
+}
+
+type binaryExpr struct {
+	op    string // 大写的运算符
+	left  expr
+	right expr
+}
+
+type notExpr struct {
+	expr expr
+}
+
+type negateExpr struct {
+	expr expr
+}
+
+type isNullExpr struct {
+	expr expr
+	not  bool
+}
@@ -0,0 +1,133 @@
+package cypher
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/graph"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestGraph(t *testing.T) *graph.Graph {
+	opts := kv.GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "hifidb-cypher")
+	opts.DirPath = dir
+	db, err := kv.Open(opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	g, err := graph.NewGraph(db)
+	assert.Nil(t, err)
+	return g
+}
+
+func mustExecute(t *testing.T, g *graph.Graph, query string, params map[string]any) *Result {
+	result, err := Execute(g, query, params)
+	assert.Nil(t, err, query)
+	return result
+}
+
+func TestParse(t *testing.T) {
+	queries := []string{
+		"MATCH (a:Person {name: 'alice'})-[r:KNOWS]->(b) WHERE b.age >= 18 AND NOT b.name STARTS WITH 'x' RETURN a, b.name AS name LIMIT 10",
+		"MATCH (a)<-[:KNOWS]-(b)--(c) RETURN DISTINCT c SKIP 1",
+		"CREATE (a:Person {name: $name})-[:KNOWS {since: 2020}]->(b:Person)",
+		"MERGE (a:Person {name: \"bob\"}) SET a.age = 30, a.score = -1.5",
+		"MATCH (n) WHERE n.name IN ['a', 'b'] OR n.age IS NOT NULL DETACH DELETE n",
+		"match (n) return id(n), labels(n) // comment",
+	}
+	for _, query := range queries {
+		_, err := Parse(query)
+		assert.Nil(t, err, query)
+	}
+
+	invalid := []string{
+		"",
+		"MATCH (a",
+		"MATCH (a)<-[r]->(b) RETURN a",
+		"RETURN 1 MATCH (n)",
+		"MATCH (n) WHERE n.name = 'abc RETURN n",
+		"MATCH (n) RETURN n LIMIT",
+	}
+	for _, query := range invalid {
+		_, err := Parse(query)
+		assert.True(t, errors.Is(err, ErrSyntax), query)
+	}
+}
+
+func TestExecute_CreateAndMatch(t *testing.T) {
+	g := openTestGraph(t)
+
+	mustExecute(t, g, `CREATE (a:Person {name: 'alice', age: 30})-[:KNOWS {since: 2020}]->(b:Person {name: 'bob', age: 17}),
+		(a)-[:KNOWS]->(c:Person {name: 'carol', age: 25}), (c)-[:LIKES]->(:Movie {title: 'Up'})`, nil)
+
+	result := mustExecute(t, g, "MATCH (a:Person {name: 'alice'})-[:KNOWS]->(b) WHERE b.age >= 18 RETURN b.name AS name", nil)
+	assert.Equal(t, []string{"name"}, result.Columns)
+	assert.Equal(t, [][]any{{"carol"}}, result.Rows)
+
+	// 参数与两跳扩展
+	result = mustExecute(t, g, "MATCH (a {name: $name})-[:KNOWS]->()-[:LIKES]->(m:Movie) RETURN m.title", map[string]any{"name": "alice"})
+	assert.Equal(t, []string{"m.title"}, result.Columns)
+	assert.Equal(t, [][]any{{"Up"}}, result.Rows)
+
+	// 入边与无方向
+	result = mustExecute(t, g, "MATCH (b:Person)<-[r:KNOWS]-(a) WHERE r.since = 2020 RETURN b.name, type(r)", nil)
+	assert.Equal(t, [][]any{{"bob", "KNOWS"}}, result.Rows)
+	result = mustExecute(t, g, "MATCH (c {name: 'carol'})--(x) RETURN x.name, x.title", nil)
+	assert.Equal(t, 2, len(result.Rows))
+
+	result = mustExecute(t, g, "MATCH (p:Person) RETURN p.name LIMIT 2", nil)
+	assert.Equal(t, 2, len(result.Rows))
+	result = mustExecute(t, g, "MATCH (p:Person)-[:KNOWS]->() RETURN DISTINCT p.name", nil)
+	assert.Equal(t, [][]any{{"alice"}}, result.Rows)
+	result = mustExecute(t, g, "MATCH (p:Person) WHERE p.name IN ['bob', 'carol'] AND p.name ENDS WITH 'ol' RETURN p.name", nil)
+	assert.Equal(t, [][]any{{"carol"}}, result.Rows)
+
+	// 已绑定的节点作为扩展起点
+	result = mustExecute(t, g, "MATCH (b {name: 'bob'}) MATCH (a)-[:KNOWS]->(b) RETURN a.name", nil)
+	assert.Equal(t, [][]any{{"alice"}}, result.Rows)
+}
+
+func TestExecute_MergeSetDelete(t *testing.T) {
+	g := openTestGraph(t)
+
+	mustExecute(t, g, "MERGE (a:Person {name: 'alice'})", nil)
+	mustExecute(t, g, "MERGE (a:Person {name: 'alice'})", nil)
+	result := mustExecute(t, g, "MATCH (a:Person) RETURN a", nil)
+	assert.Equal(t, 1, len(result.Rows))
+	id := string(result.Rows[0][0].(*graph.Vertex).Id)
+
+	mustExecute(t, g, "MATCH (a:Person {name: 'alice'}) SET a.age = 31, a.name = null", nil)
+	result = mustExecute(t, g, "MATCH (a:Person) RETURN id(a), a.age, a.name", nil)
+	assert.Equal(t, [][]any{{id, "31", nil}}, result.Rows)
+
+	mustExecute(t, g, "MATCH (a:Person) MERGE (a)-[:OWNS]->(c:Car {brand: 'x'})", nil)
+	mustExecute(t, g, "MATCH (a:Person) MERGE (a)-[:OWNS]->(c:Car {brand: 'x'})", nil)
+	result = mustExecute(t, g, "MATCH (:Person)-[r:OWNS]->(c:Car) RETURN c.brand", nil)
+	assert.Equal(t, 1, len(result.Rows))
+
+	_, err := Execute(g, "MATCH (a:Person) DELETE a", nil)
+	assert.NotNil(t, err)
+	// 有一个顶点不能删除时其他顶点都不删除
+	for range 5 {
+		mustExecute(t, g, "CREATE (:Tmp)", nil)
+	}
+	_, err = Execute(g, "MATCH (n) DELETE n", nil)
+	assert.NotNil(t, err)
+	result = mustExecute(t, g, "MATCH (n) RETURN n", nil)
+	assert.Equal(t, 7, len(result.Rows))
+	mustExecute(t, g, "MATCH (n:Tmp) DELETE n", nil)
+	mustExecute(t, g, "MATCH (a:Person)-[r:OWNS]->(c) DELETE r, c", nil)
+	mustExecute(t, g, "MATCH (a:Person) DELETE a", nil)
+	result = mustExecute(t, g, "MATCH (n) RETURN n", nil)
+	assert.Equal(t, 0, len(result.Rows))
+
+	mustExecute(t, g, "CREATE (a:Person)-[:KNOWS]->(b:Person)", nil)
+	mustExecute(t, g, "MATCH (a:Person) DETACH DELETE a", nil)
+	result = mustExecute(t, g, "MATCH (n) RETURN n", nil)
+	assert.Equal(t, 0, len(result.Rows))
+}
@@ -0,0 +1,664 @@
+package cypher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/graph"
+)
+
+// Result 查询结果，没有 RETURN 子句时为空
+// 顶点与边以 *graph.Vertex 与 *graph.Edge 返回，属性以string返回
+type Result struct {
+	Columns []string
+	Rows    [][]any
+}
+
+// Execute 解析并执行查询语句
+func Execute(g *graph.Graph, query string, params map[string]any) (*Result, error) {
+	q, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return q.Execute(g, params)
+}
+
+type edgeId struct {
+	from, label, to string
+}
+
+// executor 一次查询的执行状态
+// 同一次查询中同一个顶点或边共享一个对象，SET 的修改对所有行可见
+type executor struct {
+	g        *graph.Graph
+	params   map[string]any
+	vertices map[string]*graph.Vertex
+	edges    map[edgeId]*graph.Edge
+}
+
+// Execute 执行查询，每个修改单独通过 WriteBatch 原子提交，整个查询不是一个事务
+func (q *Query) Execute(g *graph.Graph, params map[string]any) (*Result, error) {
+	ex := &executor{
+		g:        g,
+		params:   params,
+		vertices: map[string]*graph.Vertex{},
+		edges:    map[edgeId]*graph.Edge{},
+	}
+
+	rows := []map[string]any{{}}
+	var err error
+	for _, c := range q.clauses {
+		switch c := c.(type) {
+		case *matchClause:
+			rows, err = ex.match(rows, c)
+		case *createClause:
+			rows, err = ex.create(rows, c)
+		case *mergeClause:
+			rows, err = ex.merge(rows, c)
+		case *setClause:
+			err = ex.set(rows, c)
+		case *deleteClause:
+			err = ex.delete(rows, c)
+		case *returnClause:
+			return ex.project(rows, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Result{}, nil
+}
+
+func (ex *executor) match(rows []map[string]any, c *matchClause) ([]map[string]any, error) {
+	var results []map[string]any
+	for _, row := range rows {
+		matched := []map[string]any{row}
+		for _, pt := range c.patterns {
+			var next []map[string]any
+			for _, r := range matched {
+				found, err := ex.matchPattern(r, pt)
+				if err != nil {
+					return nil, err
+				}
+				next = append(next, found...)
+			}
+			matched = next
+		}
+
+		for _, r := range matched {
+			if c.where != nil {
+				ok, err := ex.evalBool(r, c.where)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// matchPattern 从已绑定的节点开始匹配，没有已绑定的节点时从第一个节点按label扫描
+// 之后沿关系通过邻接表的前缀迭代向两侧扩展
+func (ex *executor) matchPattern(row map[string]any, pt *pattern) ([]map[string]any, error) {
+	start := 0
+	for i, node := range pt.nodes {
+		if _, ok := row[node.variable]; node.variable != "" && ok {
+			start = i
+			break
+		}
+	}
+
+	candidates, err := ex.nodeCandidates(row, pt.nodes[start])
+	if err != nil {
+		return nil, err
+	}
+	var results []map[string]any
+	for _, v := range candidates {
+		r := bind(row, pt.nodes[start].variable, v)
+		if err := ex.expandPath(pt, start, start, v, v, r, nil, &results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// expandPath 先向右扩展到最后一个节点，再向左扩展到第一个节点
+func (ex *executor) expandPath(pt *pattern, left, right int, leftV, rightV *graph.Vertex,
+	row map[string]any, used []*graph.Edge, results *[]map[string]any) error {
+
+	var from *graph.Vertex
+	var rel *relPattern
+	var to *nodePattern
+	direction := 0
+	if right < len(pt.rels) {
+		from, rel, to = rightV, pt.rels[right], pt.nodes[right+1]
+		direction = rel.direction
+	} else if left > 0 {
+		// 向左扩展时关系的方向相反
+		from, rel, to = leftV, pt.rels[left-1], pt.nodes[left-1]
+		direction = reverseDirection(rel.direction)
+	} else {
+		*results = append(*results, row)
+		return nil
+	}
+
+	edges, err := ex.adjacentEdges(from, rel.relType, direction)
+	if err != nil {
+		return err
+	}
+	for _, e := range edges {
+		// 同一条路径中的关系不能重复
+		if containsEdge(used, e) {
+			continue
+		}
+		if ok, err := ex.relMatches(row, rel, e); err != nil || !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		otherId := e.To
+		if string(e.To) == string(from.Id) && string(e.From) != string(from.Id) {
+			otherId = e.From
+		}
+		other, err := ex.vertex(otherId)
+		if err != nil {
+			return err
+		}
+		if ok, err := ex.nodeMatches(row, to, other); err != nil || !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		r := bind(bind(row, rel.variable, e), to.variable, other)
+		nextUsed := append(append([]*graph.Edge(nil), used...), e)
+		if right < len(pt.rels) {
+			err = ex.expandPath(pt, left, right+1, leftV, other, r, nextUsed, results)
+		} else {
+			err = ex.expandPath(pt, left-1, right, other, rightV, r, nextUsed, results)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adjacentEdges 获取顶点在指定方向上的边
+func (ex *executor) adjacentEdges(v *graph.Vertex, relType string, direction int) ([]*graph.Edge, error) {
+	var edges []*graph.Edge
+	if direction != directionIn {
+		out, err := ex.g.OutEdges(v.Id, relType)
+		if err != nil {
+			return nil, err
+		}
+		edges = append(edges, out...)
+	}
+	if direction != directionOut {
+		in, err := ex.g.InEdges(v.Id, relType)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range in {
+			// 无方向时自环边在出边中已经出现过
+			if direction == directionBoth && string(e.From) == string(e.To) {
+				continue
+			}
+			edges = append(edges, e)
+		}
+	}
+	for i, e := range edges {
+		edges[i] = ex.internEdge(e)
+	}
+	return edges, nil
+}
+
+func (ex *executor) nodeCandidates(row map[string]any, node *nodePattern) ([]*graph.Vertex, error) {
+	if bound, ok := row[node.variable]; node.variable != "" && ok {
+		v, ok := bound.(*graph.Vertex)
+		if !ok {
+			return nil, fmt.Errorf("cypher: variable `%s` is not a node", node.variable)
+		}
+		if matched, err := ex.nodeMatches(row, node, v); err != nil || !matched {
+			return nil, err
+		}
+		return []*graph.Vertex{v}, nil
+	}
+
+	vertices, err := ex.g.Vertices(node.label)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]*graph.Vertex, 0, len(vertices))
+	for _, v := range vertices {
+		v = ex.internVertex(v)
+		matched, err := ex.nodeMatches(row, node, v)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			candidates = append(candidates, v)
+		}
+	}
+	return candidates, nil
+}
+
+func (ex *executor) nodeMatches(row map[string]any, node *nodePattern, v *graph.Vertex) (bool, error) {
+	if bound, ok := row[node.variable]; node.variable != "" && ok && !equalValues(bound, v) {
+		return false, nil
+	}
+	if node.label != "" && node.label != v.Label {
+		return false, nil
+	}
+	return ex.propsMatch(row, node.props, v.Props)
+}
+
+func (ex *executor) relMatches(row map[string]any, rel *relPattern, e *graph.Edge) (bool, error) {
+	if bound, ok := row[rel.variable]; rel.variable != "" && ok && !equalValues(bound, e) {
+		return false, nil
+	}
+	return ex.propsMatch(row, rel.props, e.Props)
+}
+
+func (ex *executor) propsMatch(row map[string]any, expected map[string]expr, props graph.Properties) (bool, error) {
+	for key, e := range expected {
+		value, err := e.eval(&evalContext{row: row, params: ex.params})
+		if err != nil {
+			return false, err
+		}
+		actual, ok := props[key]
+		if !ok || value == nil || !equalValues(string(actual), value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (ex *executor) create(rows []map[string]any, c *createClause) ([]map[string]any, error) {
+	results := make([]map[string]any, 0, len(rows))
+	for _, row := range rows {
+		var err error
+		for _, pt := range c.patterns {
+			if row, err = ex.createPattern(row, pt); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, row)
+	}
+	return results, nil
+}
+
+// merge 模式存在时绑定所有匹配的结果，否则创建整个模式
+func (ex *executor) merge(rows []map[string]any, c *mergeClause) ([]map[string]any, error) {
+	var results []map[string]any
+	for _, row := range rows {
+		matched, err := ex.matchPattern(row, c.pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matched) > 0 {
+			results = append(results, matched...)
+			continue
+		}
+		created, err := ex.createPattern(row, c.pattern)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, created)
+	}
+	return results, nil
+}
+
+func (ex *executor) createPattern(row map[string]any, pt *pattern) (map[string]any, error) {
+	vertices := make([]*graph.Vertex, len(pt.nodes))
+	for i, node := range pt.nodes {
+		if bound, ok := row[node.variable]; node.variable != "" && ok {
+			v, ok := bound.(*graph.Vertex)
+			if !ok {
+				return nil, fmt.Errorf("cypher: variable `%s` is not a node", node.variable)
+			}
+			vertices[i] = v
+			continue
+		}
+
+		props, err := ex.evalProps(row, node.props)
+		if err != nil {
+			return nil, err
+		}
+		v := &graph.Vertex{Id: newVertexId(), Label: node.label, Props: props}
+		if err := ex.g.AddVertex(v.Id, v.Label, v.Props); err != nil {
+			return nil, err
+		}
+		vertices[i] = ex.internVertex(v)
+		row = bind(row, node.variable, vertices[i])
+	}
+
+	for i, rel := range pt.rels {
+		if _, ok := row[rel.variable]; rel.variable != "" && ok {
+			return nil, fmt.Errorf("cypher: variable `%s` already declared", rel.variable)
+		}
+		if rel.relType == "" {
+			return nil, fmt.Errorf("cypher: relationship type is required in CREATE")
+		}
+		from, to := vertices[i], vertices[i+1]
+		switch rel.direction {
+		case directionBoth:
+			return nil, fmt.Errorf("cypher: relationship direction is required in CREATE")
+		case directionIn:
+			from, to = to, from
+		}
+
+		props, err := ex.evalProps(row, rel.props)
+		if err != nil {
+			return nil, err
+		}
+		if err := ex.g.AddEdge(from.Id, rel.relType, to.Id, props); err != nil {
+			return nil, err
+		}
+		e := ex.internEdge(&graph.Edge{From: from.Id, Label: rel.relType, To: to.Id, Props: props})
+		e.Props = props
+		row = bind(row, rel.variable, e)
+	}
+	return row, nil
+}
+
+func (ex *executor) set(rows []map[string]any, c *setClause) error {
+	for _, row := range rows {
+		for _, item := range c.items {
+			target, ok := row[item.variable]
+			if !ok {
+				return fmt.Errorf("cypher: variable `%s` not defined", item.variable)
+			}
+			value, err := item.value.eval(&evalContext{row: row, params: ex.params})
+			if err != nil {
+				return err
+			}
+
+			switch t := target.(type) {
+			case nil:
+				continue
+			case *graph.Vertex:
+				if err := setProperty(t.Props, item.property, value); err != nil {
+					return err
+				}
+				err = ex.g.AddVertex(t.Id, t.Label, t.Props)
+			case *graph.Edge:
+				if err := setProperty(t.Props, item.property, value); err != nil {
+					return err
+				}
+				err = ex.g.AddEdge(t.From, t.Label, t.To, t.Props)
+			default:
+				return fmt.Errorf("cypher: can not set property on %T", target)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delete 先删除所有的边再删除顶点，同一条语句中删除的边不会阻止删除顶点
+// 不是 DETACH 时先检查所有顶点，存在其他边时不做任何修改
+func (ex *executor) delete(rows []map[string]any, c *deleteClause) error {
+	var vertices []*graph.Vertex
+	var edges []*graph.Edge
+	deletedEdges := map[edgeId]struct{}{}
+	for _, row := range rows {
+		for _, variable := range c.variables {
+			target, ok := row[variable]
+			if !ok {
+				return fmt.Errorf("cypher: variable `%s` not defined", variable)
+			}
+			switch t := target.(type) {
+			case nil:
+			case *graph.Vertex:
+				vertices = append(vertices, t)
+			case *graph.Edge:
+				edges = append(edges, t)
+				deletedEdges[edgeId{from: string(t.From), label: t.Label, to: string(t.To)}] = struct{}{}
+			default:
+				return fmt.Errorf("cypher: can not delete %T", target)
+			}
+		}
+	}
+
+	if !c.detach {
+		for _, v := range vertices {
+			out, err := ex.g.OutEdges(v.Id, "")
+			if err != nil {
+				return err
+			}
+			in, err := ex.g.InEdges(v.Id, "")
+			if err != nil {
+				return err
+			}
+			for _, e := range append(out, in...) {
+				if _, ok := deletedEdges[edgeId{from: string(e.From), label: e.Label, to: string(e.To)}]; !ok {
+					return fmt.Errorf("cypher: can not delete node with relationships, use DETACH DELETE")
+				}
+			}
+		}
+	}
+
+	for _, e := range edges {
+		if err := ex.g.DeleteEdge(e.From, e.Label, e.To); err != nil && !errors.Is(err, errs.ErrEdgeNotFound) {
+			return err
+		}
+	}
+	for _, v := range vertices {
+		if err := ex.g.DeleteVertex(v.Id); err != nil && !errors.Is(err, errs.ErrVertexNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ex *executor) project(rows []map[string]any, c *returnClause) (*Result, error) {
+	result := &Result{}
+	items := c.items
+	if c.star {
+		var names []string
+		if len(rows) > 0 {
+			for name := range rows[0] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			items = append(items, &returnItem{expr: &variableExpr{name: name}, alias: name})
+		}
+	}
+	for _, item := range items {
+		result.Columns = append(result.Columns, item.alias)
+	}
+
+	skip, err := ex.evalCount(c.skip, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := ex.evalCount(c.limit, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if limit >= 0 && int64(len(result.Rows)) >= limit {
+			break
+		}
+		values := make([]any, len(items))
+		for i, item := range items {
+			if values[i], err = item.expr.eval(&evalContext{row: row, params: ex.params}); err != nil {
+				return nil, err
+			}
+		}
+		if c.distinct {
+			key := valueKey(values)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, nil
+}
+
+func (ex *executor) evalBool(row map[string]any, e expr) (bool, error) {
+	value, err := e.eval(&evalContext{row: row, params: ex.params})
+	if err != nil {
+		return false, err
+	}
+	b, _ := value.(bool)
+	return b, nil
+}
+
+// evalCount SKIP 与 LIMIT 的值必须是非负整数
+func (ex *executor) evalCount(e expr, defaultValue int64) (int64, error) {
+	if e == nil {
+		return defaultValue, nil
+	}
+	value, err := e.eval(&evalContext{params: ex.params})
+	if err != nil {
+		return 0, err
+	}
+	n, ok := value.(int64)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("cypher: SKIP and LIMIT expect a non-negative integer")
+	}
+	return n, nil
+}
+
+func (ex *executor) evalProps(row map[string]any, exprs map[string]expr) (graph.Properties, error) {
+	props := graph.Properties{}
+	for key, e := range exprs {
+		value, err := e.eval(&evalContext{row: row, params: ex.params})
+		if err != nil {
+			return nil, err
+		}
+		if err := setProperty(props, key, value); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+func (ex *executor) vertex(id []byte) (*graph.Vertex, error) {
+	if v, ok := ex.vertices[string(id)]; ok {
+		return v, nil
+	}
+	v, err := ex.g.GetVertex(id)
+	if err != nil {
+		return nil, err
+	}
+	return ex.internVertex(v), nil
+}
+
+func (ex *executor) internVertex(v *graph.Vertex) *graph.Vertex {
+	if cached, ok := ex.vertices[string(v.Id)]; ok {
+		return cached
+	}
+	if v.Props == nil {
+		v.Props = graph.Properties{}
+	}
+	ex.vertices[string(v.Id)] = v
+	return v
+}
+
+func (ex *executor) internEdge(e *graph.Edge) *graph.Edge {
+	id := edgeId{from: string(e.From), label: e.Label, to: string(e.To)}
+	if cached, ok := ex.edges[id]; ok {
+		return cached
+	}
+	if e.Props == nil {
+		e.Props = graph.Properties{}
+	}
+	ex.edges[id] = e
+	return e
+}
+
+// setProperty 设置属性，值为null时删除属性
+func setProperty(props graph.Properties, key string, value any) error {
+	if value == nil {
+		delete(props, key)
+		return nil
+	}
+	s, err := formatValue(value)
+	if err != nil {
+		return err
+	}
+	props[key] = []byte(s)
+	return nil
+}
+
+// bind 复制一行并绑定变量，匿名变量不绑定
+func bind(row map[string]any, variable string, value any) map[string]any {
+	if variable == "" {
+		return row
+	}
+	r := make(map[string]any, len(row)+1)
+	for k, v := range row {
+		r[k] = v
+	}
+	r[variable] = value
+	return r
+}
+
+func containsEdge(edges []*graph.Edge, e *graph.Edge) bool {
+	for _, used := range edges {
+		if used == e {
+			return true
+		}
+	}
+	return false
+}
+
+func reverseDirection(direction int) int {
+	switch direction {
+	case directionOut:
+		return directionIn
+	case directionIn:
+		return directionOut
+	}
+	return direction
+}
+
+// valueKey 生成用于 DISTINCT 去重的key
+func valueKey(value any) string {
+	switch v := value.(type) {
+	case *graph.Vertex:
+		return fmt.Sprintf("v%q", v.Id)
+	case *graph.Edge:
+		return fmt.Sprintf("e%q%q%q", v.From, v.Label, v.To)
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = valueKey(item)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	}
+	return fmt.Sprintf("%T%v", value, value)
+}
+
+// newVertexId CREATE 创建的顶点使用随机id，可以通过 id(n) 获取
+func newVertexId() []byte {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return []byte(hex.EncodeToString(buf))
+}
@@ -0,0 +1,440 @@
+package cypher
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/kamijoucen/hifidb/pkg/graph"
+)
+
+// 表达式的值为 nil、bool、int64、float64、string、[]any、*graph.Vertex、*graph.Edge
+// 属性以字节存储，读取后为string，与数字或布尔值比较时按对方的类型解析
+
+type evalContext struct {
+	row    map[string]any
+	params map[string]any
+}
+
+func (e *literalExpr) eval(ctx *evalContext) (any, error) {
+	return e.value, nil
+}
+
+func (e *paramExpr) eval(ctx *evalContext) (any, error) {
+	value, ok := ctx.params[e.name]
+	if !ok {
+		return nil, fmt.Errorf("cypher: missing parameter $%s", e.name)
+	}
+	return normalizeValue(value)
+}
+
+func (e *variableExpr) eval(ctx *evalContext) (any, error) {
+	value, ok := ctx.row[e.name]
+	if !ok {
+		return nil, fmt.Errorf("cypher: variable `%s` not defined", e.name)
+	}
+	return value, nil
+}
+
+func (e *propertyExpr) eval(ctx *evalContext) (any, error) {
+	target, err := e.target.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var props graph.Properties
+	switch t := target.(type) {
+	case nil:
+		return nil, nil
+	case *graph.Vertex:
+		props = t.Props
+	case *graph.Edge:
+		props = t.Props
+	default:
+		return nil, fmt.Errorf("cypher: can not access property `%s` of %T", e.key, target)
+	}
+	value, ok := props[e.key]
+	if !ok {
+		return nil, nil
+	}
+	return string(value), nil
+}
+
+func (e *funcExpr) eval(ctx *evalContext) (any, error) {
+	args := make([]any, len(e.args))
+	for i, arg := range e.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	if e.name == "list" {
+		return args, nil
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("cypher: function %s expects 1 argument", e.name)
+	}
+
+	arg := args[0]
+	if arg == nil {
+		return nil, nil
+	}
+	switch e.name {
+	case "id":
+		switch t := arg.(type) {
+		case *graph.Vertex:
+			return string(t.Id), nil
+		case *graph.Edge:
+			return string(t.From) + "-" + t.Label + "->" + string(t.To), nil
+		}
+	case "type":
+		if t, ok := arg.(*graph.Edge); ok {
+			return t.Label, nil
+		}
+	case "labels":
+		if t, ok := arg.(*graph.Vertex); ok {
+			if t.Label == "" {
+				return []any{}, nil
+			}
+			return []any{t.Label}, nil
+		}
+	case "tostring":
+		return formatValue(arg)
+	case "tointeger":
+		if f, ok := toNumber(arg); ok {
+			return int64(f), nil
+		}
+		return nil, nil
+	case "tofloat":
+		if f, ok := toNumber(arg); ok {
+			return f, nil
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("cypher: unknown function %s", e.name)
+	}
+	return nil, fmt.Errorf("cypher: invalid argument %T for function %s", arg, e.name)
+}
+
+func (e *binaryExpr) eval(ctx *evalContext) (any, error) {
+	left, err := e.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// AND 与 OR 短路求值，null 按三值逻辑处理
+	switch e.op {
+	case "AND":
+		if left == false {
+			return false, nil
+		}
+	case "OR":
+		if left == true {
+			return true, nil
+		}
+	}
+	right, err := e.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "AND", "OR":
+		return evalLogic(e.op, left, right)
+	case "+", "-":
+		return evalArithmetic(e.op, left, right)
+	}
+
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	switch e.op {
+	case "=":
+		return equalValues(left, right), nil
+	case "<>":
+		return !equalValues(left, right), nil
+	case "<", "<=", ">", ">=":
+		c, ok := compareValues(left, right)
+		if !ok {
+			return nil, nil
+		}
+		switch e.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "STARTS WITH", "ENDS WITH", "CONTAINS":
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if !lok || !rok {
+			return nil, nil
+		}
+		switch e.op {
+		case "STARTS WITH":
+			return strings.HasPrefix(ls, rs), nil
+		case "ENDS WITH":
+			return strings.HasSuffix(ls, rs), nil
+		default:
+			return strings.Contains(ls, rs), nil
+		}
+	case "IN":
+		list, ok := right.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cypher: IN expects a list")
+		}
+		for _, item := range list {
+			if item != nil && equalValues(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("cypher: unknown operator %s", e.op)
+}
+
+func (e *notExpr) eval(ctx *evalContext) (any, error) {
+	value, err := e.expr.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		return !v, nil
+	}
+	return nil, fmt.Errorf("cypher: NOT expects a boolean")
+}
+
+func (e *negateExpr) eval(ctx *evalContext) (any, error) {
+	value, err := e.expr.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		return -v, nil
+	case float64:
+		return -v, nil
+	}
+	return nil, fmt.Errorf("cypher: can not negate %T", value)
+}
+
+func (e *isNullExpr) eval(ctx *evalContext) (any, error) {
+	value, err := e.expr.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return (value == nil) != e.not, nil
+}
+
+func evalLogic(op string, left, right any) (any, error) {
+	lb, lok := left.(bool)
+	rb, rok := right.(bool)
+	if (left != nil && !lok) || (right != nil && !rok) {
+		return nil, fmt.Errorf("cypher: %s expects booleans", op)
+	}
+	if op == "AND" {
+		if (lok && !lb) || (rok && !rb) {
+			return false, nil
+		}
+	} else if (lok && lb) || (rok && rb) {
+		return true, nil
+	}
+	if !lok || !rok {
+		return nil, nil
+	}
+	return op == "AND", nil
+}
+
+func evalArithmetic(op string, left, right any) (any, error) {
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	li, lint := left.(int64)
+	ri, rint := right.(int64)
+	if lint && rint {
+		if op == "+" {
+			return li + ri, nil
+		}
+		return li - ri, nil
+	}
+	_, lnum := left.(float64)
+	_, rnum := right.(float64)
+	if (lnum || lint) && (rnum || rint) {
+		lf, _ := toNumber(left)
+		rf, _ := toNumber(right)
+		if op == "+" {
+			return lf + rf, nil
+		}
+		return lf - rf, nil
+	}
+	if op == "+" {
+		if ls, ok := left.(string); ok {
+			rs, err := formatValue(right)
+			return ls + rs, err
+		}
+		if rs, ok := right.(string); ok {
+			ls, err := formatValue(left)
+			return ls + rs, err
+		}
+	}
+	return nil, fmt.Errorf("cypher: can not apply %s to %T and %T", op, left, right)
+}
+
+// equalValues 判断两个非空值是否相等，类型无法比较时不相等
+func equalValues(left, right any) bool {
+	switch l := left.(type) {
+	case *graph.Vertex:
+		r, ok := right.(*graph.Vertex)
+		return ok && string(l.Id) == string(r.Id)
+	case *graph.Edge:
+		r, ok := right.(*graph.Edge)
+		return ok && string(l.From) == string(r.From) && l.Label == r.Label && string(l.To) == string(r.To)
+	case []any:
+		r, ok := right.([]any)
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if l[i] == nil || r[i] == nil || !equalValues(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	c, ok := compareValues(left, right)
+	return ok && c == 0
+}
+
+// compareValues 比较两个标量，字符串与数字或布尔值比较时按对方的类型解析字符串
+func compareValues(left, right any) (int, bool) {
+	if ls, ok := left.(string); ok {
+		if rs, ok := right.(string); ok {
+			return strings.Compare(ls, rs), true
+		}
+	}
+	if isBool(left) || isBool(right) {
+		lb, lok := toBool(left)
+		rb, rok := toBool(right)
+		if !lok || !rok {
+			return 0, false
+		}
+		switch {
+		case lb == rb:
+			return 0, true
+		case !lb:
+			return -1, true
+		default:
+			return 1, true
+		}
+	}
+
+	li, lint := left.(int64)
+	ri, rint := right.(int64)
+	if lint && rint {
+		return compareOrdered(li, ri), true
+	}
+	lf, lok := toNumber(left)
+	rf, rok := toNumber(right)
+	if !lok || !rok {
+		return 0, false
+	}
+	return compareOrdered(lf, rf), true
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func isBool(value any) bool {
+	_, ok := value.(bool)
+	return ok
+}
+
+func toBool(value any) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+func toNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+// formatValue 将标量格式化为属性存储的字符串
+func formatValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("cypher: %T can not be stored as a property", value)
+}
+
+// normalizeValue 将参数转换为表达式使用的类型
+func normalizeValue(value any) (any, error) {
+	switch v := value.(type) {
+	case nil, bool, int64, float64, string, *graph.Vertex, *graph.Edge:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case []byte:
+		return string(v), nil
+	case []string:
+		list := make([]any, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list, nil
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = normalized
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("cypher: unsupported parameter type %T", value)
+}
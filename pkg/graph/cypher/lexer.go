@@ -0,0 +1,150 @@
+package cypher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrSyntax 查询语句语法错误
+var ErrSyntax = errors.New("cypher syntax error")
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenString
+	tokenInteger
+	tokenFloat
+	tokenParam
+	tokenSymbol
+)
+
+type token struct {
+	typ   tokenType
+	text  string // 标识符与关键字保留原始大小写，字符串为转义后的内容
+	start int    // 在查询语句中的起止位置，用于生成列名与错误信息
+	end   int
+}
+
+// 多字符符号需要放在单字符之前匹配
+var symbols = []string{"<>", "<=", ">=", "(", ")", "[", "]", "{", "}", ":", ",", ".", "-", "<", ">", "=", "*", "+"}
+
+// lex 将查询语句拆分为token
+func lex(query string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '/' && strings.HasPrefix(query[i:], "//"):
+			// 单行注释
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case isIdentStart(c):
+			start := i
+			for i < len(query) && isIdentPart(query[i]) {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokenIdent, text: query[start:i], start: start, end: i})
+		case c == '`':
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				return nil, syntaxError(i, "unterminated quoted identifier")
+			}
+			tokens = append(tokens, token{typ: tokenIdent, text: query[i+1 : i+1+end], start: i, end: i + end + 2})
+			i += end + 2
+		case c == '$':
+			start := i
+			i++
+			for i < len(query) && isIdentPart(query[i]) {
+				i++
+			}
+			if i == start+1 {
+				return nil, syntaxError(start, "invalid parameter")
+			}
+			tokens = append(tokens, token{typ: tokenParam, text: query[start+1 : i], start: start, end: i})
+		case c >= '0' && c <= '9':
+			start := i
+			typ := tokenInteger
+			for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+				i++
+			}
+			if i+1 < len(query) && query[i] == '.' && query[i+1] >= '0' && query[i+1] <= '9' {
+				typ = tokenFloat
+				i++
+				for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, token{typ: typ, text: query[start:i], start: start, end: i})
+		case c == '\'' || c == '"':
+			text, end, err := lexString(query, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{typ: tokenString, text: text, start: i, end: end})
+			i = end
+		default:
+			matched := false
+			for _, sym := range symbols {
+				if strings.HasPrefix(query[i:], sym) {
+					tokens = append(tokens, token{typ: tokenSymbol, text: sym, start: i, end: i + len(sym)})
+					i += len(sym)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, syntaxError(i, fmt.Sprintf("unexpected character %q", c))
+			}
+		}
+	}
+	tokens = append(tokens, token{typ: tokenEOF, start: len(query), end: len(query)})
+	return tokens, nil
+}
+
+// lexString 解析单引号或双引号字符串，返回转义后的内容与结束位置
+func lexString(query string, start int) (string, int, error) {
+	quote := query[start]
+	var sb strings.Builder
+	for i := start + 1; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == quote:
+			return sb.String(), i + 1, nil
+		case c == '\\' && i+1 < len(query):
+			i++
+			switch query[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			default:
+				sb.WriteByte(query[i])
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", 0, syntaxError(start, "unterminated string")
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func syntaxError(pos int, msg string) error {
+	return fmt.Errorf("%w at position %d: %s", ErrSyntax, pos, msg)
+}
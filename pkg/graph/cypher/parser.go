@@ -0,0 +1,602 @@
+package cypher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type parser struct {
+	query  string
+	tokens []token
+	pos    int
+}
+
+// Parse 解析查询语句
+func Parse(query string) (*Query, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{query: query, tokens: tokens}
+	return p.parseQuery()
+}
+
+func (p *parser) parseQuery() (*Query, error) {
+	q := &Query{}
+	for {
+		if p.peek().typ == tokenEOF {
+			break
+		}
+		if p.isSymbol(";") {
+			p.next()
+			continue
+		}
+		c, err := p.parseClause()
+		if err != nil {
+			return nil, err
+		}
+		q.clauses = append(q.clauses, c)
+		if _, ok := c.(*returnClause); ok && p.peek().typ != tokenEOF {
+			return nil, p.errorf("RETURN must be the last clause")
+		}
+	}
+	if len(q.clauses) == 0 {
+		return nil, p.errorf("empty query")
+	}
+	return q, nil
+}
+
+func (p *parser) parseClause() (clause, error) {
+	switch {
+	case p.acceptKeyword("MATCH"):
+		return p.parseMatch()
+	case p.acceptKeyword("CREATE"):
+		patterns, err := p.parsePatterns()
+		if err != nil {
+			return nil, err
+		}
+		return &createClause{patterns: patterns}, nil
+	case p.acceptKeyword("MERGE"):
+		pt, err := p.parsePattern()
+		if err != nil {
+			return nil, err
+		}
+		return &mergeClause{pattern: pt}, nil
+	case p.acceptKeyword("SET"):
+		return p.parseSet()
+	case p.acceptKeyword("DETACH"):
+		if err := p.expectKeyword("DELETE"); err != nil {
+			return nil, err
+		}
+		return p.parseDelete(true)
+	case p.acceptKeyword("DELETE"):
+		return p.parseDelete(false)
+	case p.acceptKeyword("RETURN"):
+		return p.parseReturn()
+	}
+	return nil, p.errorf("unexpected %s", p.describe(p.peek()))
+}
+
+func (p *parser) parseMatch() (clause, error) {
+	patterns, err := p.parsePatterns()
+	if err != nil {
+		return nil, err
+	}
+	m := &matchClause{patterns: patterns}
+	if p.acceptKeyword("WHERE") {
+		if m.where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (p *parser) parseSet() (clause, error) {
+	s := &setClause{}
+	for {
+		variable, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("."); err != nil {
+			return nil, err
+		}
+		property, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		s.items = append(s.items, &setItem{variable: variable, property: property, value: value})
+		if !p.acceptSymbol(",") {
+			return s, nil
+		}
+	}
+}
+
+func (p *parser) parseDelete(detach bool) (clause, error) {
+	d := &deleteClause{detach: detach}
+	for {
+		variable, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		d.variables = append(d.variables, variable)
+		if !p.acceptSymbol(",") {
+			return d, nil
+		}
+	}
+}
+
+func (p *parser) parseReturn() (clause, error) {
+	r := &returnClause{distinct: p.acceptKeyword("DISTINCT")}
+	if p.acceptSymbol("*") {
+		r.star = true
+	} else {
+		for {
+			start := p.peek().start
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			// 没有别名时使用表达式原文作为列名
+			item := &returnItem{expr: e, alias: p.query[start:p.tokens[p.pos-1].end]}
+			if p.acceptKeyword("AS") {
+				if item.alias, err = p.expectIdent(); err != nil {
+					return nil, err
+				}
+			}
+			r.items = append(r.items, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	var err error
+	if p.acceptKeyword("SKIP") {
+		if r.skip, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		if r.limit, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (p *parser) parsePatterns() ([]*pattern, error) {
+	var patterns []*pattern
+	for {
+		pt, err := p.parsePattern()
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pt)
+		if !p.acceptSymbol(",") {
+			return patterns, nil
+		}
+	}
+}
+
+// parsePattern (a:Label {k: v})-[r:TYPE {k: v}]->(b)<-[:TYPE]-(c)
+func (p *parser) parsePattern() (*pattern, error) {
+	node, err := p.parseNode()
+	if err != nil {
+		return nil, err
+	}
+	pt := &pattern{nodes: []*nodePattern{node}}
+	for p.isSymbol("-") || p.isSymbol("<") {
+		rel, err := p.parseRel()
+		if err != nil {
+			return nil, err
+		}
+		node, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		pt.rels = append(pt.rels, rel)
+		pt.nodes = append(pt.nodes, node)
+	}
+	return pt, nil
+}
+
+func (p *parser) parseNode() (*nodePattern, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	node := &nodePattern{}
+	var err error
+	if p.peek().typ == tokenIdent {
+		node.variable = p.next().text
+	}
+	if p.acceptSymbol(":") {
+		if node.label, err = p.expectIdent(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isSymbol("{") {
+		if node.props, err = p.parseProperties(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (p *parser) parseRel() (*relPattern, error) {
+	rel := &relPattern{direction: directionBoth}
+	if p.acceptSymbol("<") {
+		rel.direction = directionIn
+	}
+	if err := p.expectSymbol("-"); err != nil {
+		return nil, err
+	}
+
+	if p.acceptSymbol("[") {
+		var err error
+		if p.peek().typ == tokenIdent {
+			rel.variable = p.next().text
+		}
+		if p.acceptSymbol(":") {
+			if rel.relType, err = p.expectIdent(); err != nil {
+				return nil, err
+			}
+		}
+		if p.isSymbol("{") {
+			if rel.props, err = p.parseProperties(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectSymbol("]"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectSymbol("-"); err != nil {
+		return nil, err
+	}
+	if p.acceptSymbol(">") {
+		if rel.direction == directionIn {
+			return nil, p.errorf("relationship can not point in both directions")
+		}
+		rel.direction = directionOut
+	}
+	return rel, nil
+}
+
+func (p *parser) parseProperties() (map[string]expr, error) {
+	if err := p.expectSymbol("{"); err != nil {
+		return nil, err
+	}
+	props := map[string]expr{}
+	if p.acceptSymbol("}") {
+		return props, nil
+	}
+	for {
+		key, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		props[key] = value
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol("}"); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// 表达式优先级从低到高 OR、AND、NOT、比较、加减、负号、属性访问
+func (p *parser) parseExpr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.acceptKeyword("NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr: e}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	var op string
+	switch {
+	case p.isSymbol("=") || p.isSymbol("<>") || p.isSymbol("<") || p.isSymbol("<=") || p.isSymbol(">") || p.isSymbol(">="):
+		op = p.next().text
+	case p.acceptKeyword("STARTS"):
+		if err := p.expectKeyword("WITH"); err != nil {
+			return nil, err
+		}
+		op = "STARTS WITH"
+	case p.acceptKeyword("ENDS"):
+		if err := p.expectKeyword("WITH"); err != nil {
+			return nil, err
+		}
+		op = "ENDS WITH"
+	case p.acceptKeyword("CONTAINS"):
+		op = "CONTAINS"
+	case p.acceptKeyword("IN"):
+		op = "IN"
+	}
+	if op != "" {
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		left = &isNullExpr{expr: left, not: not}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAdditive() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("+") || p.isSymbol("-") {
+		op := p.next().text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.acceptSymbol("-") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateExpr{expr: e}, nil
+	}
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptSymbol(".") {
+		key, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		e = &propertyExpr{target: e, key: key}
+	}
+	return e, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokenInteger:
+		p.next()
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", t.text)
+		}
+		return &literalExpr{value: n}, nil
+	case tokenFloat:
+		p.next()
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid float %s", t.text)
+		}
+		return &literalExpr{value: f}, nil
+	case tokenString:
+		p.next()
+		return &literalExpr{value: t.text}, nil
+	case tokenParam:
+		p.next()
+		return &paramExpr{name: t.text}, nil
+	case tokenIdent:
+		switch strings.ToUpper(t.text) {
+		case "TRUE":
+			p.next()
+			return &literalExpr{value: true}, nil
+		case "FALSE":
+			p.next()
+			return &literalExpr{value: false}, nil
+		case "NULL":
+			p.next()
+			return &literalExpr{value: nil}, nil
+		}
+		p.next()
+		if p.acceptSymbol("(") {
+			return p.parseFunction(t.text)
+		}
+		return &variableExpr{name: t.text}, nil
+	case tokenSymbol:
+		switch t.text {
+		case "(":
+			p.next()
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		case "[":
+			p.next()
+			return p.parseList()
+		}
+	}
+	return nil, p.errorf("unexpected %s", p.describe(t))
+}
+
+func (p *parser) parseFunction(name string) (expr, error) {
+	f := &funcExpr{name: strings.ToLower(name)}
+	if p.acceptSymbol(")") {
+		return f, nil
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		f.args = append(f.args, arg)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseList 列表字面量，以函数 list 的形式表示
+func (p *parser) parseList() (expr, error) {
+	f := &funcExpr{name: "list"}
+	if p.acceptSymbol("]") {
+		return f, nil
+	}
+	for {
+		item, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		f.args = append(f.args, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol("]"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isSymbol(sym string) bool {
+	t := p.peek()
+	return t.typ == tokenSymbol && t.text == sym
+}
+
+func (p *parser) acceptSymbol(sym string) bool {
+	if p.isSymbol(sym) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.acceptSymbol(sym) {
+		return p.errorf("expected '%s' but got %s", sym, p.describe(p.peek()))
+	}
+	return nil
+}
+
+// acceptKeyword 关键字不区分大小写
+func (p *parser) acceptKeyword(keyword string) bool {
+	t := p.peek()
+	if t.typ == tokenIdent && strings.EqualFold(t.text, keyword) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return p.errorf("expected %s but got %s", keyword, p.describe(p.peek()))
+	}
+	return nil
+}
+
+func (p *parser) expectIdent() (string, error) {
+	t := p.peek()
+	if t.typ != tokenIdent {
+		return "", p.errorf("expected identifier but got %s", p.describe(t))
+	}
+	p.next()
+	return t.text, nil
+}
+
+func (p *parser) describe(t token) string {
+	if t.typ == tokenEOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("'%s'", p.query[t.start:t.end])
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return syntaxError(p.peek().start, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,274 @@
+package graph
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+// Properties 顶点与边的属性
+type Properties map[string][]byte
+
+// Vertex 顶点
+type Vertex struct {
+	Id    []byte
+	Label string
+	Props Properties
+}
+
+// Edge 有向边，同一对顶点之间每个label最多一条边
+type Edge struct {
+	From  []byte
+	Label string
+	To    []byte
+	Props Properties
+}
+
+// GraphColumnFamily 保存图数据的列族，图数据与其他数据的key互不影响
+const GraphColumnFamily = "graph"
+
+// Graph 基于 kv.DB 的属性图，每次修改通过 WriteBatch 原子提交
+// 图数据保存在单独的列族中，列族中只有图写入的key
+type Graph struct {
+	cf   *kv.ColumnFamily
+	lock *sync.RWMutex // 串行化先检查再写入的修改
+}
+
+// NewGraph 打开数据库中的图，列族不存在时创建
+func NewGraph(db *kv.DB) (*Graph, error) {
+	cf, err := db.ColumnFamily(GraphColumnFamily)
+	if errors.Is(err, errs.ErrColumnFamilyNotFound) {
+		cf, err = db.CreateColumnFamily(GraphColumnFamily)
+		// 并发创建时使用已经创建的列族
+		if errors.Is(err, errs.ErrColumnFamilyExists) {
+			cf, err = db.ColumnFamily(GraphColumnFamily)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Graph{
+		cf:   cf,
+		lock: &sync.RWMutex{},
+	}, nil
+}
+
+// AddVertex 添加顶点，顶点已存在时覆盖label与属性
+func (g *Graph) AddVertex(id []byte, label string, props Properties) error {
+	if len(id) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.cf.Put(vertexKey(id), encodeVertex(label, props))
+}
+
+// GetVertex 获取顶点
+func (g *Graph) GetVertex(id []byte) (*Vertex, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.getVertex(id)
+}
+
+// Vertices 按前缀迭代获取所有顶点，label不为空时只返回该label的顶点
+func (g *Graph) Vertices(label string) ([]*Vertex, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	iterOpts := kv.GetDefaultIteratorOptions()
+	iterOpts.Prefix = []byte{vertexKeyTag}
+	iter := g.cf.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var vertices []*Vertex
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		id, _, err := readPart(iter.Key()[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf, err := iter.Value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeVertex(append([]byte(nil), id...), buf)
+		if err != nil {
+			return nil, err
+		}
+		if label == "" || v.Label == label {
+			vertices = append(vertices, v)
+		}
+	}
+	return vertices, nil
+}
+
+// DeleteVertex 删除顶点以及所有与其相连的边
+func (g *Graph) DeleteVertex(id []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, err := g.getVertex(id); err != nil {
+		return err
+	}
+
+	keys := [][]byte{vertexKey(id)}
+	outEdges, err := g.edges(outEdgeKeyTag, id, "", false)
+	if err != nil {
+		return err
+	}
+	for _, e := range outEdges {
+		keys = append(keys, outEdgeKey(e.From, e.Label, e.To), inEdgeKey(e.To, e.Label, e.From))
+	}
+	inEdges, err := g.edges(inEdgeKeyTag, id, "", false)
+	if err != nil {
+		return err
+	}
+	for _, e := range inEdges {
+		keys = append(keys, outEdgeKey(e.From, e.Label, e.To), inEdgeKey(e.To, e.Label, e.From))
+	}
+
+	wb := g.newWriteBatch(len(keys))
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// AddEdge 添加从from到to的边，两个顶点都必须存在，边已存在时覆盖属性
+func (g *Graph) AddEdge(from []byte, label string, to []byte, props Properties) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if _, err := g.getVertex(from); err != nil {
+		return err
+	}
+	if _, err := g.getVertex(to); err != nil {
+		return err
+	}
+
+	wb := g.newWriteBatch(2)
+	if err := wb.Put(outEdgeKey(from, label, to), encodeProperties(nil, props)); err != nil {
+		return err
+	}
+	if err := wb.Put(inEdgeKey(to, label, from), nil); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// GetEdge 获取边
+func (g *Graph) GetEdge(from []byte, label string, to []byte) (*Edge, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	buf, err := g.cf.Get(outEdgeKey(from, label, to))
+	if err != nil {
+		if errors.Is(err, errs.ErrKeyNotFound) {
+			return nil, errs.ErrEdgeNotFound
+		}
+		return nil, err
+	}
+	props, err := decodeProperties(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &Edge{From: from, Label: label, To: to, Props: props}, nil
+}
+
+// DeleteEdge 删除边
+func (g *Graph) DeleteEdge(from []byte, label string, to []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	key := outEdgeKey(from, label, to)
+	if _, err := g.cf.Get(key); err != nil {
+		if errors.Is(err, errs.ErrKeyNotFound) {
+			return errs.ErrEdgeNotFound
+		}
+		return err
+	}
+
+	wb := g.newWriteBatch(2)
+	if err := wb.Delete(key); err != nil {
+		return err
+	}
+	if err := wb.Delete(inEdgeKey(to, label, from)); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// OutEdges 获取顶点的出边，label为空时返回所有label的边
+func (g *Graph) OutEdges(id []byte, label string) ([]*Edge, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.edges(outEdgeKeyTag, id, label, true)
+}
+
+// InEdges 获取顶点的入边，label为空时返回所有label的边
+func (g *Graph) InEdges(id []byte, label string) ([]*Edge, error) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.edges(inEdgeKeyTag, id, label, true)
+}
+
+func (g *Graph) getVertex(id []byte) (*Vertex, error) {
+	buf, err := g.cf.Get(vertexKey(id))
+	if err != nil {
+		if errors.Is(err, errs.ErrKeyNotFound) {
+			return nil, errs.ErrVertexNotFound
+		}
+		return nil, err
+	}
+	return decodeVertex(id, buf)
+}
+
+// edges 按前缀迭代邻接表，withProps 为false时不读取边的属性
+func (g *Graph) edges(tag byte, id []byte, label string, withProps bool) ([]*Edge, error) {
+	iterOpts := kv.GetDefaultIteratorOptions()
+	iterOpts.Prefix = edgeKeyPrefix(tag, id, label)
+	iter := g.cf.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var edges []*Edge
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		first, edgeLabel, second, err := decodeEdgeKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		e := &Edge{Label: edgeLabel}
+		if tag == outEdgeKeyTag {
+			e.From, e.To = append([]byte(nil), first...), append([]byte(nil), second...)
+		} else {
+			e.To, e.From = append([]byte(nil), first...), append([]byte(nil), second...)
+		}
+
+		if withProps {
+			// 入边不存储属性，属性从对应的出边读取
+			var buf []byte
+			if tag == outEdgeKeyTag {
+				buf, err = iter.Value()
+			} else {
+				buf, err = g.cf.Get(outEdgeKey(e.From, e.Label, e.To))
+			}
+			if err != nil {
+				return nil, err
+			}
+			if e.Props, err = decodeProperties(buf); err != nil {
+				return nil, err
+			}
+		}
+		edges = append(edges, e)
+	}
+	return edges, nil
+}
+
+func (g *Graph) newWriteBatch(size int) *kv.WriteBatch {
+	opts := kv.GetDefaultWriteBatchOptions()
+	opts.MaxBatchSize = max(opts.MaxBatchSize, size)
+	return g.cf.NewWriteBatch(opts)
+}
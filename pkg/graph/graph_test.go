@@ -0,0 +1,132 @@
+package graph
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestGraph(t *testing.T) (*Graph, *kv.DB) {
+	opts := kv.GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "hifidb-graph")
+	opts.DirPath = dir
+	db, err := kv.Open(opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	g, err := NewGraph(db)
+	assert.Nil(t, err)
+	return g, db
+}
+
+func TestGraph_Vertex(t *testing.T) {
+	g, _ := openTestGraph(t)
+
+	assert.Nil(t, g.AddVertex([]byte("alice"), "Person", Properties{"age": []byte("30")}))
+	v, err := g.GetVertex([]byte("alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Person", v.Label)
+	assert.Equal(t, []byte("30"), v.Props["age"])
+
+	_, err = g.GetVertex([]byte("bob"))
+	assert.Equal(t, errs.ErrVertexNotFound, err)
+	assert.Equal(t, errs.ErrKeyIsEmpty, g.AddVertex(nil, "Person", nil))
+}
+
+func TestGraph_Edge(t *testing.T) {
+	g, _ := openTestGraph(t)
+
+	for _, id := range []string{"a", "b", "c", "ab"} {
+		assert.Nil(t, g.AddVertex([]byte(id), "Person", nil))
+	}
+	assert.Nil(t, g.AddEdge([]byte("a"), "knows", []byte("b"), Properties{"since": []byte("2020")}))
+	assert.Nil(t, g.AddEdge([]byte("a"), "knows", []byte("c"), nil))
+	assert.Nil(t, g.AddEdge([]byte("a"), "likes", []byte("b"), nil))
+	assert.Nil(t, g.AddEdge([]byte("ab"), "knows", []byte("c"), nil))
+	assert.Nil(t, g.AddEdge([]byte("c"), "knows", []byte("a"), nil))
+	assert.Equal(t, errs.ErrVertexNotFound, g.AddEdge([]byte("a"), "knows", []byte("x"), nil))
+
+	// 前缀为 "a" 的顶点 "ab" 的边不会出现在 "a" 的邻接表中
+	edges, err := g.OutEdges([]byte("a"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(edges))
+	edges, err = g.OutEdges([]byte("a"), "knows")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(edges))
+	assert.Equal(t, []byte("b"), edges[0].To)
+	assert.Equal(t, []byte("2020"), edges[0].Props["since"])
+
+	edges, err = g.InEdges([]byte("b"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(edges))
+	assert.Equal(t, []byte("a"), edges[0].From)
+	assert.Equal(t, []byte("2020"), edges[0].Props["since"])
+
+	e, err := g.GetEdge([]byte("a"), "knows", []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2020"), e.Props["since"])
+
+	assert.Nil(t, g.DeleteEdge([]byte("a"), "likes", []byte("b")))
+	assert.Equal(t, errs.ErrEdgeNotFound, g.DeleteEdge([]byte("a"), "likes", []byte("b")))
+	edges, err = g.InEdges([]byte("b"), "likes")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(edges))
+}
+
+func TestGraph_DeleteVertex(t *testing.T) {
+	g, db := openTestGraph(t)
+
+	for _, id := range []string{"a", "b", "c"} {
+		assert.Nil(t, g.AddVertex([]byte(id), "Person", nil))
+	}
+	assert.Nil(t, g.AddEdge([]byte("a"), "knows", []byte("b"), nil))
+	assert.Nil(t, g.AddEdge([]byte("c"), "knows", []byte("a"), nil))
+	assert.Nil(t, g.AddEdge([]byte("a"), "self", []byte("a"), nil))
+	assert.Nil(t, g.AddEdge([]byte("b"), "knows", []byte("c"), nil))
+
+	assert.Nil(t, g.DeleteVertex([]byte("a")))
+	_, err := g.GetVertex([]byte("a"))
+	assert.Equal(t, errs.ErrVertexNotFound, err)
+
+	edges, err := g.InEdges([]byte("b"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(edges))
+	edges, err = g.OutEdges([]byte("c"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(edges))
+
+	// 只剩下 b、c 两个顶点与 b->c 的出边与入边
+	cf, err := db.ColumnFamily(GraphColumnFamily)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(cf.ListKeys()))
+	assert.Equal(t, errs.ErrVertexNotFound, g.DeleteVertex([]byte("a")))
+}
+
+func TestGraph_OtherKeys(t *testing.T) {
+	g, db := openTestGraph(t)
+
+	// 默认列族中的key不会被当作图数据
+	assert.Nil(t, db.Put([]byte("value"), []byte("x")))
+	assert.Nil(t, db.Put([]byte("v"), []byte("x")))
+	assert.Nil(t, g.AddVertex([]byte("alice"), "Person", nil))
+
+	vertices, err := g.Vertices("")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(vertices))
+	assert.Equal(t, []byte("alice"), vertices[0].Id)
+
+	// 再次打开使用已经创建的列族
+	g2, err := NewGraph(db)
+	assert.Nil(t, err)
+	v, err := g2.GetVertex([]byte("alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Person", v.Label)
+	val, err := db.Get([]byte("value"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("x"), val)
+}
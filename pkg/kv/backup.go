@@ -0,0 +1,230 @@
+package kv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// Backup 在线备份数据库到指定目录，备份期间可以正常读写，生成的目录可以直接打开
+// 旧的数据文件不会再被修改，优先使用硬链接，活跃文件只拷贝备份开始时已写入的部分
+// B+树索引与锁文件不会备份，打开备份时会根据数据文件重建索引
+func (db *DB) Backup(dir string) error {
+	if err := checkDirIsEmpty(dir); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	if db.isMerging {
+		db.lock.Unlock()
+		return errs.ErrMergeIsProgress
+	}
+	if db.isBackingUp {
+		db.lock.Unlock()
+		return errs.ErrBackupIsProgress
+	}
+
+	// 写入都在库锁内完成，此时活跃文件的写入位置不会落在批量写的中间
+	var activeFileId uint32
+	var activeSize int64
+	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			db.lock.Unlock()
+			return err
+		}
+		activeFileId = db.activeFile.FileId
+		activeSize = db.activeFile.WriteOffset
+	}
+	olderFileIds := make([]uint32, 0, len(db.olderFiles))
+	for fid := range db.olderFiles {
+		olderFileIds = append(olderFileIds, fid)
+	}
+	// 列族文件在创建与删除列族时整体替换，在库锁内读取
+	families, err := os.ReadFile(filepath.Join(db.options.DirPath, FamilyFileName))
+	if err != nil && !os.IsNotExist(err) {
+		db.lock.Unlock()
+		return err
+	}
+
+	// 备份期间禁止merge删除旧的数据文件
+	db.isBackingUp = true
+	db.lock.Unlock()
+	defer func() {
+		db.lock.Lock()
+		db.isBackingUp = false
+		db.lock.Unlock()
+	}()
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	for _, fid := range olderFileIds {
+		if err := linkOrCopyFile(GetDataFileName(db.options.DirPath, fid), GetDataFileName(dir, fid)); err != nil {
+			return err
+		}
+	}
+	// merge生成的hint文件与merge完成标识
+	for _, name := range []string{HintFileName, MergeFinishedFileName} {
+		src := filepath.Join(db.options.DirPath, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := linkOrCopyFile(src, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if families != nil {
+		if err := writeFileSync(filepath.Join(dir, FamilyFileName), families); err != nil {
+			return err
+		}
+	}
+	if db.activeFile != nil {
+		src := GetDataFileName(db.options.DirPath, activeFileId)
+		if err := copyFile(src, GetDataFileName(dir, activeFileId), activeSize); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+const (
+	restoreDirName    = "-restore"     // 恢复时拷贝备份的临时目录
+	restoreOldDirName = "-restore-old" // 交换目录时原数据目录的临时位置
+)
+
+// Restore 使用备份覆盖数据目录，数据目录不能被其他进程打开
+// 备份先拷贝到临时目录并持久化，再与数据目录交换，拷贝失败时原数据目录不受影响
+func Restore(backupDir, dirPath string) error {
+	if _, err := os.Stat(backupDir); err != nil {
+		return err
+	}
+	oldDir := siblingDirPath(dirPath, restoreOldDirName)
+	// 上次恢复在交换目录时中断，原数据目录已被移走，先移回原来的位置
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		if _, err := os.Stat(oldDir); err == nil {
+			if err := os.Rename(oldDir, dirPath); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	unlock, err := lockDir(dirPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	restoreDir := siblingDirPath(dirPath, restoreDirName)
+	if err := os.RemoveAll(restoreDir); err != nil {
+		return err
+	}
+	if err := CopyDir(backupDir, restoreDir, []string{fileLockName}); err != nil {
+		_ = os.RemoveAll(restoreDir)
+		return err
+	}
+	if err := syncDir(restoreDir); err != nil {
+		_ = os.RemoveAll(restoreDir)
+		return err
+	}
+
+	// 原数据未完成的merge结果不属于备份，打开时不能再使用
+	if err := os.RemoveAll(siblingDirPath(dirPath, mergeDirName)); err != nil {
+		return err
+	}
+
+	// 交换数据目录，拷贝完成的备份替换原数据目录之后再删除原来的数据
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(dirPath, oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(restoreDir, dirPath); err != nil {
+		_ = os.Rename(oldDir, dirPath)
+		return err
+	}
+	if err := syncDir(filepath.Dir(filepath.Clean(dirPath))); err != nil {
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// checkDirIsEmpty 备份目录不存在或者为空
+func checkDirIsEmpty(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(entries) > 0 {
+		return errs.ErrDirIsNotEmpty
+	}
+	return nil
+}
+
+// linkOrCopyFile 优先创建硬链接，跨设备等无法链接时拷贝文件
+func linkOrCopyFile(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest, -1)
+}
+
+// copyFile 拷贝文件的前size个字节，size为负数时拷贝整个文件
+func copyFile(src, dest string, size int64) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if size < 0 {
+		_, err = io.Copy(destFile, srcFile)
+	} else {
+		_, err = io.CopyN(destFile, srcFile, size)
+		if errors.Is(err, io.EOF) {
+			return errs.ErrDataDirCorrupted
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
+
+// writeFileSync 写入文件并持久化
+func writeFileSync(fileName string, data []byte) error {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDir 持久化目录项
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,94 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Backup(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, BPlusTree} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-backup")
+		opts.DirPath = dir
+		opts.DataFileSize = 1024 * 1024
+		opts.MemoryIndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := range 20000 {
+			assert.Nil(t, db.Put(GetTestKey(i), RandomValue(64)))
+		}
+		for i := range 5000 {
+			assert.Nil(t, db.Delete(GetTestKey(i)))
+		}
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Put(GetTestKey(1), []byte("before-backup")))
+
+		backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+		assert.Nil(t, db.Backup(backupDir))
+		assert.Equal(t, errs.ErrDirIsNotEmpty, db.Backup(backupDir))
+		_, err = os.Stat(filepath.Join(backupDir, fileLockName))
+		assert.True(t, os.IsNotExist(err))
+
+		// 备份之后的写入不会出现在备份中
+		assert.Nil(t, db.Put(GetTestKey(2), []byte("after-backup")))
+		assert.Nil(t, db.Delete(GetTestKey(1)))
+
+		backupOpts := *opts
+		backupOpts.DirPath = backupDir
+		backupDB, err := Open(&backupOpts)
+		assert.Nil(t, err)
+		val, err := backupDB.Get(GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("before-backup"), val)
+		_, err = backupDB.Get(GetTestKey(2))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Equal(t, 15001, len(backupDB.ListKeys()))
+		destroyDB(backupDB)
+
+		destroyDB(db)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-restore")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(GetTestKey(1), []byte("v1")))
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-restore-backup")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+	assert.Nil(t, db.Put(GetTestKey(2), []byte("v2")))
+
+	// 数据库打开时不能恢复
+	assert.Equal(t, errs.ErrDataBaseIsUsing, Restore(backupDir, dir))
+	assert.Nil(t, db.Close())
+
+	// 原数据未完成的merge结果在恢复时删除
+	mergeDir := siblingDirPath(dir, mergeDirName)
+	assert.Nil(t, os.MkdirAll(mergeDir, os.ModePerm))
+	defer os.RemoveAll(mergeDir)
+	// 模拟上次恢复在交换目录时中断
+	assert.Nil(t, os.Rename(dir, siblingDirPath(dir, restoreOldDirName)))
+
+	assert.Nil(t, Restore(backupDir, dir))
+	for _, suffix := range []string{mergeDirName, restoreDirName, restoreOldDirName} {
+		_, err = os.Stat(siblingDirPath(dir, suffix))
+		assert.True(t, os.IsNotExist(err))
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	val, err := db.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	_, err = db.Get(GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+}
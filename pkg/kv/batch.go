@@ -1,9 +1,11 @@
 package kv
 
 import (
+	"bytes"
 	"encoding/binary"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/kamijoucen/hifidb/pkg/errs"
 )
@@ -12,12 +14,14 @@ const nonTransactionSeqNo uint64 = 0
 
 var txnFinishedKey = []byte("txn-fin")
 
-// WriteBatch 原子写
+// WriteBatch 原子写，可以同时写入多个列族
 type WriteBatch struct {
 	options       *WriteBatchOptions
 	lock          *sync.Mutex
 	db            *DB
-	pendingWrites map[string]*LogRecord
+	family        *ColumnFamily         // Put、Delete 等方法写入的列族
+	pendingWrites map[string]*LogRecord // 列族编号与key -> 记录
+	rangeDeletes  []*LogRecord          // 范围删除，提交时先于 pendingWrites 生效
 }
 
 func (db *DB) NewWriteBatch(options *WriteBatchOptions) *WriteBatch {
@@ -25,12 +29,44 @@ func (db *DB) NewWriteBatch(options *WriteBatchOptions) *WriteBatch {
 		options:       options,
 		lock:          &sync.Mutex{},
 		db:            db,
+		family:        db.defaultFamily,
 		pendingWrites: map[string]*LogRecord{},
 	}
 }
 
 // Put 添加数据
 func (wb *WriteBatch) Put(key, value []byte) error {
+	return wb.putWithExpire(wb.family, key, value, 0)
+}
+
+// PutCF 向指定的列族添加数据
+func (wb *WriteBatch) PutCF(cf *ColumnFamily, key, value []byte) error {
+	return wb.putWithExpire(cf, key, value, 0)
+}
+
+// PutWithTTL 添加数据并设置过期时间，ttl 必须大于0
+func (wb *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errs.ErrInvalidTTL
+	}
+	return wb.putWithExpire(wb.family, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire 为key设置过期时间，key 可以是批量中尚未提交的数据
+func (wb *WriteBatch) Expire(key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errs.ErrInvalidTTL
+	}
+	return wb.resetExpire(key, time.Now().Add(ttl).UnixNano())
+}
+
+// Persist 移除key的过期时间
+func (wb *WriteBatch) Persist(key []byte) error {
+	return wb.resetExpire(key, 0)
+}
+
+// putWithExpire 添加数据，expire 为0表示永不过期
+func (wb *WriteBatch) putWithExpire(cf *ColumnFamily, key, value []byte, expire int64) error {
 
 	if len(key) == 0 {
 		return errs.ErrKeyIsEmpty
@@ -40,16 +76,64 @@ func (wb *WriteBatch) Put(key, value []byte) error {
 	defer wb.lock.Unlock()
 
 	logRecord := &LogRecord{
-		Key:   key,
-		Value: value,
-		Type:  LogRecordNormal,
+		Key:    key,
+		Value:  value,
+		Type:   LogRecordNormal,
+		Expire: expire,
+		Family: cf.id,
+	}
+	wb.pendingWrites[batchKey(cf, key)] = logRecord
+	return nil
+}
+
+// resetExpire 使用key当前的value重写记录，更新过期时间
+func (wb *WriteBatch) resetExpire(key []byte, expire int64) error {
+
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+
+	cf := wb.family
+	var value []byte
+	if record := wb.pendingWrites[batchKey(cf, key)]; record != nil {
+		if record.Type == LogRecordDeleted {
+			return errs.ErrKeyNotFound
+		}
+		value = record.Value
+	} else if wb.rangeDeleted(cf, key) {
+		return errs.ErrKeyNotFound
+	} else {
+		v, err := wb.db.get(cf, key, nil)
+		if err != nil {
+			return err
+		}
+		value = v
+	}
+
+	wb.pendingWrites[batchKey(cf, key)] = &LogRecord{
+		Key:    key,
+		Value:  value,
+		Type:   LogRecordNormal,
+		Expire: expire,
+		Family: cf.id,
 	}
-	wb.pendingWrites[string(key)] = logRecord
 	return nil
 }
 
 // Delete 删除数据
 func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.delete(wb.family, key)
+}
+
+// DeleteCF 删除指定列族中的数据
+func (wb *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) error {
+	return wb.delete(cf, key)
+}
+
+func (wb *WriteBatch) delete(cf *ColumnFamily, key []byte) error {
 
 	if len(key) == 0 {
 		return errs.ErrKeyIsEmpty
@@ -58,58 +142,157 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	wb.lock.Lock()
 	defer wb.lock.Unlock()
 
-	logRecordPos := wb.db.index.Get(key)
+	wb.db.lock.RLock()
+	var logRecordPos *LogRecordPos
+	if !cf.dropped {
+		logRecordPos = cf.index.Get(key)
+	}
+	wb.db.lock.RUnlock()
 	// 如果要删除的数据在内存中不存在，直接返回
 	if logRecordPos == nil {
-		if wb.pendingWrites[string(key)] != nil {
-			delete(wb.pendingWrites, string(key))
+		if wb.pendingWrites[batchKey(cf, key)] != nil {
+			delete(wb.pendingWrites, batchKey(cf, key))
 			return nil
 		}
 	}
 
 	logRecord := &LogRecord{
-		Key:   key,
-		Value: nil,
-		Type:  LogRecordDeleted,
+		Key:    key,
+		Value:  nil,
+		Type:   LogRecordDeleted,
+		Family: cf.id,
+	}
+	wb.pendingWrites[batchKey(cf, key)] = logRecord
+	return nil
+}
+
+// DeleteRange 删除 [start, end) 范围内的所有key，end 为空时删除start之后所有的key
+// 只写入一条范围删除记录，批量中之前写入的范围内的key一起丢弃，之后写入的key不受影响
+func (wb *WriteBatch) DeleteRange(start, end []byte) error {
+	if len(start) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return errs.ErrInvalidKeyRange
+	}
+
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+
+	cf := wb.family
+	for key, record := range wb.pendingWrites {
+		if record.Family == cf.id && inRange(record.Key, start, end) {
+			delete(wb.pendingWrites, key)
+		}
 	}
-	wb.pendingWrites[string(key)] = logRecord
+	wb.rangeDeletes = append(wb.rangeDeletes, &LogRecord{
+		Key:    start,
+		Value:  end,
+		Type:   LogRecordRangeDeleted,
+		Family: cf.id,
+	})
 	return nil
 }
 
+// DeletePrefix 删除以prefix开头的所有key
+func (wb *WriteBatch) DeletePrefix(prefix []byte) error {
+	return wb.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// rangeDeleted key 是否在批量中的范围删除内
+func (wb *WriteBatch) rangeDeleted(cf *ColumnFamily, key []byte) bool {
+	for _, record := range wb.rangeDeletes {
+		if record.Family == cf.id && inRange(key, record.Key, record.Value) {
+			return true
+		}
+	}
+	return false
+}
+
 // Commit 提交写入
 func (wb *WriteBatch) Commit() error {
 
 	wb.lock.Lock()
 	defer wb.lock.Unlock()
 
-	if len(wb.pendingWrites) == 0 {
+	if len(wb.pendingWrites) == 0 && len(wb.rangeDeletes) == 0 {
 		return nil
 	}
 
-	if len := len(wb.pendingWrites); len > int(wb.options.MaxBatchSize) {
+	if len := len(wb.pendingWrites) + len(wb.rangeDeletes); len > int(wb.options.MaxBatchSize) {
 		return errs.ErrExceedMaxFileSize
 	}
 
-	// DB加锁保证事务提交串行
-	wb.db.lock.Lock()
-	defer wb.db.lock.Unlock()
+	// 组提交在库锁内执行，保证事务提交串行
+	err := wb.db.commit(wb.options.EachSyncWrites, func() error {
+		return wb.db.commitRecords(wb.pendingWrites, wb.rangeDeletes...)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 清空已经提交的数据
+	clear(wb.pendingWrites)
+	wb.rangeDeletes = nil
+
+	return nil
+}
+
+// commitRecords 原子写入一组记录并更新索引，调用方需持有库锁
+// 记录由组提交统一写入与持久化，范围删除先于其他记录写入，重放时也按照相同的顺序生效
+func (db *DB) commitRecords(records map[string]*LogRecord, rangeDeletes ...*LogRecord) error {
+
+	// 写入之前检查列族，避免只提交一部分
+	for _, record := range records {
+		if db.familyIndex(record.Family) == nil {
+			return errs.ErrColumnFamilyNotFound
+		}
+	}
+	for _, record := range rangeDeletes {
+		if db.familyIndex(record.Family) == nil {
+			return errs.ErrColumnFamilyNotFound
+		}
+	}
 
 	// 获取最新的事务id
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 写入数据, 暂不更新索引, 制造一种快照读的效果
 	// TODO 复用
-	positions := make(map[string]*LogRecordPos, len(wb.pendingWrites))
-	for _, logRecord := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&LogRecord{
-			Key:   logRecordKeyWithSeq(logRecord.Key, seqNo),
-			Value: logRecord.Value,
-			Type:  logRecord.Type,
+	positions := make(map[string]*LogRecordPos, len(records))
+	// 默认列族的记录按照写入顺序生成变更
+	changes := make([]*LogRecord, 0, len(records)+len(rangeDeletes))
+	rangePositions := make([]*LogRecordPos, len(rangeDeletes))
+	for i, logRecord := range rangeDeletes {
+		logRecordPos, err := db.appendLogRecord(&LogRecord{
+			Key:    logRecordKeyWithSeq(logRecord.Key, seqNo),
+			Value:  logRecord.Value,
+			Type:   logRecord.Type,
+			Family: logRecord.Family,
 		})
 		if err != nil {
-			return nil
+			return err
+		}
+		rangePositions[i] = logRecordPos
+		if logRecord.Family == defaultFamilyId {
+			changes = append(changes, logRecord)
+		}
+	}
+	for key, logRecord := range records {
+		logRecordPos, err := db.appendLogRecord(&LogRecord{
+			Key:    logRecordKeyWithSeq(logRecord.Key, seqNo),
+			Value:  logRecord.Value,
+			Type:   logRecord.Type,
+			Expire: logRecord.Expire,
+			Family: logRecord.Family,
+		})
+		if err != nil {
+			return err
+		}
+		positions[key] = logRecordPos
+		if logRecord.Family == defaultFamilyId {
+			changes = append(changes, logRecord)
 		}
-		positions[string(logRecord.Key)] = logRecordPos
 	}
 
 	finishedRecord := &LogRecord{
@@ -117,38 +300,52 @@ func (wb *WriteBatch) Commit() error {
 		Type: LogRecordTxnFinished,
 	}
 	// 写入事务完成标记
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := db.appendLogRecord(finishedRecord)
+	if err != nil {
 		return err
 	}
-
-	// 持久化
-	if wb.options.EachSyncWrites {
-		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
-		}
+	for i, record := range changes {
+		db.recordChange(record, record.Key, changeSeq(finishedPos.Fid, finishedPos.Offset), true, i == len(changes)-1)
 	}
 
 	// 更新索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
+	var deletedKeys [][]byte
+	for i, record := range rangeDeletes {
+		db.reclaimSize += int64(rangePositions[i].Size)
+		track := len(db.activeTxns) > 0 && record.Family == defaultFamilyId
+		db.familyIndex(record.Family).DeleteRange(record.Key, record.Value, func(key []byte, oldPos *LogRecordPos) {
+			db.reclaimSize += int64(oldPos.Size)
+			if track {
+				deletedKeys = append(deletedKeys, key)
+			}
+		})
+	}
+	for key, record := range records {
+		pos := positions[key]
+		index := db.familyIndex(record.Family)
 		var oldPos *LogRecordPos
 		switch record.Type {
 		case LogRecordNormal:
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos = index.Put(record.Key, pos)
 		case LogRecordDeleted:
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _ = index.Delete(record.Key)
+			db.reclaimSize += int64(pos.Size)
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.reclaimSize += int64(oldPos.Size)
 		}
 	}
 
-	// 清空已经提交的数据
-	clear(wb.pendingWrites)
-
+	// 记录提交的key，用于检测并发事务的冲突
+	db.trackCommit(seqNo, records, deletedKeys...)
 	return nil
 }
 
+// batchKey 批量写中记录的key，不同列族中相同的key互不覆盖
+func batchKey(cf *ColumnFamily, key []byte) string {
+	return string(binary.AppendUvarint(nil, uint64(cf.id))) + string(key)
+}
+
 // logRecordKeyWithSeq 生成带事务ID的key
 func logRecordKeyWithSeq(key []byte, seqNO uint64) []byte {
 	// TODO 复用
@@ -3,6 +3,7 @@ package kv
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/kamijoucen/hifidb/pkg/errs"
 	"github.com/stretchr/testify/assert"
@@ -112,3 +113,78 @@ func TestDB_WriteBatch2(t *testing.T) {
 //	//err = wb.Commit()
 //	//assert.Nil(t, err)
 //}
+
+func TestDB_WriteBatchTTL(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(GetTestKey(1), []byte("value-1"))
+	assert.Nil(t, err)
+
+	wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.PutWithTTL(GetTestKey(2), []byte("value-2"), 100*time.Millisecond))
+	assert.Nil(t, wb.Expire(GetTestKey(1), 100*time.Millisecond))
+	assert.Nil(t, wb.Put(GetTestKey(3), []byte("value-3")))
+	assert.Nil(t, wb.Expire(GetTestKey(3), 100*time.Millisecond))
+	assert.Nil(t, wb.Persist(GetTestKey(3)))
+	assert.Equal(t, errs.ErrKeyNotFound, wb.Expire(GetTestKey(4), time.Second))
+	assert.Nil(t, wb.Commit())
+
+	val, err := db.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-1"), val)
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = db.Get(GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	_, err = db.Get(GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	val, err = db.Get(GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-3"), val)
+}
+
+func TestDB_WriteBatchDeletePrefix(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-prefix")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a1", "a2", "a3", "b1"} {
+		assert.Nil(t, db.Put([]byte(key), []byte(key)))
+	}
+
+	wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.Put([]byte("a4"), []byte("a4")))
+	assert.Nil(t, wb.DeletePrefix([]byte("a")))
+	// 范围删除之后写入的key不受影响
+	assert.Nil(t, wb.Put([]byte("a2"), []byte("new")))
+	assert.Equal(t, errs.ErrKeyNotFound, wb.Persist([]byte("a1")))
+	assert.Nil(t, wb.Delete([]byte("b1")))
+	assert.Equal(t, errs.ErrInvalidKeyRange, wb.DeleteRange([]byte("b"), []byte("a")))
+
+	// 提交之前不可见
+	assert.Equal(t, 4, len(db.ListKeys()))
+	assert.Nil(t, wb.Commit())
+
+	check := func() {
+		keys := db.ListKeys()
+		assert.Equal(t, 1, len(keys))
+		val, err := db.Get([]byte("a2"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+	}
+	check()
+
+	// 重启之后按照相同的顺序重放
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
@@ -0,0 +1,387 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+const (
+	// SubscribeLatest 只订阅之后的变更，不重放数据文件
+	SubscribeLatest uint64 = math.MaxUint64
+
+	// changeOffsetBits 变更序列号中文件内偏移占用的位数，高位为文件编号
+	changeOffsetBits = 40
+
+	// maxDataFileSize 数据文件大小的上限，保证偏移可以存入变更序列号
+	maxDataFileSize int64 = 1 << changeOffsetBits
+
+	// maxSubscriberQueue 订阅者未消费的事件数量上限，超过后丢弃，改为从数据文件重放
+	maxSubscriberQueue = 4096
+)
+
+type ChangeType byte
+
+const (
+	ChangePut ChangeType = iota
+	ChangeDelete
+	// ChangeDeleteRange 范围删除，删除 [Key, Value) 范围内的key，Value 为空时不限制结束位置
+	ChangeDeleteRange
+)
+
+// ChangeEvent 已写入日志的一次变更，只包含默认列族的写入
+// Key 与 Value 被所有订阅者共享，不能修改
+type ChangeEvent struct {
+	Type   ChangeType
+	Key    []byte
+	Value  []byte // 删除时为空，范围删除时为结束key
+	Expire int64  // 过期时间，UnixNano，0表示永不过期
+
+	// SeqNo 变更序列号，由提交在日志中的位置生成，随写入递增，同一次批量写中的事件相同
+	// 订阅中断后使用最后一个 Last 事件的 SeqNo+1 恢复
+	SeqNo uint64
+	Batch bool // 是否来自批量写或事务
+	Last  bool // 是否为本次提交中的最后一个事件，单条写入总是为 true
+}
+
+// subscription 一个订阅者，写入的事件先进入队列，由单独的协程发送到通道
+type subscription struct {
+	prefix   []byte
+	ch       chan ChangeEvent
+	lock     *sync.Mutex
+	queue    []ChangeEvent // 等待发送的实时事件
+	overflow bool          // 队列是否溢出，溢出后需要从数据文件重放
+	notify   chan struct{}
+	cancelCh chan struct{}
+	once     *sync.Once
+	done     chan struct{}
+	err      error // 订阅因错误结束时的错误
+}
+
+// Subscribe 订阅key以prefix开头的变更，从序列号为fromSeq的变更开始
+// 早于订阅时刻的变更从数据文件中重放，之后的变更在写入日志后发送，事件按照提交顺序不重不漏
+// fromSeq 为0时重放所有数据文件；早于上一次merge的变更已被合并，此时从merge后的数据开始重放，
+// 每个key只保留merge时的最新值
+// 返回的 cancel 用于结束订阅并关闭通道，订阅因错误结束时返回该错误
+func (db *DB) Subscribe(prefix []byte, fromSeq uint64) (<-chan ChangeEvent, func() error) {
+	s := &subscription{
+		prefix:   bytes.Clone(prefix),
+		ch:       make(chan ChangeEvent),
+		lock:     &sync.Mutex{},
+		notify:   make(chan struct{}, 1),
+		cancelCh: make(chan struct{}),
+		once:     &sync.Once{},
+		done:     make(chan struct{}),
+	}
+	cancel := func() error {
+		s.once.Do(func() { close(s.cancelCh) })
+		<-s.done
+		return s.err
+	}
+
+	db.lock.Lock()
+	select {
+	case <-db.closeCh:
+		db.lock.Unlock()
+		close(s.ch)
+		close(s.done)
+		return s.ch, cancel
+	default:
+	}
+	files, from, end := db.pinChangeFiles(fromSeq)
+	if db.subscribers == nil {
+		db.subscribers = make(map[*subscription]struct{})
+	}
+	db.subscribers[s] = struct{}{}
+	db.wg.Add(1)
+	db.lock.Unlock()
+
+	go s.run(db, files, from, end)
+	return s.ch, cancel
+}
+
+// changeSeq 由日志中的位置生成变更序列号
+func changeSeq(fid uint32, offset int64) uint64 {
+	return uint64(fid)<<changeOffsetBits | uint64(offset)
+}
+
+// pinChangeFiles 获取需要重放的数据文件与重放范围，调用方需持有库锁
+// 数据文件在调用 releaseSnapshot 之前不会被merge关闭，没有需要重放的变更时返回nil
+func (db *DB) pinChangeFiles(from uint64) (map[uint32]*DataFile, uint64, uint64) {
+	// 持有库锁时不在组提交中，活跃文件的写入位置之前都是完整的提交
+	var end uint64
+	if db.activeFile != nil {
+		end = changeSeq(db.activeFile.FileId, db.activeFile.WriteOffset)
+	}
+	if from >= end {
+		return nil, end, end
+	}
+
+	// merge 生成的文件中记录的位置与原来的位置无关，只能从头重放
+	if from > 0 {
+		if _, err := os.Stat(filepath.Join(db.options.DirPath, MergeFinishedFileName)); err == nil {
+			nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
+			if err != nil || from < changeSeq(nonMergeFileId, 0) {
+				from = 0
+			}
+		}
+	}
+
+	files := make(map[uint32]*DataFile, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		files[fid] = dataFile
+	}
+	files[db.activeFile.FileId] = db.activeFile
+	db.snapshots++
+	return files, from, end
+}
+
+// recordChange 记录追加到日志的变更，写入文件之后发送给订阅者，调用方需持有库锁
+func (db *DB) recordChange(r *LogRecord, key []byte, seq uint64, batch, last bool) {
+	if len(db.subscribers) == 0 {
+		return
+	}
+	event := ChangeEvent{
+		Key:    bytes.Clone(key),
+		Expire: r.Expire,
+		SeqNo:  seq,
+		Batch:  batch,
+		Last:   last,
+	}
+	switch r.Type {
+	case LogRecordDeleted:
+		event.Type = ChangeDelete
+	case LogRecordRangeDeleted:
+		event.Type = ChangeDeleteRange
+		event.Value = bytes.Clone(r.Value)
+	default:
+		event.Type = ChangePut
+		event.Value = bytes.Clone(r.Value)
+	}
+	db.pendingChanges = append(db.pendingChanges, event)
+}
+
+// publishChanges 将已写入文件的变更发送给订阅者，调用方需持有库锁
+func (db *DB) publishChanges() {
+	if len(db.pendingChanges) == 0 {
+		return
+	}
+	for s := range db.subscribers {
+		s.publish(db.pendingChanges)
+	}
+	db.pendingChanges = db.pendingChanges[:0]
+}
+
+// publish 将事件加入队列，同一次写入的事件一起加入，保证批量写不会被溢出截断
+func (s *subscription) publish(events []ChangeEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.overflow {
+		return
+	}
+	n, matched := len(s.queue), false
+	for _, event := range events {
+		last := event.Last
+		if event.matchPrefix(s.prefix) {
+			event.Last = false
+			s.queue = append(s.queue, event)
+			matched = true
+		}
+		// 过滤之后本次提交中的最后一个事件
+		if last && matched {
+			s.queue[len(s.queue)-1].Last = true
+			matched = false
+		}
+	}
+	if len(s.queue) == n {
+		return
+	}
+	if len(s.queue) > maxSubscriberQueue {
+		s.queue = nil
+		s.overflow = true
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run 先重放数据文件中的变更，再发送实时的变更
+func (s *subscription) run(db *DB, files map[uint32]*DataFile, next, end uint64) {
+	defer db.wg.Done()
+	defer close(s.done)
+	defer close(s.ch)
+	defer func() {
+		db.lock.Lock()
+		delete(db.subscribers, s)
+		db.lock.Unlock()
+	}()
+
+	for {
+		if files != nil {
+			var ok bool
+			ok, s.err = s.replay(db, files, next, end)
+			db.releaseSnapshot()
+			if !ok || s.err != nil {
+				return
+			}
+			next = end
+		}
+
+		select {
+		case <-s.notify:
+		case <-s.cancelCh:
+			return
+		case <-db.closeCh:
+			return
+		}
+
+		s.lock.Lock()
+		events, overflow := s.queue, s.overflow
+		s.queue = nil
+		s.lock.Unlock()
+
+		// 消费过慢时丢弃队列中的事件，从最后一个完整发送的提交之后重放
+		if overflow {
+			db.lock.Lock()
+			files, next, end = db.pinChangeFiles(next)
+			s.lock.Lock()
+			s.queue = nil
+			s.overflow = false
+			s.lock.Unlock()
+			db.lock.Unlock()
+			continue
+		}
+		for _, event := range events {
+			if !s.send(db, event) {
+				return
+			}
+			if event.Last {
+				next = event.SeqNo + 1
+			}
+		}
+	}
+}
+
+// send 发送事件，订阅取消或数据库关闭时返回false
+func (s *subscription) send(db *DB, event ChangeEvent) bool {
+	select {
+	case s.ch <- event:
+		return true
+	case <-s.cancelCh:
+		return false
+	case <-db.closeCh:
+		return false
+	}
+}
+
+// replay 按照日志顺序重放 [from, end) 之间的变更，订阅取消或数据库关闭时返回false
+func (s *subscription) replay(db *DB, files map[uint32]*DataFile, from, end uint64) (bool, error) {
+	fids := make([]uint32, 0, len(files))
+	for fid := range files {
+		fids = append(fids, fid)
+	}
+	slices.Sort(fids)
+
+	// 批量写的记录可能跨越文件，从起始位置的前一个文件开始读取
+	startFid := uint32(from >> changeOffsetBits)
+	if startFid > 0 {
+		startFid--
+	}
+	endFid, endOffset := uint32(end>>changeOffsetBits), int64(end&(1<<changeOffsetBits-1))
+
+	batches := make(map[uint64][]ChangeEvent)
+	for _, fid := range fids {
+		if fid < startFid || fid > endFid {
+			continue
+		}
+		dataFile := files[fid]
+		fileSize, err := dataFile.IoManager.Size()
+		if err != nil {
+			return false, err
+		}
+
+		var offset int64 = 0
+		for fid != endFid || offset < endOffset {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				// 与启动时一样跳过损坏的数据段
+				if errors.Is(err, errs.ErrInvalidCRC) && db.options.RecoveryMode == RecoverySkipCorrupt {
+					if offset = findNextRecord(dataFile, offset+1, fileSize); offset >= 0 {
+						continue
+					}
+					break
+				}
+				return false, err
+			}
+			seq := changeSeq(fid, offset)
+			offset += size
+
+			key, txnSeqNo := parseLogRecordKey(logRecord.Key)
+			var events []ChangeEvent
+			switch {
+			case logRecord.Type == LogRecordTxnFinished:
+				events = batches[txnSeqNo]
+				delete(batches, txnSeqNo)
+			case logRecord.Family != defaultFamilyId:
+				continue
+			case txnSeqNo == nonTransactionSeqNo:
+				events = []ChangeEvent{newChangeEvent(logRecord, key, false)}
+			default:
+				// 事务提交之后才发送
+				batches[txnSeqNo] = append(batches[txnSeqNo], newChangeEvent(logRecord, key, true))
+				continue
+			}
+			if seq < from {
+				continue
+			}
+			events = slices.DeleteFunc(events, func(event ChangeEvent) bool {
+				return !event.matchPrefix(s.prefix)
+			})
+			for i := range events {
+				events[i].SeqNo = seq
+				events[i].Last = i == len(events)-1
+				if !s.send(db, events[i]) {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// newChangeEvent 由读取的日志记录生成事件
+func newChangeEvent(r *LogRecord, key []byte, batch bool) ChangeEvent {
+	event := ChangeEvent{Key: key, Expire: r.Expire, Batch: batch, Last: true}
+	switch r.Type {
+	case LogRecordDeleted:
+		event.Type = ChangeDelete
+	case LogRecordRangeDeleted:
+		event.Type = ChangeDeleteRange
+		event.Value = r.Value
+	default:
+		event.Type = ChangePut
+		event.Value = r.Value
+	}
+	return event
+}
+
+// matchPrefix 判断事件是否涉及以prefix开头的key，范围删除只要范围与前缀相交即匹配
+func (e *ChangeEvent) matchPrefix(prefix []byte) bool {
+	if e.Type != ChangeDeleteRange {
+		return bytes.HasPrefix(e.Key, prefix)
+	}
+	end := prefixEnd(prefix)
+	return beforeEnd(prefix, e.Value) && (len(end) == 0 || bytes.Compare(e.Key, end) < 0)
+}
@@ -0,0 +1,144 @@
+package kv
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receiveChanges 从通道中读取n个事件
+func receiveChanges(t *testing.T, ch <-chan ChangeEvent, n int) []ChangeEvent {
+	events := make([]ChangeEvent, 0, n)
+	for len(events) < n {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %d events", len(events))
+			}
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout after %d events", len(events))
+		}
+	}
+	return events
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	// 订阅之前的写入从数据文件重放
+	for i := range 500 {
+		assert.Nil(t, db.Put(GetTestKey(i), RandomValue(64)))
+	}
+	assert.Nil(t, db.Delete(GetTestKey(0)))
+	wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.Put([]byte("batch-1"), []byte("v1")))
+	assert.Nil(t, wb.Put([]byte("batch-2"), []byte("v2")))
+	assert.Nil(t, wb.Commit())
+	users, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	assert.Nil(t, users.Put([]byte("batch-3"), []byte("ignored")))
+
+	ch, cancel := db.Subscribe(nil, 0)
+	events := receiveChanges(t, ch, 503)
+	for i := range 500 {
+		assert.Equal(t, ChangePut, events[i].Type)
+		assert.Equal(t, GetTestKey(i), events[i].Key)
+		assert.True(t, events[i].Last)
+		if i > 0 {
+			assert.Greater(t, events[i].SeqNo, events[i-1].SeqNo)
+		}
+	}
+	assert.Equal(t, ChangeDelete, events[500].Type)
+	assert.Nil(t, events[500].Value)
+	assert.True(t, events[501].Batch)
+	assert.Equal(t, events[501].SeqNo, events[502].SeqNo)
+	assert.False(t, events[501].Last)
+	assert.True(t, events[502].Last)
+
+	// 之后的写入在提交后发送
+	assert.Nil(t, db.Put([]byte("live"), []byte("value")))
+	live := receiveChanges(t, ch, 1)[0]
+	assert.Equal(t, []byte("live"), live.Key)
+	assert.Equal(t, []byte("value"), live.Value)
+	assert.Greater(t, live.SeqNo, events[502].SeqNo)
+	assert.Nil(t, cancel())
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	// 从指定的序列号恢复，只包含前缀匹配的key
+	ch, cancel = db.Subscribe([]byte("batch-"), events[400].SeqNo)
+	resumed := receiveChanges(t, ch, 2)
+	// 批量写中的事件按照写入日志的顺序发送，与添加的顺序无关
+	assert.ElementsMatch(t, [][]byte{[]byte("batch-1"), []byte("batch-2")}, [][]byte{resumed[0].Key, resumed[1].Key})
+	assert.Nil(t, cancel())
+
+	ch, cancel = db.Subscribe(nil, live.SeqNo+1)
+	wb = db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.Put([]byte("batch-4"), []byte("v4")))
+	assert.Nil(t, wb.Delete(GetTestKey(1)))
+	assert.Nil(t, wb.Commit())
+	batch := receiveChanges(t, ch, 2)
+	assert.Equal(t, batch[0].SeqNo, batch[1].SeqNo)
+	assert.True(t, batch[1].Last)
+	assert.Nil(t, cancel())
+}
+
+func TestDB_SubscribeSlowConsumer(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-slow")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	// 不消费的订阅者队列溢出后从数据文件重放，事件不重不漏
+	ch, cancel := db.Subscribe(nil, SubscribeLatest)
+	n := maxSubscriberQueue * 3
+	for i := range n {
+		assert.Nil(t, db.Put(GetTestKey(i), []byte("value")))
+	}
+	events := receiveChanges(t, ch, n)
+	for i, event := range events {
+		assert.Equal(t, GetTestKey(i), event.Key)
+	}
+	assert.Nil(t, db.Put([]byte("tail"), []byte("value")))
+	assert.Equal(t, []byte("tail"), receiveChanges(t, ch, 1)[0].Key)
+	assert.Nil(t, cancel())
+}
+
+func TestDB_SubscribeAfterMerge(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	for i := range 1000 {
+		assert.Nil(t, db.Put(GetTestKey(i%100), RandomValue(64)))
+	}
+	ch, cancel := db.Subscribe(nil, 0)
+	events := receiveChanges(t, ch, 1000)
+	assert.Nil(t, cancel())
+	assert.Nil(t, db.Merge())
+
+	// 早于merge的位置从merge后的数据开始重放，每个key只有最新值
+	ch, cancel = db.Subscribe(nil, events[500].SeqNo)
+	merged := receiveChanges(t, ch, 100)
+	keys := make(map[string]struct{})
+	for _, event := range merged {
+		keys[string(event.Key)] = struct{}{}
+	}
+	assert.Equal(t, 100, len(keys))
+	assert.Nil(t, cancel())
+}
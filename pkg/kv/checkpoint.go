@@ -0,0 +1,235 @@
+package kv
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// 启动时重放数据文件，持久化的索引每个事务写入的记录数
+const indexBatchSize = 64 * 1024
+
+// indexCheckpoint 持久化索引的检查点，索引中已经应用了该位置之前的所有记录
+// 异常退出之后只需要从该位置开始重放数据文件
+type indexCheckpoint struct {
+	Fid            uint32
+	Offset         int64
+	SeqNo          uint64
+	ReclaimSize    int64
+	NonMergeFileId uint32 // 索引中已合并文件的位置对应的merge
+}
+
+// checkpointIndexer 持久化的索引，一批修改与检查点在同一个事务中提交
+type checkpointIndexer interface {
+	begin()
+	commit(cp *indexCheckpoint) error
+	rollback()
+	checkpoint() *indexCheckpoint
+	reset() error
+}
+
+func (cp *indexCheckpoint) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*3)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(cp.Fid))
+	index += binary.PutVarint(buf[index:], cp.Offset)
+	index += binary.PutUvarint(buf[index:], cp.SeqNo)
+	index += binary.PutVarint(buf[index:], cp.ReclaimSize)
+	index += binary.PutUvarint(buf[index:], uint64(cp.NonMergeFileId))
+	return buf[:index]
+}
+
+func decodeIndexCheckpoint(buf []byte) *indexCheckpoint {
+	var index = 0
+	fid, n := binary.Uvarint(buf[index:])
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	index += n
+	seqNo, n := binary.Uvarint(buf[index:])
+	index += n
+	reclaimSize, n := binary.Varint(buf[index:])
+	index += n
+	nonMergeFileId, _ := binary.Uvarint(buf[index:])
+	return &indexCheckpoint{
+		Fid:            uint32(fid),
+		Offset:         offset,
+		SeqNo:          seqNo,
+		ReclaimSize:    reclaimSize,
+		NonMergeFileId: uint32(nonMergeFileId),
+	}
+}
+
+// posBefore 位置 a 是否在位置 b 之前
+func posBefore(a, b *LogRecordPos) bool {
+	return a.Fid < b.Fid || (a.Fid == b.Fid && a.Offset < b.Offset)
+}
+
+// checkpointIndexes 所有列族中持久化的索引，调用方需持有库锁
+func (db *DB) checkpointIndexes() []checkpointIndexer {
+	var indexes []checkpointIndexer
+	for _, cf := range db.families {
+		if index, ok := cf.index.(checkpointIndexer); ok {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// beginIndexBatch 持久化的索引开始批量写入，调用方需持有库锁
+func (db *DB) beginIndexBatch() {
+	for _, index := range db.checkpointIndexes() {
+		index.begin()
+	}
+}
+
+// commitIndexBatch 提交持久化索引的批量写入，pos 不为空时保存为检查点，调用方需持有库锁
+// pos 之前的记录必须已经写入数据文件并应用到索引
+func (db *DB) commitIndexBatch(pos *LogRecordPos) error {
+	var err error
+	for _, index := range db.checkpointIndexes() {
+		if e := index.commit(db.newIndexCheckpoint(pos)); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// rollbackIndexBatch 放弃持久化索引的批量写入，调用方需持有库锁
+func (db *DB) rollbackIndexBatch() {
+	for _, index := range db.checkpointIndexes() {
+		index.rollback()
+	}
+}
+
+// initIndexCheckpoint 新建的持久化索引以当前写入的位置作为检查点，之前的记录都不属于该索引
+func (db *DB) initIndexCheckpoint(index Indexer) error {
+	if index, ok := index.(checkpointIndexer); ok {
+		return index.commit(db.newIndexCheckpoint(db.writtenPos()))
+	}
+	return nil
+}
+
+func (db *DB) newIndexCheckpoint(pos *LogRecordPos) *indexCheckpoint {
+	if pos == nil {
+		return nil
+	}
+	return &indexCheckpoint{
+		Fid:            pos.Fid,
+		Offset:         pos.Offset,
+		SeqNo:          atomic.LoadUint64(&db.seqNo),
+		ReclaimSize:    db.reclaimSize,
+		NonMergeFileId: db.nonMergeFileId,
+	}
+}
+
+// writtenPos 活跃文件中已经写入的位置，调用方需持有库锁
+func (db *DB) writtenPos() *LogRecordPos {
+	if db.activeFile == nil {
+		return &LogRecordPos{}
+	}
+	return &LogRecordPos{Fid: db.activeFile.FileId, Offset: db.activeFile.WriteOffset}
+}
+
+// splitIndexBatch 持久化索引的批量写入每 indexBatchSize 次修改提交一次，调用方需持有库锁
+// pos 返回提交时保存的检查点，为空时不保存
+func (db *DB) splitIndexBatch(count *int, pos func() *LogRecordPos) error {
+	*count++
+	if *count < indexBatchSize {
+		return nil
+	}
+	*count = 0
+	var cp *LogRecordPos
+	if pos != nil {
+		cp = pos()
+	}
+	if err := db.commitIndexBatch(cp); err != nil {
+		return err
+	}
+	db.beginIndexBatch()
+	return nil
+}
+
+// loadIndexCheckpoint 获取持久化索引可以使用的检查点，返回nil时需要清空索引后完整重建
+// 各个列族的索引分别提交，使用其中最早的检查点，已经应用过的记录按顺序再次应用结果不变
+func (db *DB) loadIndexCheckpoint(fileIds []uint32) (*indexCheckpoint, error) {
+	var cp *indexCheckpoint
+	for _, index := range db.checkpointIndexes() {
+		saved := index.checkpoint()
+		if saved == nil {
+			return nil, nil
+		}
+		if cp == nil || saved.Fid < cp.Fid || (saved.Fid == cp.Fid && saved.Offset < cp.Offset) {
+			cp = saved
+		}
+	}
+	if cp == nil {
+		return nil, nil
+	}
+	// 检查点之后的记录已经被merge重写，或者索引对应的merge比数据目录中的更新，都无法重放
+	if cp.Fid < db.nonMergeFileId || cp.NonMergeFileId > db.nonMergeFileId {
+		return nil, nil
+	}
+	// 检查点超出了数据文件的范围，说明数据文件在索引提交之后丢失了数据
+	if len(fileIds) == 0 {
+		if cp.Fid != 0 || cp.Offset != 0 {
+			return nil, nil
+		}
+		return cp, nil
+	}
+	dataFile := db.olderFiles[cp.Fid]
+	if db.activeFile.FileId == cp.Fid {
+		dataFile = db.activeFile
+	}
+	if dataFile == nil {
+		return nil, nil
+	}
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	if cp.Offset > size {
+		return nil, nil
+	}
+	return cp, nil
+}
+
+// loadIndex 构建索引
+// 持久化的索引从检查点开始重放数据文件，没有可用的检查点时清空后使用hint文件与数据文件重建，
+// 重放的修改分批提交
+func (db *DB) loadIndex(fileIds []uint32) error {
+	cp, err := db.loadIndexCheckpoint(fileIds)
+	if err != nil {
+		return err
+	}
+	from := &LogRecordPos{}
+	if cp != nil {
+		from.Fid, from.Offset = cp.Fid, cp.Offset
+		db.seqNo, db.reclaimSize = cp.SeqNo, cp.ReclaimSize
+	} else {
+		for _, index := range db.checkpointIndexes() {
+			if err := index.reset(); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.beginIndexBatch()
+	switch {
+	case cp == nil:
+		// 从hint文件加载索引
+		err = db.loadIndexFromHintFile()
+	case cp.NonMergeFileId != db.nonMergeFileId:
+		// 上次退出前应用了merge，但索引还没有更新
+		err = db.updateIndexFromHintFile()
+	}
+	if err != nil {
+		db.rollbackIndexBatch()
+		return err
+	}
+	// 加载索引
+	pos, err := db.loadIndexFromDataFiles(fileIds, from)
+	if err != nil {
+		db.rollbackIndexBatch()
+		return err
+	}
+	return db.commitIndexBatch(pos)
+}
@@ -0,0 +1,128 @@
+package kv
+
+import "github.com/kamijoucen/hifidb/pkg/errs"
+
+// 组提交时写缓冲保留的最大容量，超过后释放，避免一次大写入长期占用内存
+const maxRetainedWriteBuf = 4 * 1024 * 1024
+
+// commitRequest 等待组提交的写请求
+type commitRequest struct {
+	fn   func() error // 在库锁内执行，追加记录并更新索引
+	sync bool         // 返回前是否需要持久化
+	err  error
+	lead bool          // 被唤醒时是否成为新的leader
+	done chan struct{} // 写请求完成或成为leader时关闭
+}
+
+// commit 通过组提交写入数据
+// 并发的写请求在队列中排队，由leader在一次持锁中依次执行，合并为一次写文件与一次同步，
+// 返回时本次写入已写入文件，sync 为 true 时已经持久化
+func (db *DB) commit(sync bool, fn func() error) error {
+	if db.replica != nil {
+		return errs.ErrReadOnlyReplica
+	}
+	req := &commitRequest{fn: fn, sync: sync, done: make(chan struct{})}
+
+	db.commitLock.Lock()
+	db.commitQueue = append(db.commitQueue, req)
+	if db.committing {
+		db.commitLock.Unlock()
+		<-req.done
+		if !req.lead {
+			return req.err
+		}
+	} else {
+		db.committing = true
+		db.commitLock.Unlock()
+	}
+
+	db.leadCommit(req)
+	return req.err
+}
+
+// leadCommit 作为leader提交队列中的所有写请求，完成后将leader交给下一个排队的请求
+func (db *DB) leadCommit(leader *commitRequest) {
+	db.commitLock.Lock()
+	group := db.commitQueue
+	db.commitQueue = nil
+	db.commitLock.Unlock()
+
+	db.commitGroup(group)
+
+	db.commitLock.Lock()
+	if len(db.commitQueue) > 0 {
+		next := db.commitQueue[0]
+		next.lead = true
+		close(next.done)
+	} else {
+		db.committing = false
+	}
+	db.commitLock.Unlock()
+
+	for _, req := range group {
+		if req != leader {
+			close(req.done)
+		}
+	}
+}
+
+// commitGroup 在库锁内执行一组写请求，缓冲的记录一次写入活跃文件，至多同步一次
+// 持久化索引的修改在一个事务中提交，记录写入文件之后才提交，索引不会领先于数据文件
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.beginIndexBatch()
+	db.inCommitGroup = true
+	needSync := false
+	for _, req := range group {
+		if req.err = req.fn(); req.err == nil && req.sync {
+			needSync = true
+		}
+	}
+	db.inCommitGroup = false
+
+	// 写入或同步失败时，同组的写请求都无法保证已经写入
+	err := db.flushWrites(needSync)
+	if err == nil {
+		err = db.commitIndexBatch(db.writtenPos())
+	} else {
+		db.rollbackIndexBatch()
+	}
+	if err != nil {
+		for _, req := range group {
+			if req.err == nil {
+				req.err = err
+			}
+		}
+	}
+}
+
+// flushWrites 将缓冲的记录写入活跃文件，并按照配置进行同步，调用方需持有库锁
+func (db *DB) flushWrites(sync bool) error {
+	if len(db.writeBuf) > 0 {
+		err := db.activeFile.Write(db.writeBuf)
+		if cap(db.writeBuf) > maxRetainedWriteBuf {
+			db.writeBuf = nil
+		} else {
+			db.writeBuf = db.writeBuf[:0]
+		}
+		if err != nil {
+			db.pendingChanges = db.pendingChanges[:0]
+			return err
+		}
+		db.publishChanges()
+		db.writeNotify.notify()
+	}
+
+	if !sync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
+		sync = true
+	}
+	if sync && db.bytesWrite > 0 {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+		db.bytesWrite = 0
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package kv
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingIOManager 统计写入与同步的次数，同步时模拟磁盘的延迟
+type countingIOManager struct {
+	IOManager
+	writes *atomic.Int64
+	syncs  *atomic.Int64
+}
+
+func (m *countingIOManager) Write(b []byte) (int, error) {
+	m.writes.Add(1)
+	return m.IOManager.Write(b)
+}
+
+func (m *countingIOManager) Sync() error {
+	m.syncs.Add(1)
+	time.Sleep(time.Millisecond)
+	return m.IOManager.Sync()
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	assert.Nil(t, db.Put(GetTestKey(-1), []byte("v")))
+	writes, syncs := &atomic.Int64{}, &atomic.Int64{}
+	db.activeFile.IoManager = &countingIOManager{IOManager: db.activeFile.IoManager, writes: writes, syncs: syncs}
+
+	const writers, perWriter = 100, 20
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				key := GetTestKey(w*perWriter + i)
+				switch i % 4 {
+				case 0, 1:
+					assert.Nil(t, db.Put(key, key))
+				case 2:
+					wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+					assert.Nil(t, wb.Put(key, key))
+					assert.Nil(t, wb.Delete(GetTestKey(w*perWriter+i-1)))
+					assert.Nil(t, wb.Commit())
+				case 3:
+					assert.Nil(t, db.Put(key, key))
+					assert.Nil(t, db.Expire(key, time.Hour))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 每个写请求都需要持久化，组提交合并了写入与同步
+	requests := int64(writers * perWriter)
+	assert.Less(t, writes.Load(), requests)
+	assert.Less(t, syncs.Load(), requests)
+	assert.GreaterOrEqual(t, writes.Load(), syncs.Load())
+
+	check := func(db *DB) {
+		assert.Equal(t, writers*perWriter*3/4+1, len(db.ListKeys()))
+		for w := range writers {
+			for i := range perWriter {
+				key := GetTestKey(w*perWriter + i)
+				val, err := db.Get(key)
+				if i%4 == 1 {
+					assert.NotNil(t, err)
+					continue
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, key, val)
+			}
+		}
+	}
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_WriteBatchSync(t *testing.T) {
+	for _, syncWrites := range []bool{false, true} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-batch-sync")
+		opts.DirPath = dir
+		opts.SyncWrites = syncWrites
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		assert.Nil(t, db.Put(GetTestKey(-1), []byte("v")))
+		writes, syncs := &atomic.Int64{}, &atomic.Int64{}
+		db.activeFile.IoManager = &countingIOManager{IOManager: db.activeFile.IoManager, writes: writes, syncs: syncs}
+
+		// 批量写是否同步只由 EachSyncWrites 决定
+		for i, eachSync := range []bool{false, true} {
+			wb := db.NewWriteBatch(&WriteBatchOptions{MaxBatchSize: 10, EachSyncWrites: eachSync})
+			assert.Nil(t, wb.Put(GetTestKey(i), []byte("v")))
+			before := syncs.Load()
+			assert.Nil(t, wb.Commit())
+			if eachSync {
+				assert.Equal(t, before+1, syncs.Load())
+			} else {
+				assert.Equal(t, before, syncs.Load())
+			}
+		}
+		destroyDB(db)
+	}
+}
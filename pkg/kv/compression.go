@@ -0,0 +1,96 @@
+package kv
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// 压缩算法定义，编号存储在记录头部，不能修改已有的值
+type Compression = uint8
+
+const (
+	// NoCompression 不压缩
+	NoCompression Compression = iota
+
+	// Snappy snappy 格式压缩
+	Snappy
+
+	// Zstd zstd 格式压缩
+	Zstd
+
+	// LZ4 lz4 block 格式压缩，压缩数据前存储原始长度
+	LZ4
+)
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		return dec
+	})
+)
+
+// compressValue 压缩value，压缩后没有变小时返回false，此时应存储原始数据
+func compressValue(c Compression, value []byte) ([]byte, bool) {
+	var compressed []byte
+	switch c {
+	case Snappy:
+		compressed = s2.EncodeSnappy(nil, value)
+	case Zstd:
+		compressed = zstdEncoder().EncodeAll(value, nil)
+	case LZ4:
+		buf := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(value)))
+		n := binary.PutUvarint(buf, uint64(len(value)))
+		size, err := lz4.CompressBlock(value, buf[n:], nil)
+		// 不可压缩的数据返回的长度为0
+		if err != nil || size == 0 {
+			return nil, false
+		}
+		compressed = buf[:n+size]
+	default:
+		return nil, false
+	}
+	if len(compressed) >= len(value) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+// decompressValue 解压value
+func decompressValue(c Compression, value []byte) ([]byte, error) {
+	switch c {
+	case Snappy:
+		decoded, err := s2.Decode(nil, value)
+		if err != nil {
+			return nil, errs.ErrInvalidCompressedValue
+		}
+		return decoded, nil
+	case Zstd:
+		decoded, err := zstdDecoder().DecodeAll(value, nil)
+		if err != nil {
+			return nil, errs.ErrInvalidCompressedValue
+		}
+		return decoded, nil
+	case LZ4:
+		size, n := binary.Uvarint(value)
+		if n <= 0 || size > math.MaxUint32 {
+			return nil, errs.ErrInvalidCompressedValue
+		}
+		decoded := make([]byte, size)
+		m, err := lz4.UncompressBlock(value[n:], decoded)
+		if err != nil || uint64(m) != size {
+			return nil, errs.ErrInvalidCompressedValue
+		}
+		return decoded, nil
+	}
+	return nil, errs.ErrInvalidCompressedValue
+}
@@ -0,0 +1,71 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Compression(t *testing.T) {
+	jsonValue := func(i int) []byte {
+		return bytes.Repeat(fmt.Appendf(nil, `{"id":%d,"name":"bitcask-go","tags":["kv","log"]}`, i), 20)
+	}
+
+	// 不压缩写入的数据作为已有的数据文件
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+	for i := range 100 {
+		assert.Nil(t, db.Put(GetTestKey(i), jsonValue(i)))
+	}
+	rawSize := db.activeFile.WriteOffset
+	assert.Nil(t, db.Close())
+
+	for _, c := range []Compression{Snappy, Zstd, LZ4} {
+		opts.Compression = c
+		db, err = Open(opts)
+		assert.Nil(t, err)
+
+		offset := db.activeFile.WriteOffset
+		for i := 100; i < 200; i++ {
+			assert.Nil(t, db.Put(GetTestKey(i), jsonValue(i)))
+		}
+		// 小于阈值的value不压缩
+		assert.Nil(t, db.Put([]byte("small"), []byte("v")))
+		assert.Less(t, (db.activeFile.WriteOffset-offset)*3, rawSize)
+
+		// 压缩与未压缩的数据都可以读取
+		for i := range 200 {
+			val, err := db.Get(GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, jsonValue(i), val)
+		}
+		val, err := db.Get([]byte("small"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), val)
+
+		// merge 按照当前的算法重写所有数据
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		// 重写之后两倍的数据仍小于最初未压缩的数据
+		assert.Less(t, stat.DiskSize, rawSize)
+		for i := range 200 {
+			val, err := db.Get(GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, jsonValue(i), val)
+		}
+		assert.Nil(t, db.Close())
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
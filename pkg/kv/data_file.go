@@ -1,10 +1,15 @@
 package kv
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/kamijoucen/hifidb/pkg/errs"
 )
@@ -20,6 +25,8 @@ type DataFile struct {
 	FileName    string
 	WriteOffset int64
 	IoManager   IOManager
+	cipher      *recordCipher // 开启加密时用于加密hint记录与解密读取的记录
+	retired     atomic.Bool   // 是否已被merge或全量同步替换，替换后文件编号会被重新使用，不再使用value缓存
 }
 
 // OpenDataFile 打开数据文件
@@ -28,6 +35,20 @@ func OpenDataFile(ioType IOType, dirPath string, fileId uint32) (*DataFile, erro
 	return newDataFile(ioType, fileName, fileId)
 }
 
+// OpenActiveDataFile 打开用于追加写入的活跃数据文件，IO_MMAP 时预分配 preallocSize 大小的空间
+func OpenActiveDataFile(ioType IOType, dirPath string, fileId uint32, preallocSize int64) (*DataFile, error) {
+	fileName := GetDataFileName(dirPath, fileId)
+	ioManager, err := NewWritableIOManager(ioType, fileName, preallocSize)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFile{
+		FileId:    fileId,
+		FileName:  fileName,
+		IoManager: ioManager,
+	}, nil
+}
+
 // OpenHintFile 打开hint文件
 func OpenHintFile(dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
@@ -64,6 +85,26 @@ func (d *DataFile) Sync() error {
 	return d.IoManager.Sync()
 }
 
+// Seal 活跃文件写满之后同步数据，预分配空间的文件截断到实际大小，之后不再写入
+func (d *DataFile) Seal() error {
+	if err := d.Sync(); err != nil {
+		return err
+	}
+	if s, ok := d.IoManager.(sealer); ok {
+		return s.Seal()
+	}
+	return nil
+}
+
+// Truncate 截断数据文件，之后从该位置继续写入
+func (d *DataFile) Truncate(size int64) error {
+	if err := d.IoManager.Truncate(size); err != nil {
+		return err
+	}
+	d.WriteOffset = size
+	return nil
+}
+
 // Write 写入数据
 func (d *DataFile) Write(b []byte) error {
 	_, err := d.IoManager.Write(b)
@@ -76,11 +117,20 @@ func (d *DataFile) Write(b []byte) error {
 
 // WriteHintRecord 写入hint记录
 func (d *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+	return d.writeFamilyHintRecord(defaultFamilyId, key, pos)
+}
+
+// writeFamilyHintRecord 写入列族中key的hint记录
+func (d *DataFile) writeFamilyHintRecord(family uint32, key []byte, pos *LogRecordPos) error {
 	record := &LogRecord{
-		Key:   key,
-		Value: EncodeLogRecordPos(pos),
+		Key:    key,
+		Value:  EncodeLogRecordPos(pos),
+		Family: family,
+	}
+	encRecord, _, err := encodeLogRecord(record, NoCompression, d.cipher)
+	if err != nil {
+		return err
 	}
-	encRecord, _ := EncodeLogRecord(record)
 	return d.Write(encRecord)
 
 }
@@ -90,52 +140,192 @@ func (d *DataFile) Close() error {
 	return d.IoManager.Close()
 }
 
+// maxPooledReadBufSize 超过该大小的读取缓冲不放回池中，避免读取大value之后长期占用内存
+const maxPooledReadBufSize = 1 << 20
+
+// readBufPool 没有映射时读取记录使用的缓冲
+var readBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+func getReadBuf() *[]byte {
+	return readBufPool.Get().(*[]byte)
+}
+
+func putReadBuf(bp *[]byte) {
+	if cap(*bp) > maxPooledReadBufSize {
+		return
+	}
+	*bp = (*bp)[:0]
+	readBufPool.Put(bp)
+}
+
+// rawLogRecord 通过crc校验但还没有解密与解压的记录
+type rawLogRecord struct {
+	header logRecordHeader
+	key    []byte
+	value  []byte
+	size   int64
+	mapped bool // key与value是否直接引用映射的内存
+}
+
 // ReadLogRecord 读取日志记录
+// 记录已加密但数据文件没有密钥时，返回通过crc校验的记录长度与 ErrEncryptionKeyRequired，
+// 此时记录中只有未加密的key
 func (d *DataFile) ReadLogRecord(off int64) (*LogRecord, int64, error) {
-
-	var fileSize, err = d.IoManager.Size()
+	raw, _, err := d.readRawLogRecord(off, 0, nil)
 	if err != nil {
 		return nil, 0, err
 	}
+	header := &raw.header
+	logRecord := &LogRecord{
+		Key:    raw.key,
+		Value:  raw.value,
+		Type:   header.recordType,
+		Expire: header.expire,
+		Family: header.family,
+	}
+	// 映射中的数据在文件关闭之后失效，解密与解压会生成新的数据，其余的需要拷贝
+	if raw.mapped {
+		if !header.encrypted || !header.encKey {
+			logRecord.Key = bytes.Clone(logRecord.Key)
+		}
+		if !header.encrypted && header.codec == NoCompression {
+			logRecord.Value = bytes.Clone(logRecord.Value)
+		}
+	}
+	if err := d.decodeLogRecord(header, logRecord); err != nil {
+		if errors.Is(err, errs.ErrEncryptionKeyRequired) {
+			return logRecord, raw.size, err
+		}
+		return nil, 0, err
+	}
+	return logRecord, raw.size, nil
+}
 
-	// 读取头部
-	var headerSize = maxLogRecordHeaderSize
-	if off+headerSize > fileSize {
-		headerSize = fileSize - off
+// readValue 读取索引位置上记录的value，没有加密与压缩时value直接引用映射的内存或者buf
+// buf 为没有映射时读取使用的缓冲，容量不足时重新分配，返回之后可以复用
+func (d *DataFile) readValue(pos *LogRecordPos, buf []byte) (LogRecordType, []byte, []byte, error) {
+	raw, buf, err := d.readRawLogRecord(pos.Offset, int64(pos.Size), buf)
+	if err != nil {
+		return 0, nil, buf, err
 	}
+	logRecord := LogRecord{Key: raw.key, Value: raw.value}
+	if err := d.decodeLogRecord(&raw.header, &logRecord); err != nil {
+		return 0, nil, buf, err
+	}
+	return raw.header.recordType, logRecord.Value, buf, nil
+}
 
-	// 读取头部
-	headerBytes, err := d.readNBytes(off, headerSize)
+// readRawLogRecord 读取记录并校验crc，sizeHint 为索引中记录的长度，为0时先读取头部
+// IO管理器支持映射时直接引用映射的内存，否则读取到buf中
+func (d *DataFile) readRawLogRecord(off, sizeHint int64, buf []byte) (rawLogRecord, []byte, error) {
+	var raw rawLogRecord
+	// 已知记录长度时一次读取完整的记录，不需要获取文件大小
+	fileSize := int64(-1)
+	n := sizeHint
+	if n <= 0 {
+		size, err := d.IoManager.Size()
+		if err != nil {
+			return raw, buf, err
+		}
+		fileSize = size
+		n = max(min(maxLogRecordHeaderSize, fileSize-off), 0)
+	}
+	data, buf, err := d.readAt(off, n, buf[:0])
 	if err != nil {
-		return nil, 0, err
+		return raw, buf, err
 	}
 
 	// 解析头部
-	header, headerSize := decodeLogRecordHeader(headerBytes)
-	if header == nil {
-		return nil, 0, io.EOF
+	headerSize := decodeLogRecordHeaderTo(data, &raw.header)
+	if headerSize == 0 {
+		return raw, buf, io.EOF
 	}
-
-	logRecord := &LogRecord{
-		Type: header.recordType,
+	header := &raw.header
+	// 预分配的空间中没有写入的部分全部为0，有效的记录crc不会为0
+	if header.crc == 0 && data[crc32.Size] == 0 && header.keySize == 0 && header.valueSize == 0 {
+		return raw, buf, io.EOF
 	}
 
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
-	if keySize > 0 || valueSize > 0 {
-		// TODO 复用
-		// 读取key和value
-		kvBuf, err := d.readNBytes(off+headerSize, keySize+valueSize)
-		if err != nil {
-			return nil, 0, err
+	size := headerSize + keySize + valueSize
+	// 读取头部时可能已经读到了部分key与value，只读取剩余的部分
+	if size > int64(len(data)) {
+		if fileSize < 0 {
+			if fileSize, err = d.IoManager.Size(); err != nil {
+				return raw, buf, err
+			}
+		}
+		// 记录超出文件末尾，说明写入不完整或长度字段已损坏
+		if off+size > fileSize {
+			return raw, buf, io.ErrUnexpectedEOF
+		}
+		if data, buf, err = d.readAt(off, size, buf); err != nil {
+			return raw, buf, err
 		}
-		logRecord.Key = kvBuf[:keySize]
-		logRecord.Value = kvBuf[keySize:]
+	}
+
+	raw.size, raw.mapped = size, d.isMapped()
+	if keySize > 0 || valueSize > 0 {
+		raw.key = data[headerSize : headerSize+keySize]
+		raw.value = data[headerSize+keySize : size]
 	}
 	// 校验crc
-	if getLogRecordCRC(logRecord, headerBytes[crc32.Size:headerSize]) != header.crc {
-		return nil, 0, errs.ErrInvalidCRC
+	if getLogRecordCRC(&LogRecord{Key: raw.key, Value: raw.value}, data[crc32.Size:headerSize]) != header.crc {
+		return raw, buf, errs.ErrInvalidCRC
 	}
-	return logRecord, headerSize + keySize + valueSize, nil
+	return raw, buf, nil
+}
+
+// readAt 读取off开始的n个字节，支持映射时直接返回映射的内存
+// 否则读取到buf中，buf 中已经读取的部分不会重复读取
+func (d *DataFile) readAt(off, n int64, buf []byte) ([]byte, []byte, error) {
+	if m, ok := d.IoManager.(mappedReader); ok {
+		data, err := m.Slice(off, n)
+		return data, buf, err
+	}
+	read := min(int64(len(buf)), n)
+	buf = slices.Grow(buf[:read], int(n-read))[:n]
+	if _, err := d.IoManager.Read(buf[read:], off+read); err != nil {
+		return nil, buf, err
+	}
+	return buf, buf, nil
+}
+
+// isMapped IO管理器是否直接返回映射的内存
+func (d *DataFile) isMapped() bool {
+	_, ok := d.IoManager.(mappedReader)
+	return ok
+}
+
+// decodeLogRecord 解密与解压记录，crc 基于磁盘上的数据计算，校验之后再解密与解压
+// 解密与解压会生成新的key与value，不再引用读取时的数据
+// 记录已加密但数据文件没有密钥时，只保留未加密的key并返回 ErrEncryptionKeyRequired
+func (d *DataFile) decodeLogRecord(header *logRecordHeader, logRecord *LogRecord) error {
+	if header.encrypted {
+		if d.cipher == nil {
+			if header.encKey {
+				logRecord.Key = nil
+			}
+			logRecord.Value = nil
+			return errs.ErrEncryptionKeyRequired
+		}
+		if err := d.cipher.decrypt(header, logRecord); err != nil {
+			return err
+		}
+	}
+	if header.codec != NoCompression {
+		value, err := decompressValue(header.codec, logRecord.Value)
+		if err != nil {
+			return err
+		}
+		logRecord.Value = value
+	}
+	return nil
 }
 
 // SetIOManager 设置IO管理器
@@ -151,6 +341,38 @@ func (d *DataFile) SetIOManager(ioType IOType) error {
 	return nil
 }
 
+// SetWritableIOManager 设置活跃文件的IO管理器
+func (d *DataFile) SetWritableIOManager(ioType IOType, preallocSize int64) error {
+	if err := d.IoManager.Close(); err != nil {
+		return err
+	}
+	newIoManager, err := NewWritableIOManager(ioType, d.FileName, preallocSize)
+	if err != nil {
+		return err
+	}
+	d.IoManager = newIoManager
+	return nil
+}
+
+// isZeroTail 判断off之后的数据是否全部为0
+// 预分配空间的文件在异常退出时没有截断，末尾会留下没有写入的空间
+func (d *DataFile) isZeroTail(off, size int64) (bool, error) {
+	buf := make([]byte, 64*1024)
+	for off < size {
+		n := min(int64(len(buf)), size-off)
+		if _, err := d.IoManager.Read(buf[:n], off); err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		off += n
+	}
+	return true, nil
+}
+
 // readNBytes 从文件中读取n个字节
 // 读取数据时，可能会发生io.EOF错误
 func (d *DataFile) readNBytes(off int64, n int64) ([]byte, error) {
@@ -1,6 +1,8 @@
 package kv
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -8,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"slices"
 
@@ -15,22 +18,48 @@ import (
 	"github.com/kamijoucen/hifidb/pkg/errs"
 )
 
+// NoExpiration 未设置过期时间的key的TTL
+const NoExpiration time.Duration = -1
+
 const (
-	seqNoKey     = "seq.no"
 	fileLockName = "flock"
 )
 
 type DB struct {
-	options     *Options
-	lock        *sync.RWMutex
-	activeFile  *DataFile
-	olderFiles  map[uint32]*DataFile
-	index       Indexer
-	seqNo       uint64
-	isMerging   bool
-	fileLock    *flock.Flock
-	bytesWrite  uint32 // 累计写入的字节数
-	reclaimSize int64  // 无效数据大小
+	options        *Options
+	lock           *sync.RWMutex
+	activeFile     *DataFile
+	olderFiles     map[uint32]*DataFile
+	index          Indexer
+	seqNo          uint64
+	isMerging      bool
+	isBackingUp    bool
+	fileLock       *flock.Flock
+	cipher         *recordCipher              // 开启加密时加密写入的记录，为空表示不加密
+	bytesWrite     uint32                     // 累计写入的字节数
+	writeBuf       []byte                     // 组提交中尚未写入活跃文件的记录
+	inCommitGroup  bool                       // leader 是否正在执行一组写请求
+	commitLock     *sync.Mutex                // 保护组提交的队列
+	commitQueue    []*commitRequest           // 等待组提交的写请求
+	committing     bool                       // 是否已有leader在提交
+	defaultFamily  *ColumnFamily              // 默认列族，索引为 db.index
+	families       map[uint32]*ColumnFamily   // 所有列族，包括默认列族
+	familyVersion  uint64                     // 列族文件的修改次数，用于通知从节点
+	nextFamilyId   uint32                     // 下一个列族的编号
+	subscribers    map[*subscription]struct{} // 变更订阅者
+	pendingChanges []ChangeEvent              // 已追加但尚未写入文件的变更
+	nonMergeFileId uint32                     // 上一次merge时未参与合并的第一个文件，0表示没有merge过
+	writeNotify    *notifier                  // 数据文件或列族变化时通知复制服务
+	replica        *replica                   // 以从节点打开时的复制状态，为空表示可写
+	reclaimSize    int64                      // 无效数据大小
+	fileReclaim    map[uint32]int64           // 切换到该活跃文件时的无效数据大小，这些无效数据都在之前的文件中
+	snapshots      int                        // 未释放的快照数量
+	activeTxns     map[uint64]int             // 活跃的读写事务，开始序列号 -> 数量
+	committedTxns  []*committedTxn            // 活跃事务开始后提交的写入
+	retiredFiles   []*DataFile                // merge替换下来但仍被快照引用的文件
+	valueCache     *valueCache                // value缓存，为空表示未开启
+	closeCh        chan struct{}              // 关闭时通知后台任务退出
+	wg             *sync.WaitGroup            // 等待后台任务退出
 }
 
 // Open 打开数据库
@@ -57,69 +86,229 @@ func Open(options *Options) (*DB, error) {
 	}
 	// 初始化db
 	db := &DB{
-		options:    options,
-		lock:       &sync.RWMutex{},
-		olderFiles: map[uint32]*DataFile{},
-		index:      NewIndex(BTree, options.DirPath, options.SyncWrites),
-		fileLock:   fileLock,
+		options:     options,
+		lock:        &sync.RWMutex{},
+		olderFiles:  map[uint32]*DataFile{},
+		fileLock:    fileLock,
+		cipher:      newRecordCipher(options.Encryption),
+		activeTxns:  map[uint64]int{},
+		fileReclaim: map[uint32]int64{},
+		commitLock:  &sync.Mutex{},
+		writeNotify: newNotifier(),
+		closeCh:     make(chan struct{}),
+		wg:          &sync.WaitGroup{},
+	}
+	if options.ValueCacheSize > 0 {
+		db.valueCache = newValueCache(options.ValueCacheSize)
+	}
+
+	if err := db.load(); err != nil {
+		db.closeOnOpenFailure()
+		return nil, err
 	}
 
+	// 启动后台merge调度
+	db.startMergeScheduler()
+
+	return db, nil
+}
+
+// load 加载数据文件并构建索引
+func (db *DB) load() error {
 	// 加载merge文件
-	if err := db.loadMergeFiles(); err != nil {
-		return nil, err
+	if _, err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+	if err := db.loadNonMergeFileId(); err != nil {
+		return err
+	}
+
+	// 初始化索引
+	index, err := NewIndex(db.options.MemoryIndexType, db.options.DirPath, db.options.SyncWrites)
+	if err != nil {
+		return err
+	}
+	db.index = index
+
+	// 加载列族
+	if err := db.loadFamilies(); err != nil {
+		return err
 	}
 
 	// 加载数据文件
 	fileIds, err := db.loadDataFiles()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// 从hint文件加载索引
-	if err := db.loadIndexFromHintFile(); err != nil {
-		return nil, err
-	}
-	// 加载索引
-	if err := db.loadIndexFromDataFiles(fileIds); err != nil {
-		return nil, err
+	// 从hint文件与数据文件加载索引，持久化的索引只需重放检查点之后的记录
+	if err := db.loadIndex(fileIds); err != nil {
+		return err
 	}
-	// 重置 mmap io 仅用于加速读
-	if db.options.MMapAtStartup {
+	// 启动时的 mmap 只用于加速读，加载完成之后切换到配置的IO类型
+	if db.options.MMapAtStartup || db.options.dataFileIOType() != IO_FILE {
 		if err := db.resetIOType(); err != nil {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	return db, nil
+// closeOnOpenFailure 打开失败时释放已经打开的文件与文件锁
+func (db *DB) closeOnOpenFailure() {
+	for _, cf := range db.families {
+		if cf.id != defaultFamilyId {
+			_ = cf.index.Close()
+		}
+	}
+	if db.index != nil {
+		_ = db.index.Close()
+	}
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, dataFile := range db.olderFiles {
+		_ = dataFile.Close()
+	}
+	_ = db.fileLock.Unlock()
 }
 
 // Put 添加数据
 func (db *DB) Put(key, value []byte) error {
+	return db.putWithExpire(db.defaultFamily, key, value, 0)
+}
+
+// PutWithTTL 添加数据并设置过期时间，ttl 必须大于0
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errs.ErrInvalidTTL
+	}
+	return db.putWithExpire(db.defaultFamily, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire 为已存在的key设置过期时间
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errs.ErrInvalidTTL
+	}
+	return db.resetExpire(key, time.Now().Add(ttl).UnixNano())
+}
+
+// Persist 移除key的过期时间
+func (db *DB) Persist(key []byte) error {
+	return db.resetExpire(key, 0)
+}
+
+// TTL 获取key的剩余存活时间，未设置过期时间时返回 NoExpiration
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, errs.ErrKeyIsEmpty
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	now := time.Now().UnixNano()
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired(now) {
+		return 0, errs.ErrKeyNotFound
+	}
+	if pos.Expire == 0 {
+		return NoExpiration, nil
+	}
+	return time.Duration(pos.Expire - now), nil
+}
+
+// putWithExpire 向列族添加数据，expire 为0表示永不过期
+func (db *DB) putWithExpire(cf *ColumnFamily, key, value []byte, expire int64) error {
 
 	if len(key) == 0 {
 		return errs.ErrKeyIsEmpty
 	}
 
 	logRecord := &LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  LogRecordNormal,
+		Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:  value,
+		Type:   LogRecordNormal,
+		Expire: expire,
+		Family: cf.id,
 	}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
-	}
+	// 写入与索引更新需在同一把锁内完成，保证merge与统计看到一致的状态
+	return db.commit(db.options.SyncWrites, func() error {
+		if cf.dropped {
+			return errs.ErrColumnFamilyNotFound
+		}
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
 
-	// 更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+		// 更新内存索引
+		if oldPos := cf.index.Put(key, pos); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+		db.trackWrite(cf, key)
+		if cf.id == defaultFamilyId {
+			db.recordChange(logRecord, key, changeSeq(pos.Fid, pos.Offset), false, true)
+		}
+		return nil
+	})
+}
+
+// resetExpire 使用原有的value重写记录，更新过期时间
+func (db *DB) resetExpire(key []byte, expire int64) error {
+
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
 	}
-	return nil
+
+	return db.commit(db.options.SyncWrites, func() error {
+		pos := db.index.Get(key)
+		if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+			return errs.ErrKeyNotFound
+		}
+		// 记录可能由同组之前的写请求写入，读取之前先写入文件
+		if err := db.flushWrites(false); err != nil {
+			return err
+		}
+		value, err := db.getValueByPosition(pos, nil)
+		if err != nil {
+			return err
+		}
+
+		logRecord := &LogRecord{
+			Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+			Value:  value,
+			Type:   LogRecordNormal,
+			Expire: expire,
+		}
+		newPos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		if oldPos := db.index.Put(key, newPos); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+		db.trackWrite(db.defaultFamily, key)
+		db.recordChange(logRecord, key, changeSeq(newPos.Fid, newPos.Offset), false, true)
+		return nil
+	})
 }
 
 // Get 根据key获取数据
 func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.get(db.defaultFamily, key, nil)
+}
+
+// GetWithBuffer 根据key获取数据，value 拷贝到 dst 中返回，dst 容量足够时不分配内存
+// 返回的value与 dst 共用底层数组，dst 可以在多次读取之间复用
+func (db *DB) GetWithBuffer(key []byte, dst []byte) ([]byte, error) {
+	return db.get(db.defaultFamily, key, dst)
+}
+
+// get 根据key获取列族中的数据，dst 不为空时value拷贝到 dst 中
+func (db *DB) get(cf *ColumnFamily, key []byte, dst []byte) ([]byte, error) {
 
 	db.lock.RLock()
 	defer db.lock.RUnlock()
@@ -127,46 +316,64 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, errs.ErrKeyIsEmpty
 	}
+	if cf.dropped {
+		return nil, errs.ErrColumnFamilyNotFound
+	}
 
-	pos := db.index.Get(key)
-	if pos == nil {
+	pos := cf.index.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
 		return nil, errs.ErrKeyNotFound
 	}
-	return db.getValueByPosition(pos)
+	return db.getValueByPosition(pos, dst)
 }
 
 // Delete 根据key删除数据
 func (db *DB) Delete(key []byte) error {
+	return db.delete(db.defaultFamily, key)
+}
+
+// delete 根据key删除列族中的数据
+func (db *DB) delete(cf *ColumnFamily, key []byte) error {
 
 	if len(key) == 0 {
 		return errs.ErrKeyIsEmpty
 	}
 
-	// 先在内存中查询索引是否存在
-	if db.index.Get(key) == nil {
-		return nil
-	}
+	return db.commit(db.options.SyncWrites, func() error {
+		if cf.dropped {
+			return errs.ErrColumnFamilyNotFound
+		}
+		// 先在内存中查询索引是否存在
+		if cf.index.Get(key) == nil {
+			return nil
+		}
 
-	logRecord := &LogRecord{
-		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Type: LogRecordDeleted,
-	}
+		logRecord := &LogRecord{
+			Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+			Type:   LogRecordDeleted,
+			Family: cf.id,
+		}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
-	}
-	db.reclaimSize += int64(pos.Size)
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		db.reclaimSize += int64(pos.Size)
 
-	oldPos, ok := db.index.Delete(key)
-	if !ok {
-		return errs.ErrIndexUpdateFailed
-	}
+		oldPos, ok := cf.index.Delete(key)
+		if !ok {
+			return errs.ErrIndexUpdateFailed
+		}
 
-	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
-	return nil
+		if oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+		db.trackWrite(cf, key)
+		if cf.id == defaultFamilyId {
+			db.recordChange(logRecord, key, changeSeq(pos.Fid, pos.Offset), false, true)
+		}
+		return nil
+	})
 }
 
 // ListKeys 列出所有key
@@ -175,40 +382,34 @@ func (db *DB) ListKeys() [][]byte {
 	indexIter := db.index.IndexIterator(false)
 	defer indexIter.Close()
 
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	now := time.Now().UnixNano()
+	keys := make([][]byte, 0, db.index.Size())
 	for indexIter.Rewind(); indexIter.Valid(); indexIter.Next() {
-		keys[idx] = indexIter.Key()
-		idx++
+		if indexIter.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, indexIter.Key())
 	}
 	return keys
 }
 
-// Fold 遍历所有key
+// Fold 遍历所有key，遍历基于调用时的快照，不阻塞写入
 func (db *DB) Fold(f func(key, value []byte) bool) error {
-
-	// 这里需要加，因为tree上的锁只会保证key的一致性，value的一致性需要库锁保证
-	db.lock.RLock()
-	defer db.lock.RUnlock()
-
-	indexIter := db.index.IndexIterator(false)
-	defer indexIter.Close()
-
-	for indexIter.Rewind(); indexIter.Valid(); indexIter.Next() {
-		valueBytes, err := db.getValueByPosition(indexIter.Value())
-		if err != nil {
-			return err
-		}
-		if !f(indexIter.Key(), valueBytes) {
-			break
-		}
-	}
-
-	return nil
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	return snapshot.Fold(f)
 }
 
 // Close 关闭数据库
 func (db *DB) Close() error {
+	// 停止后台任务
+	select {
+	case <-db.closeCh:
+	default:
+		close(db.closeCh)
+	}
+	db.wg.Wait()
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	defer func() {
@@ -217,12 +418,18 @@ func (db *DB) Close() error {
 		}
 	}()
 
-	if err := db.index.Close(); err != nil {
-		return err
+	// 关闭所有列族的索引，默认列族使用 db.index
+	for _, cf := range db.families {
+		if err := cf.index.Close(); err != nil {
+			return err
+		}
 	}
 
-	// 关闭活跃文
+	// 关闭活跃文件
 	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
 		if err := db.activeFile.Close(); err != nil {
 			return err
 		}
@@ -233,24 +440,30 @@ func (db *DB) Close() error {
 			return err
 		}
 	}
+	for _, d := range db.retiredFiles {
+		if err := d.Close(); err != nil {
+			return err
+		}
+	}
 	// 清空映射
 	db.activeFile = nil
 	db.olderFiles = nil
+	db.retiredFiles = nil
 	return nil
 }
 
 // Sync 持久化数据
 func (db *DB) Sync() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
 	if db.activeFile == nil {
 		return nil
 	}
-	db.lock.Lock()
-	defer db.lock.Unlock()
 	return db.activeFile.Sync()
 }
 
 // getValueByPosition 根据位置获取数据
-func (db *DB) getValueByPosition(pos *LogRecordPos) ([]byte, error) {
+func (db *DB) getValueByPosition(pos *LogRecordPos, dst []byte) ([]byte, error) {
 	var d *DataFile
 	if db.activeFile.FileId == pos.Fid {
 		d = db.activeFile
@@ -262,24 +475,55 @@ func (db *DB) getValueByPosition(pos *LogRecordPos) ([]byte, error) {
 		return nil, errs.ErrDataFileNotFound
 	}
 
-	r, _, err := d.ReadLogRecord(pos.Offset)
+	return db.readValue(d, pos, dst)
+}
+
+// readValue 从数据文件中读取位置上的value，dst 不为空时拷贝到 dst 中，否则返回新的拷贝
+func (db *DB) readValue(d *DataFile, pos *LogRecordPos, dst []byte) ([]byte, error) {
+	bp := getReadBuf()
+	defer putReadBuf(bp)
+	value, err := db.readValueUnsafe(d, pos, bp)
+	if err != nil {
+		return nil, err
+	}
+	if dst == nil {
+		return bytes.Clone(value), nil
+	}
+	return append(dst[:0], value...), nil
+}
+
+// readValueUnsafe 读取位置上的value，开启缓存时优先读取缓存
+// 返回的value可能直接引用缓存、映射的内存或者 bp 中的缓冲，不能修改，bp 归还之前有效
+func (db *DB) readValueUnsafe(d *DataFile, pos *LogRecordPos, bp *[]byte) ([]byte, error) {
+	if db.valueCache != nil {
+		if value, ok := db.valueCache.get(d, pos.Offset); ok {
+			return value, nil
+		}
+	}
+	recordType, value, buf, err := d.readValue(pos, *bp)
+	*bp = buf
 	if err != nil {
 		return nil, err
 	}
-	if r.Type == LogRecordDeleted {
+	if recordType == LogRecordDeleted {
 		return nil, errs.ErrKeyNotFound
 	}
-	return r.Value, nil
+	if db.valueCache != nil {
+		db.valueCache.add(d, pos.Offset, value)
+	}
+	return value, nil
 }
 
-// appendLogRecordWithLock 添加日志记录 加锁
-func (db *DB) appendLogRecordWithLock(logRecord *LogRecord) (*LogRecordPos, error) {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-	return db.appendLogRecord(logRecord)
+// retireFile 标记被替换的数据文件并清理它的缓存，之后同一编号的文件可以重新使用缓存
+func (db *DB) retireFile(d *DataFile) {
+	d.retired.Store(true)
+	if db.valueCache != nil {
+		db.valueCache.removeFile(d.FileId)
+	}
 }
 
 // appendLogRecord 添加日志记录
+// 组提交时记录先追加到写缓冲，由leader统一写入与同步
 func (db *DB) appendLogRecord(r *LogRecord) (*LogRecordPos, error) {
 
 	if db.activeFile == nil {
@@ -287,10 +531,20 @@ func (db *DB) appendLogRecord(r *LogRecord) (*LogRecordPos, error) {
 			return nil, err
 		}
 	}
-	encRecord, size := EncodeLogRecord(r)
+	compression := db.options.Compression
+	if len(r.Value) < db.options.CompressionThreshold {
+		compression = NoCompression
+	}
+	encRecord, size, err := encodeLogRecord(r, compression, db.cipher)
+	if err != nil {
+		return nil, err
+	}
 
-	if db.activeFile.WriteOffset+size > db.options.DataFileSize {
-		if err := db.activeFile.Sync(); err != nil {
+	if db.activeFile.WriteOffset+int64(len(db.writeBuf))+size > db.options.DataFileSize {
+		if err := db.flushWrites(false); err != nil {
+			return nil, err
+		}
+		if err := db.activeFile.Seal(); err != nil {
 			return nil, err
 		}
 
@@ -300,29 +554,21 @@ func (db *DB) appendLogRecord(r *LogRecord) (*LogRecordPos, error) {
 			return nil, err
 		}
 	}
-	writeOffset := db.activeFile.WriteOffset
-	if err := db.activeFile.Write(encRecord); err != nil {
-		return nil, err
-	}
-
+	writeOffset := db.activeFile.WriteOffset + int64(len(db.writeBuf))
+	db.writeBuf = append(db.writeBuf, encRecord...)
 	db.bytesWrite += uint32(size)
 
-	var needSync = db.options.SyncWrites
-	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
-		needSync = true
-	}
-
-	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
+	if !db.inCommitGroup {
+		if err := db.flushWrites(db.options.SyncWrites); err != nil {
 			return nil, err
 		}
-		db.bytesWrite = 0
 	}
 
 	pos := &LogRecordPos{
 		Fid:    db.activeFile.FileId,
 		Offset: writeOffset,
 		Size:   uint32(size),
+		Expire: r.Expire,
 	}
 	return pos, nil
 }
@@ -335,11 +581,13 @@ func (db *DB) setActiveDataFile() error {
 		initFleId = db.activeFile.FileId + 1
 	}
 
-	d, err := OpenDataFile(IO_FILE, db.options.DirPath, initFleId)
+	d, err := OpenActiveDataFile(db.options.dataFileIOType(), db.options.DirPath, initFleId, db.options.DataFileSize)
 	if err != nil {
 		return err
 	}
+	d.cipher = db.cipher
 	db.activeFile = d
+	db.writeNotify.notify()
 	return nil
 }
 
@@ -377,6 +625,7 @@ func (db *DB) loadDataFiles() ([]uint32, error) {
 		if err != nil {
 			return nil, err
 		}
+		dataFile.cipher = db.cipher
 		if i == len(fileIds)-1 {
 			db.activeFile = dataFile
 		} else {
@@ -387,48 +636,22 @@ func (db *DB) loadDataFiles() ([]uint32, error) {
 	return fileIds, nil
 }
 
-// loadIndexFromDataFiles 从数据文件加载索引
-func (db *DB) loadIndexFromDataFiles(fileIds []uint32) error {
+// loadIndexFromDataFiles 从数据文件的 from 位置开始加载索引，返回重放之后可以保存的检查点
+// 持久化的索引分批提交，调用方需要先开始批量写入
+func (db *DB) loadIndexFromDataFiles(fileIds []uint32, from *LogRecordPos) (*LogRecordPos, error) {
 
 	if len(fileIds) == 0 {
-		return nil
-	}
-
-	// 检查是否发生过merge
-	hasMerge, nonMergeFileId := false, uint32(0)
-	mergeFinishedFileName := filepath.Join(db.options.DirPath, MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinishedFileName); err == nil {
-		fid, err := db.getNonMergeFileId(db.options.DirPath)
-		if err != nil {
-			return err
-		}
-		hasMerge = true
-		nonMergeFileId = fid
-	}
-
-	updateIndex := func(key []byte, recordType LogRecordType, pos *LogRecordPos) {
-
-		var oldPos *LogRecordPos
-		if recordType == LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
-		}
-
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
-		}
+		return from, nil
 	}
 
-	// 事务数据
-	transactionRecords := make(map[uint64][]*TransactionRecord)
-	var currentSeqNo = nonTransactionSeqNo
+	loader := db.newIndexLoader()
+	var count int
+	var fid uint32
+	var offset int64
+	for _, fid = range fileIds {
 
-	for _, fid := range fileIds {
-
-		// 如果是merge完成的文件，跳过
-		if hasMerge && fid < nonMergeFileId {
+		// 如果是merge完成的文件或者在检查点之前，跳过
+		if fid < db.nonMergeFileId || fid < from.Fid {
 			continue
 		}
 		var dataFile *DataFile
@@ -438,57 +661,206 @@ func (db *DB) loadIndexFromDataFiles(fileIds []uint32) error {
 			dataFile = db.olderFiles[fid]
 		}
 
-		var offset int64 = 0
+		fileSize, err := dataFile.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		isActive := fid == db.activeFile.FileId
+
+		offset = 0
+		if fid == from.Fid {
+			offset = from.Offset
+		}
 		for {
 			// 构造内存位置索引
 			logRecord, rSize, err := dataFile.ReadLogRecord(offset)
 
 			if err != nil {
-				if err == io.EOF {
+				if err == io.EOF && offset >= fileSize {
+					break
+				}
+				// 通过映射写入的活跃文件异常退出时没有截断，丢弃末尾预分配但没有写入的空间
+				// 上次写入时的IO类型可能与本次打开不同，活跃文件末尾全部为0时都按未写入处理
+				// 其他文件末尾的空白按损坏处理，遵循恢复模式
+				if err == io.EOF && isActive {
+					zero, err := dataFile.isZeroTail(offset, fileSize)
+					if err != nil {
+						return nil, err
+					}
+					if zero {
+						if err := os.Truncate(dataFile.FileName, offset); err != nil {
+							return nil, err
+						}
+						break
+					}
+				}
+				// 不完整或损坏的记录按恢复模式处理
+				next, err := db.recoverCorruption(dataFile, isActive, offset, fileSize, err)
+				if err != nil {
+					return nil, err
+				}
+				if next < 0 {
 					break
 				}
-				return err
+				offset = next
+				continue
 			}
 
-			logRecordPos := &LogRecordPos{
+			loader.apply(logRecord, &LogRecordPos{
 				Fid:    fid,
 				Offset: offset,
 				Size:   uint32(rSize),
-			}
-
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 如果事务提交才更新索引
-				if logRecord.Type == LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else { // 未读到事务提交标记，缓存事务数据
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
-			}
-			// 更新事务ID
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
+				Expire: logRecord.Expire,
+			})
 			// 更新offset
 			offset += rSize
+
+			// 持久化的索引分批提交，未读到提交标记的事务需要从第一条记录开始重放
+			if err := db.splitIndexBatch(&count, func() *LogRecordPos {
+				return loader.checkpoint(fid, offset)
+			}); err != nil {
+				return nil, err
+			}
 		}
 		// 如果是活跃文件，需要更新offset
-		if fid == db.activeFile.FileId {
+		if isActive {
 			db.activeFile.WriteOffset = offset
 		}
-		// 更新事务ID
-		db.seqNo = currentSeqNo
 	}
-	return nil
+	return loader.checkpoint(fid, offset), nil
+}
+
+// indexLoader 按照日志顺序重放记录并更新索引，事务的记录在读到提交标记之后才更新
+type indexLoader struct {
+	db                 *DB
+	now                int64
+	transactionRecords map[uint64][]*TransactionRecord // 未读到提交标记的事务数据
+}
+
+func (db *DB) newIndexLoader() *indexLoader {
+	return &indexLoader{
+		db:                 db,
+		now:                time.Now().UnixNano(),
+		transactionRecords: make(map[uint64][]*TransactionRecord),
+	}
+}
+
+// checkpoint 重放到 fid 文件的 offset 位置时可以保存的检查点
+// 未读到提交标记的事务之后还可能提交，检查点不能超过它的第一条记录
+func (l *indexLoader) checkpoint(fid uint32, offset int64) *LogRecordPos {
+	pos := &LogRecordPos{Fid: fid, Offset: offset}
+	for _, records := range l.transactionRecords {
+		if first := records[0].Pos; posBefore(first, pos) {
+			pos = &LogRecordPos{Fid: first.Fid, Offset: first.Offset}
+		}
+	}
+	return pos
+}
+
+// apply 重放一条记录，调用方需持有库锁
+func (l *indexLoader) apply(logRecord *LogRecord, pos *LogRecordPos) {
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	if seqNo == nonTransactionSeqNo {
+		l.updateIndex(logRecord, realKey, pos)
+	} else {
+		// 如果事务提交才更新索引
+		if logRecord.Type == LogRecordTxnFinished {
+			for _, txnRecord := range l.transactionRecords[seqNo] {
+				l.updateIndex(txnRecord.Record, txnRecord.Record.Key, txnRecord.Pos)
+			}
+			delete(l.transactionRecords, seqNo)
+		} else { // 未读到事务提交标记，缓存事务数据
+			logRecord.Key = realKey
+			l.transactionRecords[seqNo] = append(l.transactionRecords[seqNo], &TransactionRecord{
+				Record: logRecord,
+				Pos:    pos,
+			})
+		}
+	}
+	// 更新事务ID
+	if seqNo > l.db.seqNo {
+		l.db.seqNo = seqNo
+	}
+}
+
+func (l *indexLoader) updateIndex(logRecord *LogRecord, key []byte, pos *LogRecordPos) {
+	db := l.db
+	index := db.familyIndex(logRecord.Family)
+	// 已删除的列族中的数据都是无效数据
+	if index == nil {
+		db.reclaimSize += int64(pos.Size)
+		return
+	}
+
+	// 按照日志顺序重放，此时索引中只有早于范围删除的数据
+	if logRecord.Type == LogRecordRangeDeleted {
+		db.reclaimSize += int64(pos.Size)
+		index.DeleteRange(key, logRecord.Value, func(_ []byte, oldPos *LogRecordPos) {
+			db.reclaimSize += int64(oldPos.Size)
+		})
+		return
+	}
+
+	var oldPos *LogRecordPos
+	// 已过期的数据等同于删除
+	if logRecord.Type == LogRecordDeleted || pos.IsExpired(l.now) {
+		oldPos, _ = index.Delete(key)
+		db.reclaimSize += int64(pos.Size)
+	} else {
+		oldPos = index.Put(key, pos)
+	}
+
+	if oldPos != nil {
+		db.reclaimSize += int64(oldPos.Size)
+	}
+}
+
+// recoverCorruption 处理启动时读到的不完整或损坏的记录
+// 返回继续读取的位置，-1 表示不再读取该文件
+func (db *DB) recoverCorruption(dataFile *DataFile, isActive bool, offset, fileSize int64, cause error) (int64, error) {
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		cause = errs.ErrIncompleteRecord
+	}
+	if !errors.Is(cause, errs.ErrIncompleteRecord) && !errors.Is(cause, errs.ErrInvalidCRC) {
+		return 0, cause
+	}
+	mode := db.options.RecoveryMode
+	if mode == RecoveryStrict {
+		return 0, cause
+	}
+
+	event := &RecoveryEvent{FileId: dataFile.FileId, Offset: offset, Err: cause}
+	next := findNextRecord(dataFile, offset+1, fileSize)
+	switch {
+	case next >= 0:
+		// 之后还有有效的记录，说明不是末尾的不完整写入
+		if mode != RecoverySkipCorrupt {
+			return 0, cause
+		}
+		event.Size = next - offset
+	case isActive:
+		// 截断活跃文件，之后的写入从最后一条有效记录之后开始
+		if err := os.Truncate(dataFile.FileName, offset); err != nil {
+			return 0, err
+		}
+		event.Size, event.Truncated = fileSize-offset, true
+	case mode == RecoverySkipCorrupt:
+		event.Size = fileSize - offset
+	default:
+		return 0, cause
+	}
+
+	// 跳过的数据由merge清理
+	if !event.Truncated {
+		db.reclaimSize += event.Size
+	}
+	if db.options.RecoveryCallback != nil {
+		db.options.RecoveryCallback(event)
+	}
+	if next >= 0 {
+		return next, nil
+	}
+	return -1, nil
 }
 
 // resetIOType 重置IO类型
@@ -496,12 +868,12 @@ func (db *DB) resetIOType() error {
 	if db.activeFile == nil {
 		return nil
 	}
-	if err := db.activeFile.SetIOManager(IO_FILE); err != nil {
+	if err := db.activeFile.SetWritableIOManager(db.options.dataFileIOType(), db.options.DataFileSize); err != nil {
 		return err
 	}
 
 	for _, d := range db.olderFiles {
-		if err := d.SetIOManager(IO_FILE); err != nil {
+		if err := d.SetIOManager(db.options.dataFileIOType()); err != nil {
 			return err
 		}
 	}
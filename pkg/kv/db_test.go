@@ -1,7 +1,9 @@
 package kv
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -34,6 +36,23 @@ func TestOpen(t *testing.T) {
 	assert.NotNil(t, db)
 }
 
+func TestOpen_OptionsLiteral(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-zero-io")
+	opts := Options{
+		DirPath:            dir,
+		DataFileSize:       256 * 1024 * 1024,
+		MemoryIndexType:    BTree,
+		DataFileMergeRatio: 0.5,
+	}
+	db, err := Open(&opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	_, ok := db.activeFile.IoManager.(*FileIO)
+	assert.True(t, ok)
+	assert.Equal(t, RecoveryStrict, db.options.RecoveryMode)
+}
+
 func TestDB_Put(t *testing.T) {
 	opts := GetDBDefaultOptions()
 	dir, _ := os.MkdirTemp("", "bitcask-go-put")
@@ -177,6 +196,51 @@ func TestDB_Get(t *testing.T) {
 	assert.Equal(t, errs.ErrKeyNotFound, err)
 }
 
+func TestDB_GetWithBuffer(t *testing.T) {
+	for _, ioType := range []IOType{IO_FILE, IO_MMAP} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-get-buffer")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.IOType = ioType
+		opts.Compression = Snappy
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		values := make(map[int][]byte)
+		for i := range 500 {
+			values[i] = RandomValue(i % 512)
+			assert.Nil(t, db.Put(GetTestKey(i), values[i]))
+		}
+		// 压缩的value
+		assert.Nil(t, db.Put(GetTestKey(1000), bytes.Repeat([]byte("a"), 1024)))
+
+		dst := make([]byte, 0, 2048)
+		for i := range 500 {
+			val, err := db.GetWithBuffer(GetTestKey(i), dst)
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+			// 容量足够时复用 dst
+			if len(val) > 0 {
+				assert.Same(t, &dst[:1][0], &val[0])
+			}
+		}
+		val, err := db.GetWithBuffer(GetTestKey(1000), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("a"), 1024), val)
+		_, err = db.GetWithBuffer(GetTestKey(2000), dst)
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+
+		// 读取时除了索引查找不再分配内存
+		key := GetTestKey(100)
+		allocs := testing.AllocsPerRun(100, func() {
+			dst, _ = db.GetWithBuffer(key, dst)
+		})
+		assert.LessOrEqual(t, allocs, float64(1))
+		destroyDB(db)
+	}
+}
+
 func TestDB_Delete(t *testing.T) {
 	opts := GetDBDefaultOptions()
 
@@ -323,3 +387,302 @@ func TestDB_Sync(t *testing.T) {
 	err = db.Sync()
 	assert.Nil(t, err)
 }
+
+func TestDB_MMapIO(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = IO_MMAP
+	db, err := Open(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+
+	for i := range 2000 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	// 写满的文件截断到实际大小，活跃文件预分配了空间
+	for _, d := range db.olderFiles {
+		fi, err := os.Stat(d.FileName)
+		assert.Nil(t, err)
+		assert.Equal(t, d.WriteOffset, fi.Size())
+	}
+	fi, err := os.Stat(db.activeFile.FileName)
+	assert.Nil(t, err)
+	assert.Equal(t, opts.DataFileSize, fi.Size())
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Less(t, stat.DiskSize, int64(len(db.olderFiles)+1)*opts.DataFileSize)
+
+	check := func(db *DB, n int) {
+		for i := range n {
+			val, err := db.Get(GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, GetTestKey(i), val)
+		}
+	}
+	check(db, 2000)
+
+	// 关闭时截断活跃文件，重启之后从末尾继续写入
+	activeFileName, writeOffset := db.activeFile.FileName, db.activeFile.WriteOffset
+	assert.Nil(t, db.Close())
+	fi, err = os.Stat(activeFileName)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOffset, fi.Size())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOffset, db.activeFile.WriteOffset)
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	check(db, 3000)
+
+	// merge 之后的旧文件同样只读映射
+	for i := range 1500 {
+		assert.Nil(t, db.Delete(GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1500, len(db.ListKeys()))
+	val, err := db.Get(GetTestKey(2999))
+	assert.Nil(t, err)
+	assert.Equal(t, GetTestKey(2999), val)
+}
+
+func TestDB_MemoryIndexType(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-type")
+	opts.DirPath = dir
+	opts.MemoryIndexType = RadixTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, ok := db.index.(*RadixTreeIndex)
+	assert.True(t, ok)
+
+	// 非法的索引类型
+	opts2 := GetDBDefaultOptions()
+	opts2.DirPath = dir
+	opts2.MemoryIndexType = 0
+	_, err = Open(opts2)
+	assert.NotNil(t, err)
+}
+
+func TestDB_BPlusTreeIndex(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.MemoryIndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	_, ok := db.index.(*BPlusTreeIndex)
+	assert.True(t, ok)
+
+	for i := range 50000 {
+		err := db.Put(GetTestKey(i), RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := range 10000 {
+		err := db.Delete(GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.Put(GetTestKey(1), []byte("batch-value")))
+	assert.Nil(t, wb.Commit())
+	seqNo := db.seqNo
+	assert.Nil(t, db.Close())
+
+	// 1.正常关闭后重启，直接使用磁盘索引
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, db2.seqNo)
+	assert.Equal(t, 40001, len(db2.ListKeys()))
+	val, err := db2.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch-value"), val)
+	_, err = db2.Get(GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// 2.merge 之后重启，索引指向新的数据文件
+	assert.Nil(t, db2.Merge())
+	assert.Nil(t, db2.Put(GetTestKey(20000), []byte("after-merge")))
+	assert.Nil(t, db2.Close())
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 40001, len(db3.ListKeys()))
+	val, err = db3.Get(GetTestKey(20000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-merge"), val)
+	val, err = db3.Get(GetTestKey(30000))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 3.未正常关闭时重放检查点之后的记录
+	assert.Nil(t, db3.Put(GetTestKey(2), []byte("rebuild")))
+	assert.Nil(t, db3.activeFile.Sync())
+	assert.Nil(t, db3.index.Close())
+	assert.Nil(t, db3.fileLock.Unlock())
+
+	db4, err := Open(opts)
+	defer destroyDB(db4)
+	assert.Nil(t, err)
+	assert.Equal(t, 40002, len(db4.ListKeys()))
+	val, err = db4.Get(GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("rebuild"), val)
+}
+
+func TestDB_BPlusTreeCheckpoint(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.MemoryIndexType = BPlusTree
+	db, err := Open(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+
+	for i := range 1000 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	// 每次组提交之后检查点都是已经写入的位置
+	index := db.index.(*BPlusTreeIndex)
+	cp := index.checkpoint()
+	assert.Equal(t, db.activeFile.FileId, cp.Fid)
+	assert.Equal(t, db.activeFile.WriteOffset, cp.Offset)
+	assert.Equal(t, db.seqNo, cp.SeqNo)
+
+	// 模拟异常退出，索引停在检查点，数据文件中还有之后的写入
+	crashDir, _ := os.MkdirTemp("", "bitcask-go-bptree-checkpoint-crash")
+	defer func() { _ = os.RemoveAll(crashDir) }()
+	assert.Nil(t, copyFile(filepath.Join(dir, BPlusTreeIndexFileName), filepath.Join(crashDir, BPlusTreeIndexFileName), -1))
+	for i := range 100 {
+		assert.Nil(t, db.Delete(GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	for i := 1000; i < 1200; i++ {
+		assert.Nil(t, wb.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Sync())
+	assert.Nil(t, CopyDir(dir, crashDir, []string{fileLockName, BPlusTreeIndexFileName}))
+
+	// 检查点之前的数据不再读取，损坏也不影响打开
+	f, err := os.OpenFile(GetDataFileName(crashDir, 0), os.O_WRONLY, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	crashOpts := *opts
+	crashOpts.DirPath = crashDir
+	crashDB, err := Open(&crashOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1100, len(crashDB.ListKeys()))
+	_, err = crashDB.Get(GetTestKey(10))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	val, err := crashDB.Get(GetTestKey(1100))
+	assert.Nil(t, err)
+	assert.Equal(t, GetTestKey(1100), val)
+	assert.Equal(t, db.seqNo, crashDB.seqNo)
+	cp = crashDB.index.(*BPlusTreeIndex).checkpoint()
+	assert.Equal(t, crashDB.activeFile.WriteOffset, cp.Offset)
+	assert.Nil(t, crashDB.Close())
+
+	// 检查点超出数据文件时清空后重建索引
+	assert.Nil(t, os.Truncate(GetDataFileName(crashDir, cp.Fid), 0))
+	assert.Nil(t, os.WriteFile(GetDataFileName(crashDir, 0), nil, DataFilePerm))
+	crashDB, err = Open(&crashOpts)
+	assert.Nil(t, err)
+	keys := len(crashDB.ListKeys())
+	assert.Less(t, keys, 1100)
+	assert.Equal(t, crashDB.index.Size(), keys)
+	assert.Nil(t, crashDB.Close())
+}
+
+func TestDB_TTL(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.非法的 ttl
+	err = db.PutWithTTL(GetTestKey(1), RandomValue(10), 0)
+	assert.Equal(t, errs.ErrInvalidTTL, err)
+
+	// 2.过期前后读取
+	err = db.PutWithTTL(GetTestKey(1), RandomValue(10), 100*time.Millisecond)
+	assert.Nil(t, err)
+	ttl, err := db.TTL(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, time.Duration(0))
+	_, err = db.Get(GetTestKey(1))
+	assert.Nil(t, err)
+
+	err = db.Put(GetTestKey(2), RandomValue(10))
+	assert.Nil(t, err)
+	ttl, err = db.TTL(GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpiration, ttl)
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = db.Get(GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	_, err = db.TTL(GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	assert.Equal(t, 1, len(db.ListKeys()))
+
+	iter := db.NewIterator(GetDefaultIteratorOptions())
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	iter.Close()
+	assert.Equal(t, [][]byte{GetTestKey(2)}, keys)
+
+	// 3.Expire 与 Persist
+	err = db.Expire(GetTestKey(1), time.Second)
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	err = db.Expire(GetTestKey(2), time.Hour)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	err = db.PutWithTTL(GetTestKey(3), []byte("persist"), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Persist(GetTestKey(3))
+	assert.Nil(t, err)
+	time.Sleep(150 * time.Millisecond)
+	val, err := db.Get(GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("persist"), val)
+
+	// 4.重启后过期时间仍然有效，过期数据在 merge 时被清理
+	err = db.PutWithTTL(GetTestKey(4), RandomValue(10), 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	ttl, err = db2.TTL(GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, db2.Merge())
+	assert.Nil(t, db2.index.Get(GetTestKey(1)))
+	_, err = db2.Get(GetTestKey(4))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db2.ListKeys()))
+}
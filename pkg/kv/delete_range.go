@@ -0,0 +1,75 @@
+package kv
+
+import (
+	"bytes"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// DeleteRange 删除 [start, end) 范围内的所有key，end 为空时删除start之后所有的key
+// 只写入一条范围删除记录，不需要逐个key写入删除记录
+func (db *DB) DeleteRange(start, end []byte) error {
+	return db.deleteRange(db.defaultFamily, start, end)
+}
+
+// DeletePrefix 删除以prefix开头的所有key
+func (db *DB) DeletePrefix(prefix []byte) error {
+	return db.deleteRange(db.defaultFamily, prefix, prefixEnd(prefix))
+}
+
+// deleteRange 删除列族中 [start, end) 范围内的所有key
+func (db *DB) deleteRange(cf *ColumnFamily, start, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return errs.ErrInvalidKeyRange
+	}
+
+	return db.commit(db.options.SyncWrites, func() error {
+		if cf.dropped {
+			return errs.ErrColumnFamilyNotFound
+		}
+
+		logRecord := &LogRecord{
+			Key:    logRecordKeyWithSeq(start, nonTransactionSeqNo),
+			Value:  end,
+			Type:   LogRecordRangeDeleted,
+			Family: cf.id,
+		}
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		db.reclaimSize += int64(pos.Size)
+
+		// 只有存在活跃事务时才需要记录删除的key
+		track := len(db.activeTxns) > 0 && cf.id == defaultFamilyId
+		var keys [][]byte
+		cf.index.DeleteRange(start, end, func(key []byte, oldPos *LogRecordPos) {
+			db.reclaimSize += int64(oldPos.Size)
+			if track {
+				keys = append(keys, key)
+			}
+		})
+		db.trackWrite(cf, keys...)
+		if cf.id == defaultFamilyId {
+			db.recordChange(logRecord, start, changeSeq(pos.Fid, pos.Offset), false, true)
+		}
+		return nil
+	})
+}
+
+// prefixEnd 计算以prefix开头的key的结束位置，prefix 全部为0xff时返回nil，表示不限制结束位置
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// inRange 判断key是否在 [start, end) 范围内，end 为空时不限制结束位置
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && beforeEnd(key, end)
+}
@@ -0,0 +1,123 @@
+package kv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_DeleteRange(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, RadixTree, BPlusTree} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-delete-range")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.MemoryIndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := range 1000 {
+			assert.Nil(t, db.Put(GetTestKey(i), RandomValue(64)))
+		}
+		// 非法的范围
+		assert.Equal(t, errs.ErrInvalidKeyRange, db.DeleteRange(GetTestKey(10), GetTestKey(10)))
+		assert.Equal(t, errs.ErrInvalidKeyRange, db.DeleteRange(GetTestKey(20), GetTestKey(10)))
+
+		// 删除 [100, 900)，范围删除之后写入的数据不受影响
+		assert.Nil(t, db.DeleteRange(GetTestKey(100), GetTestKey(900)))
+		assert.Nil(t, db.Put(GetTestKey(500), []byte("after-range")))
+		check := func(db *DB) {
+			assert.Equal(t, 201, len(db.ListKeys()))
+			_, err := db.Get(GetTestKey(100))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+			_, err = db.Get(GetTestKey(899))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+			_, err = db.Get(GetTestKey(99))
+			assert.Nil(t, err)
+			_, err = db.Get(GetTestKey(900))
+			assert.Nil(t, err)
+			val, err := db.Get(GetTestKey(500))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("after-range"), val)
+		}
+		check(db)
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Greater(t, stat.ReclaimableSize, int64(800*64))
+
+		// 重启之后按照日志顺序重放范围删除
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		check(db)
+
+		// merge 丢弃被覆盖的数据与范围删除记录
+		assert.Nil(t, db.Merge())
+		check(db)
+		stat, err = db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), stat.ReclaimableSize)
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		check(db)
+		destroyDB(db)
+	}
+}
+
+func TestDB_DeletePrefix(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-prefix")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+
+	cf, err := db.CreateColumnFamily("tenant")
+	assert.Nil(t, err)
+	for _, key := range []string{"tenant-1/a", "tenant-1/b", "tenant-10/a", "tenant-2/a"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("value")))
+		assert.Nil(t, cf.Put([]byte(key), []byte("value")))
+	}
+	assert.Nil(t, db.Put([]byte{0xff, 0xff}, []byte("value")))
+
+	ch, cancel := db.Subscribe([]byte("tenant-1/"), SubscribeLatest)
+	assert.Nil(t, db.DeletePrefix([]byte("tenant-1/")))
+	event := <-ch
+	assert.Equal(t, ChangeDeleteRange, event.Type)
+	assert.Equal(t, []byte("tenant-1/"), event.Key)
+	assert.Equal(t, []byte("tenant-10"), event.Value)
+	assert.Nil(t, cancel())
+
+	assert.Equal(t, [][]byte{[]byte("tenant-10/a"), []byte("tenant-2/a"), {0xff, 0xff}}, db.ListKeys())
+	// 其他列族不受影响
+	assert.Equal(t, 4, len(cf.ListKeys()))
+	assert.Nil(t, cf.DeletePrefix([]byte("tenant-")))
+	assert.Equal(t, 0, len(cf.ListKeys()))
+
+	// 前缀全部为0xff时删除之后所有的key
+	assert.Nil(t, db.DeletePrefix([]byte{0xff}))
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	// 重放时从数据文件中读取范围删除
+	ch, cancel = db.Subscribe([]byte{0xff}, 0)
+	var events []ChangeEvent
+	for len(events) < 2 {
+		events = append(events, <-ch)
+	}
+	assert.Nil(t, cancel())
+	assert.Equal(t, ChangePut, events[0].Type)
+	assert.Equal(t, ChangeDeleteRange, events[1].Type)
+	assert.Equal(t, []byte{0xff}, events[1].Key)
+	assert.Empty(t, events[1].Value)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("tenant-10/a"), []byte("tenant-2/a")}, db.ListKeys())
+	cf, err = db.ColumnFamily("tenant")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(cf.ListKeys()))
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package kv
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// AvailableDiskSize 获取目录所在磁盘的剩余可用空间
+func AvailableDiskSize(dirPath string) (int64, error) {
+	kernel32, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		return 0, err
+	}
+	proc, err := kernel32.FindProc("GetDiskFreeSpaceExW")
+	if err != nil {
+		return 0, err
+	}
+	dirPtr, err := syscall.UTF16PtrFromString(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	var available int64
+	ret, _, err := proc.Call(uintptr(unsafe.Pointer(dirPtr)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return available, nil
+}
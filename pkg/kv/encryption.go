@@ -0,0 +1,157 @@
+package kv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"sync"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// KeyProvider 提供静态加密使用的密钥
+// 密钥长度为16、24或32字节，分别使用 AES-128、AES-192、AES-256，同一个编号对应的密钥不能修改
+type KeyProvider interface {
+	// CurrentKey 返回写入新数据使用的密钥与编号
+	CurrentKey() (uint32, []byte, error)
+
+	// Key 根据编号返回密钥，用于读取之前写入的数据
+	// 轮换密钥之后旧的密钥需要保留到merge完成，merge 会使用当前的密钥重写所有数据
+	Key(id uint32) ([]byte, error)
+}
+
+// EncryptionOptions 静态加密选项，数据文件与hint文件中的value使用 AES-GCM 加密
+type EncryptionOptions struct {
+	KeyProvider KeyProvider
+
+	// EncryptKeys 是否同时加密key，加密之后离线检查无法识别未提交的事务
+	// B+树索引以明文存储key，不能与 EncryptKeys 同时使用
+	EncryptKeys bool
+}
+
+// staticKeyProvider 使用固定的一组密钥
+type staticKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewStaticKeyProvider 使用固定的一组密钥创建 KeyProvider，current 为写入新数据使用的密钥编号
+func NewStaticKeyProvider(current uint32, keys map[uint32][]byte) KeyProvider {
+	return &staticKeyProvider{current: current, keys: keys}
+}
+
+func (p *staticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	key, err := p.Key(p.current)
+	return p.current, key, err
+}
+
+func (p *staticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, errs.ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// recordCipher 加密与解密日志记录，按照密钥编号缓存 AEAD
+type recordCipher struct {
+	provider    KeyProvider
+	encryptKeys bool
+	lock        *sync.RWMutex
+	aeads       map[uint32]cipher.AEAD
+}
+
+// newRecordCipher 未开启加密时返回nil
+func newRecordCipher(opts *EncryptionOptions) *recordCipher {
+	if opts == nil {
+		return nil
+	}
+	return &recordCipher{
+		provider:    opts.KeyProvider,
+		encryptKeys: opts.EncryptKeys,
+		lock:        &sync.RWMutex{},
+		aeads:       map[uint32]cipher.AEAD{},
+	}
+}
+
+// current 获取写入新数据使用的密钥
+func (c *recordCipher) current() (uint32, cipher.AEAD, error) {
+	id, key, err := c.provider.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := c.cachedAEAD(id, func() ([]byte, error) { return key, nil })
+	return id, aead, err
+}
+
+// byId 获取读取数据使用的密钥
+func (c *recordCipher) byId(id uint32) (cipher.AEAD, error) {
+	return c.cachedAEAD(id, func() ([]byte, error) { return c.provider.Key(id) })
+}
+
+func (c *recordCipher) cachedAEAD(id uint32, getKey func() ([]byte, error)) (cipher.AEAD, error) {
+	c.lock.RLock()
+	aead, ok := c.aeads[id]
+	c.lock.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := getKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.aeads[id] = aead
+	c.lock.Unlock()
+	return aead, nil
+}
+
+// decrypt 解密读取的记录
+func (c *recordCipher) decrypt(header *logRecordHeader, r *LogRecord) error {
+	aead, err := c.byId(header.keyId)
+	if err != nil {
+		return err
+	}
+	value, err := openData(aead, r.Value, r.Key)
+	if err != nil {
+		return err
+	}
+	if header.encKey {
+		if r.Key, err = openData(aead, r.Key, nil); err != nil {
+			return err
+		}
+	}
+	r.Value = value
+	return nil
+}
+
+// sealData 加密数据，密文之前存储随机的nonce
+func sealData(aead cipher.AEAD, plaintext, additionalData []byte) []byte {
+	nonceSize := aead.NonceSize()
+	buf := make([]byte, nonceSize, nonceSize+len(plaintext)+aead.Overhead())
+	_, _ = rand.Read(buf)
+	return aead.Seal(buf, buf, plaintext, additionalData)
+}
+
+// openData 解密 sealData 加密的数据
+func openData(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize+aead.Overhead() {
+		return nil, errs.ErrDecryptFailed
+	}
+	plaintext, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], additionalData)
+	if err != nil {
+		return nil, errs.ErrDecryptFailed
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Encryption(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	secret := []byte("customer-secret")
+	value := func(i int) []byte {
+		return append(bytes.Repeat(secret, 30), GetTestKey(i)...)
+	}
+	// 数据目录中的所有文件都不能包含明文
+	assertNoPlaintext := func(dir string) {
+		entries, err := os.ReadDir(dir)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			assert.Nil(t, err)
+			assert.False(t, bytes.Contains(data, secret), entry.Name())
+			assert.False(t, bytes.Contains(data, []byte("kv-go-key")), entry.Name())
+		}
+	}
+
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.Compression = Zstd
+	opts.Encryption = &EncryptionOptions{
+		KeyProvider: NewStaticKeyProvider(1, map[uint32][]byte{1: key1}),
+		EncryptKeys: true,
+	}
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	for i := range 100 {
+		assert.Nil(t, db.Put(GetTestKey(i), value(i)))
+	}
+	wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.Put(GetTestKey(100), value(100)))
+	assert.Nil(t, wb.Delete(GetTestKey(0)))
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+	assertNoPlaintext(dir)
+
+	// 没有密钥或密钥错误时无法打开
+	plainOpts := *opts
+	plainOpts.Encryption = nil
+	_, err = Open(&plainOpts)
+	assert.Equal(t, errs.ErrEncryptionKeyRequired, err)
+	wrongOpts := *opts
+	wrongOpts.Encryption = &EncryptionOptions{KeyProvider: NewStaticKeyProvider(1, map[uint32][]byte{1: key2})}
+	_, err = Open(&wrongOpts)
+	assert.Equal(t, errs.ErrDecryptFailed, err)
+
+	// B+树索引以明文存储key，不能加密key
+	bptreeOpts := *opts
+	bptreeOpts.MemoryIndexType = BPlusTree
+	_, err = Open(&bptreeOpts)
+	assert.NotNil(t, err)
+
+	// 离线检查不需要密钥
+	report, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, int64(103), report.Records)
+
+	// 轮换密钥，merge 使用新的密钥重写所有数据
+	opts.Encryption.KeyProvider = NewStaticKeyProvider(2, map[uint32][]byte{1: key1, 2: key2})
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(GetTestKey(101), value(101)))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	assertNoPlaintext(dir)
+	_, err = os.Stat(filepath.Join(dir, HintFileName))
+	assert.Nil(t, err)
+
+	// 旧的密钥不再需要
+	opts.Encryption.KeyProvider = NewStaticKeyProvider(2, map[uint32][]byte{2: key2})
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, len(db.ListKeys()))
+	_, err = db.Get(GetTestKey(0))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	for i := 1; i <= 101; i++ {
+		val, err := db.Get(GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value(i), val)
+	}
+}
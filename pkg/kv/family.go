@@ -0,0 +1,366 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+const (
+	// DefaultColumnFamily 默认列族的名称，DB 上的读写都作用于默认列族
+	DefaultColumnFamily = "default"
+
+	// FamilyFileName 保存列族名称与编号的文件，每次修改时整体重写
+	FamilyFileName = "column-families"
+
+	defaultFamilyId uint32 = 0
+)
+
+// ColumnFamily 列族，每个列族拥有独立的索引与key空间
+// 列族中的数据与其他列族写入相同的数据文件，删除列族只删除索引，数据在merge时清理
+type ColumnFamily struct {
+	db      *DB
+	id      uint32
+	name    string
+	index   Indexer
+	dropped bool // 是否已删除，调用方需持有库锁
+}
+
+// CreateColumnFamily 创建列族
+func (db *DB) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	if len(name) == 0 {
+		return nil, errs.ErrColumnFamilyNameIsEmpty
+	}
+	if db.replica != nil {
+		return nil, errs.ErrReadOnlyReplica
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.findFamily(name) != nil {
+		return nil, errs.ErrColumnFamilyExists
+	}
+	// 编号不复用，已删除列族的数据在merge之前仍留在数据文件中
+	id := db.nextFamilyId
+	index, err := db.newFamilyIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ColumnFamily{db: db, id: id, name: name, index: index}
+	// 新列族在数据文件中还没有数据，保存列族之前初始化检查点，失败时列族文件保持不变
+	// 保存列族之前异常退出时留下的索引文件是空的，再次使用该编号时检查点会被覆盖
+	if err := db.initIndexCheckpoint(index); err != nil {
+		_ = db.removeFamilyIndex(cf)
+		return nil, err
+	}
+
+	families := make(map[uint32]*ColumnFamily, len(db.families)+1)
+	for fid, family := range db.families {
+		families[fid] = family
+	}
+	families[id] = cf
+	if err := db.saveFamilies(families, id+1); err != nil {
+		_ = db.removeFamilyIndex(cf)
+		return nil, err
+	}
+	db.families = families
+	db.nextFamilyId = id + 1
+	return cf, nil
+}
+
+// ColumnFamily 获取列族
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	cf := db.findFamily(name)
+	if cf == nil {
+		return nil, errs.ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// ColumnFamilies 列出所有列族的名称，包括默认列族
+func (db *DB) ColumnFamilies() []string {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	names := make([]string, 0, len(db.families))
+	for _, cf := range db.families {
+		names = append(names, cf.name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// DropColumnFamily 删除列族，只删除列族的索引，不遍历列族中的数据
+// 列族的数据在下一次merge时清理，已获取的列族句柄之后的读写返回 ErrColumnFamilyNotFound
+func (db *DB) DropColumnFamily(name string) error {
+	if name == DefaultColumnFamily {
+		return errs.ErrDropDefaultColumnFamily
+	}
+	if db.replica != nil {
+		return errs.ErrReadOnlyReplica
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	cf := db.findFamily(name)
+	if cf == nil {
+		return errs.ErrColumnFamilyNotFound
+	}
+	families := make(map[uint32]*ColumnFamily, len(db.families))
+	for fid, family := range db.families {
+		if fid != cf.id {
+			families[fid] = family
+		}
+	}
+	if err := db.saveFamilies(families, db.nextFamilyId); err != nil {
+		return err
+	}
+	db.families = families
+	cf.dropped = true
+	return db.removeFamilyIndex(cf)
+}
+
+// Name 列族名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Put 写入数据
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	return cf.db.putWithExpire(cf, key, value, 0)
+}
+
+// Get 根据key获取数据
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.db.get(cf, key, nil)
+}
+
+// GetWithBuffer 根据key获取数据，value 拷贝到 dst 中返回，dst 容量足够时不分配内存
+func (cf *ColumnFamily) GetWithBuffer(key []byte, dst []byte) ([]byte, error) {
+	return cf.db.get(cf, key, dst)
+}
+
+// Delete 根据key删除数据
+func (cf *ColumnFamily) Delete(key []byte) error {
+	return cf.db.delete(cf, key)
+}
+
+// DeleteRange 删除 [start, end) 范围内的所有key，end 为空时删除start之后所有的key
+func (cf *ColumnFamily) DeleteRange(start, end []byte) error {
+	return cf.db.deleteRange(cf, start, end)
+}
+
+// DeletePrefix 删除以prefix开头的所有key
+func (cf *ColumnFamily) DeletePrefix(prefix []byte) error {
+	return cf.db.deleteRange(cf, prefix, prefixEnd(prefix))
+}
+
+// ListKeys 列出列族中所有的key
+func (cf *ColumnFamily) ListKeys() [][]byte {
+	iterOpts := GetDefaultIteratorOptions()
+	iterOpts.KeysOnly = true
+	it := cf.NewIterator(iterOpts)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+// NewIterator 创建列族上的迭代器，迭代器基于创建时的快照
+func (cf *ColumnFamily) NewIterator(opts *IteratorOptions) *Iterator {
+	db := cf.db
+	db.lock.Lock()
+	snapshot := db.newFamilySnapshot(cf)
+	db.lock.Unlock()
+
+	it := snapshot.NewIterator(opts)
+	it.snapshot = snapshot
+	return it
+}
+
+// NewWriteBatch 创建写入该列族的批量写，可以通过 PutCF 与 DeleteCF 同时写入其他列族
+func (cf *ColumnFamily) NewWriteBatch(opts *WriteBatchOptions) *WriteBatch {
+	wb := cf.db.NewWriteBatch(opts)
+	wb.family = cf
+	return wb
+}
+
+// findFamily 根据名称查找列族，调用方需持有库锁
+func (db *DB) findFamily(name string) *ColumnFamily {
+	for _, cf := range db.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// familyIndex 获取列族的索引，列族不存在时返回nil，调用方需持有库锁
+func (db *DB) familyIndex(id uint32) Indexer {
+	if cf := db.families[id]; cf != nil {
+		return cf.index
+	}
+	return nil
+}
+
+// newFamilyIndex 创建列族的索引，B+树索引的每个列族使用单独的文件
+func (db *DB) newFamilyIndex(id uint32) (Indexer, error) {
+	if db.options.MemoryIndexType == BPlusTree {
+		return newBPlusTreeIndexFile(familyIndexFileName(db.options.DirPath, id), db.options.SyncWrites)
+	}
+	return NewIndex(db.options.MemoryIndexType, db.options.DirPath, db.options.SyncWrites)
+}
+
+// removeFamilyIndex 关闭并删除列族的索引
+func (db *DB) removeFamilyIndex(cf *ColumnFamily) error {
+	if err := cf.index.Close(); err != nil {
+		return err
+	}
+	if db.options.MemoryIndexType == BPlusTree {
+		return removeIfExists(familyIndexFileName(db.options.DirPath, cf.id))
+	}
+	return nil
+}
+
+// familyIndexFileName 列族的B+树索引文件
+func familyIndexFileName(dirPath string, id uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%s-%d", BPlusTreeIndexFileName, id))
+}
+
+// removeFamilyIndexFiles 删除所有列族的B+树索引文件
+func removeFamilyIndexFiles(dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), BPlusTreeIndexFileName+"-") {
+			if err := os.Remove(filepath.Join(dirPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadFamilies 加载列族并创建索引
+func (db *DB) loadFamilies() error {
+	db.defaultFamily = &ColumnFamily{db: db, id: defaultFamilyId, name: DefaultColumnFamily, index: db.index}
+	db.families = map[uint32]*ColumnFamily{defaultFamilyId: db.defaultFamily}
+
+	names, nextId, err := db.readFamilies()
+	if err != nil {
+		return err
+	}
+	db.nextFamilyId = nextId
+	for id, name := range names {
+		index, err := db.newFamilyIndex(id)
+		if err != nil {
+			return err
+		}
+		db.families[id] = &ColumnFamily{db: db, id: id, name: name, index: index}
+	}
+	return nil
+}
+
+// readFamilies 读取列族文件，返回非默认列族的编号与名称，以及下一个列族编号
+// 文件中第一条记录的key为空，value为下一个列族编号，其余记录为列族名称与编号
+func (db *DB) readFamilies() (map[uint32]string, uint32, error) {
+	names := make(map[uint32]string)
+	nextId := defaultFamilyId + 1
+
+	fileName := filepath.Join(db.options.DirPath, FamilyFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return names, nextId, nil
+	}
+	familyFile, err := newDataFile(IO_FILE, fileName, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	familyFile.cipher = db.cipher
+	defer func() {
+		_ = familyFile.Close()
+	}()
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := familyFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, err
+		}
+		offset += size
+
+		id, err := strconv.ParseUint(string(logRecord.Value), 10, 32)
+		if err != nil {
+			return nil, 0, errs.ErrDataDirCorrupted
+		}
+		if len(logRecord.Key) == 0 {
+			nextId = uint32(id)
+			continue
+		}
+		names[uint32(id)] = string(logRecord.Key)
+	}
+	return names, nextId, nil
+}
+
+// saveFamilies 保存列族，先写入临时文件再替换，调用方需持有库锁
+func (db *DB) saveFamilies(families map[uint32]*ColumnFamily, nextId uint32) error {
+	records := []*LogRecord{{Value: []byte(strconv.FormatUint(uint64(nextId), 10))}}
+	for id, cf := range families {
+		if id != defaultFamilyId {
+			records = append(records, &LogRecord{Key: []byte(cf.name), Value: []byte(strconv.FormatUint(uint64(id), 10))})
+		}
+	}
+	var buf []byte
+	for _, record := range records {
+		encRecord, _, err := encodeLogRecord(record, NoCompression, db.cipher)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encRecord...)
+	}
+	if err := db.replaceFamilyFile(buf); err != nil {
+		return err
+	}
+	db.familyVersion++
+	db.writeNotify.notify()
+	return nil
+}
+
+// replaceFamilyFile 原子地替换列族文件
+func (db *DB) replaceFamilyFile(data []byte) error {
+	fileName := filepath.Join(db.options.DirPath, FamilyFileName)
+	tmpFileName := fileName + ".tmp"
+	if err := writeFileSync(tmpFileName, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		return err
+	}
+	return syncDir(db.options.DirPath)
+}
+
+// newFamilySnapshot 创建列族的快照，调用方需持有库锁
+func (db *DB) newFamilySnapshot(cf *ColumnFamily) *Snapshot {
+	if cf.dropped {
+		return db.newIndexSnapshot(NewBTreeIndex())
+	}
+	return db.newIndexSnapshot(cf.index)
+}
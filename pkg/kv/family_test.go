@@ -0,0 +1,150 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ColumnFamily(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, BPlusTree} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-family")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.MemoryIndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		users, err := db.CreateColumnFamily("users")
+		assert.Nil(t, err)
+		orders, err := db.CreateColumnFamily("orders")
+		assert.Nil(t, err)
+		_, err = db.CreateColumnFamily("users")
+		assert.Equal(t, errs.ErrColumnFamilyExists, err)
+		_, err = db.CreateColumnFamily("")
+		assert.Equal(t, errs.ErrColumnFamilyNameIsEmpty, err)
+		assert.Equal(t, []string{DefaultColumnFamily, "orders", "users"}, db.ColumnFamilies())
+
+		// 相同的key在不同列族中互不影响
+		for i := range 100 {
+			assert.Nil(t, db.Put(GetTestKey(i), []byte("default")))
+			assert.Nil(t, users.Put(GetTestKey(i), []byte("users")))
+		}
+		for i := range 50 {
+			assert.Nil(t, users.Delete(GetTestKey(i)))
+		}
+		val, err := users.Get(GetTestKey(60))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("users"), val)
+		_, err = users.Get(GetTestKey(10))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		val, err = db.Get(GetTestKey(10))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("default"), val)
+		assert.Equal(t, 100, len(db.ListKeys()))
+		assert.Equal(t, 50, len(users.ListKeys()))
+		assert.Equal(t, 0, len(orders.ListKeys()))
+
+		it := users.NewIterator(GetDefaultIteratorOptions())
+		it.Rewind()
+		assert.True(t, it.Valid())
+		assert.Equal(t, GetTestKey(50), it.Key())
+		it.Close()
+
+		// 批量写可以同时写入多个列族
+		wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+		assert.Nil(t, wb.Put([]byte("order-count"), []byte("1")))
+		assert.Nil(t, wb.PutCF(orders, GetTestKey(1), []byte("order-1")))
+		assert.Nil(t, wb.DeleteCF(users, GetTestKey(99)))
+		assert.Nil(t, wb.Commit())
+		val, err = orders.Get(GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("order-1"), val)
+		_, err = users.Get(GetTestKey(99))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		_, err = db.Get(GetTestKey(99))
+		assert.Nil(t, err)
+
+		// 删除列族之后句柄不可用，数据在merge时清理
+		assert.Equal(t, errs.ErrDropDefaultColumnFamily, db.DropColumnFamily(DefaultColumnFamily))
+		assert.Nil(t, db.DropColumnFamily("orders"))
+		assert.Equal(t, errs.ErrColumnFamilyNotFound, db.DropColumnFamily("orders"))
+		_, err = orders.Get(GetTestKey(1))
+		assert.Equal(t, errs.ErrColumnFamilyNotFound, err)
+		assert.Equal(t, errs.ErrColumnFamilyNotFound, orders.Put(GetTestKey(1), []byte("x")))
+		wb = users.NewWriteBatch(GetDefaultWriteBatchOptions())
+		assert.Nil(t, wb.Put(GetTestKey(1), []byte("users")))
+		assert.Nil(t, wb.PutCF(orders, GetTestKey(2), []byte("order-2")))
+		assert.Equal(t, errs.ErrColumnFamilyNotFound, wb.Commit())
+		_, err = users.Get(GetTestKey(1))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Nil(t, db.Close())
+
+		// 重新打开后列族仍然存在，已删除列族的数据不会加载
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{DefaultColumnFamily, "users"}, db.ColumnFamilies())
+		users, err = db.ColumnFamily("users")
+		assert.Nil(t, err)
+		assert.Equal(t, 49, len(users.ListKeys()))
+		assert.Equal(t, 101, len(db.ListKeys()))
+
+		// 新建的同名列族不会看到已删除列族的数据
+		orders, err = db.CreateColumnFamily("orders")
+		assert.Nil(t, err)
+		_, err = orders.Get(GetTestKey(1))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		users, err = db.ColumnFamily("users")
+		assert.Nil(t, err)
+		assert.Equal(t, 49, len(users.ListKeys()))
+		assert.Equal(t, 101, len(db.ListKeys()))
+		val, err = users.Get(GetTestKey(98))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("users"), val)
+
+		destroyDB(db)
+	}
+}
+
+func TestDB_CreateColumnFamilyFailed(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-family-failed")
+	opts.DirPath = dir
+	opts.MemoryIndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.Put(GetTestKey(1), []byte("default")))
+
+	// 无法保存列族文件时删除已创建的索引，列族不变
+	tmpFileName := filepath.Join(dir, FamilyFileName+".tmp")
+	assert.Nil(t, os.Mkdir(tmpFileName, os.ModePerm))
+	_, err = db.CreateColumnFamily("users")
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{DefaultColumnFamily}, db.ColumnFamilies())
+	_, err = os.Stat(familyIndexFileName(dir, 1))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, os.Remove(tmpFileName))
+	users, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	assert.Nil(t, users.Put(GetTestKey(1), []byte("users")))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	users, err = db.ColumnFamily("users")
+	assert.Nil(t, err)
+	val, err := users.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+}
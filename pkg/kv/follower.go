@@ -0,0 +1,590 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+const (
+	// 与主节点断开后重新连接的间隔，连续失败时逐渐增加
+	minReplicaRetryInterval = 100 * time.Millisecond
+	maxReplicaRetryInterval = 5 * time.Second
+)
+
+// ReplicationStatus 从节点的复制状态
+type ReplicationStatus struct {
+	Connected bool
+
+	// 已应用的位置
+	FileId uint32
+	Offset int64
+
+	// 最近一次心跳时主节点的位置
+	PrimaryFileId uint32
+	PrimaryOffset int64
+
+	LastError error // 最近一次断开连接的原因
+}
+
+// replica 从节点的复制状态
+type replica struct {
+	addr    string
+	loader  *indexLoader // 跨消息保存未提交的事务数据，调用方需持有库锁
+	pending []byte       // 活跃文件末尾还不完整的记录，收到之后的数据后再写入，调用方需持有库锁
+
+	lock   *sync.Mutex // 保护以下字段
+	status ReplicationStatus
+}
+
+// OpenFollower 以从节点方式打开数据库，从 primaryAddr 上的 ReplicationServer 复制数据
+// 从节点只读，写入返回 ErrReadOnlyReplica，读取到的数据可能落后于主节点
+// 从节点不会自动merge，主节点merge之后会发送merge生成的文件，加密时需要使用与主节点相同的密钥
+func OpenFollower(options *Options, primaryAddr string) (*DB, error) {
+	opts := *options
+	opts.MergeCheckInterval = 0
+	db, err := Open(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock.Lock()
+	err = db.truncateUncommittedTail()
+	db.replica = &replica{addr: primaryAddr, loader: db.newIndexLoader(), lock: &sync.Mutex{}}
+	db.lock.Unlock()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	db.wg.Add(1)
+	go db.replicate()
+	return db, nil
+}
+
+// ReplicationStatus 获取从节点的复制状态，不是从节点时返回nil
+func (db *DB) ReplicationStatus() *ReplicationStatus {
+	if db.replica == nil {
+		return nil
+	}
+	db.lock.RLock()
+	fid, offset := db.replicaPosition()
+	db.lock.RUnlock()
+
+	r := db.replica
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	status := r.status
+	status.FileId, status.Offset = fid, offset
+	return &status
+}
+
+// replicaPosition 从节点已应用的位置，调用方需持有库锁
+func (db *DB) replicaPosition() (uint32, int64) {
+	if db.activeFile == nil {
+		return 0, 0
+	}
+	return db.activeFile.FileId, db.activeFile.WriteOffset
+}
+
+// replicate 持续从主节点复制数据，断开后重新连接，直到数据库关闭
+func (db *DB) replicate() {
+	defer db.wg.Done()
+
+	r := db.replica
+	retry := minReplicaRetryInterval
+	for {
+		connected, err := db.replicateOnce()
+		r.lock.Lock()
+		r.status.Connected = false
+		r.status.LastError = err
+		r.lock.Unlock()
+		if connected {
+			retry = minReplicaRetryInterval
+		}
+
+		select {
+		case <-db.closeCh:
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxReplicaRetryInterval)
+	}
+}
+
+// replicateOnce 连接主节点并应用收到的数据，返回是否连接成功以及断开的原因
+func (db *DB) replicateOnce() (bool, error) {
+	r := db.replica
+	conn, err := net.DialTimeout("tcp", r.addr, 3*replicationHeartbeat)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// 关闭数据库时断开连接
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-db.closeCh:
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	// 主节点从已写入的位置开始发送，丢弃上次连接收到的不完整记录
+	db.lock.Lock()
+	r.pending = nil
+	mergeId := db.nonMergeFileId
+	fid, offset := db.replicaPosition()
+	db.lock.Unlock()
+
+	writer := bufio.NewWriter(conn)
+	payload := binary.AppendUvarint(nil, uint64(mergeId))
+	payload = binary.AppendUvarint(payload, uint64(fid))
+	payload = binary.AppendUvarint(payload, uint64(offset))
+	if err := writeReplMessage(writer, replMsgHello, payload); err != nil {
+		return false, err
+	}
+	if err := writer.Flush(); err != nil {
+		return false, err
+	}
+
+	r.lock.Lock()
+	r.status.Connected = true
+	r.lock.Unlock()
+
+	reader := bufio.NewReader(conn)
+	recv := &replicaFiles{}
+	defer recv.close()
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(3 * replicationHeartbeat)); err != nil {
+			return true, err
+		}
+		typ, payload, err := readReplMessage(reader)
+		if err != nil {
+			return true, err
+		}
+		if err := db.applyReplMessage(typ, payload, recv); err != nil {
+			return true, err
+		}
+	}
+}
+
+// applyReplMessage 应用主节点发送的一条消息
+func (db *DB) applyReplMessage(typ byte, payload []byte, recv *replicaFiles) error {
+	d := &replDecoder{buf: payload}
+	switch typ {
+	case replMsgChunk:
+		fid, offset := uint32(d.uvarint()), int64(d.uvarint())
+		data := d.rest()
+		if d.err != nil {
+			return d.err
+		}
+		return db.applyReplicaChunk(fid, offset, data)
+
+	case replMsgFile:
+		target, name, offset := d.byte(), d.string(), int64(d.uvarint())
+		data := d.rest()
+		if d.err != nil {
+			return d.err
+		}
+		var dir string
+		switch target {
+		case replTargetSnapshot:
+			dir = siblingDirPath(db.options.DirPath, replicaSyncDirName)
+		case replTargetMerge:
+			dir = db.getMergePath()
+		default:
+			return errs.ErrReplicationOutOfSync
+		}
+		return recv.write(dir, name, offset, data)
+
+	case replMsgSnapshotEnd:
+		mergeId, fid, offset := uint32(d.uvarint()), uint32(d.uvarint()), int64(d.uvarint())
+		if d.err != nil {
+			return d.err
+		}
+		if err := recv.finish(); err != nil {
+			return err
+		}
+		if err := db.installReplicaSnapshot(siblingDirPath(db.options.DirPath, replicaSyncDirName)); err != nil {
+			return err
+		}
+		// 使用同步的文件打开之后的位置应与主节点一致
+		db.lock.RLock()
+		curFid, curOffset := db.replicaPosition()
+		ok := db.nonMergeFileId == mergeId && curFid == fid && curOffset == offset
+		db.lock.RUnlock()
+		if !ok {
+			return errs.ErrReplicationOutOfSync
+		}
+		return nil
+
+	case replMsgMergeEnd:
+		mergeId := uint32(d.uvarint())
+		if d.err != nil {
+			return d.err
+		}
+		if err := recv.finish(); err != nil {
+			return err
+		}
+		return db.applyMergeFiles(mergeId)
+
+	case replMsgFamilies:
+		return db.applyReplicaFamilies(payload)
+
+	case replMsgHeartbeat:
+		fid, offset := uint32(d.uvarint()), int64(d.uvarint())
+		if d.err != nil {
+			return d.err
+		}
+		r := db.replica
+		r.lock.Lock()
+		r.status.PrimaryFileId, r.status.PrimaryOffset = fid, offset
+		r.lock.Unlock()
+		return nil
+	}
+	return errs.ErrReplicationOutOfSync
+}
+
+// applyReplicaChunk 将主节点的记录写入相同的位置并更新索引
+// 末尾不完整的记录暂存在内存中，数据文件中只写入完整的记录
+func (db *DB) applyReplicaChunk(fid uint32, offset int64, data []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	r := db.replica
+	if db.activeFile == nil || fid != db.activeFile.FileId {
+		// 主节点切换到了新的活跃文件
+		if offset != 0 || len(r.pending) > 0 || (db.activeFile == nil && fid != 0) || (db.activeFile != nil && fid != db.activeFile.FileId+1) {
+			return errs.ErrReplicationOutOfSync
+		}
+		if db.activeFile != nil {
+			if err := db.activeFile.Seal(); err != nil {
+				return err
+			}
+			db.olderFiles[db.activeFile.FileId] = db.activeFile
+		}
+		if err := db.setActiveDataFile(); err != nil {
+			return err
+		}
+		// 主节点merge时切换的活跃文件，应用merge结果时扣除之前文件中的无效数据
+		db.fileReclaim[db.activeFile.FileId] = db.reclaimSize
+	}
+	if offset != db.activeFile.WriteOffset+int64(len(r.pending)) {
+		return errs.ErrReplicationOutOfSync
+	}
+
+	buf := append(r.pending, data...)
+	n := completeRecordsSize(buf)
+	r.pending = append([]byte(nil), buf[n:]...)
+	if n == 0 {
+		return nil
+	}
+
+	start := db.activeFile.WriteOffset
+	if err := db.activeFile.Write(buf[:n]); err != nil {
+		return err
+	}
+	loader := r.loader
+	loader.now = time.Now().UnixNano()
+	db.beginIndexBatch()
+	for off := start; off < db.activeFile.WriteOffset; {
+		logRecord, size, err := db.activeFile.ReadLogRecord(off)
+		if err != nil {
+			// 丢弃无法解析的数据，重新连接后从之前的位置开始
+			db.rollbackIndexBatch()
+			r.pending = nil
+			if truncErr := db.truncateActiveFile(start); truncErr != nil {
+				return truncErr
+			}
+			return err
+		}
+		loader.apply(logRecord, &LogRecordPos{
+			Fid:    fid,
+			Offset: off,
+			Size:   uint32(size),
+			Expire: logRecord.Expire,
+		})
+		off += size
+	}
+	if db.options.SyncWrites {
+		if err := db.activeFile.Sync(); err != nil {
+			db.rollbackIndexBatch()
+			return err
+		}
+	}
+	// 跨消息的事务还没有提交，检查点不能超过它的第一条记录
+	return db.commitIndexBatch(loader.checkpoint(fid, db.activeFile.WriteOffset))
+}
+
+// completeRecordsSize buf 开头的完整记录的总长度
+func completeRecordsSize(buf []byte) int {
+	var n int64
+	for n < int64(len(buf)) {
+		header, headerSize := decodeLogRecordHeader(buf[n:])
+		if header == nil {
+			break
+		}
+		size := headerSize + int64(header.keySize) + int64(header.valueSize)
+		if n+size > int64(len(buf)) {
+			break
+		}
+		n += size
+	}
+	return int(n)
+}
+
+// applyReplicaFamilies 使用主节点的列族文件更新列族
+func (db *DB) applyReplicaFamilies(data []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.replaceFamilyFile(data); err != nil {
+		return err
+	}
+	names, nextId, err := db.readFamilies()
+	if err != nil {
+		return err
+	}
+
+	families := make(map[uint32]*ColumnFamily, len(names)+1)
+	for id, cf := range db.families {
+		if _, ok := names[id]; ok || id == defaultFamilyId {
+			families[id] = cf
+			continue
+		}
+		// 主节点已删除的列族
+		cf.dropped = true
+		if err := db.removeFamilyIndex(cf); err != nil {
+			return err
+		}
+	}
+	for id, name := range names {
+		if families[id] != nil {
+			continue
+		}
+		index, err := db.newFamilyIndex(id)
+		if err != nil {
+			return err
+		}
+		if err := db.initIndexCheckpoint(index); err != nil {
+			return err
+		}
+		families[id] = &ColumnFamily{db: db, id: id, name: name, index: index}
+	}
+	db.families = families
+	db.nextFamilyId = nextId
+	db.familyVersion++
+	return nil
+}
+
+// installReplicaSnapshot 使用全量同步的文件替换数据目录并重新加载
+func (db *DB) installReplicaSnapshot(dir string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// 关闭当前的索引与数据文件，仍被快照引用的文件延迟关闭
+	for _, cf := range db.families {
+		cf.dropped = cf.id != defaultFamilyId
+		_ = cf.index.Close()
+	}
+	dataFiles := make([]*DataFile, 0, len(db.olderFiles)+1)
+	for _, dataFile := range db.olderFiles {
+		dataFiles = append(dataFiles, dataFile)
+	}
+	if db.activeFile != nil {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+	for _, dataFile := range dataFiles {
+		db.retireFile(dataFile)
+		if db.snapshots > 0 {
+			db.retiredFiles = append(db.retiredFiles, dataFile)
+		} else {
+			_ = dataFile.Close()
+		}
+	}
+	db.activeFile = nil
+	db.olderFiles = map[uint32]*DataFile{}
+
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == fileLockName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(db.options.DirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	entries, err = os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(db.options.DirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := syncDir(db.options.DirPath); err != nil {
+		return err
+	}
+
+	db.reclaimSize = 0
+	db.fileReclaim = map[uint32]int64{}
+	db.seqNo = 0
+	db.replica.loader = db.newIndexLoader()
+	if err := db.load(); err != nil {
+		return err
+	}
+	db.familyVersion++
+	return nil
+}
+
+// truncateUncommittedTail 截断末尾未提交的事务数据，调用方需持有库锁
+// 从节点重新打开时内存中的事务数据已经丢失，截断之后由主节点重新发送
+func (db *DB) truncateUncommittedTail() error {
+	for db.activeFile != nil {
+		start, err := uncommittedTailOffset(db.activeFile)
+		if err != nil {
+			return err
+		}
+		if start < 0 {
+			return nil
+		}
+		if start > 0 {
+			return db.truncateActiveFile(start)
+		}
+
+		// 整个文件都是未提交的事务数据，事务可能从上一个文件开始
+		fid := db.activeFile.FileId
+		if err := db.activeFile.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(db.activeFile.FileName); err != nil {
+			return err
+		}
+		db.activeFile = nil
+		if fid == 0 || db.olderFiles[fid-1] == nil {
+			return nil
+		}
+		prev := db.olderFiles[fid-1]
+		delete(db.olderFiles, fid-1)
+		size, err := prev.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		prev.WriteOffset = size
+		db.activeFile = prev
+	}
+	return nil
+}
+
+// truncateActiveFile 截断活跃文件，调用方需持有库锁
+func (db *DB) truncateActiveFile(size int64) error {
+	if err := db.activeFile.Truncate(size); err != nil {
+		return err
+	}
+	// 截断位置之后会写入新的记录，清理文件的缓存
+	if db.valueCache != nil {
+		db.valueCache.removeFile(db.activeFile.FileId)
+	}
+	return nil
+}
+
+// uncommittedTailOffset 查找文件末尾未提交的事务数据的起始位置，没有时返回-1
+func uncommittedTailOffset(dataFile *DataFile) (int64, error) {
+	start := int64(-1)
+	var offset int64
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				return start, nil
+			}
+			return 0, err
+		}
+		_, seqNo := parseLogRecordKey(logRecord.Key)
+		if seqNo == nonTransactionSeqNo || logRecord.Type == LogRecordTxnFinished {
+			start = -1
+		} else if start < 0 {
+			start = offset
+		}
+		offset += size
+	}
+}
+
+// replicaFiles 正在接收的文件
+type replicaFiles struct {
+	files map[string]*os.File
+}
+
+// write 写入文件的一部分，目录中第一个文件开始接收时清空目录
+// 文件名来自主节点，只能是目录中的文件，不能包含路径
+func (r *replicaFiles) write(dir, name string, offset int64, data []byte) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || name != filepath.Base(name) {
+		return errs.ErrReplicationOutOfSync
+	}
+	if offset < 0 {
+		return errs.ErrReplicationOutOfSync
+	}
+	fileName := filepath.Join(dir, filepath.Base(name))
+	f := r.files[fileName]
+	if f == nil {
+		if len(r.files) == 0 {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				return err
+			}
+		}
+		var err error
+		if f, err = os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DataFilePerm); err != nil {
+			return err
+		}
+		if r.files == nil {
+			r.files = make(map[string]*os.File)
+		}
+		r.files[fileName] = f
+	}
+	_, err := f.WriteAt(data, offset)
+	return err
+}
+
+// finish 持久化接收的文件
+func (r *replicaFiles) finish() error {
+	defer r.close()
+	var dir string
+	for fileName, f := range r.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		dir = filepath.Dir(fileName)
+	}
+	if dir == "" {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+func (r *replicaFiles) close() {
+	for _, f := range r.files {
+		_ = f.Close()
+	}
+	r.files = nil
+}
@@ -0,0 +1,543 @@
+package kv
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+const quarantineDirName = "-quarantine"
+
+// IssueType 数据目录检查发现的问题类型
+type IssueType uint8
+
+const (
+	// IssueCorruptRecord 记录crc校验失败
+	IssueCorruptRecord IssueType = iota + 1
+
+	// IssueTornRecord 文件末尾的记录不完整
+	IssueTornRecord
+
+	// IssueDanglingTxn 事务记录没有对应的提交标记，打开时会被忽略
+	IssueDanglingTxn
+
+	// IssueOrphanMergeDir 未完成的merge目录
+	IssueOrphanMergeDir
+
+	// IssueCorruptHintFile hint文件损坏或指向不存在的位置
+	IssueCorruptHintFile
+
+	// IssueCorruptMergeFinished merge完成标识文件损坏
+	IssueCorruptMergeFinished
+)
+
+func (t IssueType) String() string {
+	switch t {
+	case IssueCorruptRecord:
+		return "corrupt record"
+	case IssueTornRecord:
+		return "torn record"
+	case IssueDanglingTxn:
+		return "dangling transaction"
+	case IssueOrphanMergeDir:
+		return "orphan merge dir"
+	case IssueCorruptHintFile:
+		return "corrupt hint file"
+	case IssueCorruptMergeFinished:
+		return "corrupt merge finished file"
+	}
+	return "unknown"
+}
+
+// Issue 检查发现的一个问题
+type Issue struct {
+	Type   IssueType
+	File   string
+	Offset int64  // 问题数据在文件中的位置
+	Size   int64  // 损坏数据的长度
+	SeqNo  uint64 // 未提交事务的序列号
+}
+
+func (i *Issue) String() string {
+	switch i.Type {
+	case IssueCorruptRecord, IssueTornRecord:
+		return fmt.Sprintf("%s: %s at offset %d, %d bytes", i.File, i.Type, i.Offset, i.Size)
+	case IssueDanglingTxn:
+		return fmt.Sprintf("%s: %s %d at offset %d", i.File, i.Type, i.SeqNo, i.Offset)
+	}
+	return fmt.Sprintf("%s: %s", i.File, i.Type)
+}
+
+// VerifyReport 数据目录的检查结果
+type VerifyReport struct {
+	DataFiles int
+	Records   int64
+	Issues    []*Issue
+	Repaired  []string // Repair 执行的修复操作
+}
+
+// OK 是否没有发现问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Verify 离线检查数据目录，检查期间数据库不能被打开
+// 检查所有数据文件、hint文件与merge完成标识，以及未完成的merge目录
+func Verify(dirPath string) (*VerifyReport, error) {
+	unlock, err := lockDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return verifyDir(dirPath)
+}
+
+// Repair 离线修复数据目录，返回修复前的检查结果与执行的修复操作
+// 损坏的数据段会移动到与数据目录同级的 -quarantine 目录，之后的有效记录保留在原文件中
+// 修改过的文件中记录的位置会变化，因此会删除hint文件与B+树索引，下次打开时重建
+func Repair(dirPath string) (*VerifyReport, error) {
+	unlock, err := lockDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	report, err := verifyDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按文件汇总需要隔离的数据段
+	badSegments := make(map[string][]*Issue)
+	rebuildIndex, dropHint := false, false
+	for _, issue := range report.Issues {
+		switch issue.Type {
+		case IssueCorruptRecord, IssueTornRecord:
+			badSegments[issue.File] = append(badSegments[issue.File], issue)
+		case IssueOrphanMergeDir:
+			if err := os.RemoveAll(issue.File); err != nil {
+				return nil, err
+			}
+			report.Repaired = append(report.Repaired, "removed "+issue.File)
+		case IssueCorruptHintFile, IssueCorruptMergeFinished:
+			dropHint = true
+		}
+	}
+
+	nonMergeFileId, hasMerge := readNonMergeFileId(dirPath)
+	for fileName, segments := range badSegments {
+		if err := quarantineSegments(dirPath, fileName, segments); err != nil {
+			return nil, err
+		}
+		report.Repaired = append(report.Repaired, fmt.Sprintf("quarantined %d segment(s) of %s", len(segments), fileName))
+		rebuildIndex = true
+
+		// hint文件中记录的是merge生成的文件中的位置
+		fid, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(fileName), DataFileSuffix))
+		if hasMerge && uint32(fid) < nonMergeFileId {
+			dropHint = true
+		}
+	}
+
+	// 不使用hint文件时，打开时会重放所有数据文件，merge生成的文件中只有有效数据，重放结果一致
+	if dropHint {
+		for _, name := range []string{HintFileName, MergeFinishedFileName} {
+			if err := removeIfExists(filepath.Join(dirPath, name)); err != nil {
+				return nil, err
+			}
+		}
+		report.Repaired = append(report.Repaired, "removed hint file, index will be rebuilt from data files")
+	}
+	if rebuildIndex || dropHint {
+		if err := removeIfExists(filepath.Join(dirPath, BPlusTreeIndexFileName)); err != nil {
+			return nil, err
+		}
+		if err := removeFamilyIndexFiles(dirPath); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func verifyDir(dirPath string) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	fileIds, err := listDataFileIds(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	report.DataFiles = len(fileIds)
+
+	// 未提交的事务，序列号 -> 第一条记录的位置
+	type txnStart struct {
+		file   string
+		offset int64
+	}
+	pendingTxns := make(map[uint64]*txnStart)
+
+	for i, fid := range fileIds {
+		fileName := GetDataFileName(dirPath, fid)
+		// 只有最后一个文件可能是通过映射写入的活跃文件
+		isActive := i == len(fileIds)-1
+		err := scanDataFile(fileName, isActive, func(record *LogRecord, offset int64) {
+			report.Records++
+			_, seqNo := parseLogRecordKey(record.Key)
+			if seqNo == nonTransactionSeqNo {
+				return
+			}
+			if record.Type == LogRecordTxnFinished {
+				delete(pendingTxns, seqNo)
+			} else if pendingTxns[seqNo] == nil {
+				pendingTxns[seqNo] = &txnStart{file: fileName, offset: offset}
+			}
+		}, func(issue *Issue) {
+			report.Issues = append(report.Issues, issue)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seqNos := make([]uint64, 0, len(pendingTxns))
+	for seqNo := range pendingTxns {
+		seqNos = append(seqNos, seqNo)
+	}
+	slices.Sort(seqNos)
+	for _, seqNo := range seqNos {
+		start := pendingTxns[seqNo]
+		report.Issues = append(report.Issues, &Issue{Type: IssueDanglingTxn, File: start.file, Offset: start.offset, SeqNo: seqNo})
+	}
+
+	if issue := verifyMergeFinished(dirPath); issue != nil {
+		report.Issues = append(report.Issues, issue)
+	}
+	if issue := verifyHintFile(dirPath); issue != nil {
+		report.Issues = append(report.Issues, issue)
+	}
+
+	// merge目录中有完成标识时，打开数据库会应用merge结果，不属于问题
+	mergePath := siblingDirPath(dirPath, mergeDirName)
+	if _, err := os.Stat(mergePath); err == nil {
+		if _, err := os.Stat(filepath.Join(mergePath, MergeFinishedFileName)); os.IsNotExist(err) {
+			report.Issues = append(report.Issues, &Issue{Type: IssueOrphanMergeDir, File: mergePath})
+		}
+	}
+	return report, nil
+}
+
+// scanDataFile 顺序读取数据文件中的记录，遇到损坏的记录时向后查找下一条有效记录
+// isActive 为 true 时末尾全部为0的数据是预分配但没有写入的空间，不是损坏
+func scanDataFile(fileName string, isActive bool, onRecord func(*LogRecord, int64), onIssue func(*Issue)) error {
+	dataFile, err := newDataFile(IO_MMAP, fileName, 0)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for offset < size {
+		record, n, err := dataFile.ReadLogRecord(offset)
+		// 没有密钥时加密的记录只校验crc
+		if isIntactRecord(err) {
+			onRecord(record, offset)
+			offset += n
+			continue
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, errs.ErrInvalidCRC) {
+			return err
+		}
+		// 通过映射写入的活跃文件末尾预分配但没有写入的空间不是损坏
+		if err == io.EOF && isActive {
+			zero, err := dataFile.isZeroTail(offset, size)
+			if err != nil {
+				return err
+			}
+			if zero {
+				return nil
+			}
+		}
+
+		next := findNextRecord(dataFile, offset+1, size)
+		if next < 0 {
+			// 之后没有有效记录，说明是末尾不完整的写入
+			issueType := IssueTornRecord
+			if errors.Is(err, errs.ErrInvalidCRC) {
+				issueType = IssueCorruptRecord
+			}
+			onIssue(&Issue{Type: issueType, File: fileName, Offset: offset, Size: size - offset})
+			return nil
+		}
+		onIssue(&Issue{Type: IssueCorruptRecord, File: fileName, Offset: offset, Size: next - offset})
+		offset = next
+	}
+	return nil
+}
+
+const (
+	// maxResyncWindow 损坏的数据之后最多向后查找的字节数，超出时按之后没有有效记录处理
+	maxResyncWindow int64 = 64 * 1024 * 1024
+	// resyncChunkSize 查找下一条记录时每次读取的字节数
+	resyncChunkSize int64 = 64 * 1024
+)
+
+// findNextRecord 查找下一条有效记录的位置，要求其后一条记录同样有效或者恰好到文件末尾，降低误判
+// 按块读取数据，只有头部合理的位置才完整读取并校验记录，最多查找 maxResyncWindow 个字节
+func findNextRecord(dataFile *DataFile, from, size int64) int64 {
+	end := min(size, from+maxResyncWindow)
+	buf := make([]byte, resyncChunkSize+maxLogRecordHeaderSize)
+	for start := from; start < end; start += resyncChunkSize {
+		n := min(int64(len(buf)), size-start)
+		if _, err := dataFile.IoManager.Read(buf[:n], start); err != nil {
+			return -1
+		}
+		for i := range min(resyncChunkSize, end-start) {
+			off := start + i
+			if !isPlausibleHeader(buf[i:n], size-off) {
+				continue
+			}
+			_, rSize, err := dataFile.ReadLogRecord(off)
+			if !isIntactRecord(err) {
+				continue
+			}
+			if off+rSize == size {
+				return off
+			}
+			if _, _, err := dataFile.ReadLogRecord(off + rSize); isIntactRecord(err) {
+				return off
+			}
+		}
+	}
+	return -1
+}
+
+// isPlausibleHeader 不校验crc，只检查data开头是否可能是记录的头部，remain 为到文件末尾的字节数
+// 所有记录的key都带有事务ID，不会为空
+func isPlausibleHeader(data []byte, remain int64) bool {
+	var header logRecordHeader
+	headerSize := decodeLogRecordHeaderTo(data, &header)
+	if headerSize == 0 || header.recordType > LogRecordRangeDeleted || header.keySize == 0 {
+		return false
+	}
+	return headerSize+int64(header.keySize)+int64(header.valueSize) <= remain
+}
+
+// isIntactRecord 记录是否完整，没有密钥无法解密的记录已经通过crc校验
+func isIntactRecord(err error) bool {
+	return err == nil || errors.Is(err, errs.ErrEncryptionKeyRequired)
+}
+
+func verifyMergeFinished(dirPath string) *Issue {
+	fileName := filepath.Join(dirPath, MergeFinishedFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	if _, ok := readNonMergeFileId(dirPath); !ok {
+		return &Issue{Type: IssueCorruptMergeFinished, File: fileName}
+	}
+	return nil
+}
+
+// verifyHintFile 检查hint文件中的每条记录都指向数据文件中存在的位置
+func verifyHintFile(dirPath string) *Issue {
+	fileName := filepath.Join(dirPath, HintFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	var issue *Issue
+	fileSizes := make(map[uint32]int64)
+	err := scanDataFile(fileName, false, func(record *LogRecord, offset int64) {
+		// 加密的记录没有密钥时无法检查位置
+		if record.Value == nil {
+			return
+		}
+		pos := DecodeLogRecordPos(record.Value)
+		size, ok := fileSizes[pos.Fid]
+		if !ok {
+			size = -1
+			if info, err := os.Stat(GetDataFileName(dirPath, pos.Fid)); err == nil {
+				size = info.Size()
+			}
+			fileSizes[pos.Fid] = size
+		}
+		if issue == nil && pos.Offset+int64(pos.Size) > size {
+			issue = &Issue{Type: IssueCorruptHintFile, File: fileName, Offset: offset}
+		}
+	}, func(i *Issue) {
+		if issue == nil {
+			issue = &Issue{Type: IssueCorruptHintFile, File: fileName, Offset: i.Offset, Size: i.Size}
+		}
+	})
+	if err != nil && issue == nil {
+		issue = &Issue{Type: IssueCorruptHintFile, File: fileName}
+	}
+	return issue
+}
+
+// readNonMergeFileId 读取merge完成标识中最近一个没有参与merge的文件id
+func readNonMergeFileId(dirPath string) (uint32, bool) {
+	fileName := filepath.Join(dirPath, MergeFinishedFileName)
+	if _, err := os.Stat(fileName); err != nil {
+		return 0, false
+	}
+	mergeFinishedFile, err := OpenMergeFinishedFile(dirPath)
+	if err != nil {
+		return 0, false
+	}
+	defer mergeFinishedFile.Close()
+
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil || string(record.Key) != mergeFinishedKey {
+		return 0, false
+	}
+	fid, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, false
+	}
+	return uint32(fid), true
+}
+
+// quarantineSegments 将损坏的数据段移动到隔离目录，并从数据文件中移除
+func quarantineSegments(dirPath, fileName string, segments []*Issue) error {
+	quarantinePath := siblingDirPath(dirPath, quarantineDirName)
+	if err := os.MkdirAll(quarantinePath, os.ModePerm); err != nil {
+		return err
+	}
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(segments, func(a, b *Issue) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	for _, segment := range segments {
+		name := fmt.Sprintf("%s.%d", filepath.Base(fileName), segment.Offset)
+		if err := writeSection(filepath.Join(quarantinePath, name), src, segment.Offset, segment.Size); err != nil {
+			return err
+		}
+	}
+
+	// 只有末尾的损坏时直接截断
+	if len(segments) == 1 && segments[0].Offset+segments[0].Size == info.Size() {
+		if err := os.Truncate(fileName, segments[0].Offset); err != nil {
+			return err
+		}
+		return syncFile(fileName)
+	}
+
+	// 先写入临时文件再替换，避免修复过程中断导致数据丢失
+	tmpFile := fileName + ".repair"
+	dest, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	var last int64
+	for _, segment := range segments {
+		if _, err := io.Copy(dest, io.NewSectionReader(src, last, segment.Offset-last)); err != nil {
+			return err
+		}
+		last = segment.Offset + segment.Size
+	}
+	if _, err := io.Copy(dest, io.NewSectionReader(src, last, info.Size()-last)); err != nil {
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		return err
+	}
+	// 替换前关闭文件，部分平台无法重命名已打开的文件
+	_ = dest.Close()
+	_ = src.Close()
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		return err
+	}
+	return syncDir(dirPath)
+}
+
+// writeSection 将文件中的一段数据写入新文件
+func writeSection(fileName string, src io.ReaderAt, offset, size int64) error {
+	dest, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if _, err := io.Copy(dest, io.NewSectionReader(src, offset, size)); err != nil {
+		return err
+	}
+	return dest.Sync()
+}
+
+// listDataFileIds 获取目录中所有数据文件的id，从小到大排序
+func listDataFileIds(dirPath string) ([]uint32, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), DataFileSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), DataFileSuffix))
+		if err != nil {
+			return nil, errs.ErrDataDirCorrupted
+		}
+		fileIds = append(fileIds, uint32(fid))
+	}
+	slices.Sort(fileIds)
+	return fileIds, nil
+}
+
+// lockDir 获取数据目录的文件锁，数据库打开时返回 ErrDataBaseIsUsing
+func lockDir(dirPath string) (func(), error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(dirPath, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, errs.ErrDataBaseIsUsing
+	}
+	return func() {
+		_ = fileLock.Unlock()
+	}, nil
+}
+
+func removeIfExists(fileName string) error {
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func syncFile(fileName string) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,143 @@
+package kv
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyAndRepair(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := range 2000 {
+		assert.Nil(t, db.Put(GetTestKey(i), RandomValue(64)))
+	}
+	// 未提交的事务记录
+	_, err = db.appendLogRecord(&LogRecord{Key: logRecordKeyWithSeq(GetTestKey(5000), 100), Value: []byte("v")})
+	assert.Nil(t, err)
+	corruptPos := db.index.Get(GetTestKey(100))
+	activeFid := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	report, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2001), report.Records)
+	assert.Equal(t, 1, len(report.Issues))
+	assert.Equal(t, IssueDanglingTxn, report.Issues[0].Type)
+	assert.Equal(t, uint64(100), report.Issues[0].SeqNo)
+
+	// 损坏旧文件中的一条记录，并在活跃文件末尾追加不完整的记录
+	corruptFile := GetDataFileName(dir, corruptPos.Fid)
+	f, err := os.OpenFile(corruptFile, os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, corruptPos.Offset+int64(corruptPos.Size)-2)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	torn, _ := EncodeLogRecord(&LogRecord{Key: []byte("torn"), Value: RandomValue(100)})
+	f, err = os.OpenFile(GetDataFileName(dir, activeFid), os.O_RDWR|os.O_APPEND, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write(torn[:len(torn)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// 损坏的记录导致无法打开
+	_, err = Open(opts)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+
+	// 打开时会清理未完成的merge目录，因此在打开失败之后创建
+	mergePath := siblingDirPath(dir, mergeDirName)
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	defer os.RemoveAll(mergePath)
+	defer os.RemoveAll(siblingDirPath(dir, quarantineDirName))
+
+	report, err = Verify(dir)
+	assert.Nil(t, err)
+	types := map[IssueType]int{}
+	for _, issue := range report.Issues {
+		types[issue.Type]++
+	}
+	assert.Equal(t, map[IssueType]int{
+		IssueCorruptRecord:  1,
+		IssueTornRecord:     1,
+		IssueDanglingTxn:    1,
+		IssueOrphanMergeDir: 1,
+	}, types)
+
+	report, err = Repair(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(report.Repaired))
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	entries, err := os.ReadDir(siblingDirPath(dir, quarantineDirName))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	// 修复后只剩下打开时会被忽略的未提交事务
+	report, err = Verify(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Issues))
+	assert.Equal(t, IssueDanglingTxn, report.Issues[0].Type)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	_, err = db.Get(GetTestKey(100))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	_, err = db.Get(GetTestKey(5000))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	assert.Equal(t, 1999, len(db.ListKeys()))
+
+	// 数据库打开时不能检查
+	_, err = Verify(dir)
+	assert.Equal(t, errs.ErrDataBaseIsUsing, err)
+	_, err = os.Stat(filepath.Join(dir, HintFileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFindNextRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-find-next")
+	defer os.RemoveAll(dir)
+
+	var data []byte
+	appendRecord := func(key string) int64 {
+		encRecord, _, err := encodeLogRecord(&LogRecord{
+			Key:   logRecordKeyWithSeq([]byte(key), nonTransactionSeqNo),
+			Value: RandomValue(64),
+		}, NoCompression, nil)
+		assert.Nil(t, err)
+		offset := int64(len(data))
+		data = append(data, encRecord...)
+		return offset
+	}
+	appendRecord("a")
+	// 超过一次读取大小的随机数据，记录可能跨越两次读取的边界
+	garbage := make([]byte, resyncChunkSize*3+17)
+	_, _ = rand.Read(garbage)
+	garbageOffset := int64(len(data))
+	data = append(data, garbage...)
+	next := appendRecord("b")
+	appendRecord("c")
+
+	fileName := GetDataFileName(dir, 0)
+	assert.Nil(t, os.WriteFile(fileName, data, DataFilePerm))
+	dataFile, err := OpenDataFile(IO_FILE, dir, 0)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	size := int64(len(data))
+	assert.Equal(t, next, findNextRecord(dataFile, garbageOffset, size))
+	// 最后一条记录恰好到文件末尾
+	last := next + (size-next)/2
+	assert.Equal(t, last, findNextRecord(dataFile, next+1, size))
+	assert.Equal(t, int64(-1), findNextRecord(dataFile, last+1, size))
+}
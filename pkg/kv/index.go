@@ -2,18 +2,21 @@ package kv
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/google/btree"
 )
 
-func NewIndex(indexType IndexType, dirPath string, syncWrites bool) Indexer {
+func NewIndex(indexType IndexType, dirPath string, syncWrites bool) (Indexer, error) {
 	switch indexType {
 	case BTree:
-		return NewBTreeIndex()
-	case ART:
-		return NewArTree()
+		return NewBTreeIndex(), nil
+	case RadixTree:
+		return NewRadixTreeIndex(), nil
+	case BPlusTree:
+		return NewBPlusTreeIndex(dirPath, syncWrites)
 	default:
-		panic("unknown index type")
+		return nil, fmt.Errorf("unsupported index type: %d", indexType)
 	}
 }
 
@@ -28,12 +31,19 @@ type Indexer interface {
 	// Delete 删除key，返回是否删除成功
 	Delete(key []byte) (*LogRecordPos, bool)
 
+	// DeleteRange 删除 [start, end) 范围内的key，end 为空时不限制结束位置
+	// f 在删除每个key之后调用，参数为删除的key与旧的位置
+	DeleteRange(start, end []byte, f func(key []byte, pos *LogRecordPos))
+
 	// Size 获取索引大小
 	Size() int
 
 	// IndexIterator 获取迭代器
 	IndexIterator(reverse bool) IndexIterator
 
+	// Snapshot 获取当前索引的只读快照，快照不受之后的写入影响，使用完毕后需要Close
+	Snapshot() Indexer
+
 	Close() error
 }
 
@@ -46,6 +56,19 @@ func (i *Item) Less(bi btree.Item) bool {
 	return bytes.Compare(i.key, bi.(*Item).key) < 0
 }
 
+// beforeEnd 判断key是否小于范围的结束key，end 为空时不限制结束位置
+func beforeEnd(key, end []byte) bool {
+	return len(end) == 0 || bytes.Compare(key, end) < 0
+}
+
+// indexError 返回索引快照或迭代器创建时的错误，例如B+树索引无法开启只读事务
+func indexError(v any) error {
+	if e, ok := v.(interface{ Err() error }); ok {
+		return e.Err()
+	}
+	return nil
+}
+
 // IndexIterator 索引迭代器
 type IndexIterator interface {
 
@@ -0,0 +1,483 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+const (
+	BPlusTreeIndexFileName = "bptree-index"
+
+	// bbolt 在读事务存活期间无法扩容映射，预留足够的映射空间避免写入被阻塞
+	// 索引文件超过映射大小之后，提交写事务需要等待所有迭代器与快照关闭，期间持有库锁，
+	// 因此B+树索引上的迭代器与快照不宜长期持有，也不能在持有期间于同一个goroutine中写入
+	bptreeInitialMmapSize = 1 << 30
+)
+
+var (
+	indexBucketName = []byte("hifidb-index")
+
+	// 保存检查点的bucket，检查点与索引的修改在同一个事务中提交
+	indexMetaBucketName = []byte("hifidb-index-meta")
+	checkpointKey       = []byte("checkpoint")
+	indexSizeKey        = []byte("size") // 索引中key的数量，与索引的修改在同一个事务中更新
+)
+
+// BPlusTreeIndex 基于磁盘的B+树索引，索引数据持久化在数据目录中
+// 数据库在一次组提交中的写入合并为一个事务，与已经写入数据文件的位置一起提交，
+// 异常退出之后只需要重放检查点之后的记录
+type BPlusTreeIndex struct {
+	tree  *bbolt.DB
+	batch bool             // 是否在批量写入，批量写入期间的修改在同一个写事务中
+	tx    *bbolt.Tx        // 批量写入的写事务，第一次写入时开始，调用方需持有库锁
+	err   error            // 写入失败的错误，之后的写入不再执行，由 commit 返回
+	saved *indexCheckpoint // 最近一次保存的检查点
+	size  atomic.Int64     // 已提交的key数量
+	delta int64            // 批量写入中还未提交的key数量变化
+}
+
+func NewBPlusTreeIndex(dirPath string, syncWrites bool) (*BPlusTreeIndex, error) {
+	return newBPlusTreeIndexFile(filepath.Join(dirPath, BPlusTreeIndexFileName), syncWrites)
+}
+
+// newBPlusTreeIndexFile 使用指定的文件创建B+树索引
+func newBPlusTreeIndexFile(fileName string, syncWrites bool) (*BPlusTreeIndex, error) {
+	opts := *bbolt.DefaultOptions
+	opts.NoSync = !syncWrites
+	opts.InitialMmapSize = bptreeInitialMmapSize
+
+	tree, err := bbolt.Open(fileName, DataFilePerm, &opts)
+	// 索引可以从数据文件重建，文件损坏时删除后重新创建，没有检查点的索引打开时会完整重建
+	if errors.Is(err, berrors.ErrInvalid) || errors.Is(err, berrors.ErrChecksum) || errors.Is(err, berrors.ErrVersionMismatch) {
+		if err := os.Remove(fileName); err != nil {
+			return nil, err
+		}
+		tree, err = bbolt.Open(fileName, DataFilePerm, &opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建索引bucket并读取检查点
+	b := &BPlusTreeIndex{tree: tree}
+	if err := tree.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(indexMetaBucketName)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(checkpointKey); v != nil {
+			b.saved = decodeIndexCheckpoint(v)
+		}
+		// 没有保存数量时统计一次
+		if v := meta.Get(indexSizeKey); v != nil {
+			size, _ := binary.Varint(v)
+			b.size.Store(size)
+			return nil
+		}
+		b.size.Store(int64(tx.Bucket(indexBucketName).Stats().KeyN))
+		return putIndexSize(tx, b.size.Load())
+	}); err != nil {
+		_ = tree.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// putIndexSize 在事务中保存key的数量
+func putIndexSize(tx *bbolt.Tx, size int64) error {
+	return tx.Bucket(indexMetaBucketName).Put(indexSizeKey, binary.AppendVarint(nil, size))
+}
+
+// update 执行一次修改，fn 返回key数量的变化，批量写入期间在同一个写事务中执行，否则单独提交
+// 修改失败时记录错误，之后的修改不再执行
+func (b *BPlusTreeIndex) update(fn func(bucket *bbolt.Bucket) (int64, error)) {
+	if b.err != nil {
+		return
+	}
+	if !b.batch {
+		var delta int64
+		b.err = b.tree.Update(func(tx *bbolt.Tx) error {
+			var err error
+			if delta, err = fn(tx.Bucket(indexBucketName)); err != nil {
+				return err
+			}
+			return putIndexSize(tx, b.size.Load()+delta)
+		})
+		if b.err == nil {
+			b.size.Add(delta)
+		}
+		return
+	}
+	if b.tx == nil {
+		if b.tx, b.err = b.tree.Begin(true); b.err != nil {
+			return
+		}
+	}
+	var delta int64
+	delta, b.err = fn(b.tx.Bucket(indexBucketName))
+	b.delta += delta
+}
+
+// begin 开始批量写入，直到 commit 或 rollback
+func (b *BPlusTreeIndex) begin() {
+	b.batch = true
+}
+
+// commit 提交批量写入，cp 不为空时在同一个事务中保存检查点
+// 之前的修改失败时放弃批量写入并返回错误
+func (b *BPlusTreeIndex) commit(cp *indexCheckpoint) error {
+	if b.err != nil {
+		err := b.err
+		b.rollback()
+		return err
+	}
+	b.batch = false
+	if b.tx == nil {
+		// 没有修改时，只在检查点变化时提交
+		if cp == nil || (b.saved != nil && *b.saved == *cp) {
+			return nil
+		}
+		tx, err := b.tree.Begin(true)
+		if err != nil {
+			return err
+		}
+		b.tx = tx
+	}
+	tx, delta := b.tx, b.delta
+	b.tx, b.delta = nil, 0
+	if cp != nil {
+		if err := tx.Bucket(indexMetaBucketName).Put(checkpointKey, cp.encode()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if delta != 0 {
+		if err := putIndexSize(tx, b.size.Load()+delta); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.size.Add(delta)
+	if cp != nil {
+		saved := *cp
+		b.saved = &saved
+	}
+	return nil
+}
+
+// rollback 放弃批量写入的修改
+func (b *BPlusTreeIndex) rollback() {
+	if b.tx != nil {
+		_ = b.tx.Rollback()
+		b.tx = nil
+	}
+	b.batch = false
+	b.err = nil
+	b.delta = 0
+}
+
+// checkpoint 最近一次保存的检查点，没有保存过时返回nil
+func (b *BPlusTreeIndex) checkpoint() *indexCheckpoint {
+	return b.saved
+}
+
+// reset 清空索引与检查点，用于从数据文件重建索引
+func (b *BPlusTreeIndex) reset() error {
+	b.rollback()
+	b.saved = nil
+	if err := b.tree.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{indexBucketName, indexMetaBucketName} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return putIndexSize(tx, 0)
+	}); err != nil {
+		return err
+	}
+	b.size.Store(0)
+	return nil
+}
+
+// Put 添加key-value，返回旧的位置
+func (b *BPlusTreeIndex) Put(key []byte, value *LogRecordPos) *LogRecordPos {
+	var oldPos *LogRecordPos
+	b.update(func(bucket *bbolt.Bucket) (int64, error) {
+		var delta int64 = 1
+		if v := bucket.Get(key); v != nil {
+			oldPos = DecodeLogRecordPos(v)
+			delta = 0
+		}
+		return delta, bucket.Put(key, EncodeLogRecordPos(value))
+	})
+	return oldPos
+}
+
+// Get 获取key对应的位置，批量写入期间可以读到还未提交的修改
+func (b *BPlusTreeIndex) Get(key []byte) *LogRecordPos {
+	if b.tx != nil {
+		if v := b.tx.Bucket(indexBucketName).Get(key); v != nil {
+			return DecodeLogRecordPos(v)
+		}
+		return nil
+	}
+	var pos *LogRecordPos
+	// 只读事务只会在索引关闭之后失败
+	_ = b.tree.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(indexBucketName).Get(key); v != nil {
+			pos = DecodeLogRecordPos(v)
+		}
+		return nil
+	})
+	return pos
+}
+
+// Delete 删除key，返回旧的位置与是否删除成功
+func (b *BPlusTreeIndex) Delete(key []byte) (*LogRecordPos, bool) {
+	var oldPos *LogRecordPos
+	b.update(func(bucket *bbolt.Bucket) (int64, error) {
+		if v := bucket.Get(key); v != nil {
+			oldPos = DecodeLogRecordPos(v)
+			return -1, bucket.Delete(key)
+		}
+		return 0, nil
+	})
+	return oldPos, oldPos != nil
+}
+
+// DeleteRange 在一个写事务中删除范围内的key
+func (b *BPlusTreeIndex) DeleteRange(start, end []byte, f func(key []byte, pos *LogRecordPos)) {
+	var keys [][]byte
+	var values [][]byte
+	b.update(func(bucket *bbolt.Bucket) (int64, error) {
+		c := bucket.Cursor()
+		for k, v := c.Seek(start); k != nil && beforeEnd(k, end); k, v = c.Seek(start) {
+			// 事务结束后原始内存不可用，删除前拷贝
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, append([]byte(nil), v...))
+			if err := c.Delete(); err != nil {
+				return 0, err
+			}
+		}
+		return -int64(len(keys)), nil
+	})
+	for i, key := range keys {
+		f(key, DecodeLogRecordPos(values[i]))
+	}
+}
+
+// Size 获取已提交的索引大小，使用保存的key数量，不需要遍历索引
+func (b *BPlusTreeIndex) Size() int {
+	return int(b.size.Load())
+}
+
+// IndexIterator 获取迭代器，迭代器持有只读事务，只能读到已提交的修改
+func (b *BPlusTreeIndex) IndexIterator(reverse bool) IndexIterator {
+	return newBPlusTreeIterator(b.tree, reverse)
+}
+
+// Snapshot 基于只读事务获取快照，快照存活期间索引文件无法扩容映射
+// 无法开启事务时返回空的快照，错误通过 Err 返回
+func (b *BPlusTreeIndex) Snapshot() Indexer {
+	tx, err := b.tree.Begin(false)
+	if err != nil {
+		return &bptreeSnapshot{err: err, lock: &sync.Mutex{}}
+	}
+	return &bptreeSnapshot{
+		tx:     tx,
+		bucket: tx.Bucket(indexBucketName),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Close 持久化并关闭索引文件，未提交的批量写入会被放弃
+func (b *BPlusTreeIndex) Close() error {
+	b.rollback()
+	if err := b.tree.Sync(); err != nil {
+		return err
+	}
+	return b.tree.Close()
+}
+
+// bptreeSnapshot B+树索引的只读快照
+type bptreeSnapshot struct {
+	tx     *bbolt.Tx
+	bucket *bbolt.Bucket
+	lock   *sync.Mutex // bbolt 事务不是并发安全的
+	err    error       // 开启只读事务失败的错误，此时快照中没有任何key
+}
+
+// Err 返回创建快照时的错误
+func (s *bptreeSnapshot) Err() error {
+	return s.err
+}
+
+func (s *bptreeSnapshot) Put(key []byte, value *LogRecordPos) *LogRecordPos {
+	panic("bptree snapshot is read only")
+}
+
+func (s *bptreeSnapshot) Get(key []byte) *LogRecordPos {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	if v := s.bucket.Get(key); v != nil {
+		return DecodeLogRecordPos(v)
+	}
+	return nil
+}
+
+func (s *bptreeSnapshot) Delete(key []byte) (*LogRecordPos, bool) {
+	panic("bptree snapshot is read only")
+}
+
+func (s *bptreeSnapshot) DeleteRange(start, end []byte, f func(key []byte, pos *LogRecordPos)) {
+	panic("bptree snapshot is read only")
+}
+
+func (s *bptreeSnapshot) Size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tx == nil {
+		return 0
+	}
+	size, _ := binary.Varint(s.tx.Bucket(indexMetaBucketName).Get(indexSizeKey))
+	return int(size)
+}
+
+func (s *bptreeSnapshot) IndexIterator(reverse bool) IndexIterator {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tx == nil {
+		return &bptreeIterator{err: s.err}
+	}
+	it := &bptreeIterator{
+		cursor:  s.bucket.Cursor(),
+		reverse: reverse,
+	}
+	it.Rewind()
+	return it
+}
+
+func (s *bptreeSnapshot) Snapshot() Indexer {
+	panic("bptree snapshot can not be nested")
+}
+
+func (s *bptreeSnapshot) Close() error {
+	if s.tx == nil {
+		return nil
+	}
+	return s.tx.Rollback()
+}
+
+// B+树 索引迭代器，迭代期间持有一个只读事务
+type bptreeIterator struct {
+	tx       *bbolt.Tx
+	cursor   *bbolt.Cursor
+	reverse  bool
+	curKey   []byte
+	curValue []byte
+	err      error // 开启只读事务失败的错误，此时迭代器没有任何key
+}
+
+// newBPlusTreeIterator 创建迭代器，无法开启事务时返回已结束的迭代器，错误通过 Err 返回
+func newBPlusTreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
+	tx, err := tree.Begin(false)
+	if err != nil {
+		return &bptreeIterator{err: err}
+	}
+	bpi := &bptreeIterator{
+		tx:      tx,
+		cursor:  tx.Bucket(indexBucketName).Cursor(),
+		reverse: reverse,
+	}
+	bpi.Rewind()
+	return bpi
+}
+
+// Err 返回创建迭代器时的错误
+func (i *bptreeIterator) Err() error {
+	return i.err
+}
+
+// Rewind 回到起始位置
+func (i *bptreeIterator) Rewind() {
+	if i.cursor == nil {
+		return
+	}
+	if i.reverse {
+		i.curKey, i.curValue = i.cursor.Last()
+	} else {
+		i.curKey, i.curValue = i.cursor.First()
+	}
+}
+
+// Seek 移动第一个大于等于key的位置，逆序时为第一个小于等于key的位置
+func (i *bptreeIterator) Seek(key []byte) {
+	if i.cursor == nil {
+		return
+	}
+	i.curKey, i.curValue = i.cursor.Seek(key)
+	if !i.reverse {
+		return
+	}
+	// cursor 只支持正向查找，逆序时需要回退到小于等于key的位置
+	if i.curKey == nil {
+		i.curKey, i.curValue = i.cursor.Last()
+		return
+	}
+	if string(i.curKey) != string(key) {
+		i.curKey, i.curValue = i.cursor.Prev()
+	}
+}
+
+// Next 移动到下一个key
+func (i *bptreeIterator) Next() {
+	if i.cursor == nil {
+		return
+	}
+	if i.reverse {
+		i.curKey, i.curValue = i.cursor.Prev()
+	} else {
+		i.curKey, i.curValue = i.cursor.Next()
+	}
+}
+
+// Valid 是否有效，即是否还有下一个key，用于退出循环
+func (i *bptreeIterator) Valid() bool {
+	return len(i.curKey) != 0
+}
+
+// Key 返回当前位置key，事务结束后原始内存不可用，因此返回拷贝
+func (i *bptreeIterator) Key() []byte {
+	return append([]byte(nil), i.curKey...)
+}
+
+// Value 返回当前位置value
+func (i *bptreeIterator) Value() *LogRecordPos {
+	return DecodeLogRecordPos(i.curValue)
+}
+
+// Close 关闭迭代器，释放只读事务，快照上的迭代器由快照负责释放
+func (i *bptreeIterator) Close() {
+	if i.tx != nil {
+		_ = i.tx.Rollback()
+	}
+}
@@ -0,0 +1,243 @@
+package kv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+func newTestBPlusTree(t *testing.T) *BPlusTreeIndex {
+	dir, _ := os.MkdirTemp("", "hifidb-bptree")
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	tree, err := NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = tree.Close()
+	})
+	return tree
+}
+
+func TestBPlusTree_Put(t *testing.T) {
+	tree := newTestBPlusTree(t)
+
+	// 首次插入应该返回 nil（没有旧值）
+	res := tree.Put([]byte("key"), &LogRecordPos{Fid: 1, Offset: 2, Size: 3})
+	assert.Nil(t, res)
+
+	// 更新已存在的 key 应该返回旧值
+	oldValue := tree.Put([]byte("key"), &LogRecordPos{Fid: 10, Offset: 20, Size: 30})
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2, Size: 3}, oldValue)
+	assert.Equal(t, 1, tree.Size())
+}
+
+func TestBPlusTree_Get(t *testing.T) {
+	tree := newTestBPlusTree(t)
+
+	tree.Put([]byte("key"), &LogRecordPos{Fid: 1, Offset: 2})
+	tree.Put([]byte("key1"), &LogRecordPos{Fid: 2, Offset: 3})
+
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2}, tree.Get([]byte("key")))
+	assert.Equal(t, &LogRecordPos{Fid: 2, Offset: 3}, tree.Get([]byte("key1")))
+	assert.Nil(t, tree.Get([]byte("key2")))
+}
+
+func TestBPlusTree_Delete(t *testing.T) {
+	tree := newTestBPlusTree(t)
+
+	tree.Put([]byte("key"), &LogRecordPos{Fid: 1, Offset: 2})
+
+	// 删除存在的 key 应该返回被删除的值和 true
+	deletedValue, ok := tree.Delete([]byte("key"))
+	assert.True(t, ok)
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2}, deletedValue)
+	assert.Nil(t, tree.Get([]byte("key")))
+
+	// 删除不存在的 key
+	deletedValue, ok = tree.Delete([]byte("nonexistent"))
+	assert.False(t, ok)
+	assert.Nil(t, deletedValue)
+	assert.Equal(t, 0, tree.Size())
+}
+
+func TestBPlusTree_Reopen(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hifidb-bptree-reopen")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	tree, err := NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	tree.Put([]byte("key"), &LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, tree.Close())
+
+	// 重新打开后索引仍然存在
+	tree2, err := NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	defer func() {
+		_ = tree2.Close()
+	}()
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2}, tree2.Get([]byte("key")))
+}
+
+func TestBPlusTree_Iterator(t *testing.T) {
+	tree := newTestBPlusTree(t)
+
+	// 1.为空的情况
+	iter1 := tree.IndexIterator(false)
+	assert.False(t, iter1.Valid())
+	iter1.Close()
+
+	tree.Put([]byte("acee"), &LogRecordPos{Fid: 1, Offset: 10})
+	tree.Put([]byte("bbcd"), &LogRecordPos{Fid: 1, Offset: 20})
+	tree.Put([]byte("ccde"), &LogRecordPos{Fid: 1, Offset: 30})
+	tree.Put([]byte("eede"), &LogRecordPos{Fid: 1, Offset: 40})
+
+	// 2.正向遍历
+	iter2 := tree.IndexIterator(false)
+	var keys []string
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+	}
+	iter2.Close()
+	assert.Equal(t, []string{"acee", "bbcd", "ccde", "eede"}, keys)
+
+	// 3.反向遍历
+	iter3 := tree.IndexIterator(true)
+	keys = nil
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	iter3.Close()
+	assert.Equal(t, []string{"eede", "ccde", "bbcd", "acee"}, keys)
+
+	// 4.正向 seek
+	iter4 := tree.IndexIterator(false)
+	iter4.Seek([]byte("cc"))
+	assert.Equal(t, "ccde", string(iter4.Key()))
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 30}, iter4.Value())
+	iter4.Close()
+
+	// 5.反向 seek
+	iter5 := tree.IndexIterator(true)
+	iter5.Seek([]byte("cc"))
+	assert.Equal(t, "bbcd", string(iter5.Key()))
+	iter5.Seek([]byte("zz"))
+	assert.Equal(t, "eede", string(iter5.Key()))
+	iter5.Seek([]byte("aa"))
+	assert.False(t, iter5.Valid())
+	iter5.Close()
+}
+
+func TestBPlusTree_Batch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hifidb-bptree-batch")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	tree, err := NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.checkpoint())
+
+	// 1.批量写入在同一个事务中，提交之前可以读到，但迭代器读不到
+	tree.begin()
+	tree.Put([]byte("key1"), &LogRecordPos{Fid: 1, Offset: 2})
+	tree.Put([]byte("key2"), &LogRecordPos{Fid: 1, Offset: 20})
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2}, tree.Get([]byte("key1")))
+	assert.Equal(t, 0, tree.Size())
+	cp := &indexCheckpoint{Fid: 1, Offset: 40, SeqNo: 3, ReclaimSize: 10}
+	assert.Nil(t, tree.commit(cp))
+	assert.Equal(t, 2, tree.Size())
+	assert.Equal(t, cp, tree.checkpoint())
+
+	// 2.写入失败时返回错误，同一批的修改全部回滚
+	tree.begin()
+	tree.Put([]byte("key3"), &LogRecordPos{Fid: 1, Offset: 40})
+	tree.Put(make([]byte, bbolt.MaxKeySize+1), &LogRecordPos{Fid: 1, Offset: 60})
+	assert.ErrorIs(t, tree.commit(&indexCheckpoint{Fid: 1, Offset: 80}), berrors.ErrKeyTooLarge)
+	assert.Nil(t, tree.Get([]byte("key3")))
+	assert.Equal(t, cp, tree.checkpoint())
+	assert.Equal(t, 2, tree.Size())
+
+	// 3.key数量随批量写入一起提交，覆盖写入不改变数量
+	tree.begin()
+	tree.Put([]byte("key1"), &LogRecordPos{Fid: 2, Offset: 2})
+	tree.Put([]byte("key3"), &LogRecordPos{Fid: 2, Offset: 20})
+	tree.Put([]byte("key4"), &LogRecordPos{Fid: 2, Offset: 40})
+	tree.Delete([]byte("key2"))
+	tree.Delete([]byte("key5"))
+	assert.Equal(t, 2, tree.Size())
+	cp = &indexCheckpoint{Fid: 2, Offset: 60, SeqNo: 3}
+	assert.Nil(t, tree.commit(cp))
+	assert.Equal(t, 3, tree.Size())
+	tree.DeleteRange([]byte("key3"), nil, func(key []byte, pos *LogRecordPos) {})
+	assert.Equal(t, 1, tree.Size())
+	snapshot := tree.Snapshot()
+	assert.Equal(t, 1, snapshot.Size())
+	assert.Nil(t, snapshot.Close())
+	tree.Put([]byte("key2"), &LogRecordPos{Fid: 2, Offset: 80})
+
+	// 4.重新打开后检查点与索引一致
+	assert.Nil(t, tree.Close())
+	tree, err = NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	assert.Equal(t, cp, tree.checkpoint())
+	assert.Equal(t, 2, tree.Size())
+
+	// 5.清空之后没有检查点
+	assert.Nil(t, tree.reset())
+	assert.Nil(t, tree.checkpoint())
+	assert.Equal(t, 0, tree.Size())
+	assert.Nil(t, tree.Close())
+}
+
+func TestBPlusTree_CorruptFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hifidb-bptree-corrupt")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	fileName := filepath.Join(dir, BPlusTreeIndexFileName)
+	assert.Nil(t, os.WriteFile(fileName, bytes.Repeat([]byte{0xff}, 8192), DataFilePerm))
+
+	// 损坏的索引文件重新创建
+	tree, err := NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.checkpoint())
+	assert.Equal(t, 0, tree.Size())
+	assert.Nil(t, tree.Close())
+}
+
+func TestBPlusTree_ClosedSnapshot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hifidb-bptree-closed")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	tree, err := NewBPlusTreeIndex(dir, false)
+	assert.Nil(t, err)
+	tree.Put([]byte("key"), &LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, tree.Close())
+
+	// 无法开启只读事务时返回空的快照与迭代器，不会panic
+	snapshot := tree.Snapshot()
+	assert.ErrorIs(t, indexError(snapshot), berrors.ErrDatabaseNotOpen)
+	assert.Nil(t, snapshot.Get([]byte("key")))
+	assert.Equal(t, 0, snapshot.Size())
+	it := snapshot.IndexIterator(false)
+	assert.ErrorIs(t, indexError(it), berrors.ErrDatabaseNotOpen)
+	it.Seek([]byte("key"))
+	assert.False(t, it.Valid())
+	it.Close()
+	assert.Nil(t, snapshot.Close())
+
+	it = tree.IndexIterator(true)
+	assert.ErrorIs(t, indexError(it), berrors.ErrDatabaseNotOpen)
+	assert.False(t, it.Valid())
+	it.Next()
+	assert.False(t, it.Valid())
+	it.Close()
+}
@@ -2,7 +2,6 @@ package kv
 
 import (
 	"bytes"
-	"sort"
 	"sync"
 
 	"github.com/google/btree"
@@ -61,18 +60,51 @@ func (b *BTreeIndex) Delete(key []byte) (*LogRecordPos, bool) {
 	return oldItem.(*Item).pos, true
 }
 
+// DeleteRange 先收集范围内的key再删除，btree 不支持遍历时修改
+func (b *BTreeIndex) DeleteRange(start, end []byte, f func(key []byte, pos *LogRecordPos)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var items []*Item
+	b.tree.AscendGreaterOrEqual(&Item{key: start}, func(bi btree.Item) bool {
+		item := bi.(*Item)
+		if !beforeEnd(item.key, end) {
+			return false
+		}
+		items = append(items, item)
+		return true
+	})
+	for _, item := range items {
+		b.tree.Delete(item)
+		f(item.key, item.pos)
+	}
+}
+
 func (b *BTreeIndex) Size() int {
 	return b.tree.Len()
 }
 
+// IndexIterator 在写时复制的克隆上迭代，迭代期间不持有索引锁，也不受之后的写入影响
 func (b *BTreeIndex) IndexIterator(reverse bool) IndexIterator {
 	if b.tree == nil {
 		return nil
 	}
-	b.lock.RLock()
-	defer b.lock.RUnlock()
+	// Clone 会修改原树的写时复制标记，需要持有写锁
+	b.lock.Lock()
+	tree := b.tree.Clone()
+	b.lock.Unlock()
+
+	return newBTreeIterator(tree, reverse)
+}
 
-	return newBTreeIterator(b.tree, reverse)
+// Snapshot 通过写时复制克隆btree，开销与数据量无关
+func (b *BTreeIndex) Snapshot() Indexer {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return &BTreeIndex{
+		tree: b.tree.Clone(),
+		lock: &sync.RWMutex{},
+	}
 }
 
 func (b *BTreeIndex) Close() error {
@@ -84,56 +116,67 @@ func (b *BTreeIndex) Close() error {
 	return nil
 }
 
-// BTree 索引迭代器
+// btreeIteratorBatchSize 迭代器每次从btree中读取的数据量
+const btreeIteratorBatchSize = 128
+
+// BTree 索引迭代器，按批次从树中读取数据，内存占用与数据量无关
 type btreeIterator struct {
-	curIndex int     // 当前遍历的下表位置
-	reverse  bool    // 是否反向遍历
-	values   []*Item // 遍历的数据
+	tree     *btree.BTree // 迭代的树，迭代期间不会被修改
+	reverse  bool         // 是否反向遍历
+	values   []*Item      // 当前批次的数据
+	curIndex int          // 当前批次中遍历的下标位置
 }
 
 func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	// TODO 内存膨胀，优化
-	var idx int
-	values := make([]*Item, tree.Len())
-
-	sf := func(item btree.Item) bool {
-		values[idx] = item.(*Item)
-		idx++
-		return true
+	it := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
+		values:  make([]*Item, 0, btreeIteratorBatchSize),
 	}
-	if reverse {
-		tree.Descend(sf)
-	} else {
-		tree.Ascend(sf)
+	it.Rewind()
+	return it
+}
+
+// load 从pivot开始读取一个批次，pivot 为空时从头读取，skipPivot 表示跳过与pivot相同的key
+func (i *btreeIterator) load(pivot *Item, skipPivot bool) {
+	i.values = i.values[:0]
+	i.curIndex = 0
+	collect := func(bi btree.Item) bool {
+		item := bi.(*Item)
+		if skipPivot && bytes.Equal(item.key, pivot.key) {
+			return true
+		}
+		i.values = append(i.values, item)
+		return len(i.values) < btreeIteratorBatchSize
 	}
-	return &btreeIterator{
-		curIndex: 0,
-		reverse:  reverse,
-		values:   values,
+	switch {
+	case pivot == nil && i.reverse:
+		i.tree.Descend(collect)
+	case pivot == nil:
+		i.tree.Ascend(collect)
+	case i.reverse:
+		i.tree.DescendLessOrEqual(pivot, collect)
+	default:
+		i.tree.AscendGreaterOrEqual(pivot, collect)
 	}
 }
 
 // Rewind 回到起始位置
 func (i *btreeIterator) Rewind() {
-	i.curIndex = 0
+	i.load(nil, false)
 }
 
-// Seek 移动第一个大于等于key的位置
+// Seek 移动第一个大于等于key的位置，逆序时为第一个小于等于key的位置
 func (i *btreeIterator) Seek(key []byte) {
-	if i.reverse {
-		i.curIndex = sort.Search(len(i.values), func(idx int) bool {
-			return bytes.Compare(i.values[idx].key, key) <= 0
-		})
-	} else {
-		i.curIndex = sort.Search(len(i.values), func(idx int) bool {
-			return bytes.Compare(i.values[idx].key, key) >= 0
-		})
-	}
+	i.load(&Item{key: key}, false)
 }
 
-// Next 移动到下一个key
+// Next 移动到下一个key，当前批次读完后从最后一个key之后继续读取
 func (i *btreeIterator) Next() {
 	i.curIndex++
+	if i.curIndex == len(i.values) && len(i.values) == btreeIteratorBatchSize {
+		i.load(i.values[len(i.values)-1], true)
+	}
 }
 
 // Valid 是否有效，即是否还有下一个key，用于退出循环
@@ -154,4 +197,5 @@ func (i *btreeIterator) Value() *LogRecordPos {
 // Close 关闭迭代器
 func (i *btreeIterator) Close() {
 	i.values = nil
+	i.curIndex = 0
 }
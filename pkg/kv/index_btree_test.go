@@ -126,3 +126,39 @@ func TestBTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+func TestBTree_IteratorConsistency(t *testing.T) {
+	bt := NewBTreeIndex()
+	for i := range 1000 {
+		bt.Put(GetTestKey(i), &LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 迭代器创建之后的写入不影响迭代结果
+	iter := bt.IndexIterator(false)
+	defer iter.Close()
+	for i := range 1000 {
+		if i%2 == 0 {
+			bt.Delete(GetTestKey(i))
+		} else {
+			bt.Put(GetTestKey(i), &LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+	}
+	bt.Put(GetTestKey(5000), &LogRecordPos{Fid: 2})
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, GetTestKey(count), iter.Key())
+		assert.Equal(t, uint32(1), iter.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	// 跨越批次的逆序 seek
+	rev := bt.IndexIterator(true)
+	defer rev.Close()
+	count = 0
+	for rev.Seek(GetTestKey(3000)); rev.Valid(); rev.Next() {
+		count++
+	}
+	assert.Equal(t, 500, count)
+}
@@ -0,0 +1,241 @@
+package kv
+
+import (
+	"sync"
+
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+)
+
+// RadixTreeIndex 基数树索引，基于 hashicorp/go-immutable-radix
+// 使用支持写时复制的基数树，快照只引用当前的根节点，之后的写入复制修改路径上的节点，
+// 快照存在期间不会累积额外的写入记录；没有快照时写入直接修改本次事务创建的节点
+type RadixTreeIndex struct {
+	txn   *iradix.Txn[*LogRecordPos]
+	root  *iradix.Node[*LogRecordPos] // 最近一次快照引用的根节点，之后没有写入时快照可以复用
+	dirty bool                        // 最近一次快照之后是否有写入
+	size  int
+	lock  *sync.RWMutex
+}
+
+// ArTree 与 RadixTreeIndex 相同，保留用于兼容
+//
+// Deprecated: 使用 RadixTreeIndex
+type ArTree = RadixTreeIndex
+
+// NewArTree 创建基数树索引，保留用于兼容
+//
+// Deprecated: 使用 NewRadixTreeIndex
+func NewArTree() *RadixTreeIndex {
+	return NewRadixTreeIndex()
+}
+
+func NewRadixTreeIndex() *RadixTreeIndex {
+	return &RadixTreeIndex{
+		txn:   iradix.New[*LogRecordPos]().Txn(),
+		dirty: true,
+		lock:  &sync.RWMutex{},
+	}
+}
+
+// Put 添加key-value，返回是否添加成功
+func (a *RadixTreeIndex) Put(key []byte, value *LogRecordPos) *LogRecordPos {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	oldValue, updated := a.txn.Insert(key, value)
+	a.dirty = true
+	if !updated {
+		a.size++
+	}
+	return oldValue
+}
+
+// Get 获取key对应的value
+func (a *RadixTreeIndex) Get(key []byte) *LogRecordPos {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	value, _ := a.txn.Get(key)
+	return value
+}
+
+// Delete 删除key，返回是否删除成功
+func (a *RadixTreeIndex) Delete(key []byte) (*LogRecordPos, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	oldValue, deleted := a.txn.Delete(key)
+	if !deleted {
+		return nil, false
+	}
+	a.dirty = true
+	a.size--
+	return oldValue, true
+}
+
+// DeleteRange 删除范围内的key，从起始key开始有序遍历
+func (a *RadixTreeIndex) DeleteRange(start, end []byte, f func(key []byte, pos *LogRecordPos)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var items []*Item
+	it := newRadixTreeIterator(a.txn.Root(), false)
+	for it.Seek(start); it.Valid() && beforeEnd(it.Key(), end); it.Next() {
+		items = append(items, &Item{key: it.Key(), pos: it.Value()})
+	}
+	it.Close()
+	for _, item := range items {
+		a.txn.Delete(item.key)
+		a.dirty = true
+		a.size--
+		f(item.key, item.pos)
+	}
+}
+
+// Size 获取索引大小
+func (a *RadixTreeIndex) Size() int {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.size
+}
+
+// IndexIterator 获取迭代器，迭代器引用当前的快照
+func (a *RadixTreeIndex) IndexIterator(reverse bool) IndexIterator {
+	snapshot := a.Snapshot().(*radixTreeSnapshot)
+	return newRadixTreeIterator(snapshot.root, reverse)
+}
+
+// Snapshot 提交当前的写入并引用根节点，开销与数据量无关
+func (a *RadixTreeIndex) Snapshot() Indexer {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// 提交之后事务不再原地修改已有的节点
+	if a.dirty {
+		a.root = a.txn.CommitOnly().Root()
+		a.dirty = false
+	}
+	return &radixTreeSnapshot{root: a.root, size: a.size}
+}
+
+// Close 关闭索引，已经获取的快照仍然可以读取
+func (a *RadixTreeIndex) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.txn = nil
+	a.root = nil
+	return nil
+}
+
+// radixTreeSnapshot 基数树的只读快照，引用的节点不会再被修改
+type radixTreeSnapshot struct {
+	root *iradix.Node[*LogRecordPos]
+	size int
+}
+
+func (s *radixTreeSnapshot) Put(key []byte, value *LogRecordPos) *LogRecordPos {
+	panic("radix tree snapshot is read only")
+}
+
+func (s *radixTreeSnapshot) Get(key []byte) *LogRecordPos {
+	value, _ := s.root.Get(key)
+	return value
+}
+
+func (s *radixTreeSnapshot) Delete(key []byte) (*LogRecordPos, bool) {
+	panic("radix tree snapshot is read only")
+}
+
+func (s *radixTreeSnapshot) DeleteRange(start, end []byte, f func(key []byte, pos *LogRecordPos)) {
+	panic("radix tree snapshot is read only")
+}
+
+func (s *radixTreeSnapshot) Size() int {
+	return s.size
+}
+
+func (s *radixTreeSnapshot) IndexIterator(reverse bool) IndexIterator {
+	return newRadixTreeIterator(s.root, reverse)
+}
+
+func (s *radixTreeSnapshot) Snapshot() Indexer {
+	panic("radix tree snapshot can not be nested")
+}
+
+func (s *radixTreeSnapshot) Close() error {
+	return nil
+}
+
+// 基数树索引迭代器，在快照的根节点上逐个读取
+type radixTreeIterator struct {
+	root    *iradix.Node[*LogRecordPos]
+	forward *iradix.Iterator[*LogRecordPos]
+	back    *iradix.ReverseIterator[*LogRecordPos]
+	reverse bool // 是否反向遍历
+	key     []byte
+	pos     *LogRecordPos
+}
+
+func newRadixTreeIterator(root *iradix.Node[*LogRecordPos], reverse bool) *radixTreeIterator {
+	it := &radixTreeIterator{
+		root:    root,
+		reverse: reverse,
+	}
+	it.Rewind()
+	return it
+}
+
+// Rewind 回到起始位置
+func (i *radixTreeIterator) Rewind() {
+	if i.reverse {
+		i.back = i.root.ReverseIterator()
+	} else {
+		i.forward = i.root.Iterator()
+	}
+	i.Next()
+}
+
+// Seek 移动第一个大于等于key的位置，逆序时为第一个小于等于key的位置
+// 从根节点沿着key的路径定位，不需要遍历之前的key
+func (i *radixTreeIterator) Seek(key []byte) {
+	if i.reverse {
+		i.back = i.root.ReverseIterator()
+		i.back.SeekReverseLowerBound(key)
+	} else {
+		i.forward = i.root.Iterator()
+		i.forward.SeekLowerBound(key)
+	}
+	i.Next()
+}
+
+// Next 移动到下一个key
+func (i *radixTreeIterator) Next() {
+	var ok bool
+	if i.reverse {
+		i.key, i.pos, ok = i.back.Previous()
+	} else {
+		i.key, i.pos, ok = i.forward.Next()
+	}
+	if !ok {
+		i.key, i.pos = nil, nil
+	}
+}
+
+// Valid 是否有效，即是否还有下一个key，用于退出循环
+func (i *radixTreeIterator) Valid() bool {
+	return i.key != nil
+}
+
+// Key 返回当前位置key
+func (i *radixTreeIterator) Key() []byte {
+	return i.key
+}
+
+// Value 返回当前位置value
+func (i *radixTreeIterator) Value() *LogRecordPos {
+	return i.pos
+}
+
+// Close 关闭迭代器
+func (i *radixTreeIterator) Close() {
+	i.forward, i.back, i.key, i.pos = nil, nil, nil, nil
+}
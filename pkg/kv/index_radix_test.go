@@ -6,8 +6,8 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestArTree_Put(t *testing.T) {
-	art := NewArTree()
+func TestRadixTree_Put(t *testing.T) {
+	art := NewRadixTreeIndex()
 
 	// 首次插入应该返回 nil（没有旧值）
 	res1 := art.Put([]byte("a"), &LogRecordPos{Fid: 1, Offset: 2})
@@ -24,8 +24,8 @@ func TestArTree_Put(t *testing.T) {
 	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2}, oldValue)
 }
 
-func TestArTree_Put_RepeatKey(t *testing.T) {
-	art := NewArTree()
+func TestRadixTree_Put_RepeatKey(t *testing.T) {
+	art := NewRadixTreeIndex()
 
 	// 首次插入
 	res1 := art.Put([]byte("key"), &LogRecordPos{Fid: 1, Offset: 100})
@@ -44,8 +44,8 @@ func TestArTree_Put_RepeatKey(t *testing.T) {
 	assert.Equal(t, &LogRecordPos{Fid: 3, Offset: 300}, finalValue)
 }
 
-func TestArTree_Get(t *testing.T) {
-	art := NewArTree()
+func TestRadixTree_Get(t *testing.T) {
+	art := NewRadixTreeIndex()
 
 	art.Put([]byte("a"), &LogRecordPos{Fid: 1, Offset: 2})
 	art.Put([]byte("b"), &LogRecordPos{Fid: 2, Offset: 3})
@@ -64,8 +64,8 @@ func TestArTree_Get(t *testing.T) {
 	assert.Nil(t, pos4)
 }
 
-func TestArTree_Delete(t *testing.T) {
-	art := NewArTree()
+func TestRadixTree_Delete(t *testing.T) {
+	art := NewRadixTreeIndex()
 
 	art.Put([]byte("a"), &LogRecordPos{Fid: 1, Offset: 2})
 	art.Put([]byte("b"), &LogRecordPos{Fid: 2, Offset: 3})
@@ -89,8 +89,8 @@ func TestArTree_Delete(t *testing.T) {
 	assert.Nil(t, deletedValue3)
 }
 
-func TestArTree_Size(t *testing.T) {
-	art := NewArTree()
+func TestRadixTree_Size(t *testing.T) {
+	art := NewRadixTreeIndex()
 
 	assert.Equal(t, 0, art.Size())
 
@@ -104,8 +104,8 @@ func TestArTree_Size(t *testing.T) {
 	assert.Equal(t, 1, art.Size())
 }
 
-func TestArTree_Iterator(t *testing.T) {
-	art := NewArTree()
+func TestRadixTree_Iterator(t *testing.T) {
+	art := NewRadixTreeIndex()
 
 	art.Put([]byte("a"), &LogRecordPos{Fid: 1, Offset: 2})
 	art.Put([]byte("b"), &LogRecordPos{Fid: 2, Offset: 3})
@@ -141,3 +141,96 @@ func TestArTree_Iterator(t *testing.T) {
 	assert.False(t, revIter.Valid())
 	revIter.Close()
 }
+
+func TestRadixTree_IteratorConsistency(t *testing.T) {
+	art := NewRadixTreeIndex()
+	for i := range 1000 {
+		art.Put(GetTestKey(i), &LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 迭代器存在期间的写入记录在写入记录中，不影响迭代结果
+	iter := art.IndexIterator(false)
+	for i := range 1000 {
+		if i%2 == 0 {
+			art.Delete(GetTestKey(i))
+		} else {
+			art.Put(GetTestKey(i), &LogRecordPos{Fid: 2, Offset: int64(i)})
+		}
+	}
+	art.Put(GetTestKey(5000), &LogRecordPos{Fid: 2})
+	assert.Equal(t, 501, art.Size())
+	assert.Nil(t, art.Get(GetTestKey(0)))
+	assert.Equal(t, uint32(2), art.Get(GetTestKey(1)).Fid)
+
+	// 第二个迭代器看到的是两次写入之后的数据
+	iter2 := art.IndexIterator(true)
+	var keys [][]byte
+	for iter2.Seek(GetTestKey(10)); iter2.Valid(); iter2.Next() {
+		keys = append(keys, iter2.Key())
+		assert.Equal(t, uint32(2), iter2.Value().Fid)
+	}
+	assert.Equal(t, [][]byte{GetTestKey(9), GetTestKey(7), GetTestKey(5), GetTestKey(3), GetTestKey(1)}, keys)
+	iter2.Close()
+
+	var count int
+	for iter.Seek(GetTestKey(500)); iter.Valid(); iter.Next() {
+		assert.Equal(t, GetTestKey(500+count), iter.Key())
+		assert.Equal(t, uint32(1), iter.Value().Fid)
+		count++
+	}
+	assert.Equal(t, 500, count)
+	iter.Close()
+
+	// 快照之后的写入复制修改的节点，不会累积写入记录
+	assert.Equal(t, 501, art.Size())
+	assert.Nil(t, art.Get(GetTestKey(2)))
+	assert.Equal(t, uint32(2), art.Get(GetTestKey(5000)).Fid)
+
+	// 快照长期存在时不影响写入
+	snapshot := art.Snapshot()
+	for i := range 1000 {
+		art.Put(GetTestKey(i), &LogRecordPos{Fid: 3, Offset: int64(i)})
+	}
+	assert.Equal(t, 1001, art.Size())
+	assert.Equal(t, 501, snapshot.Size())
+	assert.Nil(t, snapshot.Get(GetTestKey(0)))
+	assert.Equal(t, uint32(3), art.Get(GetTestKey(0)).Fid)
+	assert.Nil(t, snapshot.Close())
+}
+
+func TestRadixTree_Seek(t *testing.T) {
+	art := NewRadixTreeIndex()
+	bt := NewBTreeIndex()
+	// 包含互为前缀的key
+	keys := [][]byte{[]byte("a"), []byte("ab"), []byte("abc"), []byte("abd"), []byte("b"), []byte("ba"), []byte("c")}
+	for i := range 200 {
+		keys = append(keys, RandomValue(i%5+1))
+	}
+	for i, key := range keys {
+		art.Put(key, &LogRecordPos{Fid: 1, Offset: int64(i)})
+		bt.Put(key, &LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 与btree索引的定位结果一致
+	targets := append(keys, []byte(""), []byte("aa"), []byte("abcd"), []byte("bb"), []byte("zzzzzzzz"))
+	for _, reverse := range []bool{false, true} {
+		it1 := art.IndexIterator(reverse)
+		it2 := bt.IndexIterator(reverse)
+		for _, target := range targets {
+			it1.Seek(target)
+			it2.Seek(target)
+			for range 3 {
+				assert.Equal(t, it2.Valid(), it1.Valid())
+				if !it2.Valid() {
+					break
+				}
+				assert.Equal(t, it2.Key(), it1.Key())
+				assert.Equal(t, it2.Value(), it1.Value())
+				it1.Next()
+				it2.Next()
+			}
+		}
+		it1.Close()
+		it2.Close()
+	}
+}
@@ -43,3 +43,7 @@ func (f *FileIO) Size() (int64, error) {
 	}
 	return fi.Size(), nil
 }
+
+func (f *FileIO) Truncate(size int64) error {
+	return f.fd.Truncate(size)
+}
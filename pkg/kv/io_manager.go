@@ -17,6 +17,19 @@ type IOManager interface {
 	Close() error
 
 	Size() (int64, error)
+
+	// Truncate 截断到指定大小，之后从该位置继续写入
+	Truncate(int64) error
+}
+
+// sealer 预分配空间的IO管理器，写满之后截断到实际大小并转为只读
+type sealer interface {
+	Seal() error
+}
+
+// mappedReader 可以直接返回映射内存的IO管理器，返回的数据在关闭之前有效，不能修改
+type mappedReader interface {
+	Slice(off int64, n int64) ([]byte, error)
 }
 
 func NewIOManager(indexType IOType, fileName string) (IOManager, error) {
@@ -28,3 +41,14 @@ func NewIOManager(indexType IOType, fileName string) (IOManager, error) {
 	}
 	return nil, fmt.Errorf("unsupported IO type: %d", indexType)
 }
+
+// NewWritableIOManager 创建活跃文件的IO管理器，IO_MMAP 时预分配 preallocSize 大小的空间并通过映射写入
+func NewWritableIOManager(ioType IOType, fileName string, preallocSize int64) (IOManager, error) {
+	switch ioType {
+	case IO_FILE:
+		return NewFileIOManager(fileName)
+	case IO_MMAP:
+		return NewWritableMMapIOManager(fileName, preallocSize)
+	}
+	return nil, fmt.Errorf("unsupported IO type: %d", ioType)
+}
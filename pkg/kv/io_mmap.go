@@ -1,39 +1,241 @@
+//go:build !windows
+
 package kv
 
 import (
-	"golang.org/x/exp/mmap"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"golang.org/x/sys/unix"
 )
 
+// MMapIO 内存映射IO
+// 只读打开时映射文件的全部内容，读取时可以直接返回映射的内存；
+// 可写打开时预分配空间并映射，写入直接拷贝到映射的内存中，文件末尾未写入的部分全部为0，
+// 关闭或写满之后截断到实际写入的大小
 type MMapIO struct {
-	mmap *mmap.ReaderAt
+	fd       *os.File
+	lock     *sync.RWMutex
+	data     []byte       // 当前的映射，长度为映射的大小
+	mappings [][]byte     // 扩容之前的映射，返回的数据可能仍在引用，关闭时才释放
+	size     atomic.Int64 // 已写入的数据大小
+	synced   int64        // 已同步到磁盘的位置
+	prealloc int64        // 每次扩容预分配的大小
+	writable bool
 }
 
+// NewMMapIOManager 只读映射已经存在的文件
 func NewMMapIOManager(fileName string) (*MMapIO, error) {
-	mmapReader, err := mmap.Open(fileName)
+	fd, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
-	return &MMapIO{
-		mmap: mmapReader,
-	}, nil
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	f := &MMapIO{fd: fd, lock: &sync.RWMutex{}}
+	if fi.Size() > 0 {
+		if f.data, err = unix.Mmap(int(fd.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED); err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	f.size.Store(fi.Size())
+	return f, nil
+}
+
+// NewWritableMMapIOManager 打开用于追加写入的文件，预分配 preallocSize 大小的空间
+// 文件中已有的数据都是有效的，之后的写入从文件末尾开始
+func NewWritableMMapIOManager(fileName string, preallocSize int64) (*MMapIO, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	f := &MMapIO{
+		fd:       fd,
+		lock:     &sync.RWMutex{},
+		synced:   fi.Size(),
+		prealloc: max(preallocSize, int64(unix.Getpagesize())),
+		writable: true,
+	}
+	f.size.Store(fi.Size())
+	if err := f.remap(max(fi.Size(), f.prealloc)); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
 func (f *MMapIO) Read(p []byte, off int64) (int, error) {
-	return f.mmap.ReadAt(p, off)
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	size := f.size.Load()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:size])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Slice 返回映射中的数据，不拷贝
+func (f *MMapIO) Slice(off int64, n int64) ([]byte, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if off < 0 || n < 0 || off+n > f.size.Load() {
+		return nil, io.EOF
+	}
+	return f.data[off : off+n : off+n], nil
 }
 
 func (f *MMapIO) Write(p []byte) (int, error) {
-	panic("not implemented")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.writable {
+		return 0, errs.ErrFileIsReadOnly
+	}
+	size := f.size.Load()
+	need := size + int64(len(p))
+	if need > int64(len(f.data)) {
+		if err := f.remap(max(need, int64(len(f.data))+f.prealloc)); err != nil {
+			return 0, err
+		}
+	}
+	copy(f.data[size:], p)
+	f.size.Store(need)
+	return len(p), nil
 }
 
 func (f *MMapIO) Sync() error {
-	panic("not implemented")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.msync()
+}
+
+// Seal 同步数据并截断到实际写入的大小，之后只读
+func (f *MMapIO) Seal() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.writable {
+		return nil
+	}
+	if err := f.msync(); err != nil {
+		return err
+	}
+	if err := f.fd.Truncate(f.size.Load()); err != nil {
+		return err
+	}
+	f.writable = false
+	return f.fd.Sync()
+}
+
+// Truncate 截断之后的数据重新置为0，与预分配的空间一致
+func (f *MMapIO) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.writable {
+		return errs.ErrFileIsReadOnly
+	}
+	if size > int64(len(f.data)) {
+		if err := f.remap(size); err != nil {
+			return err
+		}
+	}
+	if cur := f.size.Load(); size < cur {
+		clear(f.data[size:cur])
+	}
+	f.size.Store(size)
+	f.synced = min(f.synced, size)
+	return nil
 }
 
 func (f *MMapIO) Close() error {
-	return f.mmap.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.fd == nil {
+		return nil
+	}
+	var err error
+	if f.writable {
+		err = f.msync()
+	}
+	for _, data := range append(f.mappings, f.data) {
+		if data == nil {
+			continue
+		}
+		if e := unix.Munmap(data); e != nil && err == nil {
+			err = e
+		}
+	}
+	f.data, f.mappings = nil, nil
+	// 预分配的空间没有写满，截断到实际的大小
+	if f.writable {
+		if e := f.fd.Truncate(f.size.Load()); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := f.fd.Close(); e != nil && err == nil {
+		err = e
+	}
+	f.fd = nil
+	return err
 }
 
 func (f *MMapIO) Size() (int64, error) {
-	return int64(f.mmap.Len()), nil
+	return f.size.Load(), nil
+}
+
+// remap 扩容文件并重新映射，调用方需持有写锁
+func (f *MMapIO) remap(capacity int64) error {
+	if err := preallocate(f.fd, capacity); err != nil {
+		return err
+	}
+	data, err := unix.Mmap(int(f.fd.Fd()), 0, int(capacity), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if f.data != nil {
+		f.mappings = append(f.mappings, f.data)
+	}
+	f.data = data
+	return nil
+}
+
+// msync 同步上次同步之后写入的数据，调用方需持有写锁
+func (f *MMapIO) msync() error {
+	size := f.size.Load()
+	if f.synced >= size {
+		return nil
+	}
+	// msync 的起始地址需要按页对齐
+	start := f.synced &^ int64(unix.Getpagesize()-1)
+	if err := unix.Msync(f.data[start:size], unix.MS_SYNC); err != nil {
+		return err
+	}
+	f.synced = size
+	return nil
+}
+
+// extendFile 文件小于size时扩展到size
+func extendFile(fd *os.File, size int64) error {
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= size {
+		return nil
+	}
+	return fd.Truncate(size)
 }
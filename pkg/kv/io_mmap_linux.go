@@ -0,0 +1,17 @@
+package kv
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate 为文件分配磁盘空间，扩展之后的部分全部为0
+// 文件系统不支持 fallocate 时退化为扩展文件大小
+func preallocate(fd *os.File, size int64) error {
+	err := unix.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return extendFile(fd, size)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !windows && !linux
+
+package kv
+
+import "os"
+
+// preallocate 扩展文件大小，扩展之后的部分全部为0
+func preallocate(fd *os.File, size int64) error {
+	return extendFile(fd, size)
+}
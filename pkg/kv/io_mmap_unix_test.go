@@ -0,0 +1,77 @@
+//go:build !windows
+
+package kv
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIOMmap_Write(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-write")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	fileName := filepath.Join(dir, "0001.data")
+
+	mio, err := NewWritableMMapIOManager(fileName, 4096)
+	assert.NoError(t, err)
+	_, err = mio.Write([]byte("key-a"))
+	assert.NoError(t, err)
+	_, err = mio.Write([]byte("value-b"))
+	assert.NoError(t, err)
+	size, _ := mio.Size()
+	assert.Equal(t, int64(12), size)
+	// 文件预分配了空间
+	fi, _ := os.Stat(fileName)
+	assert.Equal(t, int64(4096), fi.Size())
+
+	buf := make([]byte, 5)
+	_, err = mio.Read(buf, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), buf)
+	// 超过写入的大小
+	n, err := mio.Read(buf, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, n)
+	b, err := mio.Slice(0, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+
+	// 超过预分配的大小时扩容，之前返回的数据仍然有效
+	big := RandomValue(10000)
+	_, err = mio.Write(big)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	assert.NoError(t, mio.Sync())
+
+	// 截断之后从截断的位置继续写入
+	assert.NoError(t, mio.Truncate(12))
+	_, err = mio.Write([]byte("-c"))
+	assert.NoError(t, err)
+	assert.NoError(t, mio.Close())
+
+	data, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key-avalue-b-c"), data)
+
+	// 重新打开之后追加写入，写满之后截断并转为只读
+	mio, err = NewWritableMMapIOManager(fileName, 4096)
+	assert.NoError(t, err)
+	_, err = mio.Write([]byte("-d"))
+	assert.NoError(t, err)
+	assert.NoError(t, mio.Seal())
+	fi, _ = os.Stat(fileName)
+	assert.Equal(t, int64(16), fi.Size())
+	_, err = mio.Write([]byte("-e"))
+	assert.Equal(t, errs.ErrFileIsReadOnly, err)
+	b, err = mio.Slice(12, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("-c-d"), b)
+	assert.NoError(t, mio.Close())
+}
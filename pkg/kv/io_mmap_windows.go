@@ -0,0 +1,52 @@
+//go:build windows
+
+package kv
+
+import (
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"golang.org/x/exp/mmap"
+)
+
+// MMapIO 只读的内存映射IO，windows 上活跃文件使用文件IO写入
+type MMapIO struct {
+	mmap *mmap.ReaderAt
+}
+
+func NewMMapIOManager(fileName string) (*MMapIO, error) {
+	mmapReader, err := mmap.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &MMapIO{
+		mmap: mmapReader,
+	}, nil
+}
+
+// NewWritableMMapIOManager windows 上不支持通过映射写入，使用文件IO
+func NewWritableMMapIOManager(fileName string, _ int64) (*FileIO, error) {
+	return NewFileIOManager(fileName)
+}
+
+func (f *MMapIO) Read(p []byte, off int64) (int, error) {
+	return f.mmap.ReadAt(p, off)
+}
+
+func (f *MMapIO) Write(p []byte) (int, error) {
+	return 0, errs.ErrFileIsReadOnly
+}
+
+func (f *MMapIO) Sync() error {
+	return nil
+}
+
+func (f *MMapIO) Truncate(int64) error {
+	return errs.ErrFileIsReadOnly
+}
+
+func (f *MMapIO) Close() error {
+	return f.mmap.Close()
+}
+
+func (f *MMapIO) Size() (int64, error) {
+	return int64(f.mmap.Len()), nil
+}
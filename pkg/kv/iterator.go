@@ -8,40 +8,47 @@ import (
 
 type Iterator struct {
 	indexIter IndexIterator
-	db        *DB
 	options   *IteratorOptions
+	getValue  func(pos *LogRecordPos) ([]byte, error)
+	now       int64     // 判断过期使用的时间
+	snapshot  *Snapshot // 迭代器独占的快照，关闭迭代器时释放
+	lower     []byte    // 由前缀与下界得到的遍历范围，包含
+	upper     []byte    // 由前缀与上界得到的遍历范围，不包含
+	count     int       // 已遍历的key数量
+	exhausted bool      // 是否已越过遍历范围
+	err       error     // 获取索引快照时的错误，此时迭代器没有任何key
 }
 
-// NewIterator 创建迭代器
+// NewIterator 创建迭代器，迭代器基于创建时的快照，不受之后的写入与merge影响
 func (db *DB) NewIterator(opts *IteratorOptions) *Iterator {
-	indexIter := db.index.IndexIterator(opts.Reverse)
-	return &Iterator{
-		indexIter: indexIter,
-		db:        db,
-		options:   opts,
-	}
+	snapshot := db.NewSnapshot()
+	it := snapshot.NewIterator(opts)
+	it.snapshot = snapshot
+	return it
 }
 
-// Rewind 回到起始位置
+// Rewind 回到起始位置，直接定位到范围内的第一个key
 func (it *Iterator) Rewind() {
-	it.indexIter.Rewind()
-	it.skipToNext()
+	it.seek(nil)
 }
 
-// Seek 移动第一个大于等于key的位置
+// Seek 移动第一个大于等于key的位置，逆序时为第一个小于等于key的位置，key 超出遍历范围时移动到范围的起点
 func (it *Iterator) Seek(key []byte) {
-	it.indexIter.Seek(key)
-	it.skipToNext()
+	it.seek(key)
 }
 
 // Next 移动到下一个key
 func (it *Iterator) Next() {
+	it.count++
 	it.indexIter.Next()
 	it.skipToNext()
 }
 
 // Valid 是否有效，即是否还有下一个key，用于退出循环
 func (it *Iterator) Valid() bool {
+	if it.exhausted || (it.options.Limit > 0 && it.count >= it.options.Limit) {
+		return false
+	}
 	return it.indexIter.Valid()
 }
 
@@ -52,33 +59,100 @@ func (it *Iterator) Key() []byte {
 
 // Value 获取当前key对应的value
 func (it *Iterator) Value() ([]byte, error) {
-
+	if it.options.KeysOnly {
+		return nil, errs.ErrIteratorKeysOnly
+	}
 	logRecordPos := it.indexIter.Value()
 	if logRecordPos == nil {
 		return nil, errs.ErrKeyNotFound
 	}
+	return it.getValue(logRecordPos)
+}
 
-	it.db.lock.RLock()
-	defer it.db.lock.RUnlock()
-
-	return it.db.getValueByPosition(logRecordPos)
+// Err 返回迭代器创建时的错误，Valid 返回 false 后用于区分遍历结束与出错
+func (it *Iterator) Err() error {
+	return it.err
 }
 
 // Close 关闭迭代器
 func (it *Iterator) Close() {
 	it.indexIter.Close()
+	if it.snapshot != nil {
+		it.snapshot.Release()
+	}
 }
 
-// skipToNext 跳过不符合条件的key
-func (it *Iterator) skipToNext() {
-	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
+// seek 定位到遍历范围内的起始位置，key 为空时从范围的起点开始
+func (it *Iterator) seek(key []byte) {
+	it.count = 0
+	it.exhausted = false
+	if !it.options.Reverse {
+		if it.lower != nil && (key == nil || bytes.Compare(key, it.lower) < 0) {
+			key = it.lower
+		}
+		if key == nil {
+			it.indexIter.Rewind()
+		} else {
+			it.indexIter.Seek(key)
+		}
+		it.skipToNext()
 		return
 	}
+
+	// 逆序时从上界之前的第一个key开始，上界不包含在范围内
+	switch {
+	case it.upper != nil && (key == nil || bytes.Compare(key, it.upper) >= 0):
+		it.indexIter.Seek(it.upper)
+		if it.indexIter.Valid() && bytes.Equal(it.indexIter.Key(), it.upper) {
+			it.indexIter.Next()
+		}
+	case key == nil:
+		it.indexIter.Rewind()
+	default:
+		it.indexIter.Seek(key)
+	}
+	it.skipToNext()
+}
+
+// skipToNext 跳过已过期的key，越过遍历范围时结束遍历
+func (it *Iterator) skipToNext() {
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
-		key := it.indexIter.Key()
-		if bytes.HasPrefix(key, it.options.Prefix) {
-			break
+		if it.pastEnd(it.indexIter.Key()) {
+			it.exhausted = true
+			return
+		}
+		if it.indexIter.Value().IsExpired(it.now) {
+			continue
+		}
+		break
+	}
+}
+
+// pastEnd 判断key是否已越过遍历方向上的范围终点
+func (it *Iterator) pastEnd(key []byte) bool {
+	if it.options.Reverse {
+		return it.lower != nil && bytes.Compare(key, it.lower) < 0
+	}
+	return it.upper != nil && bytes.Compare(key, it.upper) >= 0
+}
+
+// iteratorBounds 合并前缀与上下界，得到遍历的范围
+func iteratorBounds(opts *IteratorOptions) ([]byte, []byte) {
+	lower, upper := opts.LowerBound, opts.UpperBound
+	if len(lower) == 0 {
+		lower = nil
+	}
+	if len(upper) == 0 {
+		upper = nil
+	}
+	if len(opts.Prefix) > 0 {
+		if lower == nil || bytes.Compare(lower, opts.Prefix) < 0 {
+			lower = opts.Prefix
+		}
+		// 前缀全部为0xff时没有结束位置
+		if end := prefixEnd(opts.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
 		}
 	}
+	return lower, upper
 }
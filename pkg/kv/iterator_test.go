@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/kamijoucen/hifidb/pkg/errs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -98,3 +99,54 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 	}
 	iter3.Close()
 }
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, RadixTree, BPlusTree} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+		opts.DirPath = dir
+		opts.MemoryIndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for _, key := range []string{"a", "b/1", "b/2", "b/3", "c", "d"} {
+			assert.Nil(t, db.Put([]byte(key), []byte(key)))
+		}
+		keys := func(iterOpts *IteratorOptions) []string {
+			it := db.NewIterator(iterOpts)
+			defer it.Close()
+			var keys []string
+			for ; it.Valid(); it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			return keys
+		}
+
+		// 上下界与前缀
+		assert.Equal(t, []string{"b/1", "b/2", "b/3", "c"}, keys(&IteratorOptions{LowerBound: []byte("b"), UpperBound: []byte("d")}))
+		assert.Equal(t, []string{"c", "b/3", "b/2", "b/1"}, keys(&IteratorOptions{LowerBound: []byte("b"), UpperBound: []byte("d"), Reverse: true}))
+		assert.Equal(t, []string{"b/3", "b/2", "b/1"}, keys(&IteratorOptions{Prefix: []byte("b/"), Reverse: true}))
+		assert.Equal(t, []string{"b/2", "b/3"}, keys(&IteratorOptions{Prefix: []byte("b/"), LowerBound: []byte("b/2")}))
+		assert.Equal(t, []string{"b/1"}, keys(&IteratorOptions{Prefix: []byte("b/"), UpperBound: []byte("b/2"), Reverse: true}))
+		assert.Nil(t, keys(&IteratorOptions{Prefix: []byte("x")}))
+
+		// 分页
+		assert.Equal(t, []string{"a", "b/1"}, keys(&IteratorOptions{Limit: 2}))
+		assert.Equal(t, []string{"b/2", "b/3"}, keys(&IteratorOptions{LowerBound: []byte("b/2"), Limit: 2}))
+		assert.Equal(t, []string{"d", "c"}, keys(&IteratorOptions{Reverse: true, Limit: 2}))
+
+		// Seek 不会越过范围
+		it := db.NewIterator(&IteratorOptions{Prefix: []byte("b/"), Reverse: true, KeysOnly: true})
+		it.Seek([]byte("z"))
+		assert.Equal(t, []byte("b/3"), it.Key())
+		_, err = it.Value()
+		assert.Equal(t, errs.ErrIteratorKeysOnly, err)
+		it.Seek([]byte("b/15"))
+		assert.Equal(t, []byte("b/1"), it.Key())
+		it.Next()
+		assert.False(t, it.Valid())
+		it.Close()
+
+		destroyDB(db)
+	}
+}
@@ -11,19 +11,41 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	// LogRecordRangeDeleted 范围删除，key 为起始key，value 为结束key（不包含），value 为空时不限制结束位置
+	LogRecordRangeDeleted
 )
 
 const (
-	// crc + type + keySize + valueSize
-	// 4 + 1 + n + n
-	maxLogRecordHeaderSize int64 = 4 + 1 + binary.MaxVarintLen32*2
+	// crc + type + keySize + valueSize + expire + family + keyId
+	// 4 + 1 + n + n + n + n + n
+	maxLogRecordHeaderSize int64 = 4 + 1 + binary.MaxVarintLen32*3 + binary.MaxVarintLen64*2
+)
+
+// type 字节的低位存储记录类型，高位作为头部的扩展标识
+const (
+	logRecordTypeMask byte = 0x07
+
+	// logRecordFlagEncrypted 记录已加密，头部携带密钥编号
+	logRecordFlagEncrypted byte = 1 << 3
+
+	// logRecordFlagExpire 头部携带过期时间
+	logRecordFlagExpire byte = 1 << 7
+
+	// logRecordCodecMask value 的压缩算法，为0时value未压缩
+	logRecordCodecMask  byte = 0x30
+	logRecordCodecShift      = 4
+
+	// logRecordFlagFamily 记录属于非默认的列族，头部携带列族编号
+	logRecordFlagFamily byte = 1 << 6
 )
 
 // LogRecord 日志记录
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	Expire int64  // 过期时间，UnixNano，0表示永不过期
+	Family uint32 // 列族编号，0 为默认列族
 }
 
 // LogRecordPos 日志记录位置
@@ -31,6 +53,12 @@ type LogRecordPos struct {
 	Fid    uint32
 	Offset int64
 	Size   uint32 // 数据在磁盘的大小
+	Expire int64  // 过期时间，UnixNano，0表示永不过期
+}
+
+// IsExpired 判断记录在指定时间是否已过期
+func (p *LogRecordPos) IsExpired(now int64) bool {
+	return p.Expire > 0 && p.Expire <= now
 }
 
 // TransactionRecord 事务记录
@@ -43,27 +71,81 @@ type TransactionRecord struct {
 type logRecordHeader struct {
 	crc        uint32
 	recordType LogRecordType
+	codec      Compression // value 的压缩算法
 	keySize    uint32
 	valueSize  uint32
+	expire     int64
+	family     uint32 // 列族编号
+	encrypted  bool   // value 是否加密
+	keyId      uint32 // 加密使用的密钥编号
+	encKey     bool   // key 是否加密
 }
 
 // EncodeLogRecord 编码日志记录
 func EncodeLogRecord(r *LogRecord) ([]byte, int64) {
+	encBytes, size, _ := encodeLogRecord(r, NoCompression, nil)
+	return encBytes, size
+}
+
+// encodeLogRecord 编码日志记录，value 按照指定的算法压缩，压缩后没有变小时存储原始数据
+// rc 不为空时压缩之后再加密
+func encodeLogRecord(r *LogRecord, c Compression, rc *recordCipher) ([]byte, int64, error) {
 	// TODO 复用
 	// header buf
 	headerBuf := make([]byte, maxLogRecordHeaderSize)
 
 	// 第五个第字节存储 type
 	headerBuf[4] = byte(r.Type)
+	if r.Expire > 0 {
+		headerBuf[4] |= logRecordFlagExpire
+	}
+	if r.Family != defaultFamilyId {
+		headerBuf[4] |= logRecordFlagFamily
+	}
+	value := r.Value
+	if c != NoCompression && len(value) > 0 {
+		if compressed, ok := compressValue(c, value); ok {
+			value = compressed
+			headerBuf[4] |= c << logRecordCodecShift
+		}
+	}
+	key := r.Key
+	var keyId uint64
+	if rc != nil {
+		id, aead, err := rc.current()
+		if err != nil {
+			return nil, 0, err
+		}
+		// 最低位标识key是否加密
+		keyId = uint64(id) << 1
+		if rc.encryptKeys {
+			key = sealData(aead, key, nil)
+			keyId |= 1
+		}
+		// value 与key绑定，防止被替换到其他记录
+		value = sealData(aead, value, key)
+		headerBuf[4] |= logRecordFlagEncrypted
+	}
 
 	var index = 5
 
 	// 第五个直接后存储变长的keySize与valueSize
-	index += binary.PutVarint(headerBuf[index:], int64(len(r.Key)))
-	index += binary.PutVarint(headerBuf[index:], int64(len(r.Value)))
+	index += binary.PutVarint(headerBuf[index:], int64(len(key)))
+	index += binary.PutVarint(headerBuf[index:], int64(len(value)))
+
+	// 设置了过期时间时追加存储
+	if r.Expire > 0 {
+		index += binary.PutVarint(headerBuf[index:], r.Expire)
+	}
+	if r.Family != defaultFamilyId {
+		index += binary.PutUvarint(headerBuf[index:], uint64(r.Family))
+	}
+	if rc != nil {
+		index += binary.PutUvarint(headerBuf[index:], keyId)
+	}
 
 	// 实际长度
-	var recordSize = index + len(r.Key) + len(r.Value)
+	var recordSize = index + len(key) + len(value)
 	// TODO 复用
 	encBytes := make([]byte, recordSize)
 
@@ -71,25 +153,29 @@ func EncodeLogRecord(r *LogRecord) ([]byte, int64) {
 	copy(encBytes[:index], headerBuf[:index])
 
 	// 将key和value拷贝到encBytes中
-	copy(encBytes[index:], r.Key)
-	copy(encBytes[index+len(r.Key):], r.Value)
+	copy(encBytes[index:], key)
+	copy(encBytes[index+len(key):], value)
 
 	// 计算crc
 	crc := crc32.ChecksumIEEE(encBytes[4:])
 	// 在预留的4个字节中写入crc
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
 
-	return encBytes, int64(recordSize)
+	return encBytes, int64(recordSize), nil
 }
 
 // EncodeLogRecordPos 编码位置信息
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
 	// TODO 复用
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	// 过期时间可选，兼容旧的位置编码
+	if pos.Expire > 0 {
+		index += binary.PutVarint(buf[index:], pos.Expire)
+	}
 	return buf[:index]
 }
 
@@ -100,57 +186,103 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
+	size, n := binary.Varint(buf[index:])
+	index += n
+	var expire int64
+	if index < len(buf) {
+		expire, _ = binary.Varint(buf[index:])
+	}
 	return &LogRecordPos{
 		Fid:    uint32(fileId),
 		Offset: offset,
 		Size:   uint32(size),
+		Expire: expire,
 	}
 }
 
 // decodeLogRecordHeader 解码日志记录头部
 func decodeLogRecordHeader(data []byte) (*logRecordHeader, int64) {
-	if len(data) < 4 {
+	header := &logRecordHeader{}
+	size := decodeLogRecordHeaderTo(data, header)
+	if size == 0 {
 		return nil, 0
 	}
+	return header, size
+}
+
+// decodeLogRecordHeaderTo 解码日志记录头部到 header 中，返回头部长度，数据不完整时返回0
+func decodeLogRecordHeaderTo(data []byte, header *logRecordHeader) int64 {
+	if len(data) <= 4 {
+		return 0
+	}
 
 	var crc = binary.LittleEndian.Uint32(data[:4])
-	var recordType = LogRecordType(data[4])
+	var recordType = LogRecordType(data[4] & logRecordTypeMask)
+	var flags = data[4] &^ logRecordTypeMask
 
 	var index = 5
 
 	// 取出变长的keySize与valueSize
 	keySize, n := binary.Varint(data[index:])
 	if n <= 0 {
-		return nil, 0
+		return 0
 	}
 	index += n
 
 	valueSize, n := binary.Varint(data[index:])
 	if n <= 0 {
-		return nil, 0
+		return 0
 	}
 	index += n
 
-	logHeader := &logRecordHeader{
+	var expire int64
+	if flags&logRecordFlagExpire != 0 {
+		expire, n = binary.Varint(data[index:])
+		if n <= 0 {
+			return 0
+		}
+		index += n
+	}
+
+	var family uint64
+	if flags&logRecordFlagFamily != 0 {
+		family, n = binary.Uvarint(data[index:])
+		if n <= 0 {
+			return 0
+		}
+		index += n
+	}
+
+	var keyId uint64
+	if flags&logRecordFlagEncrypted != 0 {
+		keyId, n = binary.Uvarint(data[index:])
+		if n <= 0 {
+			return 0
+		}
+		index += n
+	}
+
+	*header = logRecordHeader{
 		crc:        crc,
 		recordType: recordType,
+		codec:      (flags & logRecordCodecMask) >> logRecordCodecShift,
 		keySize:    uint32(keySize),
 		valueSize:  uint32(valueSize),
+		expire:     expire,
+		family:     uint32(family),
+		encrypted:  flags&logRecordFlagEncrypted != 0,
+		keyId:      uint32(keyId >> 1),
+		encKey:     keyId&1 != 0,
 	}
-	return logHeader, int64(index)
+	return int64(index)
 }
 
-// getLogRecordCRC 获取日志记录的crc
+// getLogRecordCRC 获取日志记录的crc，依次累加头部、key与value，不需要拼接
 func getLogRecordCRC(logRecord *LogRecord, logRecordHeaderBytes []byte) uint32 {
 	if logRecord == nil {
 		return 0
 	}
-	// TODO 复用
-	checkBytes := make([]byte, len(logRecordHeaderBytes)+len(logRecord.Key)+len(logRecord.Value))
-	copy(checkBytes, logRecordHeaderBytes)
-	copy(checkBytes[len(logRecordHeaderBytes):], logRecord.Key)
-	copy(checkBytes[len(logRecordHeaderBytes)+len(logRecord.Key):], logRecord.Value)
-
-	return crc32.ChecksumIEEE(checkBytes)
+	crc := crc32.ChecksumIEEE(logRecordHeaderBytes)
+	crc = crc32.Update(crc, crc32.IEEETable, logRecord.Key)
+	return crc32.Update(crc, crc32.IEEETable, logRecord.Value)
 }
@@ -1,6 +1,7 @@
 package kv
 
 import (
+	"bytes"
 	"hash/crc32"
 	"testing"
 
@@ -94,3 +95,64 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	rec := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.Equal(t, int64(len(res)), n)
+
+	// 过期时间存储在头部，类型不受标识位影响
+	h, size := decodeLogRecordHeader(res)
+	assert.NotNil(t, h)
+	assert.Equal(t, LogRecordNormal, h.recordType)
+	assert.Equal(t, rec.Expire, h.expire)
+	assert.Equal(t, uint32(4), h.keySize)
+	assert.Equal(t, uint32(10), h.valueSize)
+	assert.Equal(t, n, size+int64(h.keySize)+int64(h.valueSize))
+	assert.Equal(t, h.crc, getLogRecordCRC(rec, res[crc32.Size:size]))
+}
+
+func TestLogRecordPos_Encode(t *testing.T) {
+	pos := &LogRecordPos{Fid: 1, Offset: 100, Size: 20}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+
+	pos2 := &LogRecordPos{Fid: 1, Offset: 100, Size: 20, Expire: 1700000000000000000}
+	assert.Equal(t, pos2, DecodeLogRecordPos(EncodeLogRecordPos(pos2)))
+
+	assert.False(t, pos.IsExpired(pos2.Expire))
+	assert.True(t, pos2.IsExpired(pos2.Expire))
+	assert.False(t, pos2.IsExpired(pos2.Expire-1))
+}
+
+func TestEncodeLogRecord_Compression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"bitcask-go","tags":["kv","log"]}`), 50)
+	for _, c := range []Compression{Snappy, Zstd, LZ4} {
+		rec := &LogRecord{Key: []byte("name"), Value: value, Expire: 1700000000000000000}
+		res, n, err := encodeLogRecord(rec, c, nil)
+		assert.Nil(t, err)
+		assert.Less(t, n, int64(len(value)))
+
+		h, size := decodeLogRecordHeader(res)
+		assert.NotNil(t, h)
+		assert.Equal(t, c, h.codec)
+		assert.Equal(t, LogRecordNormal, h.recordType)
+		assert.Equal(t, rec.Expire, h.expire)
+
+		stored := res[size+int64(h.keySize):]
+		decoded, err := decompressValue(h.codec, stored)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decoded)
+	}
+
+	// 压缩后没有变小时存储原始数据
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")}
+	res, _, _ := encodeLogRecord(rec, Zstd, nil)
+	h, _ := decodeLogRecordHeader(res)
+	assert.Equal(t, NoCompression, h.codec)
+	assert.Equal(t, uint32(10), h.valueSize)
+}
@@ -1,12 +1,15 @@
 package kv
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kamijoucen/hifidb/pkg/errs"
 )
@@ -16,45 +19,80 @@ const (
 	mergeFinishedKey = "merge.finished"
 )
 
+// Merge 合并数据文件，清理无效数据，完成后立即替换当前数据库中已合并的文件
 func (db *DB) Merge() error {
-	if db.activeFile == nil {
-		return nil
+	if db.replica != nil {
+		return errs.ErrReadOnlyReplica
 	}
 
 	db.lock.Lock()
+	if db.activeFile == nil {
+		db.lock.Unlock()
+		return nil
+	}
 	if db.isMerging {
 		db.lock.Unlock()
 		return errs.ErrMergeIsProgress
 	}
+	// 备份期间不能删除旧的数据文件
+	if db.isBackingUp {
+		db.lock.Unlock()
+		return errs.ErrBackupIsProgress
+	}
+
+	// 检查磁盘剩余空间是否足够存放merge后的数据
+	if err := db.checkMergeDiskSpace(); err != nil {
+		db.lock.Unlock()
+		return err
+	}
 
 	db.isMerging = true
 	defer func() {
+		db.lock.Lock()
 		db.isMerging = false
+		db.lock.Unlock()
 	}()
 
-	if err := db.activeFile.Sync(); err != nil {
-		db.lock.Unlock()
+	mergeFiles, nonMergeFileId, err := db.rotateMergeFiles()
+	// 此时可以接收新的写入， 因为所有需要合并的文件都已经快照
+	db.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := db.writeMergeFiles(mergeFiles, nonMergeFileId); err != nil {
 		return err
 	}
+	return db.applyMergeFiles(nonMergeFileId)
+}
+
+// rotateMergeFiles 切换到新的活跃文件，返回需要merge的文件与没有参与merge的第一个文件，调用方需持有库锁
+func (db *DB) rotateMergeFiles() ([]*DataFile, uint32, error) {
+	if err := db.activeFile.Seal(); err != nil {
+		return nil, 0, err
+	}
 
 	db.olderFiles[db.activeFile.FileId] = db.activeFile
 
 	// 创建新的活跃文件
 	if err := db.setActiveDataFile(); err != nil {
-		db.lock.Unlock()
-		return err
+		return nil, 0, err
 	}
 
 	// 记录最近一条没有参与merge的文件ID
 	nonMergeFileId := db.activeFile.FileId
+	db.fileReclaim[nonMergeFileId] = db.reclaimSize
 
 	// 所有需要merge的文件
 	var mergeFiles []*DataFile
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
-	// 此时可以接收新的写入， 因为所有需要合并的文件都已经快照
-	db.lock.Unlock()
+	return mergeFiles, nonMergeFileId, nil
+}
+
+// writeMergeFiles 将有效数据重写到merge目录，并生成hint文件与merge完成标识
+func (db *DB) writeMergeFiles(mergeFiles []*DataFile, nonMergeFileId uint32) error {
 
 	// 从小到大合并
 	sort.Slice(mergeFiles, func(i, j int) bool {
@@ -77,6 +115,12 @@ func (db *DB) Merge() error {
 	mergeOptions := *db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	// merge过程不需要持久化索引，位置信息通过hint文件保存
+	mergeOptions.MemoryIndexType = BTree
+	mergeOptions.MergeCheckInterval = 0
+	mergeOptions.ValueCacheSize = 0
+	// merge 顺序写入之后即关闭，不需要预分配空间
+	mergeOptions.IOType = IO_FILE
 
 	mergeDB, err := Open(&mergeOptions)
 	if err != nil {
@@ -91,32 +135,54 @@ func (db *DB) Merge() error {
 	if err != nil {
 		return err
 	}
+	// hint文件中的key同样需要加密
+	hintFile.cipher = db.cipher
 	defer func() {
 		_ = hintFile.Close()
 	}()
 
+	now := time.Now().UnixNano()
 	for _, dataFile := range mergeFiles {
+		fileSize, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
 		var offset int64 = 0
 		for {
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
-				if err == io.EOF {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				// 启动时跳过的损坏数据段在merge时同样跳过
+				if errors.Is(err, errs.ErrInvalidCRC) && db.options.RecoveryMode == RecoverySkipCorrupt {
+					if offset = findNextRecord(dataFile, offset+1, fileSize); offset >= 0 {
+						continue
+					}
 					break
 				}
 				return err
 			}
 			// 获取key并比对真实位置，用于判断是否需是最新
+			// 索引不会指向删除与范围删除记录，被范围删除覆盖的数据也已从索引中移除，都不会写入merge文件
 			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
-			if logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset {
-				// 能读到就是有效的数据，merge 文件中无需携带事务ID
+			// 已删除列族的数据不再写入merge文件
+			var logRecordPos *LogRecordPos
+			db.lock.RLock()
+			if index := db.familyIndex(logRecord.Family); index != nil {
+				logRecordPos = index.Get(realKey)
+			}
+			db.lock.RUnlock()
+			if logRecordPos != nil && logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset &&
+				!logRecordPos.IsExpired(now) {
+				// 能读到且未过期就是有效的数据，merge 文件中无需携带事务ID
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
 				pos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
 					return err
 				}
 				// 将记录的位置写入hint文件
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
+				if err := hintFile.writeFamilyHintRecord(logRecord.Family, realKey, pos); err != nil {
 					return err
 				}
 			}
@@ -155,20 +221,152 @@ func (db *DB) Merge() error {
 	return nil
 }
 
+// startMergeScheduler 启动后台merge调度，无效数据占比达到阈值时自动merge
+func (db *DB) startMergeScheduler() {
+	if db.options.MergeCheckInterval <= 0 {
+		return
+	}
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+
+		ticker := time.NewTicker(db.options.MergeCheckInterval)
+		defer ticker.Stop()
+
+		var lastMergeTime time.Time
+		for {
+			select {
+			case <-db.closeCh:
+				return
+			case <-ticker.C:
+			}
+			if time.Since(lastMergeTime) < db.options.MergeMinInterval || !db.needMerge() {
+				continue
+			}
+			// 空间不足、正在手动merge或备份时，等待下一个间隔后再尝试
+			if err := db.Merge(); err != nil && db.options.MergeErrorCallback != nil {
+				db.options.MergeErrorCallback(err)
+			}
+			lastMergeTime = time.Now()
+		}
+	}()
+}
+
+// needMerge 判断无效数据占比是否达到merge阈值
+func (db *DB) needMerge() bool {
+	stat, err := db.Stat()
+	if err != nil || stat.DiskSize == 0 {
+		return false
+	}
+	return float64(stat.ReclaimableSize)/float64(stat.DiskSize) >= db.options.DataFileMergeRatio
+}
+
 func (db *DB) getMergePath() string {
-	dir := path.Dir(path.Clean(db.options.DirPath))
-	base := path.Base(db.options.DirPath)
-	return path.Join(dir, base+mergeDirName)
+	return siblingDirPath(db.options.DirPath, mergeDirName)
+}
+
+// siblingDirPath 获取与数据目录同级、以数据目录名加后缀命名的目录
+func siblingDirPath(dirPath, suffix string) string {
+	dir := path.Dir(path.Clean(dirPath))
+	base := path.Base(dirPath)
+	return path.Join(dir, base+suffix)
 }
 
-// loadMergeFiles 加载merge文件
-func (db *DB) loadMergeFiles() error {
+// applyMergeFiles 将merge结果替换到当前数据库
+func (db *DB) applyMergeFiles(nonMergeFileId uint32) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// 关闭已合并的文件，文件的删除与替换由loadMergeFiles完成
+	// 仍被快照引用的文件延迟到快照释放后关闭，已打开的文件在删除后依然可读
+	for fid, dataFile := range db.olderFiles {
+		if fid >= nonMergeFileId {
+			continue
+		}
+		delete(db.olderFiles, fid)
+		db.retireFile(dataFile)
+		if db.snapshots > 0 {
+			db.retiredFiles = append(db.retiredFiles, dataFile)
+			continue
+		}
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	applied, err := db.loadMergeFiles()
+	if err != nil || !applied {
+		return err
+	}
+
+	// 打开merge后的数据文件
+	dirEntries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), DataFileSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.Split(entry.Name(), ".")[0])
+		if err != nil {
+			return errs.ErrDataDirCorrupted
+		}
+		if uint32(fid) >= nonMergeFileId {
+			continue
+		}
+		dataFile, err := OpenDataFile(db.options.dataFileIOType(), db.options.DirPath, uint32(fid))
+		if err != nil {
+			return err
+		}
+		dataFile.cipher = db.cipher
+		db.olderFiles[uint32(fid)] = dataFile
+	}
+
+	// 更新仍指向已合并文件的索引，已合并文件中的无效数据已被清理
+	// merge开始时的无效数据都在已合并的文件中，merge期间新产生的无效数据仍然保留
+	// 重启之后没有记录时不扣除，下一次merge时再修正
+	db.reclaimSize = max(db.reclaimSize-db.fileReclaim[nonMergeFileId], 0)
+	for fid := range db.fileReclaim {
+		if fid <= nonMergeFileId {
+			delete(db.fileReclaim, fid)
+		}
+	}
+	db.nonMergeFileId = nonMergeFileId
+	db.writeNotify.notify()
+	db.beginIndexBatch()
+	if err := db.updateIndexFromHintFile(); err != nil {
+		db.rollbackIndexBatch()
+		return err
+	}
+	return db.commitIndexBatch(db.writtenPos())
+}
+
+// checkMergeDiskSpace 检查磁盘剩余空间是否能容纳merge后的有效数据
+func (db *DB) checkMergeDiskSpace() error {
+	dirSize, err := DirSize(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	available, err := AvailableDiskSize(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	if dirSize-db.preallocatedSize()-db.reclaimSize >= available {
+		return errs.ErrNoEnoughSpaceForMerge
+	}
+	return nil
+}
+
+// loadMergeFiles 加载merge文件，返回是否应用了merge结果
+func (db *DB) loadMergeFiles() (bool, error) {
 
 	mergePath := db.getMergePath()
 	if _, err := os.Stat(mergePath); err != nil {
 		if os.IsNotExist(err) {
 			// merge目录不存在，说明没有发生过merge
-			return nil
+			return false, nil
 		}
 	}
 	defer func() {
@@ -177,7 +375,7 @@ func (db *DB) loadMergeFiles() error {
 
 	dirEntries, err := os.ReadDir(mergePath)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// 检查merge完成标识文件
@@ -186,7 +384,6 @@ func (db *DB) loadMergeFiles() error {
 	for _, entry := range dirEntries {
 		if entry.Name() == MergeFinishedFileName {
 			mergeFinished = true
-			break
 		}
 		if entry.Name() == fileLockName {
 			continue
@@ -195,22 +392,22 @@ func (db *DB) loadMergeFiles() error {
 	}
 
 	if !mergeFinished {
-		return nil
+		return false, nil
 	}
 
 	// 获取最近一次未被合并的文件ID
 	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
 	if err != nil {
-		return nil
+		return false, nil
 	}
 
 	// 删除所有已合并的文件
 	var fileId uint32 = 0
 	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := GetDataFileName(mergePath, fileId)
+		fileName := GetDataFileName(db.options.DirPath, fileId)
 		if _, err := os.Stat(fileName); err == nil {
 			if err := os.Remove(fileName); err != nil {
-				return err
+				return false, err
 			}
 		}
 	}
@@ -220,9 +417,24 @@ func (db *DB) loadMergeFiles() error {
 		srcPath := filepath.Join(mergePath, fileName)
 		dstPath := filepath.Join(db.options.DirPath, fileName)
 		if err := os.Rename(srcPath, dstPath); err != nil {
-			return err
+			return false, err
 		}
 	}
+	return true, nil
+}
+
+// loadNonMergeFileId 加载上一次merge时未参与合并的第一个文件ID
+func (db *DB) loadNonMergeFileId() error {
+	mergeFinishedFileName := filepath.Join(db.options.DirPath, MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinishedFileName); err != nil {
+		db.nonMergeFileId = 0
+		return nil
+	}
+	fid, err := db.getNonMergeFileId(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	db.nonMergeFileId = fid
 	return nil
 }
 
@@ -247,7 +459,39 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 }
 
 // loadIndexFromHintFile 从hint文件加载索引
+// hint文件中的位置不是重放的位置，持久化的索引分批提交时不保存检查点
 func (db *DB) loadIndexFromHintFile() error {
+	var count int
+	return db.foreachHintRecord(func(family uint32, key []byte, pos *LogRecordPos) error {
+		if index := db.familyIndex(family); index != nil {
+			index.Put(key, pos)
+		}
+		return db.splitIndexBatch(&count, nil)
+	})
+}
+
+// updateIndexFromHintFile 使用hint文件更新磁盘索引
+// 磁盘索引中已包含merge之后的写入和删除，只更新仍指向已合并文件的key
+func (db *DB) updateIndexFromHintFile() error {
+	nonMergeFileId, err := db.getNonMergeFileId(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	var count int
+	return db.foreachHintRecord(func(family uint32, key []byte, pos *LogRecordPos) error {
+		index := db.familyIndex(family)
+		if index == nil {
+			return nil
+		}
+		if oldPos := index.Get(key); oldPos != nil && oldPos.Fid < nonMergeFileId {
+			index.Put(key, pos)
+		}
+		return db.splitIndexBatch(&count, nil)
+	})
+}
+
+// foreachHintRecord 遍历hint文件中的索引
+func (db *DB) foreachHintRecord(f func(family uint32, key []byte, pos *LogRecordPos) error) error {
 
 	hintFileName := filepath.Join(db.options.DirPath, HintFileName)
 	// 检查hint文件是否存在
@@ -261,21 +505,26 @@ func (db *DB) loadIndexFromHintFile() error {
 	if err != nil {
 		return err
 	}
+	hintFile.cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
 
 	// 读取文件中的索引
 	var offset int64 = 0
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
 			return err
 		}
 
 		// 解析索引位置
-		pos := DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		if err := f(logRecord.Family, logRecord.Key, DecodeLogRecordPos(logRecord.Value)); err != nil {
+			return err
+		}
 		offset += size
 	}
 	return nil
@@ -0,0 +1,159 @@
+package kv
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Merge(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := range 50000 {
+		assert.Nil(t, db.Put(GetTestKey(i), RandomValue(128)))
+	}
+	for i := range 40000 {
+		assert.Nil(t, db.Delete(GetTestKey(i)))
+	}
+	assert.Nil(t, db.Put(GetTestKey(49999), []byte("latest")))
+	before, err := db.Stat()
+	assert.Nil(t, err)
+
+	// merge 完成后立即生效，无需重启
+	assert.Nil(t, db.Merge())
+	after, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), after.ReclaimableSize)
+	assert.Less(t, after.DiskSize, before.DiskSize)
+	assert.Equal(t, 10000, len(db.ListKeys()))
+
+	val, err := db.Get(GetTestKey(49999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("latest"), val)
+	_, err = db.Get(GetTestKey(1))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// merge 之后继续写入并重启
+	assert.Nil(t, db.Put(GetTestKey(1), []byte("after-merge")))
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 10001, len(db2.ListKeys()))
+	val, err = db2.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-merge"), val)
+	val, err = db2.Get(GetTestKey(49999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("latest"), val)
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.DataFileMergeRatio = 0.5
+	opts.MergeCheckInterval = 10 * time.Millisecond
+	opts.MergeMinInterval = 0
+	mergeErrs := make(chan error, 1)
+	opts.MergeErrorCallback = func(err error) {
+		select {
+		case mergeErrs <- err:
+		default:
+		}
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := range 10000 {
+		assert.Nil(t, db.Put(GetTestKey(i), RandomValue(128)))
+	}
+	// 未达到阈值时不会merge
+	time.Sleep(50 * time.Millisecond)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), stat.DataFileNum)
+
+	// 覆盖写入使无效数据超过阈值，备份期间merge失败时通过回调通知
+	db.lock.Lock()
+	db.isBackingUp = true
+	db.lock.Unlock()
+	for i := range 10000 {
+		assert.Nil(t, db.Put(GetTestKey(i), RandomValue(128)))
+	}
+	select {
+	case err := <-mergeErrs:
+		assert.Equal(t, errs.ErrBackupIsProgress, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("merge error callback not called")
+	}
+	db.lock.Lock()
+	db.isBackingUp = false
+	db.lock.Unlock()
+	assert.Eventually(t, func() bool {
+		stat, err := db.Stat()
+		return err == nil && stat.ReclaimableSize == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 10000, len(db.ListKeys()))
+	for i := range 10000 {
+		_, err := db.Get(GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_MergeKeepsNewReclaimSize(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-reclaim")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := range 1000 {
+		assert.Nil(t, db.Put(GetTestKey(i), RandomValue(128)))
+	}
+	for i := range 500 {
+		assert.Nil(t, db.Delete(GetTestKey(i)))
+	}
+
+	// 按照 Merge 的步骤执行，在切换活跃文件之后写入产生新的无效数据
+	db.lock.Lock()
+	mergeFiles, nonMergeFileId, err := db.rotateMergeFiles()
+	db.lock.Unlock()
+	assert.Nil(t, err)
+	for range 10 {
+		assert.Nil(t, db.Put([]byte("hot"), RandomValue(128)))
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	before := stat.ReclaimableSize
+
+	assert.Nil(t, db.writeMergeFiles(mergeFiles, nonMergeFileId))
+	assert.Nil(t, db.applyMergeFiles(nonMergeFileId))
+
+	// 只扣除已合并文件中的无效数据，merge期间产生的无效数据仍然保留
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Greater(t, stat.ReclaimableSize, int64(9*128))
+	assert.Less(t, stat.ReclaimableSize, before)
+	assert.Equal(t, 501, len(db.ListKeys()))
+
+	// 之后的merge清理剩下的无效数据
+	assert.Nil(t, db.Merge())
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.ReclaimableSize)
+}
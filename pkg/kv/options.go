@@ -2,6 +2,7 @@ package kv
 
 import (
 	"errors"
+	"time"
 )
 
 // 索引类型定义
@@ -11,10 +12,18 @@ const (
 	// BTree index
 	BTree IndexType = iota + 1
 
-	// ART ART index
-	ART
+	// RadixTree 写时复制的基数树索引，创建快照的开销与数据量无关
+	RadixTree
+
+	// BPlusTree 持久化在磁盘上的B+树索引, 启动时无需重建索引
+	BPlusTree
 )
 
+// ART 与 RadixTree 相同，保留用于兼容，索引已不是自适应基数树
+//
+// Deprecated: 使用 RadixTree
+const ART = RadixTree
+
 // IO类型定义
 type IOType = uint8
 
@@ -23,6 +32,29 @@ const (
 	IO_MMAP
 )
 
+// 启动时遇到损坏数据的恢复模式
+type RecoveryMode = uint8
+
+const (
+	// RecoveryStrict 遇到不完整或损坏的记录时打开失败，默认的恢复模式
+	RecoveryStrict RecoveryMode = iota
+
+	// RecoveryTruncateTail 活跃文件末尾不完整或损坏的记录截断丢弃，其余位置的损坏打开失败
+	RecoveryTruncateTail
+
+	// RecoverySkipCorrupt 在 RecoveryTruncateTail 的基础上，跳过任意文件中损坏的数据段
+	RecoverySkipCorrupt
+)
+
+// RecoveryEvent 启动恢复时丢弃的数据
+type RecoveryEvent struct {
+	FileId    uint32
+	Offset    int64 // 丢弃的数据在文件中的位置
+	Size      int64 // 丢弃的数据长度
+	Truncated bool  // 是否从该位置截断了文件
+	Err       error // 丢弃的原因，ErrInvalidCRC 或 ErrIncompleteRecord
+}
+
 // Options 数据库配置选项
 type Options struct {
 	// DirPath      数据库目录路径
@@ -37,14 +69,45 @@ type Options struct {
 	// BytesPerSync   累计写入多少字节后进行一次同步
 	BytesPerSync uint32
 
-	// MemoryIndexType 内存索引类型
+	// MemoryIndexType 索引类型, BPlusTree 类型的索引存储在磁盘上
 	MemoryIndexType IndexType
 
 	// MMapAtStartUp 是否在启动时将数据文件映射到内存
 	MMapAtStartup bool
 
-	// DataFileMergeRatio 数据文件合并阈值
+	// IOType 数据文件的IO类型，IO_MMAP 时活跃文件预分配 DataFileSize 大小的空间并通过映射写入，
+	// 旧的数据文件只读映射，读取时不拷贝，为0时使用 IO_FILE
+	IOType IOType
+
+	// DataFileMergeRatio 数据文件合并阈值，无效数据占比达到该值时自动merge
 	DataFileMergeRatio float64
+
+	// MergeCheckInterval 后台检查是否需要merge的间隔，为0时不开启自动merge
+	MergeCheckInterval time.Duration
+
+	// MergeMinInterval 两次自动merge之间的最小间隔
+	MergeMinInterval time.Duration
+
+	// MergeErrorCallback 自动merge失败时的回调，可以为空，在后台merge的协程中调用
+	MergeErrorCallback func(err error)
+
+	// RecoveryMode 启动时遇到损坏数据的恢复模式，为0时使用 RecoveryStrict，丢弃数据需要显式指定
+	RecoveryMode RecoveryMode
+
+	// RecoveryCallback 启动恢复丢弃数据时的回调，可以为空
+	RecoveryCallback func(event *RecoveryEvent)
+
+	// Compression 写入时value的压缩算法，修改后已有的数据仍然可以读取，merge时按照新的算法重写
+	Compression Compression
+
+	// CompressionThreshold value 长度小于该值时不压缩
+	CompressionThreshold int
+
+	// Encryption 静态加密选项，为空时不加密，开启之后不能关闭
+	Encryption *EncryptionOptions
+
+	// ValueCacheSize value缓存的容量，单位为字节，为0时不开启缓存
+	ValueCacheSize int64
 }
 
 // CheckOptions 检查配置选项是否有效
@@ -52,40 +115,95 @@ func CheckOptions(options *Options) error {
 	if options.DirPath == "" {
 		return errors.New("database dir path is empty")
 	}
-	if options.DataFileSize <= 0 {
+	if options.DataFileSize <= 0 || options.DataFileSize > maxDataFileSize {
 		return errors.New("database data file size is invalid")
 	}
 
+	if options.MemoryIndexType < BTree || options.MemoryIndexType > BPlusTree {
+		return errors.New("database memory index type is invalid")
+	}
+
+	if options.IOType != 0 && options.IOType != IO_FILE && options.IOType != IO_MMAP {
+		return errors.New("database io type is invalid")
+	}
+
 	if options.DataFileMergeRatio <= 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("database data file merge ratio must be between 0 and 1")
 	}
 
+	if options.MergeCheckInterval < 0 || options.MergeMinInterval < 0 {
+		return errors.New("database merge interval is invalid")
+	}
+
+	if options.RecoveryMode > RecoverySkipCorrupt {
+		return errors.New("database recovery mode is invalid")
+	}
+
+	if options.Compression > LZ4 {
+		return errors.New("database compression is invalid")
+	}
+
+	if options.CompressionThreshold < 0 {
+		return errors.New("database compression threshold is invalid")
+	}
+
+	if options.ValueCacheSize < 0 {
+		return errors.New("database value cache size is invalid")
+	}
+
+	if options.Encryption != nil && options.Encryption.KeyProvider == nil {
+		return errors.New("database encryption key provider is empty")
+	}
+
+	// B+树索引将key明文存储在索引文件中
+	if options.Encryption != nil && options.Encryption.EncryptKeys && options.MemoryIndexType == BPlusTree {
+		return errors.New("database key encryption is not supported by the bptree index")
+	}
+
 	return nil
 }
 
+// dataFileIOType 数据文件的IO类型，未设置时使用文件IO
+func (o *Options) dataFileIOType() IOType {
+	if o.IOType == 0 {
+		return IO_FILE
+	}
+	return o.IOType
+}
+
 // GetDBDefaultOptions 获取默认数据库配置
 func GetDBDefaultOptions() *Options {
 	return &Options{
-		DirPath:            "./data",
-		DataFileSize:       1024 * 1024 * 1024, // 1GB
-		SyncWrites:         false,
-		MemoryIndexType:    BTree,
-		BytesPerSync:       0, // 不开启
-		MMapAtStartup:      true,
-		DataFileMergeRatio: 0.5, // 默认合并比例为50%
+		DirPath:              "./data",
+		DataFileSize:         1024 * 1024 * 1024, // 1GB
+		SyncWrites:           false,
+		MemoryIndexType:      BTree,
+		BytesPerSync:         0, // 不开启
+		MMapAtStartup:        true,
+		IOType:               IO_FILE,
+		DataFileMergeRatio:   0.5, // 默认合并比例为50%
+		MergeCheckInterval:   0,   // 不开启自动merge
+		MergeMinInterval:     time.Hour,
+		RecoveryMode:         RecoveryStrict,
+		Compression:          NoCompression,
+		CompressionThreshold: 256,
 	}
 }
 
 // IteratorOptions 迭代器选项
 type IteratorOptions struct {
-	Prefix  []byte // 遍历的key前缀
-	Reverse bool   // 是否逆序遍历
+	Prefix     []byte // 遍历的key前缀
+	Reverse    bool   // 是否逆序遍历
+	LowerBound []byte // 遍历的下界，包含该key，为空时不限制
+	UpperBound []byte // 遍历的上界，不包含该key，为空时不限制
+	Limit      int    // 最多遍历的key数量，0 表示不限制
+	KeysOnly   bool   // 只遍历key，不读取value
 }
 
 // WriteBatchOptions 写批量操作选项
 type WriteBatchOptions struct {
 	MaxBatchSize   int  // 最大批量大小
-	EachSyncWrites bool // 每次写操作是否同步
+	EachSyncWrites bool // 提交时是否同步，不受 Options.SyncWrites 影响
 }
 
 func GetDefaultWriteBatchOptions() *WriteBatchOptions {
@@ -0,0 +1,206 @@
+package kv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_RecoveryTornTail(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-torn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := range 100 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	activeFid, writeOffset := db.activeFile.FileId, db.activeFile.WriteOffset
+	assert.Nil(t, db.Close())
+
+	// 在活跃文件末尾追加不完整的记录
+	torn, _ := EncodeLogRecord(&LogRecord{Key: []byte("torn"), Value: RandomValue(100)})
+	f, err := os.OpenFile(GetDataFileName(dir, activeFid), os.O_RDWR|os.O_APPEND, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = f.Write(torn[:len(torn)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	opts.RecoveryMode = RecoveryStrict
+	_, err = Open(opts)
+	assert.Equal(t, errs.ErrIncompleteRecord, err)
+
+	var events []*RecoveryEvent
+	opts.RecoveryMode = RecoveryTruncateTail
+	opts.RecoveryCallback = func(event *RecoveryEvent) {
+		events = append(events, event)
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, 1, len(events))
+	assert.True(t, events[0].Truncated)
+	assert.Equal(t, writeOffset, events[0].Offset)
+	assert.Equal(t, int64(len(torn)/2), events[0].Size)
+	assert.Equal(t, writeOffset, db.activeFile.WriteOffset)
+
+	// 截断之后的写入可以正常读取
+	assert.Nil(t, db.Put([]byte("after"), []byte("v")))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	val, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	assert.Equal(t, 101, len(db.ListKeys()))
+}
+
+func TestDB_RecoverySkipCorrupt(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-skip")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	for i := range 100 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	pos := db.index.Get(GetTestKey(50))
+	assert.Nil(t, db.Close())
+
+	// 损坏中间的一条记录
+	f, err := os.OpenFile(GetDataFileName(dir, pos.Fid), os.O_RDWR, DataFilePerm)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, pos.Offset+int64(pos.Size)-2)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// 默认模式只处理末尾的不完整记录
+	_, err = Open(opts)
+	assert.Equal(t, errs.ErrInvalidCRC, err)
+
+	var events []*RecoveryEvent
+	opts.RecoveryMode = RecoverySkipCorrupt
+	opts.RecoveryCallback = func(event *RecoveryEvent) {
+		events = append(events, event)
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, 1, len(events))
+	assert.False(t, events[0].Truncated)
+	assert.Equal(t, pos.Offset, events[0].Offset)
+	assert.Equal(t, int64(pos.Size), events[0].Size)
+	assert.Equal(t, errs.ErrInvalidCRC, events[0].Err)
+
+	_, err = db.Get(GetTestKey(50))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	assert.Equal(t, 99, len(db.ListKeys()))
+
+	// merge 同样跳过损坏的记录
+	assert.Nil(t, db.Merge())
+	val, err := db.Get(GetTestKey(51))
+	assert.Nil(t, err)
+	assert.Equal(t, GetTestKey(51), val)
+}
+
+func TestDB_RecoveryPreallocatedTail(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-prealloc")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = IO_MMAP
+	db, err := Open(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+	for i := range 100 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	assert.Nil(t, db.Sync())
+	writeOffset := db.activeFile.WriteOffset
+
+	// 未关闭时拷贝数据目录，模拟异常退出，活跃文件末尾是预分配的空间
+	crashDir, _ := os.MkdirTemp("", "bitcask-go-recovery-prealloc-crash")
+	assert.Nil(t, CopyDir(dir, crashDir, []string{fileLockName}))
+	fi, err := os.Stat(GetDataFileName(crashDir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	assert.Equal(t, opts.DataFileSize, fi.Size())
+
+	// 末尾没有写入的空间不是损坏的数据
+	report, err := Verify(crashDir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, int64(100), report.Records)
+	crashOpts := *opts
+	crashOpts.DirPath = crashDir
+	crashOpts.RecoveryMode = RecoveryStrict
+	crashDB, err := Open(&crashOpts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(crashDB) }()
+	assert.Equal(t, writeOffset, crashDB.activeFile.WriteOffset)
+	assert.Equal(t, 100, len(crashDB.ListKeys()))
+
+	// 截断之后的写入可以正常读取
+	assert.Nil(t, crashDB.Put([]byte("after"), []byte("v")))
+	assert.Nil(t, crashDB.Close())
+	crashDB, err = Open(&crashOpts)
+	assert.Nil(t, err)
+	val, err := crashDB.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+	assert.Equal(t, 101, len(crashDB.ListKeys()))
+}
+
+func TestDB_RecoveryZeroTail(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-zero-tail")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = IO_MMAP
+	db, err := Open(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+	for i := range 10 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	assert.Nil(t, db.Sync())
+	fileId := db.activeFile.FileId
+	writeOffset := db.activeFile.WriteOffset
+
+	// 通过映射写入之后异常退出，使用文件IO打开时末尾预分配的空间同样不是损坏
+	crashDir, _ := os.MkdirTemp("", "bitcask-go-recovery-zero-tail-crash")
+	assert.Nil(t, CopyDir(dir, crashDir, []string{fileLockName}))
+	fileName := GetDataFileName(crashDir, fileId)
+	fi, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, opts.DataFileSize, fi.Size())
+
+	var events []*RecoveryEvent
+	crashOpts := *opts
+	crashOpts.DirPath = crashDir
+	crashOpts.IOType = IO_FILE
+	crashOpts.RecoveryMode = RecoveryStrict
+	crashOpts.RecoveryCallback = func(e *RecoveryEvent) {
+		events = append(events, e)
+	}
+	crashDB, err := Open(&crashOpts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(crashDB) }()
+	assert.Equal(t, 0, len(events))
+	assert.Equal(t, writeOffset, crashDB.activeFile.WriteOffset)
+	assert.Equal(t, 10, len(crashDB.ListKeys()))
+	fi, err = os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, writeOffset, fi.Size())
+
+	// 截断之后的写入可以正常读取
+	assert.Nil(t, crashDB.Put([]byte("after"), []byte("v")))
+	assert.Nil(t, crashDB.Close())
+	crashDB, err = Open(&crashOpts)
+	assert.Nil(t, err)
+	val, err := crashDB.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+}
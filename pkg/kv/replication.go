@@ -0,0 +1,672 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// 复制协议的消息类型，每条消息为 type(1) + uvarint 长度 + 内容
+const (
+	// replMsgHello 从节点连接后发送已应用的merge与位置
+	replMsgHello byte = iota + 1
+	// replMsgChunk 数据文件中从指定位置开始的完整记录，数据为空时表示切换到新的文件
+	replMsgChunk
+	// replMsgFile 全量同步或merge时发送的文件内容
+	replMsgFile
+	// replMsgSnapshotEnd 全量同步的文件发送完毕
+	replMsgSnapshotEnd
+	// replMsgMergeEnd merge生成的文件发送完毕
+	replMsgMergeEnd
+	// replMsgFamilies 列族文件的内容
+	replMsgFamilies
+	// replMsgHeartbeat 空闲时发送主节点的位置
+	replMsgHeartbeat
+)
+
+// replMsgFile 的目标目录
+const (
+	replTargetSnapshot byte = iota
+	replTargetMerge
+)
+
+const (
+	// maxReplicationChunk 一次发送的数据大小，超过该大小的单条记录分多次发送
+	maxReplicationChunk = 1024 * 1024
+
+	// maxReplicationMessage 单条消息大小的上限，数据之外的部分为文件名与位置
+	maxReplicationMessage = maxReplicationChunk + 4096
+
+	// replicationHeartbeat 空闲时发送心跳的间隔，从节点超过三个间隔没有收到消息时重新连接
+	replicationHeartbeat = time.Second
+
+	// replicaSyncDirName 全量同步时使用的临时目录后缀
+	replicaSyncDirName = "-replica-sync"
+)
+
+// ReplicationServer 主节点的复制服务，将追加到数据文件的记录发送给从节点
+// 从节点的数据文件与主节点逐字节一致，从节点使用 OpenFollower 打开
+type ReplicationServer struct {
+	db       *DB
+	lock     *sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       *sync.WaitGroup
+	closed   bool
+	closeCh  chan struct{}
+	syncLock *sync.Mutex // 全量同步依次进行
+}
+
+func NewReplicationServer(db *DB) *ReplicationServer {
+	return &ReplicationServer{
+		db:       db,
+		lock:     &sync.Mutex{},
+		conns:    map[net.Conn]struct{}{},
+		wg:       &sync.WaitGroup{},
+		closeCh:  make(chan struct{}),
+		syncLock: &sync.Mutex{},
+	}
+}
+
+// ListenAndServe 监听地址并处理从节点的连接，直到 Close 被调用
+func (s *ReplicationServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve 在给定的 listener 上处理从节点的连接，直到 Close 被调用
+func (s *ReplicationServer) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		_ = l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+// Addr 返回监听的地址，未开始监听时返回nil
+func (s *ReplicationServer) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close 停止监听并断开所有从节点，不会关闭底层的 DB
+func (s *ReplicationServer) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.closeCh)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// handleConn 向一个从节点发送数据，出错时断开连接，由从节点重新连接
+func (s *ReplicationServer) handleConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+	typ, payload, err := readReplMessage(reader)
+	if err != nil || typ != replMsgHello {
+		return
+	}
+	d := &replDecoder{buf: payload}
+	st := &replicaStream{
+		db:      s.db,
+		writer:  bufio.NewWriter(conn),
+		mergeId: uint32(d.uvarint()),
+		fid:     uint32(d.uvarint()),
+		offset:  int64(d.uvarint()),
+	}
+	if d.err != nil {
+		return
+	}
+
+	// 从节点的位置已经不存在时全量同步
+	if !st.canResume() {
+		if err := s.fullSync(st); err != nil {
+			return
+		}
+	}
+	_ = st.run(s.closeCh)
+}
+
+// fullSync 备份数据库并发送所有文件，从节点使用这些文件替换自己的数据目录
+func (s *ReplicationServer) fullSync(st *replicaStream) error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	db := s.db
+	dir := siblingDirPath(db.options.DirPath, replicaSyncDirName)
+	_ = os.RemoveAll(dir)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if err := db.Backup(dir); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var fid uint32
+	var offset int64
+	for _, entry := range entries {
+		fileName := filepath.Join(dir, entry.Name())
+		size, err := st.sendFile(replTargetSnapshot, entry.Name(), func(off int64, n int) ([]byte, error) {
+			return readFileAt(fileName, off, n)
+		}, fileSizeOf(fileName))
+		if err != nil {
+			return err
+		}
+		// 备份中最新的数据文件为同步之后的位置
+		if strings.HasSuffix(entry.Name(), DataFileSuffix) {
+			id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), DataFileSuffix))
+			if err != nil {
+				return errs.ErrDataDirCorrupted
+			}
+			if uint32(id) >= fid {
+				fid, offset = uint32(id), size
+			}
+		}
+	}
+
+	var mergeId uint32
+	if _, err := os.Stat(filepath.Join(dir, MergeFinishedFileName)); err == nil {
+		if mergeId, err = db.getNonMergeFileId(dir); err != nil {
+			return err
+		}
+	}
+	payload := binary.AppendUvarint(nil, uint64(mergeId))
+	payload = binary.AppendUvarint(payload, uint64(fid))
+	payload = binary.AppendUvarint(payload, uint64(offset))
+	if err := st.send(replMsgSnapshotEnd, payload); err != nil {
+		return err
+	}
+	st.mergeId, st.fid, st.offset = mergeId, fid, offset
+	return nil
+}
+
+// replicaStream 一个从节点的发送状态
+type replicaStream struct {
+	db     *DB
+	writer *bufio.Writer
+
+	mergeId uint32 // 从节点已应用的merge
+	fid     uint32 // 下一次发送的位置
+	offset  int64
+
+	familiesSent  bool
+	familyVersion uint64
+
+	pendingMerge uint32 // 等待发送的merge
+	mergeAt      uint64 // 发送到该位置之后才能发送merge生成的文件
+}
+
+// canResume 判断能否从从节点的位置继续发送
+func (st *replicaStream) canResume() bool {
+	db := st.db
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	// 从节点的merge比主节点新，说明不是同一个数据库
+	if st.mergeId > db.nonMergeFileId {
+		return false
+	}
+	// 已合并的文件与从节点中的文件不同
+	if st.fid < db.nonMergeFileId {
+		return false
+	}
+	if db.activeFile == nil {
+		return st.fid == 0 && st.offset == 0
+	}
+	if st.fid == db.activeFile.FileId {
+		return st.offset <= db.activeFile.WriteOffset
+	}
+	if dataFile := db.olderFiles[st.fid]; dataFile != nil {
+		size, err := dataFile.IoManager.Size()
+		return err == nil && st.offset <= size
+	}
+	return false
+}
+
+// run 持续发送数据，直到连接断开、数据库关闭或者复制服务关闭
+func (st *replicaStream) run(closeCh chan struct{}) error {
+	ticker := time.NewTicker(replicationHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		wait, err := st.step()
+		if err != nil {
+			return err
+		}
+		if wait == nil {
+			continue
+		}
+		if err := st.writer.Flush(); err != nil {
+			return err
+		}
+		select {
+		case <-wait:
+		case <-ticker.C:
+			if err := st.sendHeartbeat(); err != nil {
+				return err
+			}
+		case <-st.db.closeCh:
+			return nil
+		case <-closeCh:
+			return nil
+		}
+	}
+}
+
+// step 发送一次数据，没有数据可以发送时返回等待新写入的通道
+func (st *replicaStream) step() (<-chan struct{}, error) {
+	db := st.db
+	db.lock.Lock()
+	// 先获取通道，避免检查之后的写入没有通知
+	wait := db.writeNotify.wait()
+
+	// 列族变化之后的记录在列族文件之后发送
+	if !st.familiesSent || st.familyVersion != db.familyVersion {
+		data, err := os.ReadFile(filepath.Join(db.options.DirPath, FamilyFileName))
+		version := db.familyVersion
+		db.lock.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		st.familiesSent, st.familyVersion = true, version
+		return nil, st.send(replMsgFamilies, data)
+	}
+
+	var end uint64
+	if db.activeFile != nil {
+		end = changeSeq(db.activeFile.FileId, db.activeFile.WriteOffset)
+	}
+	if st.mergeId != db.nonMergeFileId {
+		// 从节点需要先应用完merge之前的所有写入，否则merge时已删除的key在从节点中会指向已合并的文件
+		if st.pendingMerge != db.nonMergeFileId {
+			st.pendingMerge, st.mergeAt = db.nonMergeFileId, end
+		}
+		if changeSeq(st.fid, st.offset) >= st.mergeAt {
+			return nil, st.sendMergeFiles()
+		}
+		if st.fid < db.nonMergeFileId {
+			db.lock.Unlock()
+			return nil, errs.ErrReplicationOutOfSync
+		}
+	}
+
+	var dataFile *DataFile
+	var limit int64
+	isActive := db.activeFile != nil && st.fid == db.activeFile.FileId
+	switch {
+	case isActive:
+		dataFile, limit = db.activeFile, db.activeFile.WriteOffset
+	case db.olderFiles[st.fid] != nil:
+		dataFile = db.olderFiles[st.fid]
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			db.lock.Unlock()
+			return nil, err
+		}
+		limit = size
+	case db.activeFile == nil && st.fid == 0:
+		db.lock.Unlock()
+		return wait, nil
+	default:
+		db.lock.Unlock()
+		return nil, errs.ErrReplicationOutOfSync
+	}
+
+	if st.offset < limit {
+		// 读取期间文件不会被merge关闭
+		db.snapshots++
+		db.lock.Unlock()
+		chunk, err := readRecordChunk(dataFile, st.offset, limit)
+		db.releaseSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		if err := st.sendChunk(st.fid, st.offset, chunk); err != nil {
+			return nil, err
+		}
+		st.offset += int64(len(chunk))
+		return nil, nil
+	}
+	db.lock.Unlock()
+	if isActive {
+		return wait, nil
+	}
+	// 文件已发送完毕，切换到下一个文件
+	st.fid, st.offset = st.fid+1, 0
+	return nil, st.sendChunk(st.fid, 0, nil)
+}
+
+// sendMergeFiles 发送merge生成的文件，调用方需持有库锁，返回前释放
+func (st *replicaStream) sendMergeFiles() error {
+	db := st.db
+	mergeId := db.nonMergeFileId
+	var mergedFiles []*DataFile
+	for fid, dataFile := range db.olderFiles {
+		if fid < mergeId {
+			mergedFiles = append(mergedFiles, dataFile)
+		}
+	}
+	// 已打开的文件在merge替换之后依然可读
+	hintFile, hintErr := os.Open(filepath.Join(db.options.DirPath, HintFileName))
+	mergeFinished, err := os.ReadFile(filepath.Join(db.options.DirPath, MergeFinishedFileName))
+	db.snapshots++
+	db.lock.Unlock()
+	defer db.releaseSnapshot()
+	if hintErr != nil {
+		return hintErr
+	}
+	defer hintFile.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, dataFile := range mergedFiles {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		if _, err := st.sendFile(replTargetMerge, filepath.Base(dataFile.FileName), func(off int64, n int) ([]byte, error) {
+			return dataFile.readNBytes(off, int64(n))
+		}, size); err != nil {
+			return err
+		}
+	}
+	stat, err := hintFile.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := st.sendFile(replTargetMerge, HintFileName, func(off int64, n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := hintFile.ReadAt(buf, off)
+		return buf, err
+	}, stat.Size()); err != nil {
+		return err
+	}
+	// merge 完成标识最后发送
+	if _, err := st.sendFile(replTargetMerge, MergeFinishedFileName, func(off int64, n int) ([]byte, error) {
+		return mergeFinished[off : off+int64(n)], nil
+	}, int64(len(mergeFinished))); err != nil {
+		return err
+	}
+	if err := st.send(replMsgMergeEnd, binary.AppendUvarint(nil, uint64(mergeId))); err != nil {
+		return err
+	}
+	st.mergeId = mergeId
+	return nil
+}
+
+// sendFile 分块发送文件，返回文件大小
+func (st *replicaStream) sendFile(target byte, name string, read func(off int64, n int) ([]byte, error), size int64) (int64, error) {
+	if size < 0 {
+		return 0, errs.ErrDataDirCorrupted
+	}
+	var off int64
+	for {
+		n := int(min(size-off, maxReplicationChunk))
+		data, err := read(off, n)
+		if err != nil {
+			return 0, err
+		}
+		payload := append([]byte{target}, binary.AppendUvarint(nil, uint64(len(name)))...)
+		payload = append(payload, name...)
+		payload = binary.AppendUvarint(payload, uint64(off))
+		if err := st.send(replMsgFile, payload, data); err != nil {
+			return 0, err
+		}
+		off += int64(n)
+		// 空文件同样需要发送一次
+		if off >= size {
+			return size, nil
+		}
+	}
+}
+
+func (st *replicaStream) sendChunk(fid uint32, offset int64, data []byte) error {
+	payload := binary.AppendUvarint(nil, uint64(fid))
+	payload = binary.AppendUvarint(payload, uint64(offset))
+	return st.send(replMsgChunk, payload, data)
+}
+
+func (st *replicaStream) sendHeartbeat() error {
+	db := st.db
+	var fid uint32
+	var offset int64
+	db.lock.RLock()
+	if db.activeFile != nil {
+		fid, offset = db.activeFile.FileId, db.activeFile.WriteOffset
+	}
+	db.lock.RUnlock()
+
+	payload := binary.AppendUvarint(nil, uint64(fid))
+	payload = binary.AppendUvarint(payload, uint64(offset))
+	if err := st.send(replMsgHeartbeat, payload); err != nil {
+		return err
+	}
+	return st.writer.Flush()
+}
+
+func (st *replicaStream) send(typ byte, payload ...[]byte) error {
+	return writeReplMessage(st.writer, typ, payload...)
+}
+
+// readRecordChunk 读取 [offset, limit) 中不超过 maxReplicationChunk 的数据
+// 数据不一定以完整的记录结束，从节点等待之后的数据拼接成完整的记录
+func readRecordChunk(dataFile *DataFile, offset, limit int64) ([]byte, error) {
+	return dataFile.readNBytes(offset, min(limit-offset, maxReplicationChunk))
+}
+
+// notifier 通知等待者有新的写入
+type notifier struct {
+	lock *sync.Mutex
+	ch   chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{lock: &sync.Mutex{}}
+}
+
+// wait 返回在下一次通知时关闭的通道
+func (n *notifier) wait() <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// writeReplMessage 写入一条消息，内容为多个部分的拼接
+func writeReplMessage(w *bufio.Writer, typ byte, payload ...[]byte) error {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+	header := append([]byte{typ}, binary.AppendUvarint(nil, uint64(size))...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, p := range payload {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReplMessage 读取一条消息
+func readReplMessage(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxReplicationMessage {
+		return 0, nil, errs.ErrReplicationOutOfSync
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return typ, payload, nil
+}
+
+// replDecoder 解析消息内容，出错之后的读取都返回零值
+type replDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *replDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errs.ErrReplicationOutOfSync
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *replDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) == 0 {
+		d.err = errs.ErrReplicationOutOfSync
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+// string 读取 uvarint 长度与内容
+func (d *replDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errs.ErrReplicationOutOfSync
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// rest 读取剩余的内容
+func (d *replDecoder) rest() []byte {
+	if d.err != nil {
+		return nil
+	}
+	b := d.buf
+	d.buf = nil
+	return b
+}
+
+// readFileAt 读取文件中从off开始的n个字节
+func readFileAt(fileName string, off int64, n int) ([]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, off); err != nil && !(errors.Is(err, io.EOF) && n == 0) {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// fileSizeOf 获取文件大小，出错时返回-1
+func fileSizeOf(fileName string) int64 {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return -1
+	}
+	return stat.Size()
+}
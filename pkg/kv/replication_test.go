@@ -0,0 +1,182 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+// startReplicationServer 在随机端口上启动复制服务
+func startReplicationServer(t *testing.T, db *DB) *ReplicationServer {
+	server := NewReplicationServer(db)
+	go func() {
+		_ = server.ListenAndServe("127.0.0.1:0")
+	}()
+	for server.Addr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server
+}
+
+// openTestFollower 打开一个从节点
+func openTestFollower(t *testing.T, dir string, server *ReplicationServer) *DB {
+	opts := GetDBDefaultOptions()
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	follower, err := OpenFollower(opts, server.Addr().String())
+	assert.Nil(t, err)
+	return follower
+}
+
+// waitReplicated 等待从节点追上主节点
+func waitReplicated(t *testing.T, primary, follower *DB) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		primary.lock.RLock()
+		fid, offset := primary.replicaPosition()
+		mergeId := primary.nonMergeFileId
+		primary.lock.RUnlock()
+		status := follower.ReplicationStatus()
+		follower.lock.RLock()
+		followerMergeId := follower.nonMergeFileId
+		follower.lock.RUnlock()
+		if status.FileId == fid && status.Offset == offset && followerMergeId == mergeId {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("follower not caught up: %+v", follower.ReplicationStatus())
+}
+
+// assertSameData 比较主从节点中的所有数据
+func assertSameData(t *testing.T, primary, follower *DB) {
+	keys := primary.ListKeys()
+	assert.Equal(t, len(keys), len(follower.ListKeys()))
+	for _, key := range keys {
+		expected, err := primary.Get(key)
+		assert.Nil(t, err)
+		val, err := follower.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+	}
+}
+
+func TestDB_Replication(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-primary")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	primary, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() { destroyDB(primary) }()
+	server := startReplicationServer(t, primary)
+	defer server.Close()
+
+	for i := range 500 {
+		assert.Nil(t, primary.Put(GetTestKey(i), RandomValue(64)))
+	}
+
+	followerDir, _ := os.MkdirTemp("", "bitcask-go-replication-follower")
+	follower := openTestFollower(t, followerDir, server)
+	defer func() { destroyDB(follower) }()
+	waitReplicated(t, primary, follower)
+	assertSameData(t, primary, follower)
+
+	// 从节点只读
+	assert.Equal(t, errs.ErrReadOnlyReplica, follower.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, errs.ErrReadOnlyReplica, follower.Delete(GetTestKey(1)))
+	assert.Equal(t, errs.ErrReadOnlyReplica, follower.Merge())
+	_, err = follower.CreateColumnFamily("users")
+	assert.Equal(t, errs.ErrReadOnlyReplica, err)
+
+	// 删除、批量写与列族实时同步
+	for i := range 100 {
+		assert.Nil(t, primary.Delete(GetTestKey(i)))
+	}
+	wb := primary.NewWriteBatch(GetDefaultWriteBatchOptions())
+	assert.Nil(t, wb.Put([]byte("batch-1"), []byte("v1")))
+	assert.Nil(t, wb.Put([]byte("batch-2"), []byte("v2")))
+	assert.Nil(t, wb.Commit())
+	users, err := primary.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	assert.Nil(t, users.Put([]byte("user-1"), []byte("alice")))
+	waitReplicated(t, primary, follower)
+	assertSameData(t, primary, follower)
+	followerUsers, err := follower.ColumnFamily("users")
+	assert.Nil(t, err)
+	val, err := followerUsers.Get([]byte("user-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("alice"), val)
+
+	// merge 生成的文件发送给从节点
+	assert.Nil(t, primary.Merge())
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, primary.Put(GetTestKey(i), RandomValue(64)))
+	}
+	waitReplicated(t, primary, follower)
+	assertSameData(t, primary, follower)
+
+	// merge 之后新加入的从节点全量同步
+	freshDir, _ := os.MkdirTemp("", "bitcask-go-replication-fresh")
+	fresh := openTestFollower(t, freshDir, server)
+	defer func() { destroyDB(fresh) }()
+	waitReplicated(t, primary, fresh)
+	assertSameData(t, primary, fresh)
+	assert.Equal(t, []string{DefaultColumnFamily, "users"}, fresh.ColumnFamilies())
+
+	// 从节点重启后从之前的位置继续
+	assert.Nil(t, follower.Close())
+	assert.Nil(t, primary.DropColumnFamily("users"))
+	for i := 600; i < 800; i++ {
+		assert.Nil(t, primary.Put(GetTestKey(i), RandomValue(64)))
+	}
+	follower = openTestFollower(t, followerDir, server)
+	waitReplicated(t, primary, follower)
+	assertSameData(t, primary, follower)
+	assert.Equal(t, []string{DefaultColumnFamily}, follower.ColumnFamilies())
+	assert.True(t, follower.ReplicationStatus().Connected)
+
+	// 超过单条消息大小的记录分多次发送
+	large := bytes.Repeat([]byte("v"), 2*maxReplicationChunk+100)
+	assert.Nil(t, primary.Put([]byte("large"), large))
+	assert.Nil(t, primary.Put([]byte("after-large"), []byte("value")))
+	waitReplicated(t, primary, follower)
+	assertSameData(t, primary, follower)
+}
+
+func TestReadReplMessage_TooLarge(t *testing.T) {
+	// 超过上限的消息在分配内存之前拒绝
+	header := append([]byte{replMsgChunk}, binary.AppendUvarint(nil, maxReplicationMessage+1)...)
+	_, _, err := readReplMessage(bufio.NewReader(bytes.NewReader(header)))
+	assert.Equal(t, errs.ErrReplicationOutOfSync, err)
+}
+
+func TestReplicaFiles_RejectPath(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-replica-files")
+	defer os.RemoveAll(dir)
+	recv := &replicaFiles{}
+	defer recv.close()
+
+	// 主节点发送的文件名不能跳出目标目录
+	for _, name := range []string{"", ".", "..", "../escape", "sub/file", `sub\file`} {
+		assert.Equal(t, errs.ErrReplicationOutOfSync, recv.write(filepath.Join(dir, "recv"), name, 0, []byte("x")), name)
+	}
+	_, err := os.Stat(filepath.Join(dir, "escape"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, errs.ErrReplicationOutOfSync, recv.write(filepath.Join(dir, "recv"), "file", -1, []byte("x")))
+	assert.Nil(t, recv.write(filepath.Join(dir, "recv"), "file", 0, []byte("x")))
+
+	// 未知的目标目录
+	db := &DB{options: &Options{DirPath: dir}}
+	payload := append([]byte{replTargetMerge + 1}, binary.AppendUvarint(nil, 4)...)
+	payload = append(payload, "file"...)
+	payload = binary.AppendUvarint(payload, 0)
+	assert.Equal(t, errs.ErrReplicationOutOfSync, db.applyReplMessage(replMsgFile, payload, recv))
+}
@@ -0,0 +1,181 @@
+package kv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// Snapshot 数据库某一时刻的只读视图，不受之后的写入与merge影响
+type Snapshot struct {
+	db    *DB
+	index Indexer
+	files map[uint32]*DataFile
+	seqNo uint64
+	now   int64 // 快照创建时间，用于判断过期
+	once  *sync.Once
+	err   error // 获取索引快照时的错误，此时快照中没有任何key
+}
+
+// NewSnapshot 创建快照，使用完毕后需要调用 Release 释放
+func (db *DB) NewSnapshot() *Snapshot {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.newSnapshot()
+}
+
+// newSnapshot 创建快照，调用方需持有库锁
+func (db *DB) newSnapshot() *Snapshot {
+	return db.newIndexSnapshot(db.index)
+}
+
+// newIndexSnapshot 创建指定索引的快照，调用方需持有库锁
+func (db *DB) newIndexSnapshot(index Indexer) *Snapshot {
+	// 写入与索引更新都在库锁内完成，此时索引中不存在提交了一半的批量写
+	files := make(map[uint32]*DataFile, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		files[fid] = dataFile
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileId] = db.activeFile
+	}
+	db.snapshots++
+
+	snapshot := index.Snapshot()
+	return &Snapshot{
+		db:    db,
+		index: snapshot,
+		err:   indexError(snapshot),
+		files: files,
+		seqNo: db.seqNo,
+		now:   time.Now().UnixNano(),
+		once:  &sync.Once{},
+	}
+}
+
+// Err 返回创建快照时的错误
+func (s *Snapshot) Err() error {
+	return s.err
+}
+
+// SeqNo 快照创建时最新的事务序列号
+func (s *Snapshot) SeqNo() uint64 {
+	return s.seqNo
+}
+
+// Get 根据key获取快照中的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errs.ErrKeyIsEmpty
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	pos := s.index.Get(key)
+	if pos == nil || pos.IsExpired(s.now) {
+		return nil, errs.ErrKeyNotFound
+	}
+	return s.getValueByPosition(pos)
+}
+
+// getUnsafe 根据key获取快照中的数据，返回的value不拷贝，bp 归还之前有效
+func (s *Snapshot) getUnsafe(key []byte, bp *[]byte) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	pos := s.index.Get(key)
+	if pos == nil || pos.IsExpired(s.now) {
+		return nil, errs.ErrKeyNotFound
+	}
+	d := s.files[pos.Fid]
+	if d == nil {
+		return nil, errs.ErrDataFileNotFound
+	}
+	return s.db.readValueUnsafe(d, pos, bp)
+}
+
+// NewIterator 创建快照上的迭代器，迭代器需要在快照释放前关闭
+func (s *Snapshot) NewIterator(opts *IteratorOptions) *Iterator {
+	it := &Iterator{
+		indexIter: s.index.IndexIterator(opts.Reverse),
+		options:   opts,
+		getValue:  s.getValueByPosition,
+		now:       s.now,
+		err:       s.err,
+	}
+	it.lower, it.upper = iteratorBounds(opts)
+	it.Rewind()
+	return it
+}
+
+// ListKeys 列出快照中所有key
+func (s *Snapshot) ListKeys() [][]byte {
+	indexIter := s.index.IndexIterator(false)
+	defer indexIter.Close()
+
+	keys := make([][]byte, 0, s.index.Size())
+	for indexIter.Rewind(); indexIter.Valid(); indexIter.Next() {
+		if indexIter.Value().IsExpired(s.now) {
+			continue
+		}
+		keys = append(keys, indexIter.Key())
+	}
+	return keys
+}
+
+// Fold 遍历快照中所有key
+func (s *Snapshot) Fold(f func(key, value []byte) bool) error {
+	if s.err != nil {
+		return s.err
+	}
+	indexIter := s.index.IndexIterator(false)
+	defer indexIter.Close()
+
+	for indexIter.Rewind(); indexIter.Valid(); indexIter.Next() {
+		pos := indexIter.Value()
+		if pos.IsExpired(s.now) {
+			continue
+		}
+		valueBytes, err := s.getValueByPosition(pos)
+		if err != nil {
+			return err
+		}
+		if !f(indexIter.Key(), valueBytes) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，允许merge关闭快照引用的旧文件
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		_ = s.index.Close()
+		s.db.releaseSnapshot()
+	})
+}
+
+// getValueByPosition 从快照引用的数据文件中读取数据
+func (s *Snapshot) getValueByPosition(pos *LogRecordPos) ([]byte, error) {
+	d := s.files[pos.Fid]
+	if d == nil {
+		return nil, errs.ErrDataFileNotFound
+	}
+	return s.db.readValue(d, pos, nil)
+}
+
+// releaseSnapshot 减少快照计数，最后一个快照释放后关闭merge替换下来的文件
+func (db *DB) releaseSnapshot() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.snapshots--
+	if db.snapshots > 0 {
+		return
+	}
+	for _, dataFile := range db.retiredFiles {
+		_ = dataFile.Close()
+	}
+	db.retiredFiles = nil
+}
@@ -0,0 +1,84 @@
+package kv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, RadixTree, BPlusTree} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+		opts.DirPath = dir
+		opts.MemoryIndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		assert.Nil(t, db.Put(GetTestKey(1), []byte("v1")))
+		assert.Nil(t, db.Put(GetTestKey(2), []byte("v2")))
+
+		snapshot := db.NewSnapshot()
+
+		// 快照之后的写入对快照不可见
+		assert.Nil(t, db.Put(GetTestKey(1), []byte("v1-new")))
+		assert.Nil(t, db.Delete(GetTestKey(2)))
+		assert.Nil(t, db.Put(GetTestKey(3), []byte("v3")))
+
+		val, err := snapshot.Get(GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+		val, err = snapshot.Get(GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), val)
+		_, err = snapshot.Get(GetTestKey(3))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		assert.Equal(t, 2, len(snapshot.ListKeys()))
+
+		val, err = db.Get(GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1-new"), val)
+
+		snapshot.Release()
+		snapshot.Release()
+		destroyDB(db)
+	}
+}
+
+func TestDB_SnapshotWithMerge(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := range 1000 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	snapshot := db.NewSnapshot()
+	iter := snapshot.NewIterator(GetDefaultIteratorOptions())
+
+	// merge 会替换快照引用的数据文件
+	for i := range 500 {
+		assert.Nil(t, db.Delete(GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, 1, len(db.retiredFiles))
+
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iter.Key(), val)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iter.Close()
+
+	snapshot.Release()
+	assert.Equal(t, 0, len(db.retiredFiles))
+	assert.Equal(t, 500, len(db.ListKeys()))
+}
@@ -1,10 +1,15 @@
 package kv
 
+import "os"
+
 type Stat struct {
 	KeyNum          uint  // key数量
 	DataFileNum     uint  // 数据文件数量
 	ReclaimableSize int64 // 可回收的空间大小
 	DiskSize        int64 // 磁盘使用大小
+
+	// ValueCache value缓存的统计信息，未开启缓存时为空
+	ValueCache *ValueCacheStat
 }
 
 func (db *DB) Stat() (*Stat, error) {
@@ -21,10 +26,26 @@ func (db *DB) Stat() (*Stat, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Stat{
+	stat := &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
-		DiskSize:        dirSize,
-	}, nil
+		DiskSize:        dirSize - db.preallocatedSize(),
+	}
+	if db.valueCache != nil {
+		stat.ValueCache = db.valueCache.stat()
+	}
+	return stat, nil
+}
+
+// preallocatedSize 活跃文件预分配但还没有写入的空间，不计入磁盘使用大小，调用方需持有库锁
+func (db *DB) preallocatedSize() int64 {
+	if db.activeFile == nil {
+		return 0
+	}
+	fi, err := os.Stat(db.activeFile.FileName)
+	if err != nil {
+		return 0
+	}
+	return max(fi.Size()-db.activeFile.WriteOffset, 0)
 }
@@ -0,0 +1,273 @@
+package kv
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// Txn 事务，所有读取都基于事务开始时的快照
+// 读写事务采用乐观并发控制，提交时检查读过的key是否被其他事务修改
+type Txn struct {
+	db            *DB
+	snapshot      *Snapshot
+	update        bool                  // 是否为读写事务
+	pendingWrites map[string]*LogRecord // 未提交的写入
+	reads         map[uint64]struct{}   // 读过的key的指纹
+	readBufs      []*[]byte             // GetUnsafe 返回的value引用的缓冲，事务结束时归还
+}
+
+// committedTxn 已提交事务修改过的key，用于冲突检测
+type committedTxn struct {
+	seqNo uint64
+	keys  map[uint64]struct{}
+}
+
+// View 执行只读事务，事务内的读取看到的是一致的时间点视图
+func (db *DB) View(fn func(txn *Txn) error) error {
+	txn := db.beginTxn(false)
+	defer txn.discard()
+	return fn(txn)
+}
+
+// Update 执行读写事务，fn 返回nil时提交
+// 事务开始后如果读过的key被其他写入修改，提交时返回 errs.ErrTxnConflict
+func (db *DB) Update(fn func(txn *Txn) error) error {
+	txn := db.beginTxn(true)
+	defer txn.discard()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.commit()
+}
+
+// Get 根据key获取数据，读写事务中可以读到自己未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errs.ErrKeyIsEmpty
+	}
+	if value, ok, err := txn.getPending(key); ok {
+		return value, err
+	}
+	return txn.snapshot.Get(key)
+}
+
+// GetUnsafe 根据key获取数据，不拷贝value
+// 返回的value直接引用映射的内存、value缓存或者事务持有的缓冲，只在事务结束之前有效，不能修改
+func (txn *Txn) GetUnsafe(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errs.ErrKeyIsEmpty
+	}
+	if value, ok, err := txn.getPending(key); ok {
+		return value, err
+	}
+	bp := getReadBuf()
+	value, err := txn.snapshot.getUnsafe(key, bp)
+	// 读取映射的内存或者缓存时没有使用缓冲，可以立即归还
+	if len(*bp) == 0 {
+		putReadBuf(bp)
+	} else {
+		txn.readBufs = append(txn.readBufs, bp)
+	}
+	return value, err
+}
+
+// getPending 读取读写事务中未提交的写入，没有时记录读过的key用于冲突检测
+func (txn *Txn) getPending(key []byte) ([]byte, bool, error) {
+	if !txn.update {
+		return nil, false, nil
+	}
+	if record := txn.pendingWrites[string(key)]; record != nil {
+		if record.Type == LogRecordDeleted || (record.Expire > 0 && record.Expire <= time.Now().UnixNano()) {
+			return nil, true, errs.ErrKeyNotFound
+		}
+		return record.Value, true, nil
+	}
+	txn.reads[fingerprint(key)] = struct{}{}
+	return nil, false, nil
+}
+
+// Put 添加数据
+func (txn *Txn) Put(key, value []byte) error {
+	return txn.putWithExpire(key, value, 0)
+}
+
+// PutWithTTL 添加数据并设置过期时间，ttl 必须大于0
+func (txn *Txn) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errs.ErrInvalidTTL
+	}
+	return txn.putWithExpire(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Delete 删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	if !txn.update {
+		return errs.ErrTxnReadOnly
+	}
+	txn.pendingWrites[string(key)] = &LogRecord{
+		Key:  key,
+		Type: LogRecordDeleted,
+	}
+	return nil
+}
+
+// NewIterator 创建迭代器，迭代器只能在事务内使用
+// 迭代器只包含事务开始时的数据，不包含未提交的写入，也不参与冲突检测
+func (txn *Txn) NewIterator(opts *IteratorOptions) *Iterator {
+	return txn.snapshot.NewIterator(opts)
+}
+
+// Fold 遍历事务开始时的所有key
+func (txn *Txn) Fold(f func(key, value []byte) bool) error {
+	return txn.snapshot.Fold(f)
+}
+
+// putWithExpire 添加数据，expire 为0表示永不过期
+func (txn *Txn) putWithExpire(key, value []byte, expire int64) error {
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	if !txn.update {
+		return errs.ErrTxnReadOnly
+	}
+	txn.pendingWrites[string(key)] = &LogRecord{
+		Key:    key,
+		Value:  value,
+		Type:   LogRecordNormal,
+		Expire: expire,
+	}
+	return nil
+}
+
+// commit 检查冲突并提交写入
+func (txn *Txn) commit() error {
+	// 只读的事务不会产生冲突
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+
+	db := txn.db
+	return db.commit(db.options.SyncWrites, func() error {
+		for _, committed := range db.committedTxns {
+			if committed.seqNo <= txn.snapshot.seqNo {
+				continue
+			}
+			for key := range committed.keys {
+				if _, ok := txn.reads[key]; ok {
+					return errs.ErrTxnConflict
+				}
+			}
+		}
+		return db.commitRecords(txn.pendingWrites)
+	})
+}
+
+// beginTxn 开始事务，读写事务需要登记开始的序列号
+func (db *DB) beginTxn(update bool) *Txn {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	txn := &Txn{
+		db:       db,
+		snapshot: db.newSnapshot(),
+		update:   update,
+	}
+	if update {
+		txn.pendingWrites = map[string]*LogRecord{}
+		txn.reads = map[uint64]struct{}{}
+		db.activeTxns[txn.snapshot.seqNo]++
+	}
+	return txn
+}
+
+// discard 结束事务，释放快照并清理不再需要的提交记录
+func (txn *Txn) discard() {
+	txn.snapshot.Release()
+	for _, bp := range txn.readBufs {
+		putReadBuf(bp)
+	}
+	txn.readBufs = nil
+	if !txn.update {
+		return
+	}
+
+	db := txn.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	startSeqNo := txn.snapshot.seqNo
+	db.activeTxns[startSeqNo]--
+	if db.activeTxns[startSeqNo] <= 0 {
+		delete(db.activeTxns, startSeqNo)
+	}
+
+	// 只需要保留比最早的活跃事务更新的提交记录
+	var minSeqNo uint64
+	var hasActive bool
+	for seqNo := range db.activeTxns {
+		if !hasActive || seqNo < minSeqNo {
+			minSeqNo = seqNo
+			hasActive = true
+		}
+	}
+	var remain []*committedTxn
+	if hasActive {
+		for _, committed := range db.committedTxns {
+			if committed.seqNo > minSeqNo {
+				remain = append(remain, committed)
+			}
+		}
+	}
+	db.committedTxns = remain
+}
+
+// trackCommit 存在活跃的读写事务时记录本次提交修改的key，调用方需持有库锁
+// deleted 为范围删除从默认列族中删除的key
+func (db *DB) trackCommit(seqNo uint64, records map[string]*LogRecord, deleted ...[]byte) {
+	if len(db.activeTxns) == 0 {
+		return
+	}
+	// 事务只读取默认列族
+	keys := make(map[uint64]struct{}, len(records)+len(deleted))
+	for _, record := range records {
+		if record.Family == defaultFamilyId {
+			keys[fingerprint(record.Key)] = struct{}{}
+		}
+	}
+	for _, key := range deleted {
+		keys[fingerprint(key)] = struct{}{}
+	}
+	db.committedTxns = append(db.committedTxns, &committedTxn{
+		seqNo: seqNo,
+		keys:  keys,
+	})
+}
+
+// trackWrite 记录非事务写入修改的key，调用方需持有库锁
+// 非事务写入不占用日志中的事务ID，这里只推进内存中的序列号
+func (db *DB) trackWrite(cf *ColumnFamily, keys ...[]byte) {
+	if len(db.activeTxns) == 0 || cf.id != defaultFamilyId || len(keys) == 0 {
+		return
+	}
+	fingerprints := make(map[uint64]struct{}, len(keys))
+	for _, key := range keys {
+		fingerprints[fingerprint(key)] = struct{}{}
+	}
+	db.seqNo++
+	db.committedTxns = append(db.committedTxns, &committedTxn{
+		seqNo: db.seqNo,
+		keys:  fingerprints,
+	})
+}
+
+// fingerprint 计算key的指纹，指纹冲突只会导致误报冲突
+func fingerprint(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64()
+}
@@ -0,0 +1,234 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_View(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-view")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := range 100 {
+		assert.Nil(t, db.Put(GetTestKey(i), []byte("0")))
+	}
+
+	// 并发的批量写每次都会更新全部key，一致的视图中所有value必须相同
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; ; round++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			wb := db.NewWriteBatch(GetDefaultWriteBatchOptions())
+			for i := range 100 {
+				_ = wb.Put(GetTestKey(i), []byte{byte('0' + round%10)})
+			}
+			_ = wb.Commit()
+		}
+	}()
+
+	for range 20 {
+		err := db.View(func(txn *Txn) error {
+			var first []byte
+			return txn.Fold(func(key, value []byte) bool {
+				if first == nil {
+					first = value
+				}
+				assert.Equal(t, first, value)
+				return true
+			})
+		})
+		assert.Nil(t, err)
+
+		err = db.View(func(txn *Txn) error {
+			iter := txn.NewIterator(GetDefaultIteratorOptions())
+			defer iter.Close()
+			first, err := txn.Get(GetTestKey(0))
+			assert.Nil(t, err)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				val, err := iter.Value()
+				assert.Nil(t, err)
+				assert.Equal(t, first, val)
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestDB_Update(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-update")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(GetTestKey(1), []byte("v1")))
+
+	// 1.读到自己未提交的写入，fn 返回错误时不提交
+	errAbort := errors.New("abort")
+	err = db.Update(func(txn *Txn) error {
+		assert.Nil(t, txn.Put(GetTestKey(2), []byte("v2")))
+		val, err := txn.Get(GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), val)
+
+		assert.Nil(t, txn.Delete(GetTestKey(1)))
+		_, err = txn.Get(GetTestKey(1))
+		assert.Equal(t, errs.ErrKeyNotFound, err)
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+	_, err = db.Get(GetTestKey(2))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// 2.正常提交
+	err = db.Update(func(txn *Txn) error {
+		return txn.Put(GetTestKey(2), []byte("v2"))
+	})
+	assert.Nil(t, err)
+	val, err := db.Get(GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 3.只读事务中不能写入
+	err = db.View(func(txn *Txn) error {
+		return txn.Put(GetTestKey(3), []byte("v3"))
+	})
+	assert.Equal(t, errs.ErrTxnReadOnly, err)
+
+	// 4.读过的key被其他写入修改后提交冲突
+	err = db.Update(func(txn *Txn) error {
+		_, err := txn.Get(GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put(GetTestKey(1), []byte("v1-new")))
+		return txn.Put(GetTestKey(1), []byte("v1-txn"))
+	})
+	assert.Equal(t, errs.ErrTxnConflict, err)
+	val, err = db.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-new"), val)
+
+	// 5.未读过的key被修改不冲突
+	err = db.Update(func(txn *Txn) error {
+		assert.Nil(t, db.Put(GetTestKey(1), []byte("v1-other")))
+		return txn.Put(GetTestKey(2), []byte("v2-new"))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db.activeTxns))
+	assert.Equal(t, 0, len(db.committedTxns))
+}
+
+func TestDB_UpdateCounter(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-update-counter")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	key := []byte("counter")
+	assert.Nil(t, db.Put(key, []byte("0")))
+
+	// 并发的读-改-写，冲突后重试，不应丢失更新
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				for {
+					err := db.Update(func(txn *Txn) error {
+						val, err := txn.Get(key)
+						if err != nil {
+							return err
+						}
+						n, _ := strconv.Atoi(string(val))
+						return txn.Put(key, []byte(strconv.Itoa(n+1)))
+					})
+					if err == nil {
+						break
+					}
+					assert.Equal(t, errs.ErrTxnConflict, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "400", string(val))
+}
+
+func TestDB_ViewGetUnsafe(t *testing.T) {
+	for _, ioType := range []IOType{IO_FILE, IO_MMAP} {
+		opts := GetDBDefaultOptions()
+		dir, _ := os.MkdirTemp("", "bitcask-go-view-unsafe")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.IOType = ioType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := range 1000 {
+			assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+		}
+		err = db.View(func(txn *Txn) error {
+			var values [][]byte
+			for i := range 1000 {
+				val, err := txn.GetUnsafe(GetTestKey(i))
+				assert.Nil(t, err)
+				values = append(values, val)
+			}
+			_, err := txn.GetUnsafe(GetTestKey(2000))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+
+			// merge 替换的文件在事务结束之前不会关闭，之前返回的value仍然有效
+			for i := range 500 {
+				assert.Nil(t, db.Delete(GetTestKey(i)))
+			}
+			assert.Nil(t, db.Merge())
+			for i, val := range values {
+				assert.Equal(t, GetTestKey(i), val)
+			}
+			return nil
+		})
+		assert.Nil(t, err)
+
+		// 读写事务中读取未提交的写入
+		err = db.Update(func(txn *Txn) error {
+			assert.Nil(t, txn.Put(GetTestKey(600), []byte("pending")))
+			val, err := txn.GetUnsafe(GetTestKey(600))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("pending"), val)
+			_, err = txn.GetUnsafe(GetTestKey(1))
+			assert.Equal(t, errs.ErrKeyNotFound, err)
+			return nil
+		})
+		assert.Nil(t, err)
+		val, err := db.Get(GetTestKey(600))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("pending"), val)
+		destroyDB(db)
+	}
+}
@@ -54,10 +54,7 @@ func CopyDir(src, dest string, exclude []string) error {
 			return os.MkdirAll(filepath.Join(dest, fileName), info.Mode())
 		}
 
-		data, err := os.ReadFile(filepath.Join(src, fileName))
-		if err != nil {
-			return err
-		}
-		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
+		// 数据文件可能很大，流式拷贝避免整个读入内存
+		return copyFile(filepath.Join(src, fileName), filepath.Join(dest, fileName), -1)
 	})
 }
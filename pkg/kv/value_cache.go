@@ -0,0 +1,165 @@
+package kv
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// valueCacheShardBits value缓存的分片数量的位数，分片减少并发读取时的锁竞争
+	valueCacheShardBits = 4
+	valueCacheShards    = 1 << valueCacheShardBits
+
+	// valueCacheEntryOverhead 每个缓存项除value之外占用的内存估算
+	valueCacheEntryOverhead = 96
+)
+
+// ValueCacheStat value缓存的统计信息
+type ValueCacheStat struct {
+	Hits      uint64 // 命中次数
+	Misses    uint64 // 未命中次数
+	Evictions uint64 // 因容量不足淘汰的数量
+	Entries   int    // 缓存项数量
+	Size      int64  // 缓存占用的内存估算，单位为字节
+}
+
+// valueCache 按照数据在日志中的位置缓存value，分片LRU，按照字节数限制容量
+// 记录写入之后不会被修改，位置变化的key自然不会再命中旧的缓存项，
+// 只有位置被重新使用时（merge替换文件、截断文件）才需要主动清理
+type valueCache struct {
+	shards    [valueCacheShards]*valueCacheShard
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type valueCacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type valueCacheEntry struct {
+	key   valueCacheKey
+	value []byte
+}
+
+type valueCacheShard struct {
+	lock     *sync.Mutex
+	capacity int64
+	size     int64
+	items    map[valueCacheKey]*list.Element
+	lru      *list.List // 头部为最近使用的缓存项
+}
+
+func newValueCache(capacity int64) *valueCache {
+	c := &valueCache{}
+	for i := range c.shards {
+		c.shards[i] = &valueCacheShard{
+			lock:     &sync.Mutex{},
+			capacity: capacity / valueCacheShards,
+			items:    make(map[valueCacheKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *valueCache) shard(key valueCacheKey) *valueCacheShard {
+	// 乘法哈希的高位分布更均匀
+	h := (uint64(key.fid)<<changeOffsetBits | uint64(key.offset)) * 0x9e3779b97f4a7c15
+	return c.shards[h>>(64-valueCacheShardBits)]
+}
+
+// get 获取缓存的value，已被替换的文件不使用缓存
+// 缓存的value写入之后不再修改，淘汰之后仍然有效，返回时不拷贝，调用方不能修改
+func (c *valueCache) get(d *DataFile, offset int64) ([]byte, bool) {
+	key := valueCacheKey{fid: d.FileId, offset: offset}
+	s := c.shard(key)
+	s.lock.Lock()
+	elem, ok := s.items[key]
+	if ok && !d.retired.Load() {
+		s.lru.MoveToFront(elem)
+		value := elem.Value.(*valueCacheEntry).value
+		s.lock.Unlock()
+		c.hits.Add(1)
+		return value, true
+	}
+	s.lock.Unlock()
+	c.misses.Add(1)
+	return nil, false
+}
+
+// add 缓存读取的value，缓存中保存拷贝
+// 替换文件时先标记文件再清理缓存，标记与插入都在分片锁内检查，已被替换的文件不会再插入缓存
+func (c *valueCache) add(d *DataFile, offset int64, value []byte) {
+	key := valueCacheKey{fid: d.FileId, offset: offset}
+	s := c.shard(key)
+	size := int64(len(value)) + valueCacheEntryOverhead
+	if size > s.capacity {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d.retired.Load() {
+		return
+	}
+	if elem, ok := s.items[key]; ok {
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.lru.PushFront(&valueCacheEntry{key: key, value: bytes.Clone(value)})
+	s.size += size
+	for s.size > s.capacity {
+		s.remove(s.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// removeFile 清理文件的所有缓存项
+func (c *valueCache) removeFile(fid uint32) {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		for key, elem := range s.items {
+			if key.fid == fid {
+				s.remove(elem)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// clear 清理所有缓存项
+func (c *valueCache) clear() {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		s.items = make(map[valueCacheKey]*list.Element)
+		s.lru.Init()
+		s.size = 0
+		s.lock.Unlock()
+	}
+}
+
+func (c *valueCache) stat() *ValueCacheStat {
+	stat := &ValueCacheStat{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for _, s := range c.shards {
+		s.lock.Lock()
+		stat.Entries += len(s.items)
+		stat.Size += s.size
+		s.lock.Unlock()
+	}
+	return stat
+}
+
+// remove 删除缓存项，调用方需持有分片锁
+func (s *valueCacheShard) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*valueCacheEntry)
+	delete(s.items, entry.key)
+	s.size -= int64(len(entry.value)) + valueCacheEntryOverhead
+}
@@ -0,0 +1,103 @@
+package kv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueCache_Evict(t *testing.T) {
+	cache := newValueCache(valueCacheShards * 1024)
+	d := &DataFile{FileId: 1}
+	for i := range 1000 {
+		cache.add(d, int64(i), RandomValue(128))
+	}
+	stat := cache.stat()
+	assert.LessOrEqual(t, stat.Size, int64(valueCacheShards*1024))
+	assert.Greater(t, stat.Evictions, uint64(0))
+	assert.Equal(t, 1000, stat.Entries+int(stat.Evictions))
+
+	// 超过分片容量的value不缓存
+	cache.add(d, 5000, RandomValue(2048))
+	_, ok := cache.get(d, 5000)
+	assert.False(t, ok)
+
+	// 被替换的文件不使用缓存
+	cache.add(d, 6000, []byte("value"))
+	value, ok := cache.get(d, 6000)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+	d.retired.Store(true)
+	_, ok = cache.get(d, 6000)
+	assert.False(t, ok)
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	opts := GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "bitcask-go-value-cache")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+
+	for i := range 1000 {
+		assert.Nil(t, db.Put(GetTestKey(i), GetTestKey(i)))
+	}
+	for range 3 {
+		val, err := db.Get(GetTestKey(10))
+		assert.Nil(t, err)
+		assert.Equal(t, GetTestKey(10), val)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stat.ValueCache.Hits)
+	assert.Equal(t, uint64(1), stat.ValueCache.Misses)
+
+	// 返回的是拷贝，修改不影响缓存
+	val, _ := db.Get(GetTestKey(10))
+	val[0] = 'x'
+	val, _ = db.Get(GetTestKey(10))
+	assert.Equal(t, GetTestKey(10), val)
+
+	// 更新之后位置变化，不会读到旧的缓存
+	assert.Nil(t, db.Put(GetTestKey(10), []byte("new-value")))
+	val, err = db.Get(GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), val)
+
+	// merge 之前的快照读取被替换的文件，merge 之后的文件重新使用相同的文件编号
+	for i := range 1000 {
+		_, err := db.Get(GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snapshot := db.NewSnapshot()
+	for i := range 500 {
+		assert.Nil(t, db.Delete(GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stat.ValueCache.Entries)
+
+	for range 2 {
+		for i := 500; i < 1000; i++ {
+			val, err := db.Get(GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, GetTestKey(i), val)
+			val, err = snapshot.Get(GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, GetTestKey(i), val)
+		}
+	}
+	val, err = snapshot.Get(GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, GetTestKey(1), val)
+	snapshot.Release()
+
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, 500, stat.ValueCache.Entries)
+}
@@ -0,0 +1,58 @@
+package raftkv
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// WriteBatch 批量写，所有操作作为一条日志提交，在状态机中原子地应用
+type WriteBatch struct {
+	node *Node
+	lock *sync.Mutex
+	ops  []op
+}
+
+// NewWriteBatch 创建批量写
+func (n *Node) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{node: n, lock: &sync.Mutex{}}
+}
+
+// Put 批量写入数据
+func (wb *WriteBatch) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	wb.ops = append(wb.ops, op{typ: opPut, key: bytes.Clone(key), value: bytes.Clone(value)})
+	return nil
+}
+
+// Delete 批量删除数据
+func (wb *WriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errs.ErrKeyIsEmpty
+	}
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+	wb.ops = append(wb.ops, op{typ: opDelete, key: bytes.Clone(key)})
+	return nil
+}
+
+// Commit 提交批量写，返回时已在多数节点上提交并在本节点应用
+// 超时或者领导者变化时日志可能已经提交，也可能被丢弃
+func (wb *WriteBatch) Commit() error {
+	wb.lock.Lock()
+	defer wb.lock.Unlock()
+
+	if len(wb.ops) == 0 {
+		return nil
+	}
+	if err := wb.node.submit(entryCommand, encodeOps(wb.ops)); err != nil {
+		return err
+	}
+	wb.ops = nil
+	return nil
+}
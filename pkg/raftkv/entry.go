@@ -0,0 +1,134 @@
+package raftkv
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+type entryType byte
+
+const (
+	// entryCommand 一组写操作
+	entryCommand entryType = iota
+	// entryConfig 成员变更，内容为变更后的全部成员，追加到日志时立即生效
+	entryConfig
+	// entryNoop 领导者当选后追加的空日志，用于提交之前任期的日志
+	entryNoop
+)
+
+// logEntry 一条raft日志
+type logEntry struct {
+	Index uint64
+	Term  uint64
+	Type  entryType
+	Data  []byte
+}
+
+// encodeEntry 编码日志，索引保存在key中
+//
+//	+-------------+--------+--------+
+//	| term varint |  type  |  data  |
+//	+-------------+--------+--------+
+func encodeEntry(e *logEntry) []byte {
+	buf := binary.AppendUvarint(nil, e.Term)
+	buf = append(buf, byte(e.Type))
+	return append(buf, e.Data...)
+}
+
+func decodeEntry(index uint64, buf []byte) (logEntry, error) {
+	term, n := binary.Uvarint(buf)
+	if n <= 0 || len(buf) <= n {
+		return logEntry{}, errs.ErrDataDirCorrupted
+	}
+	return logEntry{Index: index, Term: term, Type: entryType(buf[n]), Data: buf[n+1:]}, nil
+}
+
+type opType byte
+
+const (
+	opPut opType = iota
+	opDelete
+)
+
+// op 一次写操作
+type op struct {
+	typ   opType
+	key   []byte
+	value []byte
+}
+
+// encodeOps 编码一组写操作，每个操作为 type + varint key size + key + varint value size + value
+func encodeOps(ops []op) []byte {
+	var buf []byte
+	for _, o := range ops {
+		buf = append(buf, byte(o.typ))
+		buf = binary.AppendUvarint(buf, uint64(len(o.key)))
+		buf = append(buf, o.key...)
+		buf = binary.AppendUvarint(buf, uint64(len(o.value)))
+		buf = append(buf, o.value...)
+	}
+	return buf
+}
+
+func decodeOps(buf []byte) ([]op, error) {
+	var ops []op
+	for len(buf) > 0 {
+		o := op{typ: opType(buf[0])}
+		buf = buf[1:]
+		var ok bool
+		if o.key, buf, ok = readBytes(buf); !ok {
+			return nil, errs.ErrDataDirCorrupted
+		}
+		if o.value, buf, ok = readBytes(buf); !ok {
+			return nil, errs.ErrDataDirCorrupted
+		}
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+// encodeMembers 按节点编号排序编码成员，每个成员为 varint id size + id + varint addr size + addr
+func encodeMembers(members map[string]string) []byte {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var buf []byte
+	for _, id := range ids {
+		buf = binary.AppendUvarint(buf, uint64(len(id)))
+		buf = append(buf, id...)
+		buf = binary.AppendUvarint(buf, uint64(len(members[id])))
+		buf = append(buf, members[id]...)
+	}
+	return buf
+}
+
+func decodeMembers(buf []byte) (map[string]string, error) {
+	members := make(map[string]string)
+	for len(buf) > 0 {
+		id, rest, ok := readBytes(buf)
+		if !ok {
+			return nil, errs.ErrDataDirCorrupted
+		}
+		addr, rest, ok := readBytes(rest)
+		if !ok {
+			return nil, errs.ErrDataDirCorrupted
+		}
+		members[string(id)] = string(addr)
+		buf = rest
+	}
+	return members, nil
+}
+
+// readBytes 读取 varint 长度与内容
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, nil, false
+	}
+	return buf[n : n+int(size)], buf[n+int(size):], true
+}
@@ -0,0 +1,153 @@
+package raftkv
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+// metaFamilyName 状态机中保存应用位置与成员的列族，与用户数据分开
+const metaFamilyName = "raft-meta"
+
+var (
+	appliedKey = []byte("applied")
+	membersKey = []byte("members")
+)
+
+// stateMachine 使用 kv.DB 作为状态机，应用位置与数据在同一个批量写中提交
+// 崩溃之后从保存的应用位置继续重放日志，因此不需要每次同步
+type stateMachine struct {
+	dirPath     string
+	options     kv.Options
+	db          *kv.DB
+	meta        *kv.ColumnFamily
+	applied     uint64            // 已应用的最后一条日志
+	appliedTerm uint64            // applied 所在的任期
+	members     map[string]string // 已应用的成员配置
+}
+
+func openStateMachine(dirPath string, options *kv.Options) (*stateMachine, error) {
+	sm := &stateMachine{dirPath: dirPath, options: *options}
+	sm.options.DirPath = dirPath
+	if err := sm.open(); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+func (sm *stateMachine) open() error {
+	db, err := kv.Open(&sm.options)
+	if err != nil {
+		return err
+	}
+	meta, err := db.ColumnFamily(metaFamilyName)
+	if err == errs.ErrColumnFamilyNotFound {
+		meta, err = db.CreateColumnFamily(metaFamilyName)
+	}
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	sm.db, sm.meta = db, meta
+	sm.applied, sm.appliedTerm, sm.members = 0, 0, map[string]string{}
+
+	buf, err := meta.Get(appliedKey)
+	if err == errs.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 16 {
+		return errs.ErrDataDirCorrupted
+	}
+	sm.applied, sm.appliedTerm = binary.BigEndian.Uint64(buf), binary.BigEndian.Uint64(buf[8:])
+
+	buf, err = meta.Get(membersKey)
+	if err == errs.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sm.members, err = decodeMembers(buf)
+	return err
+}
+
+// apply 应用一条已提交的日志
+func (sm *stateMachine) apply(e *logEntry) error {
+	wb := sm.db.NewWriteBatch(&kv.WriteBatchOptions{MaxBatchSize: math.MaxInt, EachSyncWrites: false})
+	var members map[string]string
+	switch e.Type {
+	case entryCommand:
+		ops, err := decodeOps(e.Data)
+		if err != nil {
+			return err
+		}
+		for _, o := range ops {
+			if o.typ == opDelete {
+				err = wb.Delete(o.key)
+			} else {
+				err = wb.Put(o.key, o.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case entryConfig:
+		var err error
+		if members, err = decodeMembers(e.Data); err != nil {
+			return err
+		}
+		if err := wb.PutCF(sm.meta, membersKey, e.Data); err != nil {
+			return err
+		}
+	}
+
+	applied := binary.BigEndian.AppendUint64(nil, e.Index)
+	applied = binary.BigEndian.AppendUint64(applied, e.Term)
+	if err := wb.PutCF(sm.meta, appliedKey, applied); err != nil {
+		return err
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	sm.applied, sm.appliedTerm = e.Index, e.Term
+	if members != nil {
+		sm.members = members
+	}
+	return nil
+}
+
+// checkpoint 将当前状态备份到 dir，作为快照
+func (sm *stateMachine) checkpoint(dir string) error {
+	return sm.db.Backup(dir)
+}
+
+// restore 使用快照替换状态机的数据
+func (sm *stateMachine) restore(snapshotDir string) error {
+	if err := sm.db.Close(); err != nil {
+		return err
+	}
+	tmpDir := sm.dirPath + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := kv.CopyDir(snapshotDir, tmpDir, nil); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(sm.dirPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, sm.dirPath); err != nil {
+		return err
+	}
+	return sm.open()
+}
+
+func (sm *stateMachine) close() error {
+	return sm.db.Close()
+}
@@ -0,0 +1,424 @@
+package raftkv
+
+import (
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+const (
+	raftLogDirName = "raft-log"
+	dataDirName    = "data"
+)
+
+// Node 一个raft节点，raft日志与状态机都保存在 HiFiDB 的数据文件中
+// 写入与读取都需要在领导者上执行，其他节点返回 ErrNotLeader，可以通过 Leader 找到领导者
+type Node struct {
+	options   *Options
+	lock      *sync.Mutex
+	storage   *raftStorage
+	sm        *stateMachine
+	smLock    *sync.RWMutex // 保护状态机，应用日志与安装快照时持有写锁
+	snapLock  *sync.RWMutex // 发送快照期间持有读锁，阻止快照被替换
+	transport *transport
+	listener  net.Listener
+	conns     map[net.Conn]struct{}
+
+	role             role
+	leaderId         string
+	lastContact      time.Time         // 最近一次收到领导者消息的时间
+	electionDeadline time.Time         // 超过该时间没有收到领导者的消息时发起选举
+	members          map[string]string // 当前的成员，包括尚未提交的成员变更
+	baseMembers      map[string]string // 状态机中已应用的成员，日志中没有成员变更时使用
+	commitIndex      uint64
+	lastApplied      uint64
+	appliedCh        chan struct{}        // 应用位置前进时关闭并替换
+	applyCh          chan struct{}        // 提交位置前进时通知应用协程
+	leader           *leaderState         // 领导者状态，不是领导者时为空
+	proposals        map[uint64]*proposal // 本节点作为领导者追加、尚未应用的日志
+
+	recvIndex uint64 // 正在接收的快照
+	recvTerm  uint64
+	recvSeq   uint64 // 下一个快照分块的序号
+
+	closed  bool
+	closeCh chan struct{}
+	wg      *sync.WaitGroup
+}
+
+// proposal 等待应用的日志，应用时任期不同说明日志已被新的领导者覆盖
+type proposal struct {
+	term uint64
+	done chan error
+}
+
+// Open 打开raft节点并开始监听，第一次启动时使用 Peers 作为初始成员
+func Open(options *Options) (*Node, error) {
+	if err := checkOptions(options); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	snapIndex, snapTerm, err := loadSnapshot(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	sm, err := openStateMachine(filepath.Join(options.DirPath, dataDirName), options.KVOptions)
+	if err != nil {
+		return nil, err
+	}
+	// 安装快照时被中断，状态机还没有替换
+	if sm.applied < snapIndex {
+		if err := sm.restore(filepath.Join(options.DirPath, snapshotDirName(snapIndex, snapTerm))); err != nil {
+			return nil, err
+		}
+	}
+	storage, err := openRaftStorage(filepath.Join(options.DirPath, raftLogDirName), snapIndex, snapTerm)
+	if err != nil {
+		_ = sm.close()
+		return nil, err
+	}
+
+	n := &Node{
+		options:     options,
+		lock:        &sync.Mutex{},
+		storage:     storage,
+		sm:          sm,
+		smLock:      &sync.RWMutex{},
+		snapLock:    &sync.RWMutex{},
+		transport:   newTransport(options.ElectionTimeout),
+		conns:       map[net.Conn]struct{}{},
+		baseMembers: sm.members,
+		commitIndex: sm.applied,
+		lastApplied: sm.applied,
+		appliedCh:   make(chan struct{}),
+		applyCh:     make(chan struct{}, 1),
+		proposals:   map[uint64]*proposal{},
+		closeCh:     make(chan struct{}),
+		wg:          &sync.WaitGroup{},
+	}
+	if err := n.bootstrap(); err != nil {
+		_ = n.closeStorage()
+		return nil, err
+	}
+	n.members = n.latestMembers()
+
+	if n.listener, err = net.Listen("tcp", options.Addr); err != nil {
+		_ = n.closeStorage()
+		return nil, err
+	}
+	n.resetElectionTimer()
+	n.wg.Add(3)
+	go n.serve()
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// bootstrap 第一次启动时将初始成员写入第一条日志，所有初始节点的第一条日志相同
+func (n *Node) bootstrap() error {
+	if len(n.options.Peers) == 0 || n.storage.term > 0 || n.storage.lastIndex() > 0 {
+		return nil
+	}
+	if err := n.storage.setHardState(1, ""); err != nil {
+		return err
+	}
+	return n.storage.append([]logEntry{{Index: 1, Term: 1, Type: entryConfig, Data: encodeMembers(n.options.Peers)}})
+}
+
+// Put 写入数据，返回时已在多数节点上提交并在本节点应用
+func (n *Node) Put(key, value []byte) error {
+	wb := n.NewWriteBatch()
+	if err := wb.Put(key, value); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// Delete 删除数据
+func (n *Node) Delete(key []byte) error {
+	wb := n.NewWriteBatch()
+	if err := wb.Delete(key); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+// Get 线性一致地读取数据
+// 领导者记录当前的提交位置，确认自己仍是领导者之后，等待状态机应用到该位置再读取
+func (n *Node) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errs.ErrKeyIsEmpty
+	}
+	index, err := n.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.waitApplied(index); err != nil {
+		return nil, err
+	}
+	n.smLock.RLock()
+	defer n.smLock.RUnlock()
+	return n.sm.db.Get(key)
+}
+
+// AddMember 添加成员，新节点使用空的 Peers 启动，由领导者发送快照与日志
+func (n *Node) AddMember(id, addr string) error {
+	return n.changeMembers(func(members map[string]string) error {
+		if _, ok := members[id]; ok {
+			return errs.ErrMemberExists
+		}
+		members[id] = addr
+		return nil
+	})
+}
+
+// RemoveMember 移除成员，移除领导者自己时在变更提交之后退位
+func (n *Node) RemoveMember(id string) error {
+	return n.changeMembers(func(members map[string]string) error {
+		if _, ok := members[id]; !ok {
+			return errs.ErrMemberNotFound
+		}
+		delete(members, id)
+		return nil
+	})
+}
+
+// changeMembers 每次变更一个成员，上一次变更提交之前不能开始新的变更
+func (n *Node) changeMembers(change func(members map[string]string) error) error {
+	n.lock.Lock()
+	if n.role != leader {
+		n.lock.Unlock()
+		return errs.ErrNotLeader
+	}
+	// 当选之后需要先提交本任期的日志，确认之前的成员变更都已提交
+	if n.configIndex() > n.commitIndex || n.commitIndex < n.leader.noopIndex {
+		n.lock.Unlock()
+		return errs.ErrMembershipChanging
+	}
+	members := maps.Clone(n.members)
+	if err := change(members); err != nil {
+		n.lock.Unlock()
+		return err
+	}
+	p, err := n.propose(entryConfig, encodeMembers(members))
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return n.wait(p.done)
+}
+
+// Members 获取当前的成员，节点编号 -> 地址
+func (n *Node) Members() map[string]string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return maps.Clone(n.members)
+}
+
+// Leader 获取已知的领导者编号与地址，未知时为空
+func (n *Node) Leader() (string, string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leaderId, n.members[n.leaderId]
+}
+
+// IsLeader 是否为领导者
+func (n *Node) IsLeader() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role == leader
+}
+
+// Addr 节点之间通信的监听地址
+func (n *Node) Addr() net.Addr {
+	return n.listener.Addr()
+}
+
+// Close 停止节点并关闭存储
+func (n *Node) Close() error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.closeCh)
+	_ = n.listener.Close()
+	for conn := range n.conns {
+		_ = conn.Close()
+	}
+	n.lock.Unlock()
+
+	n.transport.close()
+	n.wg.Wait()
+	return n.closeStorage()
+}
+
+func (n *Node) closeStorage() error {
+	err := n.storage.close()
+	if smErr := n.sm.close(); err == nil {
+		err = smErr
+	}
+	return err
+}
+
+// submit 追加日志并等待应用
+func (n *Node) submit(typ entryType, data []byte) error {
+	n.lock.Lock()
+	p, err := n.propose(typ, data)
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return n.wait(p.done)
+}
+
+// wait 等待请求完成，超时或节点关闭时返回错误
+func (n *Node) wait(done chan error) error {
+	timer := time.NewTimer(n.options.RequestTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errs.ErrRaftTimeout
+	case <-n.closeCh:
+		return errs.ErrRaftClosed
+	}
+}
+
+// waitApplied 等待状态机应用到 index
+func (n *Node) waitApplied(index uint64) error {
+	timer := time.NewTimer(n.options.RequestTimeout)
+	defer timer.Stop()
+	for {
+		n.lock.Lock()
+		if n.lastApplied >= index {
+			n.lock.Unlock()
+			return nil
+		}
+		ch := n.appliedCh
+		n.lock.Unlock()
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return errs.ErrRaftTimeout
+		case <-n.closeCh:
+			return errs.ErrRaftClosed
+		}
+	}
+}
+
+// applyLoop 依次应用已提交的日志
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		n.lock.Lock()
+		var entries []logEntry
+		var err error
+		if n.commitIndex > n.lastApplied {
+			entries, err = n.storage.slice(n.lastApplied+1, min(n.commitIndex, n.lastApplied+maxApplyEntries)+1)
+		}
+		n.lock.Unlock()
+
+		if err == nil && len(entries) > 0 {
+			if err := n.applyEntries(entries); err == nil {
+				continue
+			}
+		}
+		// 没有需要应用的日志，或者读取、应用失败后等待下一次提交或心跳间隔之后重试
+		select {
+		case <-n.applyCh:
+		case <-time.After(n.options.HeartbeatInterval):
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+func (n *Node) applyEntries(entries []logEntry) error {
+	n.smLock.Lock()
+	defer n.smLock.Unlock()
+
+	var err error
+	for i := range entries {
+		// 安装快照之后已经包含
+		if entries[i].Index != n.sm.applied+1 {
+			continue
+		}
+		if err = n.sm.apply(&entries[i]); err != nil {
+			break
+		}
+	}
+
+	n.lock.Lock()
+	n.advanceApplied()
+	needSnapshot := n.options.SnapshotThreshold > 0 && n.sm.applied-n.storage.snapIndex >= n.options.SnapshotThreshold
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if needSnapshot {
+		return n.takeSnapshot()
+	}
+	return nil
+}
+
+// advanceApplied 更新应用位置并通知等待者，调用方需持有状态机锁与节点锁
+func (n *Node) advanceApplied() {
+	if n.sm.applied <= n.lastApplied {
+		return
+	}
+	n.lastApplied = n.sm.applied
+	n.baseMembers = n.sm.members
+	for index, p := range n.proposals {
+		if index > n.lastApplied {
+			continue
+		}
+		if term, ok := n.storage.termOf(index); ok && term == p.term {
+			p.done <- nil
+		} else {
+			p.done <- errs.ErrLeadershipLost
+		}
+		delete(n.proposals, index)
+	}
+	close(n.appliedCh)
+	n.appliedCh = make(chan struct{})
+}
+
+// latestMembers 日志中最新的成员变更，没有时使用状态机中的成员，调用方需持有节点锁
+func (n *Node) latestMembers() map[string]string {
+	if index := n.configIndex(); index > 0 {
+		if e, err := n.storage.entry(index); err == nil {
+			if members, err := decodeMembers(e.Data); err == nil {
+				return members
+			}
+		}
+	}
+	return n.baseMembers
+}
+
+// configIndex 日志中最新的成员变更的位置，没有时返回0，调用方需持有节点锁
+func (n *Node) configIndex() uint64 {
+	return n.storage.configIndex()
+}
+
+// quorum 多数派的数量，调用方需持有节点锁
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+// isMember 自己是否为成员，不是成员的节点不参与选举，调用方需持有节点锁
+func (n *Node) isMember() bool {
+	_, ok := n.members[n.options.ID]
+	return ok
+}
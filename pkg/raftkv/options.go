@@ -0,0 +1,75 @@
+package raftkv
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+type Options struct {
+	// 节点编号，集群内唯一
+	ID string
+
+	// 节点之间通信的监听地址
+	Addr string
+
+	// 数据目录，包含raft日志、状态机与快照
+	DirPath string
+
+	// 初始集群的成员，节点编号 -> 地址，只在第一次启动时使用
+	// 通过 AddMember 加入已有集群的节点为空
+	Peers map[string]string
+
+	// 选举超时的下限，实际的超时在 [ElectionTimeout, 2*ElectionTimeout) 之间随机
+	ElectionTimeout time.Duration
+
+	// 领导者发送心跳的间隔，应远小于 ElectionTimeout
+	HeartbeatInterval time.Duration
+
+	// 等待写入提交或读取确认的超时时间
+	RequestTimeout time.Duration
+
+	// 上一次快照之后应用的日志数量超过该值时生成快照并压缩日志，为0时不生成快照
+	SnapshotThreshold uint64
+
+	// 状态机使用的存储配置，DirPath 被忽略
+	KVOptions *kv.Options
+}
+
+// GetDefaultOptions 获取默认配置
+func GetDefaultOptions() *Options {
+	return &Options{
+		DirPath:           "./raft-data",
+		ElectionTimeout:   time.Second,
+		HeartbeatInterval: 100 * time.Millisecond,
+		RequestTimeout:    5 * time.Second,
+		SnapshotThreshold: 10000,
+		KVOptions:         kv.GetDBDefaultOptions(),
+	}
+}
+
+func checkOptions(options *Options) error {
+	if options.ID == "" {
+		return errors.New("raft node id is empty")
+	}
+	if options.Addr == "" {
+		return errors.New("raft node address is empty")
+	}
+	if options.DirPath == "" {
+		return errors.New("raft dir path is empty")
+	}
+	if options.HeartbeatInterval <= 0 || options.ElectionTimeout <= options.HeartbeatInterval {
+		return errors.New("election timeout must be greater than heartbeat interval")
+	}
+	if options.RequestTimeout <= 0 {
+		return errors.New("request timeout must be positive")
+	}
+	if options.KVOptions == nil {
+		return errors.New("kv options is nil")
+	}
+	if len(options.Peers) > 0 && options.Peers[options.ID] == "" {
+		return errors.New("initial peers must contain the node itself")
+	}
+	return nil
+}
@@ -0,0 +1,734 @@
+package raftkv
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+const (
+	// maxAppendEntries 一次发送的最大日志数量
+	maxAppendEntries = 512
+
+	// maxApplyEntries 一次应用的最大日志数量
+	maxApplyEntries = 512
+)
+
+// leaderState 一个任期内的领导者状态，退位时 stopCh 关闭
+type leaderState struct {
+	term      uint64
+	since     time.Time
+	noopIndex uint64 // 当选时追加的空日志，提交之后之前任期的日志都已提交
+	peers     map[string]*peerState
+	readRound uint64         // 读请求的轮次，之后发送的消息被确认时说明仍是领导者
+	reads     []*readRequest // 等待确认的读请求
+	stopCh    chan struct{}
+}
+
+// peerState 领导者记录的其他节点的复制进度
+type peerState struct {
+	addr        string
+	nextIndex   uint64
+	matchIndex  uint64
+	ackedRound  uint64    // 已确认的最大轮次
+	lastContact time.Time // 最近一次收到响应的时间
+	trigger     chan struct{}
+	stopCh      chan struct{} // 成员被移除时关闭
+}
+
+type readRequest struct {
+	round uint64
+	done  chan error
+}
+
+// run 检查选举超时，领导者检查是否仍能联系到多数节点
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	now := time.Now()
+	switch {
+	case n.role == leader:
+		if !n.checkQuorum(now) {
+			n.becomeFollower(n.storage.term)
+		}
+	case now.After(n.electionDeadline):
+		if n.isMember() {
+			n.startElection()
+		} else {
+			n.resetElectionTimer()
+		}
+	}
+}
+
+// checkQuorum 领导者在一个选举超时内联系不到多数节点时退位，避免网络隔离的领导者继续服务读请求
+func (n *Node) checkQuorum(now time.Time) bool {
+	ls := n.leader
+	if now.Sub(ls.since) < n.options.ElectionTimeout {
+		return true
+	}
+	count := 0
+	for id := range n.members {
+		if id == n.options.ID {
+			count++
+		} else if p := ls.peers[id]; p != nil && now.Sub(p.lastContact) < n.options.ElectionTimeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.options.ElectionTimeout
+	n.electionDeadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+// startElection 进入下一个任期并请求其他成员投票，调用方需持有节点锁
+func (n *Node) startElection() {
+	if err := n.storage.setHardState(n.storage.term+1, n.options.ID); err != nil {
+		n.resetElectionTimer()
+		return
+	}
+	n.role = candidate
+	n.leaderId = ""
+	n.resetElectionTimer()
+
+	term := n.storage.term
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	args := &requestVoteArgs{
+		Term:        term,
+		CandidateId: n.options.ID,
+		LastIndex:   n.storage.lastIndex(),
+		LastTerm:    n.storage.lastTerm(),
+	}
+	for id, addr := range n.members {
+		if id == n.options.ID {
+			continue
+		}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			resp, err := n.transport.call(addr, &rpcMessage{Vote: args})
+			if err != nil || resp.VoteReply == nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if resp.VoteReply.Term > n.storage.term {
+				n.becomeFollower(resp.VoteReply.Term)
+				return
+			}
+			if n.role != candidate || n.storage.term != term || !resp.VoteReply.Granted {
+				return
+			}
+			if votes++; votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeFollower 转为跟随者，任期增加时清除投票，调用方需持有节点锁
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.storage.term {
+		// 持久化失败时保持原来的任期，之后收到的消息会再次尝试
+		if err := n.storage.setHardState(term, ""); err == nil {
+			n.leaderId = ""
+		}
+	}
+	if ls := n.leader; ls != nil {
+		close(ls.stopCh)
+		for _, r := range ls.reads {
+			r.done <- errs.ErrNotLeader
+		}
+		n.leader = nil
+	}
+	n.role = follower
+	n.resetElectionTimer()
+}
+
+// becomeLeader 当选领导者，追加一条空日志并开始复制，调用方需持有节点锁
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leaderId = n.options.ID
+	n.leader = &leaderState{
+		term:   n.storage.term,
+		since:  time.Now(),
+		peers:  map[string]*peerState{},
+		stopCh: make(chan struct{}),
+	}
+	noop := logEntry{Index: n.storage.lastIndex() + 1, Term: n.storage.term, Type: entryNoop}
+	if err := n.storage.append([]logEntry{noop}); err != nil {
+		n.becomeFollower(n.storage.term)
+		return
+	}
+	n.leader.noopIndex = noop.Index
+	n.updatePeers()
+	n.advanceCommit()
+}
+
+// propose 领导者追加一条日志，调用方需持有节点锁
+func (n *Node) propose(typ entryType, data []byte) (*proposal, error) {
+	if n.closed {
+		return nil, errs.ErrRaftClosed
+	}
+	if n.role != leader {
+		return nil, errs.ErrNotLeader
+	}
+	e := logEntry{Index: n.storage.lastIndex() + 1, Term: n.storage.term, Type: typ, Data: data}
+	if err := n.storage.append([]logEntry{e}); err != nil {
+		return nil, err
+	}
+	p := &proposal{term: e.Term, done: make(chan error, 1)}
+	n.proposals[e.Index] = p
+	// 成员变更追加之后立即生效
+	if typ == entryConfig {
+		n.members = n.latestMembers()
+		n.updatePeers()
+	}
+	n.advanceCommit()
+	n.triggerPeers()
+	return p, nil
+}
+
+// updatePeers 为新的成员开始复制，调用方需持有节点锁
+func (n *Node) updatePeers() {
+	ls := n.leader
+	for id, addr := range n.members {
+		if id == n.options.ID || ls.peers[id] != nil {
+			continue
+		}
+		p := &peerState{
+			addr:        addr,
+			nextIndex:   n.storage.lastIndex() + 1,
+			lastContact: time.Now(),
+			trigger:     make(chan struct{}, 1),
+			stopCh:      make(chan struct{}),
+		}
+		ls.peers[id] = p
+		n.wg.Add(1)
+		go n.replicate(ls, p)
+	}
+}
+
+// prunePeers 成员变更提交之后停止向已移除的成员复制，调用方需持有节点锁
+// 变更提交之前继续复制，使被移除的节点得知自己已不是成员，不再发起选举
+func (n *Node) prunePeers() {
+	ls := n.leader
+	for id, p := range ls.peers {
+		if _, ok := n.members[id]; !ok {
+			close(p.stopCh)
+			delete(ls.peers, id)
+		}
+	}
+}
+
+func (n *Node) triggerPeers() {
+	for _, p := range n.leader.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advanceCommit 提交多数成员已复制的本任期日志，调用方需持有节点锁
+func (n *Node) advanceCommit() {
+	ls := n.leader
+	for index := n.storage.lastIndex(); index > n.commitIndex; index-- {
+		// 只能通过统计副本数提交本任期的日志，之前任期的日志随之提交
+		if term, _ := n.storage.termOf(index); term != ls.term {
+			return
+		}
+		count := 0
+		for id := range n.members {
+			if id == n.options.ID {
+				count++
+			} else if p := ls.peers[id]; p != nil && p.matchIndex >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.setCommitIndex(index)
+			return
+		}
+	}
+}
+
+// setCommitIndex 更新提交位置，调用方需持有节点锁
+func (n *Node) setCommitIndex(index uint64) {
+	n.commitIndex = index
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+	if n.role != leader {
+		return
+	}
+	n.triggerPeers()
+	if n.configIndex() <= n.commitIndex {
+		n.prunePeers()
+		// 已将自己移除的领导者退位
+		if !n.isMember() {
+			n.becomeFollower(n.storage.term)
+		}
+	}
+}
+
+// replicate 向一个成员复制日志，空闲时发送心跳，直到退位或者成员被移除
+func (n *Node) replicate(ls *leaderState, p *peerState) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if n.sendAppendEntries(ls, p) {
+			// 仍有日志需要发送，检查是否退位之后继续发送
+			select {
+			case <-ls.stopCh:
+				return
+			case <-p.stopCh:
+				return
+			case <-n.closeCh:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-p.trigger:
+		case <-ticker.C:
+		case <-ls.stopCh:
+			return
+		case <-p.stopCh:
+			return
+		case <-n.closeCh:
+			return
+		}
+	}
+}
+
+// sendAppendEntries 发送一次日志或心跳，返回是否需要立即继续发送
+func (n *Node) sendAppendEntries(ls *leaderState, p *peerState) bool {
+	n.lock.Lock()
+	if n.leader != ls {
+		n.lock.Unlock()
+		return false
+	}
+	// 需要的日志已被压缩，发送快照
+	if p.nextIndex <= n.storage.snapIndex {
+		n.lock.Unlock()
+		return n.sendSnapshot(ls, p)
+	}
+	prevIndex := p.nextIndex - 1
+	prevTerm, _ := n.storage.termOf(prevIndex)
+	entries, err := n.storage.slice(p.nextIndex, min(n.storage.lastIndex(), prevIndex+maxAppendEntries)+1)
+	if err != nil {
+		// 读取日志失败，等待下一次心跳重试
+		n.lock.Unlock()
+		return false
+	}
+	args := &appendEntriesArgs{
+		Term:         ls.term,
+		LeaderId:     n.options.ID,
+		PrevIndex:    prevIndex,
+		PrevTerm:     prevTerm,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	round := ls.readRound
+	n.lock.Unlock()
+
+	resp, err := n.transport.call(p.addr, &rpcMessage{Append: args})
+	if err != nil || resp.AppendReply == nil {
+		return false
+	}
+	reply := resp.AppendReply
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.acknowledge(ls, p, reply.Term, round) {
+		return false
+	}
+	if !reply.Success {
+		p.nextIndex = max(1, min(reply.ConflictIndex, prevIndex))
+		return true
+	}
+	if match := prevIndex + uint64(len(args.Entries)); match > p.matchIndex {
+		p.matchIndex = match
+		n.advanceCommit()
+	}
+	p.nextIndex = p.matchIndex + 1
+	return n.leader == ls && p.nextIndex <= n.storage.lastIndex()
+}
+
+// sendSnapshot 分块发送当前的快照，返回是否发送成功
+func (n *Node) sendSnapshot(ls *leaderState, p *peerState) bool {
+	n.snapLock.RLock()
+	defer n.snapLock.RUnlock()
+
+	n.lock.Lock()
+	if n.leader != ls {
+		n.lock.Unlock()
+		return false
+	}
+	snapIndex, snapTerm, dir := n.storage.snapIndex, n.storage.snapTerm, n.snapshotDir()
+	round := ls.readRound
+	n.lock.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	args := installSnapshotArgs{Term: ls.term, LeaderId: n.options.ID, SnapIndex: snapIndex, SnapTerm: snapTerm}
+	send := func() bool {
+		resp, err := n.transport.call(p.addr, &rpcMessage{Snapshot: &args})
+		if err != nil || resp.SnapshotReply == nil {
+			return false
+		}
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		args.Seq++
+		return n.acknowledge(ls, p, resp.SnapshotReply.Term, round) && resp.SnapshotReply.Success
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return false
+		}
+		ok := sendFileChunks(f, func(offset int64, data []byte) bool {
+			args.File, args.Offset, args.Data = entry.Name(), offset, data
+			return send()
+		})
+		_ = f.Close()
+		if !ok {
+			return false
+		}
+	}
+	args.File, args.Offset, args.Data, args.Done = "", 0, nil, true
+	if !send() {
+		return false
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.leader != ls {
+		return false
+	}
+	p.matchIndex = max(p.matchIndex, snapIndex)
+	p.nextIndex = p.matchIndex + 1
+	n.advanceCommit()
+	return true
+}
+
+// sendFileChunks 分块读取文件，空文件同样发送一次
+func sendFileChunks(f *os.File, send func(offset int64, data []byte) bool) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	var offset int64
+	for {
+		buf := make([]byte, min(stat.Size()-offset, maxSnapshotChunk))
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return false
+		}
+		if !send(offset, buf) {
+			return false
+		}
+		if offset += int64(len(buf)); offset >= stat.Size() {
+			return true
+		}
+	}
+}
+
+// acknowledge 处理其他节点的响应，返回是否仍是该任期的领导者，调用方需持有节点锁
+// 任何同任期的响应都说明对方承认自己是领导者，用于确认读请求
+func (n *Node) acknowledge(ls *leaderState, p *peerState, term, round uint64) bool {
+	if term > n.storage.term {
+		n.becomeFollower(term)
+		return false
+	}
+	if n.leader != ls {
+		return false
+	}
+	p.lastContact = time.Now()
+	if round > p.ackedRound {
+		p.ackedRound = round
+		n.checkReads()
+	}
+	return true
+}
+
+// readIndex 获取线性一致读的位置，确认仍是领导者之后返回
+func (n *Node) readIndex() (uint64, error) {
+	n.lock.Lock()
+	if n.role != leader {
+		n.lock.Unlock()
+		return 0, errs.ErrNotLeader
+	}
+	ls := n.leader
+	// 空日志提交之前，提交位置可能落后于之前任期已提交的日志
+	index := max(n.commitIndex, ls.noopIndex)
+	ls.readRound++
+	r := &readRequest{round: ls.readRound, done: make(chan error, 1)}
+	ls.reads = append(ls.reads, r)
+	n.checkReads()
+	n.triggerPeers()
+	n.lock.Unlock()
+
+	if err := n.wait(r.done); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// checkReads 完成多数成员已确认的读请求，调用方需持有节点锁
+func (n *Node) checkReads() {
+	ls := n.leader
+	remain := ls.reads[:0]
+	for _, r := range ls.reads {
+		count := 0
+		for id := range n.members {
+			if id == n.options.ID {
+				count++
+			} else if p := ls.peers[id]; p != nil && p.ackedRound >= r.round {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			r.done <- nil
+		} else {
+			remain = append(remain, r)
+		}
+	}
+	ls.reads = remain
+}
+
+func (n *Node) handleRequestVote(args *requestVoteArgs) *requestVoteReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	reply := &requestVoteReply{Term: n.storage.term}
+	if args.Term < n.storage.term {
+		return reply
+	}
+	// 仍能收到领导者的消息时拒绝，避免被移除或网络隔离的节点干扰集群
+	if args.Term > n.storage.term && (n.role == leader ||
+		(n.leaderId != "" && time.Since(n.lastContact) < n.options.ElectionTimeout)) {
+		return reply
+	}
+	if args.Term > n.storage.term {
+		n.becomeFollower(args.Term)
+		reply.Term = n.storage.term
+	}
+
+	lastIndex, lastTerm := n.storage.lastIndex(), n.storage.lastTerm()
+	upToDate := args.LastTerm > lastTerm || (args.LastTerm == lastTerm && args.LastIndex >= lastIndex)
+	if args.Term == n.storage.term && upToDate && (n.storage.vote == "" || n.storage.vote == args.CandidateId) {
+		if err := n.storage.setHardState(n.storage.term, args.CandidateId); err != nil {
+			return reply
+		}
+		reply.Granted = true
+		n.resetElectionTimer()
+	}
+	return reply
+}
+
+// followLeader 收到当前任期领导者的消息，调用方需持有节点锁
+func (n *Node) followLeader(term uint64, leaderId string) {
+	if term > n.storage.term || n.role != follower {
+		n.becomeFollower(term)
+	}
+	n.leaderId = leaderId
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+}
+
+func (n *Node) handleAppendEntries(args *appendEntriesArgs) *appendEntriesReply {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	reply := &appendEntriesReply{Term: n.storage.term}
+	if args.Term < n.storage.term {
+		return reply
+	}
+	n.followLeader(args.Term, args.LeaderId)
+	reply.Term = n.storage.term
+
+	prevIndex, prevTerm, entries := args.PrevIndex, args.PrevTerm, args.Entries
+	// 快照中的日志已经提交，与领导者一致
+	if snapIndex := n.storage.snapIndex; prevIndex < snapIndex {
+		skip := snapIndex - prevIndex
+		if uint64(len(entries)) <= skip {
+			reply.Success = true
+			return reply
+		}
+		prevIndex, prevTerm, entries = snapIndex, n.storage.snapTerm, entries[skip:]
+	}
+	if prevIndex > n.storage.lastIndex() {
+		reply.ConflictIndex = n.storage.lastIndex() + 1
+		return reply
+	}
+	if term, _ := n.storage.termOf(prevIndex); term != prevTerm {
+		// 跳过冲突任期中的所有日志
+		conflict := prevIndex
+		for conflict-1 > n.storage.snapIndex {
+			if t, _ := n.storage.termOf(conflict - 1); t != term {
+				break
+			}
+			conflict--
+		}
+		reply.ConflictIndex = conflict
+		return reply
+	}
+
+	// 跳过已有的日志，从第一条不一致的日志开始覆盖
+	for i, e := range entries {
+		if term, ok := n.storage.termOf(e.Index); ok && term == e.Term {
+			continue
+		}
+		if err := n.storage.append(entries[i:]); err != nil {
+			reply.ConflictIndex = e.Index
+			return reply
+		}
+		n.members = n.latestMembers()
+		break
+	}
+	if commit := min(args.LeaderCommit, prevIndex+uint64(len(entries))); commit > n.commitIndex {
+		n.setCommitIndex(commit)
+	}
+	reply.Success = true
+	return reply
+}
+
+func (n *Node) handleInstallSnapshot(args *installSnapshotArgs) *installSnapshotReply {
+	n.lock.Lock()
+	reply := &installSnapshotReply{Term: n.storage.term}
+	if args.Term < n.storage.term {
+		n.lock.Unlock()
+		return reply
+	}
+	n.followLeader(args.Term, args.LeaderId)
+	reply.Term = n.storage.term
+
+	recvDir := filepath.Join(n.options.DirPath, snapshotRecvDir)
+	if args.Seq == 0 {
+		if err := os.RemoveAll(recvDir); err != nil {
+			n.lock.Unlock()
+			return reply
+		}
+		n.recvIndex, n.recvTerm, n.recvSeq = args.SnapIndex, args.SnapTerm, 0
+	}
+	if args.Seq != n.recvSeq || args.SnapIndex != n.recvIndex || args.SnapTerm != n.recvTerm {
+		n.lock.Unlock()
+		return reply
+	}
+	n.recvSeq++
+	if !args.Done {
+		reply.Success = writeChunk(recvDir, args.File, args.Offset, args.Data) == nil
+		n.lock.Unlock()
+		return reply
+	}
+	n.recvIndex, n.recvTerm, n.recvSeq = 0, 0, 0
+	n.lock.Unlock()
+
+	reply.Success = n.installSnapshot(recvDir, args.SnapIndex, args.SnapTerm) == nil
+	return reply
+}
+
+// installSnapshot 使用收到的快照替换状态机，快照之前的日志被丢弃
+func (n *Node) installSnapshot(dir string, index, term uint64) error {
+	n.smLock.Lock()
+	defer n.smLock.Unlock()
+
+	// 状态机已经包含快照中的数据
+	if index <= n.sm.applied {
+		return os.RemoveAll(dir)
+	}
+	if err := syncDirFiles(dir); err != nil {
+		return err
+	}
+	return n.replaceSnapshot(dir, index, term, func(snapshotDir string) error {
+		if err := n.sm.restore(snapshotDir); err != nil {
+			return err
+		}
+		n.commitIndex = max(n.commitIndex, index)
+		n.advanceApplied()
+		n.members = n.latestMembers()
+		return nil
+	})
+}
+
+// writeChunk 写入快照文件的一部分
+func writeChunk(dir, name string, offset int64, data []byte) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, filepath.Base(name)), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, offset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDirFiles 持久化目录中的文件
+func syncDirFiles(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		f, err := os.OpenFile(filepath.Join(dir, entry.Name()), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
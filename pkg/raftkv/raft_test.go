@@ -0,0 +1,281 @@
+package raftkv
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCluster 在本机上运行的集群
+type testCluster struct {
+	t       *testing.T
+	dirs    map[string]string
+	addrs   map[string]string
+	nodes   map[string]*Node
+	options func(id string) *Options
+}
+
+// freeAddr 获取一个空闲的本地地址
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	c := &testCluster{t: t, dirs: map[string]string{}, addrs: map[string]string{}, nodes: map[string]*Node{}}
+	peers := map[string]string{}
+	for _, id := range ids {
+		c.dirs[id], _ = os.MkdirTemp("", "hifidb-raft-"+id)
+		c.addrs[id] = freeAddr(t)
+		peers[id] = c.addrs[id]
+	}
+	c.options = func(id string) *Options {
+		opts := GetDefaultOptions()
+		opts.ID = id
+		opts.Addr = c.addrs[id]
+		opts.DirPath = c.dirs[id]
+		opts.ElectionTimeout = 300 * time.Millisecond
+		opts.HeartbeatInterval = 30 * time.Millisecond
+		opts.SnapshotThreshold = 100
+		kvOptions := kv.GetDBDefaultOptions()
+		kvOptions.DataFileSize = 64 * 1024
+		opts.KVOptions = kvOptions
+		if _, ok := peers[id]; ok {
+			opts.Peers = peers
+		}
+		return opts
+	}
+	for _, id := range ids {
+		c.start(id)
+	}
+	return c
+}
+
+func (c *testCluster) start(id string) {
+	if c.dirs[id] == "" {
+		c.dirs[id], _ = os.MkdirTemp("", "hifidb-raft-"+id)
+		c.addrs[id] = freeAddr(c.t)
+	}
+	node, err := Open(c.options(id))
+	assert.Nil(c.t, err)
+	c.nodes[id] = node
+}
+
+func (c *testCluster) stop(id string) {
+	assert.Nil(c.t, c.nodes[id].Close())
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) destroy() {
+	for id := range c.nodes {
+		c.stop(id)
+	}
+	for _, dir := range c.dirs {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// leader 等待选出领导者
+func (c *testCluster) leader() *Node {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range c.nodes {
+			if node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+// waitApplied 等待节点应用到领导者的提交位置
+func (c *testCluster) waitApplied(leader *Node, ids ...string) {
+	leader.lock.Lock()
+	commit := leader.commitIndex
+	leader.lock.Unlock()
+	for _, id := range ids {
+		assert.Nil(c.t, c.nodes[id].waitApplied(commit))
+	}
+}
+
+// localGet 直接读取节点的状态机
+func localGet(node *Node, key []byte) ([]byte, error) {
+	node.smLock.RLock()
+	defer node.smLock.RUnlock()
+	return node.sm.db.Get(key)
+}
+
+func TestNode_Cluster(t *testing.T) {
+	c := newTestCluster(t, "n1", "n2", "n3")
+	defer c.destroy()
+
+	leader := c.leader()
+	for i := range 50 {
+		assert.Nil(t, leader.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	assert.Nil(t, leader.Delete([]byte("key-0")))
+	wb := leader.NewWriteBatch()
+	assert.Nil(t, wb.Put([]byte("batch-1"), []byte("v1")))
+	assert.Nil(t, wb.Put([]byte("batch-2"), []byte("v2")))
+	assert.Nil(t, wb.Delete([]byte("key-1")))
+	assert.Nil(t, wb.Commit())
+
+	val, err := leader.Get([]byte("key-10"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-10"), val)
+	_, err = leader.Get([]byte("key-0"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	_, err = leader.Get([]byte("key-1"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	// 跟随者拒绝读写，状态机与领导者一致
+	for id, node := range c.nodes {
+		if node == leader {
+			continue
+		}
+		assert.Equal(t, errs.ErrNotLeader, node.Put([]byte("key"), []byte("value")))
+		_, err := node.Get([]byte("key-10"))
+		assert.Equal(t, errs.ErrNotLeader, err)
+		leaderId, _ := node.Leader()
+		assert.Equal(t, leader.options.ID, leaderId)
+		c.waitApplied(leader, id)
+		val, err := localGet(node, []byte("batch-2"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v2"), val)
+	}
+
+	// 领导者停止之后选出新的领导者，数据不丢失
+	oldId := leader.options.ID
+	c.stop(oldId)
+	leader = c.leader()
+	val, err = leader.Get([]byte("batch-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	for i := 50; i < 300; i++ {
+		assert.Nil(t, leader.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	// 重启的节点从日志或快照中追上
+	c.start(oldId)
+	c.waitApplied(leader, oldId)
+	val, err = localGet(c.nodes[oldId], []byte("key-299"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-299"), val)
+}
+
+func TestNode_Membership(t *testing.T) {
+	c := newTestCluster(t, "n1", "n2", "n3")
+	defer c.destroy()
+
+	leader := c.leader()
+	for i := range 300 {
+		assert.Nil(t, leader.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	// 日志已被快照压缩
+	leader.lock.Lock()
+	assert.Greater(t, leader.storage.snapIndex, uint64(0))
+	leader.lock.Unlock()
+
+	// 新节点通过快照加入
+	c.start("n4")
+	assert.Nil(t, leader.AddMember("n4", c.addrs["n4"]))
+	assert.Equal(t, errs.ErrMemberExists, leader.AddMember("n4", c.addrs["n4"]))
+	assert.Nil(t, leader.Put([]byte("after-join"), []byte("value")))
+	c.waitApplied(leader, "n4")
+	val, err := localGet(c.nodes["n4"], []byte("key-150"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-150"), val)
+	val, err = localGet(c.nodes["n4"], []byte("after-join"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Equal(t, 4, len(c.nodes["n4"].Members()))
+
+	// 移除领导者之后，剩余的节点选出新的领导者
+	oldId := leader.options.ID
+	assert.Equal(t, errs.ErrMemberNotFound, leader.RemoveMember("n9"))
+	assert.Nil(t, leader.RemoveMember(oldId))
+	c.stop(oldId)
+	leader = c.leader()
+	_, ok := leader.Members()[oldId]
+	assert.False(t, ok)
+	assert.Nil(t, leader.Put([]byte("after-remove"), []byte("value")))
+	val, err = leader.Get([]byte("key-299"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-299"), val)
+}
+
+func TestRaftStorage_Window(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hifidb-raft-storage")
+	defer os.RemoveAll(dir)
+	s, err := openRaftStorage(dir, 0, 0)
+	assert.Nil(t, err)
+
+	// 超出内存窗口的日志从存储中读取
+	count := uint64(3*maxCachedEntries + 10)
+	for index := uint64(1); index <= count; index++ {
+		e := logEntry{Index: index, Term: index/1000 + 1, Type: entryCommand, Data: []byte(fmt.Sprint(index))}
+		if index == 5 {
+			e.Type = entryConfig
+		}
+		assert.Nil(t, s.append([]logEntry{e}))
+	}
+	assert.LessOrEqual(t, len(s.entries), 2*maxCachedEntries)
+	assert.Equal(t, count, s.lastIndex())
+	assert.Equal(t, count/1000+1, s.lastTerm())
+	assert.Equal(t, uint64(5), s.configIndex())
+	term, ok := s.termOf(999)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), term)
+	term, _ = s.termOf(1000)
+	assert.Equal(t, uint64(2), term)
+
+	entries, err := s.slice(s.cachedFrom()-2, s.cachedFrom()+2)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+	for i, e := range entries {
+		assert.Equal(t, s.cachedFrom()-2+uint64(i), e.Index)
+		assert.Equal(t, []byte(fmt.Sprint(e.Index)), e.Data)
+	}
+	e, err := s.entry(5)
+	assert.Nil(t, err)
+	assert.Equal(t, entryConfig, e.Type)
+
+	// 覆盖写入窗口之前的日志
+	assert.Nil(t, s.append([]logEntry{{Index: 3, Term: 9, Type: entryCommand}}))
+	assert.Equal(t, uint64(3), s.lastIndex())
+	assert.Equal(t, uint64(0), s.configIndex())
+	term, _ = s.termOf(2)
+	assert.Equal(t, uint64(1), term)
+	assert.Equal(t, uint64(9), s.lastTerm())
+	for index := uint64(4); index <= 10; index++ {
+		assert.Nil(t, s.append([]logEntry{{Index: index, Term: 9, Type: entryConfig}}))
+	}
+
+	// 压缩日志之后保留快照之后的日志
+	assert.Nil(t, s.compact(6, 9))
+	assert.Equal(t, []uint64{7, 8, 9, 10}, s.configs)
+	_, ok = s.termOf(5)
+	assert.False(t, ok)
+	term, _ = s.termOf(7)
+	assert.Equal(t, uint64(9), term)
+	assert.Nil(t, s.close())
+
+	s, err = openRaftStorage(dir, 6, 9)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), s.lastIndex())
+	assert.Equal(t, 4, len(s.entries))
+	assert.Equal(t, uint64(10), s.configIndex())
+	_, err = s.readEntry(count)
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	assert.Nil(t, s.close())
+}
@@ -0,0 +1,103 @@
+package raftkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	snapshotDirPrefix  = "snapshot-"
+	snapshotTmpDirName = "snapshot.tmp"
+	snapshotRecvDir    = "snapshot.recv"
+
+	// maxSnapshotChunk 发送快照时每次发送的数据大小
+	maxSnapshotChunk = 1024 * 1024
+)
+
+// snapshotDirName 快照目录名称包含快照的最后一条日志，目录内容为状态机的备份
+func snapshotDirName(index, term uint64) string {
+	return fmt.Sprintf("%s%020d-%d", snapshotDirPrefix, index, term)
+}
+
+// loadSnapshot 查找最新的快照，删除旧的快照与未完成的临时目录
+func loadSnapshot(dirPath string) (index, term uint64, err error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var latest string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == snapshotTmpDirName || name == snapshotRecvDir {
+			if err := os.RemoveAll(filepath.Join(dirPath, name)); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		if !entry.IsDir() || !strings.HasPrefix(name, snapshotDirPrefix) {
+			continue
+		}
+		var i, t uint64
+		if _, err := fmt.Sscanf(name, snapshotDirPrefix+"%d-%d", &i, &t); err != nil {
+			continue
+		}
+		if latest != "" && i <= index {
+			if err := os.RemoveAll(filepath.Join(dirPath, name)); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		if latest != "" {
+			if err := os.RemoveAll(filepath.Join(dirPath, latest)); err != nil {
+				return 0, 0, err
+			}
+		}
+		latest, index, term = name, i, t
+	}
+	return index, term, nil
+}
+
+// takeSnapshot 将状态机备份为快照并压缩日志，调用方需持有状态机锁
+func (n *Node) takeSnapshot() error {
+	sm := n.sm
+	tmpDir := filepath.Join(n.options.DirPath, snapshotTmpDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := sm.checkpoint(tmpDir); err != nil {
+		return err
+	}
+	return n.replaceSnapshot(tmpDir, sm.applied, sm.appliedTerm, nil)
+}
+
+// replaceSnapshot 使用 dir 中的文件作为新的快照，删除旧快照并压缩日志
+// install 不为空时在压缩日志之后调用，用于安装从领导者收到的快照
+func (n *Node) replaceSnapshot(dir string, index, term uint64, install func(snapshotDir string) error) error {
+	n.snapLock.Lock()
+	defer n.snapLock.Unlock()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	oldDir := n.snapshotDir()
+	newDir := filepath.Join(n.options.DirPath, snapshotDirName(index, term))
+	if err := os.Rename(dir, newDir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if err := n.storage.compact(index, term); err != nil {
+		return err
+	}
+	if install != nil {
+		return install(newDir)
+	}
+	return nil
+}
+
+// snapshotDir 当前快照的目录，调用方需持有节点锁
+func (n *Node) snapshotDir() string {
+	return filepath.Join(n.options.DirPath, snapshotDirName(n.storage.snapIndex, n.storage.snapTerm))
+}
@@ -0,0 +1,303 @@
+package raftkv
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+const (
+	// maxCachedEntries 内存中保留的最近日志数量，超过 2*maxCachedEntries 时裁剪，更早的日志从存储中读取
+	maxCachedEntries = 4096
+
+	// logMergeInterval 后台检查日志存储是否需要merge的间隔，压缩日志之后删除的记录由后台merge回收
+	logMergeInterval = 10 * time.Second
+)
+
+var (
+	hardStateKey   = []byte("hard-state")
+	entryKeyPrefix = []byte("entry-")
+)
+
+// termSpan 从 index 开始的连续日志属于同一个任期
+type termSpan struct {
+	index uint64
+	term  uint64
+}
+
+// raftStorage 使用 kv.DB 保存任期、投票与日志，调用方需持有节点锁
+// 内存中只保留最近的一段日志，以及全部日志的任期与成员变更的位置
+type raftStorage struct {
+	db   *kv.DB
+	term uint64
+	vote string
+
+	snapIndex uint64     // 最近一次快照包含的最后一条日志
+	snapTerm  uint64     // snapIndex 所在的任期
+	last      uint64     // 最后一条日志
+	entries   []logEntry // 最近的日志，entries[i].Index == last-len(entries)+1+i
+	terms     []termSpan // snapIndex 之后日志的任期，按位置排序
+	configs   []uint64   // snapIndex 之后成员变更日志的位置
+}
+
+func entryKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte{}, entryKeyPrefix...), index)
+}
+
+// openRaftStorage 打开日志存储，快照之前的日志已被压缩，不再加载
+func openRaftStorage(dirPath string, snapIndex, snapTerm uint64) (*raftStorage, error) {
+	options := kv.GetDBDefaultOptions()
+	options.DirPath = dirPath
+	options.SyncWrites = true
+	options.MergeCheckInterval = logMergeInterval
+	options.MergeMinInterval = logMergeInterval
+	db, err := kv.Open(options)
+	if err != nil {
+		return nil, err
+	}
+	s := &raftStorage{db: db, snapIndex: snapIndex, snapTerm: snapTerm, last: snapIndex}
+	if err := s.load(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *raftStorage) load() error {
+	buf, err := s.db.Get(hardStateKey)
+	if err != nil && err != errs.ErrKeyNotFound {
+		return err
+	}
+	if err == nil {
+		term, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errs.ErrDataDirCorrupted
+		}
+		s.term, s.vote = term, string(buf[n:])
+	}
+
+	iterOptions := kv.GetDefaultIteratorOptions()
+	iterOptions.Prefix = entryKeyPrefix
+	it := s.db.NewIterator(iterOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		index := binary.BigEndian.Uint64(it.Key()[len(entryKeyPrefix):])
+		// 压缩日志时被中断，剩余的旧日志已包含在快照中
+		if index <= s.snapIndex {
+			continue
+		}
+		if index != s.lastIndex()+1 {
+			return errs.ErrDataDirCorrupted
+		}
+		value, err := it.Value()
+		if err != nil {
+			return err
+		}
+		e, err := decodeEntry(index, value)
+		if err != nil {
+			return err
+		}
+		s.push(e)
+	}
+	return nil
+}
+
+// setHardState 持久化任期与投票
+func (s *raftStorage) setHardState(term uint64, vote string) error {
+	if term == s.term && vote == s.vote {
+		return nil
+	}
+	buf := binary.AppendUvarint(nil, term)
+	if err := s.db.Put(hardStateKey, append(buf, vote...)); err != nil {
+		return err
+	}
+	s.term, s.vote = term, vote
+	return nil
+}
+
+func (s *raftStorage) lastIndex() uint64 {
+	return s.last
+}
+
+func (s *raftStorage) lastTerm() uint64 {
+	if len(s.terms) == 0 {
+		return s.snapTerm
+	}
+	return s.terms[len(s.terms)-1].term
+}
+
+// termOf 获取日志的任期，日志已被压缩或不存在时返回false
+func (s *raftStorage) termOf(index uint64) (uint64, bool) {
+	if index == s.snapIndex {
+		return s.snapTerm, true
+	}
+	if index < s.snapIndex || index > s.last {
+		return 0, false
+	}
+	// 最后一个起始位置不大于 index 的任期
+	i := sort.Search(len(s.terms), func(i int) bool { return s.terms[i].index > index })
+	return s.terms[i-1].term, true
+}
+
+// configIndex 最新的成员变更日志的位置，没有时返回0
+func (s *raftStorage) configIndex() uint64 {
+	if len(s.configs) == 0 {
+		return 0
+	}
+	return s.configs[len(s.configs)-1]
+}
+
+// cachedFrom 内存中的第一条日志
+func (s *raftStorage) cachedFrom() uint64 {
+	return s.last + 1 - uint64(len(s.entries))
+}
+
+// entry 获取 snapIndex 之后的一条日志
+func (s *raftStorage) entry(index uint64) (logEntry, error) {
+	if from := s.cachedFrom(); index >= from {
+		return s.entries[index-from], nil
+	}
+	return s.readEntry(index)
+}
+
+// readEntry 从存储中读取一条日志
+func (s *raftStorage) readEntry(index uint64) (logEntry, error) {
+	value, err := s.db.Get(entryKey(index))
+	if err != nil {
+		return logEntry{}, err
+	}
+	return decodeEntry(index, value)
+}
+
+// slice 复制 [lo, hi) 之间的日志，lo 需要大于 snapIndex，不在内存中的日志从存储中读取
+func (s *raftStorage) slice(lo, hi uint64) ([]logEntry, error) {
+	if lo >= hi {
+		return nil, nil
+	}
+	entries := make([]logEntry, 0, hi-lo)
+	from := s.cachedFrom()
+	for ; lo < hi && lo < from; lo++ {
+		e, err := s.readEntry(lo)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if lo < hi {
+		entries = append(entries, s.entries[lo-from:hi-from]...)
+	}
+	return entries, nil
+}
+
+// append 从 entries[0].Index 开始覆盖写入日志，之后的旧日志被删除
+func (s *raftStorage) append(entries []logEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first := entries[0].Index
+	if first <= s.snapIndex || first > s.lastIndex()+1 {
+		return errs.ErrDataDirCorrupted
+	}
+
+	wb := s.newWriteBatch()
+	for i := range entries {
+		if err := wb.Put(entryKey(entries[i].Index), encodeEntry(&entries[i])); err != nil {
+			return err
+		}
+	}
+	for index := entries[len(entries)-1].Index + 1; index <= s.lastIndex(); index++ {
+		if err := wb.Delete(entryKey(index)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	s.truncate(first)
+	for _, e := range entries {
+		s.push(e)
+	}
+	return nil
+}
+
+// push 在最后追加一条日志
+func (s *raftStorage) push(e logEntry) {
+	s.last = e.Index
+	if len(s.terms) == 0 || s.terms[len(s.terms)-1].term != e.Term {
+		s.terms = append(s.terms, termSpan{index: e.Index, term: e.Term})
+	}
+	if e.Type == entryConfig {
+		s.configs = append(s.configs, e.Index)
+	}
+	s.entries = append(s.entries, e)
+	// 裁剪时复制到新的数组，释放旧日志的内存
+	if len(s.entries) > 2*maxCachedEntries {
+		s.entries = append([]logEntry(nil), s.entries[len(s.entries)-maxCachedEntries:]...)
+	}
+}
+
+// truncate 删除内存中从 first 开始的日志
+func (s *raftStorage) truncate(first uint64) {
+	if from := s.cachedFrom(); first >= from {
+		s.entries = s.entries[:first-from]
+	} else {
+		s.entries = nil
+	}
+	i := sort.Search(len(s.terms), func(i int) bool { return s.terms[i].index >= first })
+	s.terms = s.terms[:i]
+	i = sort.Search(len(s.configs), func(i int) bool { return s.configs[i] >= first })
+	s.configs = s.configs[:i]
+	s.last = first - 1
+}
+
+// compact 快照已经持久化，删除快照包含的日志
+// 日志中与快照最后一条日志一致时保留之后的日志，否则丢弃全部日志
+// 删除的日志占用的空间由后台merge回收，不在持有节点锁时进行
+func (s *raftStorage) compact(snapIndex, snapTerm uint64) error {
+	if snapIndex <= s.snapIndex {
+		return nil
+	}
+	end := s.last
+	if term, ok := s.termOf(snapIndex); ok && term == snapTerm {
+		end = snapIndex
+	}
+
+	wb := s.newWriteBatch()
+	for index := s.snapIndex + 1; index <= end; index++ {
+		if err := wb.Delete(entryKey(index)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+
+	if end < s.last {
+		// 保留的第一条日志所在的任期从该位置开始
+		term, _ := s.termOf(end + 1)
+		if from := s.cachedFrom(); end >= from {
+			s.entries = append([]logEntry(nil), s.entries[end+1-from:]...)
+		}
+		i := sort.Search(len(s.terms), func(i int) bool { return s.terms[i].index > end+1 })
+		s.terms = append([]termSpan{{index: end + 1, term: term}}, s.terms[i:]...)
+	} else {
+		s.entries, s.terms, s.last = nil, nil, snapIndex
+	}
+	i := sort.Search(len(s.configs), func(i int) bool { return s.configs[i] > snapIndex })
+	s.configs = slices.Clone(s.configs[i:])
+	s.snapIndex, s.snapTerm = snapIndex, snapTerm
+	return nil
+}
+
+func (s *raftStorage) newWriteBatch() *kv.WriteBatch {
+	return s.db.NewWriteBatch(&kv.WriteBatchOptions{MaxBatchSize: math.MaxInt, EachSyncWrites: true})
+}
+
+func (s *raftStorage) close() error {
+	return s.db.Close()
+}
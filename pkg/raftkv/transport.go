@@ -0,0 +1,224 @@
+package raftkv
+
+import (
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+)
+
+type requestVoteArgs struct {
+	Term        uint64
+	CandidateId string
+	LastIndex   uint64
+	LastTerm    uint64
+}
+
+type requestVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendEntriesArgs struct {
+	Term         uint64
+	LeaderId     string
+	PrevIndex    uint64
+	PrevTerm     uint64
+	Entries      []logEntry
+	LeaderCommit uint64
+}
+
+type appendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64 // 失败时领导者下一次尝试的位置
+}
+
+// installSnapshotArgs 快照按文件分块发送，Seq 从0开始递增，Done 为 true 时表示发送完毕
+type installSnapshotArgs struct {
+	Term      uint64
+	LeaderId  string
+	SnapIndex uint64
+	SnapTerm  uint64
+	Seq       uint64
+	File      string
+	Offset    int64
+	Data      []byte
+	Done      bool
+}
+
+type installSnapshotReply struct {
+	Term    uint64
+	Success bool
+}
+
+// rpcMessage 节点之间的请求与响应，每次只设置其中一个字段
+type rpcMessage struct {
+	Vote          *requestVoteArgs
+	VoteReply     *requestVoteReply
+	Append        *appendEntriesArgs
+	AppendReply   *appendEntriesReply
+	Snapshot      *installSnapshotArgs
+	SnapshotReply *installSnapshotReply
+}
+
+// rpcConn 一个到其他节点的连接，同一时刻只有一个请求
+type rpcConn struct {
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+func newRPCConn(conn net.Conn) *rpcConn {
+	return &rpcConn{conn: conn, enc: gob.NewEncoder(conn), dec: gob.NewDecoder(conn)}
+}
+
+// transport 向其他节点发送请求，空闲的连接按地址复用
+type transport struct {
+	lock    *sync.Mutex
+	idle    map[string][]*rpcConn
+	active  map[*rpcConn]struct{} // 正在发送请求的连接，关闭时一起断开
+	timeout time.Duration
+	closed  bool
+}
+
+func newTransport(timeout time.Duration) *transport {
+	return &transport{
+		lock:    &sync.Mutex{},
+		idle:    map[string][]*rpcConn{},
+		active:  map[*rpcConn]struct{}{},
+		timeout: timeout,
+	}
+}
+
+// call 发送请求并等待响应，出错时关闭连接
+func (t *transport) call(addr string, req *rpcMessage) (*rpcMessage, error) {
+	c, err := t.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp := &rpcMessage{}
+	err = c.conn.SetDeadline(time.Now().Add(t.timeout))
+	if err == nil {
+		err = c.enc.Encode(req)
+	}
+	if err == nil {
+		err = c.dec.Decode(resp)
+	}
+	t.put(addr, c, err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *transport) get(addr string) (*rpcConn, error) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	if conns := t.idle[addr]; len(conns) > 0 {
+		c := conns[len(conns)-1]
+		t.idle[addr] = conns[:len(conns)-1]
+		t.active[c] = struct{}{}
+		t.lock.Unlock()
+		return c, nil
+	}
+	t.lock.Unlock()
+
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := newRPCConn(conn)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+	t.active[c] = struct{}{}
+	return c, nil
+}
+
+// put 归还连接，请求失败时关闭连接
+func (t *transport) put(addr string, c *rpcConn, reuse bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.active, c)
+	if t.closed || !reuse {
+		_ = c.conn.Close()
+		return
+	}
+	t.idle[addr] = append(t.idle[addr], c)
+}
+
+func (t *transport) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	for _, conns := range t.idle {
+		for _, c := range conns {
+			_ = c.conn.Close()
+		}
+	}
+	for c := range t.active {
+		_ = c.conn.Close()
+	}
+	t.idle = nil
+}
+
+// serve 处理其他节点的请求，直到 listener 关闭
+func (n *Node) serve() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.lock.Lock()
+		if n.closed {
+			n.lock.Unlock()
+			_ = conn.Close()
+			return
+		}
+		n.conns[conn] = struct{}{}
+		n.wg.Add(1)
+		n.lock.Unlock()
+
+		go n.handleConn(conn)
+	}
+}
+
+func (n *Node) handleConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		n.lock.Lock()
+		delete(n.conns, conn)
+		n.lock.Unlock()
+		n.wg.Done()
+	}()
+
+	c := newRPCConn(conn)
+	for {
+		req := &rpcMessage{}
+		if err := c.dec.Decode(req); err != nil {
+			return
+		}
+		resp := &rpcMessage{}
+		switch {
+		case req.Vote != nil:
+			resp.VoteReply = n.handleRequestVote(req.Vote)
+		case req.Append != nil:
+			resp.AppendReply = n.handleAppendEntries(req.Append)
+		case req.Snapshot != nil:
+			resp.SnapshotReply = n.handleInstallSnapshot(req.Snapshot)
+		default:
+			return
+		}
+		if err := c.enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,638 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+const (
+	serverName    = "hifidb"
+	serverVersion = "0.1.0"
+
+	defaultScanCount = 10
+)
+
+var (
+	errSyntax      = errors.New("ERR syntax error")
+	errNotInteger  = errors.New("ERR value is not an integer or out of range")
+	errInvalidExpr = errors.New("ERR invalid expire time")
+)
+
+// kvWriter 写命令的执行目标，直接写入 kv.DB 或在 MULTI 中写入 kv.WriteBatch
+type kvWriter interface {
+	Put(key, value []byte) error
+	PutWithTTL(key, value []byte, ttl time.Duration) error
+	Delete(key []byte) error
+	Expire(key []byte, ttl time.Duration) error
+	Persist(key []byte) error
+}
+
+// execCtx 命令执行的上下文
+type execCtx struct {
+	c      *client
+	w      *Writer
+	kv     kvWriter
+	inExec bool // 是否在 EXEC 中执行
+}
+
+type command struct {
+	handler func(s *Server, ctx *execCtx, args [][]byte)
+	arity   int  // 参数个数(包含命令名)，负数表示最少个数
+	noMulti bool // 不能在 MULTI 中排队执行
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"ping":    {handler: pingCommand, arity: -1},
+		"echo":    {handler: echoCommand, arity: 2},
+		"quit":    {handler: quitCommand, arity: 1, noMulti: true},
+		"hello":   {handler: helloCommand, arity: -1, noMulti: true},
+		"select":  {handler: selectCommand, arity: 2},
+		"command": {handler: commandCommand, arity: -1},
+		"client":  {handler: clientCommand, arity: -2},
+		"get":     {handler: getCommand, arity: 2},
+		"set":     {handler: setCommand, arity: -3},
+		"del":     {handler: delCommand, arity: -2},
+		"exists":  {handler: existsCommand, arity: -2},
+		"mget":    {handler: mgetCommand, arity: -2},
+		"mset":    {handler: msetCommand, arity: -3},
+		"ttl":     {handler: ttlCommand, arity: 2},
+		"pttl":    {handler: pttlCommand, arity: 2},
+		"expire":  {handler: expireCommand, arity: 3},
+		"pexpire": {handler: pexpireCommand, arity: 3},
+		"persist": {handler: persistCommand, arity: 2},
+		"scan":    {handler: scanCommand, arity: -2, noMulti: true},
+		"keys":    {handler: keysCommand, arity: 2, noMulti: true},
+		"dbsize":  {handler: dbsizeCommand, arity: 1},
+		"multi":   {handler: multiCommand, arity: 1, noMulti: true},
+		"exec":    {handler: execCommand, arity: 1, noMulti: true},
+		"discard": {handler: discardCommand, arity: 1, noMulti: true},
+	}
+}
+
+// dispatch 查找并执行命令，MULTI 中的命令只入队
+func (s *Server) dispatch(c *client, args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd := commands[name]
+	if cmd == nil {
+		c.dirty = c.multi
+		c.writer.WriteError("ERR unknown command '" + string(args[0]) + "'")
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.dirty = c.multi
+		c.writer.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+
+	if c.multi && !cmd.noMulti {
+		c.queued = append(c.queued, args)
+		c.writer.WriteSimpleString("QUEUED")
+		return
+	}
+	if c.multi && (name == "multi" || name == "hello") {
+		c.writer.WriteError("ERR " + strings.ToUpper(name) + " calls can not be nested")
+		return
+	}
+	if c.multi && (name == "scan" || name == "keys") {
+		c.dirty = true
+		c.writer.WriteError("ERR " + strings.ToUpper(name) + " is not allowed in MULTI")
+		return
+	}
+
+	cmd.handler(s, &execCtx{c: c, w: c.writer, kv: s.db}, args)
+}
+
+func pingCommand(s *Server, ctx *execCtx, args [][]byte) {
+	if len(args) > 2 {
+		ctx.w.WriteError("ERR wrong number of arguments for 'ping' command")
+		return
+	}
+	if len(args) == 2 {
+		ctx.w.WriteBulk(args[1])
+		return
+	}
+	ctx.w.WriteSimpleString("PONG")
+}
+
+func echoCommand(s *Server, ctx *execCtx, args [][]byte) {
+	ctx.w.WriteBulk(args[1])
+}
+
+func quitCommand(s *Server, ctx *execCtx, args [][]byte) {
+	ctx.c.quit = true
+	ctx.w.WriteSimpleString("OK")
+}
+
+// helloCommand HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(s *Server, ctx *execCtx, args [][]byte) {
+	proto := ctx.c.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			ctx.w.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != RESP2 && v != RESP3 {
+			ctx.w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	ctx.c.proto = proto
+	ctx.w.SetProto(proto)
+
+	ctx.w.WriteMapLen(7)
+	ctx.w.WriteBulkString("server")
+	ctx.w.WriteBulkString(serverName)
+	ctx.w.WriteBulkString("version")
+	ctx.w.WriteBulkString(serverVersion)
+	ctx.w.WriteBulkString("proto")
+	ctx.w.WriteInteger(int64(proto))
+	ctx.w.WriteBulkString("id")
+	ctx.w.WriteInteger(ctx.c.id)
+	ctx.w.WriteBulkString("mode")
+	ctx.w.WriteBulkString("standalone")
+	ctx.w.WriteBulkString("role")
+	ctx.w.WriteBulkString("master")
+	ctx.w.WriteBulkString("modules")
+	ctx.w.WriteArrayLen(0)
+}
+
+// selectCommand 只有一个数据库
+func selectCommand(s *Server, ctx *execCtx, args [][]byte) {
+	if string(args[1]) != "0" {
+		ctx.w.WriteError("ERR DB index is out of range")
+		return
+	}
+	ctx.w.WriteSimpleString("OK")
+}
+
+// commandCommand redis-cli 启动时会查询命令文档，返回空结果即可
+func commandCommand(s *Server, ctx *execCtx, args [][]byte) {
+	if len(args) > 1 && strings.EqualFold(string(args[1]), "count") {
+		ctx.w.WriteInteger(int64(len(commands)))
+		return
+	}
+	if len(args) > 1 && strings.EqualFold(string(args[1]), "docs") {
+		ctx.w.WriteMapLen(0)
+		return
+	}
+	ctx.w.WriteArrayLen(0)
+}
+
+func clientCommand(s *Server, ctx *execCtx, args [][]byte) {
+	if strings.EqualFold(string(args[1]), "id") {
+		ctx.w.WriteInteger(ctx.c.id)
+		return
+	}
+	// SETNAME、SETINFO 等客户端库常用的子命令直接忽略
+	ctx.w.WriteSimpleString("OK")
+}
+
+func getCommand(s *Server, ctx *execCtx, args [][]byte) {
+	value, err := s.db.Get(args[1])
+	if err != nil {
+		if errors.Is(err, errs.ErrKeyNotFound) {
+			ctx.w.WriteNull()
+			return
+		}
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteBulk(value)
+}
+
+// setCommand SET key value [NX | XX] [EX seconds | PX milliseconds]
+// NX 与 XX 的存在性检查与写入不是原子的
+func setCommand(s *Server, ctx *execCtx, args [][]byte) {
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch {
+		case opt == "nx" && !xx:
+			nx = true
+		case opt == "xx" && !nx:
+			xx = true
+		case (opt == "ex" || opt == "px") && ttl == 0 && i+1 < len(args):
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				ctx.w.WriteError(errNotInteger.Error())
+				return
+			}
+			if n <= 0 {
+				ctx.w.WriteError(errInvalidExpr.Error() + " in 'set' command")
+				return
+			}
+			if opt == "ex" {
+				ttl = time.Duration(n) * time.Second
+			} else {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			ctx.w.WriteError(errSyntax.Error())
+			return
+		}
+	}
+
+	if nx || xx {
+		exists, err := s.exists(args[1])
+		if err != nil {
+			writeError(ctx.w, err)
+			return
+		}
+		if (nx && exists) || (xx && !exists) {
+			ctx.w.WriteNull()
+			return
+		}
+	}
+
+	var err error
+	if ttl > 0 {
+		err = ctx.kv.PutWithTTL(args[1], args[2], ttl)
+	} else {
+		err = ctx.kv.Put(args[1], args[2])
+	}
+	if err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteSimpleString("OK")
+}
+
+func delCommand(s *Server, ctx *execCtx, args [][]byte) {
+	var deleted int64
+	for _, key := range args[1:] {
+		exists, err := s.exists(key)
+		if err != nil {
+			writeError(ctx.w, err)
+			return
+		}
+		if !exists {
+			continue
+		}
+		if err := ctx.kv.Delete(key); err != nil {
+			writeError(ctx.w, err)
+			return
+		}
+		deleted++
+	}
+	ctx.w.WriteInteger(deleted)
+}
+
+func existsCommand(s *Server, ctx *execCtx, args [][]byte) {
+	var count int64
+	for _, key := range args[1:] {
+		exists, err := s.exists(key)
+		if err != nil {
+			writeError(ctx.w, err)
+			return
+		}
+		if exists {
+			count++
+		}
+	}
+	ctx.w.WriteInteger(count)
+}
+
+// mgetCommand 基于同一个快照读取，保证多个key的一致性
+func mgetCommand(s *Server, ctx *execCtx, args [][]byte) {
+	snapshot := s.db.NewSnapshot()
+	defer snapshot.Release()
+
+	values := make([][]byte, len(args)-1)
+	for i, key := range args[1:] {
+		value, err := snapshot.Get(key)
+		if err != nil && !errors.Is(err, errs.ErrKeyNotFound) {
+			writeError(ctx.w, err)
+			return
+		}
+		values[i] = value
+		if err != nil {
+			values[i] = nil
+		}
+	}
+	ctx.w.WriteArrayLen(len(values))
+	for _, value := range values {
+		if value == nil {
+			ctx.w.WriteNull()
+			continue
+		}
+		ctx.w.WriteBulk(value)
+	}
+}
+
+// msetCommand 通过 WriteBatch 原子写入多个key
+func msetCommand(s *Server, ctx *execCtx, args [][]byte) {
+	if len(args)%2 != 1 {
+		ctx.w.WriteError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	// EXEC 中已经处于批量写中
+	if ctx.inExec {
+		for i := 1; i < len(args); i += 2 {
+			if err := ctx.kv.Put(args[i], args[i+1]); err != nil {
+				writeError(ctx.w, err)
+				return
+			}
+		}
+		ctx.w.WriteSimpleString("OK")
+		return
+	}
+
+	wb := s.db.NewWriteBatch(writeBatchOptions(len(args) / 2))
+	for i := 1; i < len(args); i += 2 {
+		if err := wb.Put(args[i], args[i+1]); err != nil {
+			writeError(ctx.w, err)
+			return
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteSimpleString("OK")
+}
+
+// ttlCommand key不存在返回-2，未设置过期时间返回-1
+func ttlCommand(s *Server, ctx *execCtx, args [][]byte) {
+	writeTTL(s, ctx, args[1], time.Second)
+}
+
+func pttlCommand(s *Server, ctx *execCtx, args [][]byte) {
+	writeTTL(s, ctx, args[1], time.Millisecond)
+}
+
+func writeTTL(s *Server, ctx *execCtx, key []byte, unit time.Duration) {
+	ttl, err := s.db.TTL(key)
+	if err != nil {
+		if errors.Is(err, errs.ErrKeyNotFound) {
+			ctx.w.WriteInteger(-2)
+			return
+		}
+		writeError(ctx.w, err)
+		return
+	}
+	if ttl == kv.NoExpiration {
+		ctx.w.WriteInteger(-1)
+		return
+	}
+	// 与 redis 一致，四舍五入到指定的单位
+	ctx.w.WriteInteger(int64((ttl + unit/2) / unit))
+}
+
+func expireCommand(s *Server, ctx *execCtx, args [][]byte) {
+	setExpire(s, ctx, args, time.Second)
+}
+
+func pexpireCommand(s *Server, ctx *execCtx, args [][]byte) {
+	setExpire(s, ctx, args, time.Millisecond)
+}
+
+// setExpire 设置成功返回1，key不存在返回0，非正数的过期时间直接删除key
+func setExpire(s *Server, ctx *execCtx, args [][]byte, unit time.Duration) {
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		ctx.w.WriteError(errNotInteger.Error())
+		return
+	}
+	exists, err := s.exists(args[1])
+	if err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	if !exists {
+		ctx.w.WriteInteger(0)
+		return
+	}
+	if n <= 0 {
+		err = ctx.kv.Delete(args[1])
+	} else {
+		err = ctx.kv.Expire(args[1], time.Duration(n)*unit)
+	}
+	if err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteInteger(1)
+}
+
+// persistCommand 移除过期时间返回1，key不存在或未设置过期时间返回0
+func persistCommand(s *Server, ctx *execCtx, args [][]byte) {
+	ttl, err := s.db.TTL(args[1])
+	if err != nil {
+		if errors.Is(err, errs.ErrKeyNotFound) {
+			ctx.w.WriteInteger(0)
+			return
+		}
+		writeError(ctx.w, err)
+		return
+	}
+	if ttl == kv.NoExpiration {
+		ctx.w.WriteInteger(0)
+		return
+	}
+	if err := ctx.kv.Persist(args[1]); err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteInteger(1)
+}
+
+// scanCommand SCAN cursor [MATCH pattern] [COUNT count]
+// 游标对应服务端保存的上一次返回的最后一个key，MATCH 的固定前缀用于前缀迭代
+func scanCommand(s *Server, ctx *execCtx, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		ctx.w.WriteError("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			ctx.w.WriteError(errSyntax.Error())
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				ctx.w.WriteError(errNotInteger.Error())
+				return
+			}
+			if n < 1 {
+				ctx.w.WriteError(errSyntax.Error())
+				return
+			}
+			count = n
+		default:
+			ctx.w.WriteError(errSyntax.Error())
+			return
+		}
+	}
+
+	var lastKey []byte
+	if cursor != 0 {
+		var ok bool
+		if lastKey, ok = s.cursors.get(cursor); !ok {
+			ctx.w.WriteError("ERR invalid cursor")
+			return
+		}
+	}
+
+	// 从上一页的最后一个key开始，不再从头遍历
+	iterOpts := kv.GetDefaultIteratorOptions()
+	iterOpts.Prefix = globPrefix(pattern)
+	iterOpts.LowerBound = lastKey
+	iterOpts.KeysOnly = true
+	iter := s.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	if iter.Valid() && bytes.Equal(iter.Key(), lastKey) {
+		iter.Next()
+	}
+
+	var keys [][]byte
+	for ; iter.Valid() && len(keys) < count; iter.Next() {
+		key := iter.Key()
+		if pattern == nil || matchGlob(pattern, key) {
+			keys = append(keys, key)
+		}
+		lastKey = key
+	}
+
+	var next uint64
+	if iter.Valid() {
+		next = s.cursors.put(lastKey)
+	}
+	ctx.w.WriteArrayLen(2)
+	ctx.w.WriteBulkString(strconv.FormatUint(next, 10))
+	ctx.w.WriteArrayLen(len(keys))
+	for _, key := range keys {
+		ctx.w.WriteBulk(key)
+	}
+}
+
+func keysCommand(s *Server, ctx *execCtx, args [][]byte) {
+	iterOpts := kv.GetDefaultIteratorOptions()
+	iterOpts.Prefix = globPrefix(args[1])
+	iterOpts.KeysOnly = true
+	iter := s.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if matchGlob(args[1], iter.Key()) {
+			keys = append(keys, iter.Key())
+		}
+	}
+	ctx.w.WriteArrayLen(len(keys))
+	for _, key := range keys {
+		ctx.w.WriteBulk(key)
+	}
+}
+
+// dbsizeCommand 使用索引中的key数量，不遍历所有key，已过期但还未清理的key也会计入
+func dbsizeCommand(s *Server, ctx *execCtx, args [][]byte) {
+	stat, err := s.db.Stat()
+	if err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteInteger(int64(stat.KeyNum))
+}
+
+func multiCommand(s *Server, ctx *execCtx, args [][]byte) {
+	ctx.c.multi = true
+	ctx.c.queued = nil
+	ctx.c.dirty = false
+	ctx.w.WriteSimpleString("OK")
+}
+
+func discardCommand(s *Server, ctx *execCtx, args [][]byte) {
+	if !ctx.c.multi {
+		ctx.w.WriteError("ERR DISCARD without MULTI")
+		return
+	}
+	resetMulti(ctx.c)
+	ctx.w.WriteSimpleString("OK")
+}
+
+// execCommand 排队的写命令写入同一个 WriteBatch 并原子提交
+// 排队的读命令读取的是 EXEC 开始时已提交的数据，看不到同一事务中之前的写入
+func execCommand(s *Server, ctx *execCtx, args [][]byte) {
+	c := ctx.c
+	if !c.multi {
+		ctx.w.WriteError("ERR EXEC without MULTI")
+		return
+	}
+	queued, dirty := c.queued, c.dirty
+	resetMulti(c)
+	if dirty {
+		ctx.w.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	// 先将回复写入缓冲，提交失败时整体返回错误
+	var buf bytes.Buffer
+	replies := NewWriter(&buf)
+	replies.SetProto(c.proto)
+
+	wb := s.db.NewWriteBatch(writeBatchOptions(len(queued) * 2))
+	execCtx := &execCtx{c: c, w: replies, kv: wb, inExec: true}
+	for _, cmdArgs := range queued {
+		commands[strings.ToLower(string(cmdArgs[0]))].handler(s, execCtx, cmdArgs)
+	}
+	if err := wb.Commit(); err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	if err := replies.Flush(); err != nil {
+		writeError(ctx.w, err)
+		return
+	}
+	ctx.w.WriteArrayLen(len(queued))
+	_, _ = ctx.w.wr.Write(buf.Bytes())
+}
+
+func resetMulti(c *client) {
+	c.multi = false
+	c.queued = nil
+	c.dirty = false
+}
+
+// exists 判断key是否存在
+func (s *Server) exists(key []byte) (bool, error) {
+	_, err := s.db.Get(key)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, errs.ErrKeyNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+func writeBatchOptions(size int) *kv.WriteBatchOptions {
+	opts := kv.GetDefaultWriteBatchOptions()
+	opts.MaxBatchSize = max(opts.MaxBatchSize, size)
+	return opts
+}
+
+func writeError(w *Writer, err error) {
+	w.WriteError("ERR " + err.Error())
+}
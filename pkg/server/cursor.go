@@ -0,0 +1,45 @@
+package server
+
+import "sync"
+
+const defaultCursorCacheSize = 4096
+
+// cursorCache 保存 SCAN 游标对应的最后一个key
+// redis 客户端要求游标为整数，超过容量时淘汰最早的游标
+type cursorCache struct {
+	lock    *sync.Mutex
+	next    uint64
+	keys    map[uint64][]byte
+	order   []uint64
+	maxSize int
+}
+
+func newCursorCache(maxSize int) *cursorCache {
+	return &cursorCache{
+		lock:    &sync.Mutex{},
+		keys:    map[uint64][]byte{},
+		maxSize: maxSize,
+	}
+}
+
+// put 保存key并返回新的游标，游标从1开始，0表示遍历结束
+func (c *cursorCache) put(key []byte) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.next++
+	c.keys[c.next] = key
+	c.order = append(c.order, c.next)
+	for len(c.order) > c.maxSize {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.next
+}
+
+func (c *cursorCache) get(cursor uint64) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key, ok := c.keys[cursor]
+	return key, ok
+}
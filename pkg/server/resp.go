@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP 协议版本
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+const (
+	maxBulkLen  = 512 * 1024 * 1024 // 与redis一致，单个参数最大512MB
+	maxArrayLen = 1024 * 1024
+)
+
+var (
+	ErrProtocol  = errors.New("protocol error")
+	crlf         = []byte("\r\n")
+	lineReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+)
+
+// Reader 读取客户端发送的命令
+type Reader struct {
+	rd *bufio.Reader
+}
+
+func NewReader(rd io.Reader) *Reader {
+	return &Reader{
+		rd: bufio.NewReader(rd),
+	}
+}
+
+// ReadCommand 读取一条命令，支持数组格式与inline格式
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		// inline 命令，例如 telnet 中直接输入
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArrayLen {
+		return nil, ErrProtocol
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for range n {
+		arg, err := r.ReadBulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// ReadReply 读取一条回复，用于客户端与测试
+// 简单字符串与整数以string与int64返回，数组与map以[]any返回，错误以error返回
+func (r *Reader) ReadReply() (any, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return errors.New(string(line[1:])), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		return r.readBulkBody(n)
+	case '*', '%':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]any, 0, n)
+		for range n {
+			item, err := r.ReadReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, ErrProtocol
+}
+
+// ReadBulk 读取一个bulk string
+func (r *Reader) ReadBulk() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, ErrProtocol
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxBulkLen {
+		return nil, ErrProtocol
+	}
+	return r.readBulkBody(n)
+}
+
+func (r *Reader) readBulkBody(n int) ([]byte, error) {
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(buf, crlf) {
+		return nil, ErrProtocol
+	}
+	return buf[:n], nil
+}
+
+// readLine 读取一行，去掉结尾的\r\n
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrProtocol
+		}
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return append([]byte(nil), line...), nil
+}
+
+// Writer 按照协议版本写入回复
+type Writer struct {
+	wr    *bufio.Writer
+	proto int
+}
+
+func NewWriter(wr io.Writer) *Writer {
+	return &Writer{
+		wr:    bufio.NewWriter(wr),
+		proto: RESP2,
+	}
+}
+
+// SetProto 设置协议版本
+func (w *Writer) SetProto(proto int) {
+	w.proto = proto
+}
+
+func (w *Writer) WriteSimpleString(s string) {
+	w.writeLine('+', s)
+}
+
+func (w *Writer) WriteError(s string) {
+	w.writeLine('-', s)
+}
+
+func (w *Writer) WriteInteger(n int64) {
+	w.writeLine(':', strconv.FormatInt(n, 10))
+}
+
+func (w *Writer) WriteBulk(b []byte) {
+	w.writeLine('$', strconv.Itoa(len(b)))
+	_, _ = w.wr.Write(b)
+	_, _ = w.wr.Write(crlf)
+}
+
+func (w *Writer) WriteBulkString(s string) {
+	w.WriteBulk([]byte(s))
+}
+
+// WriteNull 写入空值，RESP2 中为空的bulk string
+func (w *Writer) WriteNull() {
+	if w.proto == RESP3 {
+		w.writeLine('_', "")
+		return
+	}
+	w.writeLine('$', "-1")
+}
+
+// WriteNullArray 写入空数组，RESP2 中为长度为-1的数组
+func (w *Writer) WriteNullArray() {
+	if w.proto == RESP3 {
+		w.writeLine('_', "")
+		return
+	}
+	w.writeLine('*', "-1")
+}
+
+func (w *Writer) WriteArrayLen(n int) {
+	w.writeLine('*', strconv.Itoa(n))
+}
+
+// WriteMapLen 写入map长度，RESP2 中以两倍长度的数组表示
+func (w *Writer) WriteMapLen(n int) {
+	if w.proto == RESP3 {
+		w.writeLine('%', strconv.Itoa(n))
+		return
+	}
+	w.WriteArrayLen(n * 2)
+}
+
+// WriteCommand 以数组格式写入命令，用于客户端与测试
+func (w *Writer) WriteCommand(args ...[]byte) {
+	w.WriteArrayLen(len(args))
+	for _, arg := range args {
+		w.WriteBulk(arg)
+	}
+}
+
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+// writeLine 写入单行回复，内容可能来自客户端，其中的换行替换为空格，避免破坏协议
+func (w *Writer) writeLine(prefix byte, s string) {
+	_ = w.wr.WriteByte(prefix)
+	_, _ = w.wr.WriteString(lineReplacer.Replace(s))
+	_, _ = w.wr.Write(crlf)
+}
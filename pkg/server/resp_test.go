@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader_ReadCommand(t *testing.T) {
+	r := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\nPING hello\r\n\r\n"))
+
+	args, err := r.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("GET"), []byte("key")}, args)
+
+	// inline 命令
+	args, err = r.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("PING"), []byte("hello")}, args)
+
+	args, err = r.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(args))
+
+	r = NewReader(strings.NewReader("*1\r\n$a\r\n"))
+	_, err = r.ReadCommand()
+	assert.ErrorIs(t, err, ErrProtocol)
+}
+
+func TestWriter_Proto(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteNull()
+	w.WriteMapLen(1)
+	w.SetProto(RESP3)
+	w.WriteNull()
+	w.WriteMapLen(1)
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "$-1\r\n*2\r\n_\r\n%1\r\n", buf.String())
+
+	buf.Reset()
+	w.WriteCommand([]byte("SET"), []byte("k"), []byte("v"))
+	assert.Nil(t, w.Flush())
+	args, err := NewReader(&buf).ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("k"), []byte("v")}, args)
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		str     string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a/*/c", "a/b/c", true},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"h[ae", "ha", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchGlob([]byte(c.pattern), []byte(c.str)), c.pattern+" "+c.str)
+	}
+	assert.Equal(t, []byte("user:"), globPrefix([]byte("user:*")))
+	assert.Equal(t, []byte("a"), globPrefix([]byte("a\\*")))
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+// Server 基于 RESP 协议的服务端，将 redis 命令映射到 kv.DB
+type Server struct {
+	db       *kv.DB
+	lock     *sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       *sync.WaitGroup
+	closed   bool
+	cursors  *cursorCache
+	clientId atomic.Int64
+}
+
+// client 一个客户端连接的状态
+type client struct {
+	id     int64
+	conn   net.Conn
+	reader *Reader
+	writer *Writer
+	proto  int
+	multi  bool       // 是否处于 MULTI 中
+	queued [][][]byte // MULTI 中排队的命令
+	dirty  bool       // MULTI 中有命令入队失败，EXEC 时放弃执行
+	quit   bool
+}
+
+func NewServer(db *kv.DB) *Server {
+	return &Server{
+		db:      db,
+		lock:    &sync.Mutex{},
+		conns:   map[net.Conn]struct{}{},
+		wg:      &sync.WaitGroup{},
+		cursors: newCursorCache(defaultCursorCacheSize),
+	}
+}
+
+// ListenAndServe 监听地址并处理连接，直到 Close 被调用
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve 在给定的 listener 上处理连接，直到 Close 被调用
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		_ = l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+// Addr 返回监听的地址，未开始监听时返回nil
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close 停止监听并关闭所有连接，不会关闭底层的 kv.DB
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// handleConn 处理一个连接上的所有命令
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+
+	c := &client{
+		id:     s.clientId.Add(1),
+		conn:   conn,
+		reader: NewReader(conn),
+		writer: NewWriter(conn),
+		proto:  RESP2,
+	}
+	for !c.quit {
+		args, err := c.reader.ReadCommand()
+		if err != nil {
+			// 协议错误时告知客户端后断开，其余错误说明连接已不可用
+			if errors.Is(err, ErrProtocol) {
+				c.writer.WriteError("ERR Protocol error")
+				_ = c.writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.dispatch(c, args)
+
+		// 管道中还有未读取的命令时延迟刷新
+		if c.reader.rd.Buffered() == 0 || c.quit {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
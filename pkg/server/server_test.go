@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient struct {
+	conn   net.Conn
+	reader *Reader
+	writer *Writer
+}
+
+func (c *testClient) do(t *testing.T, args ...string) any {
+	bs := make([][]byte, len(args))
+	for i, arg := range args {
+		bs[i] = []byte(arg)
+	}
+	c.writer.WriteCommand(bs...)
+	assert.Nil(t, c.writer.Flush())
+	reply, err := c.reader.ReadReply()
+	assert.Nil(t, err)
+	return reply
+}
+
+func startTestServer(t *testing.T) (*Server, *testClient) {
+	opts := kv.GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "hifidb-server")
+	opts.DirPath = dir
+	db, err := kv.Open(opts)
+	assert.Nil(t, err)
+
+	srv := NewServer(db)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = srv.Close()
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return srv, &testClient{conn: conn, reader: NewReader(conn), writer: NewWriter(conn)}
+}
+
+func TestServer_Strings(t *testing.T) {
+	_, c := startTestServer(t)
+
+	assert.Equal(t, "PONG", c.do(t, "PING"))
+	assert.Equal(t, "OK", c.do(t, "SET", "k1", "v1"))
+	assert.Equal(t, []byte("v1"), c.do(t, "GET", "k1"))
+	assert.Nil(t, c.do(t, "GET", "missing"))
+
+	assert.Nil(t, c.do(t, "SET", "k1", "v2", "NX"))
+	assert.Equal(t, "OK", c.do(t, "SET", "k1", "v2", "XX"))
+	assert.Nil(t, c.do(t, "SET", "k2", "v2", "XX"))
+
+	assert.Equal(t, "OK", c.do(t, "MSET", "a", "1", "b", "2"))
+	assert.Equal(t, []any{[]byte("1"), nil, []byte("2")}, c.do(t, "MGET", "a", "missing", "b"))
+	assert.Equal(t, int64(2), c.do(t, "EXISTS", "a", "b", "c"))
+	assert.Equal(t, int64(1), c.do(t, "DEL", "a", "c"))
+	assert.Equal(t, int64(2), c.do(t, "DBSIZE"))
+
+	reply := c.do(t, "FOO")
+	assert.Equal(t, errors.New("ERR unknown command 'FOO'"), reply)
+	// 命令名中的换行不会破坏回复
+	reply = c.do(t, "FOO\r\n+OK")
+	assert.Equal(t, errors.New("ERR unknown command 'FOO  +OK'"), reply)
+	assert.Equal(t, "PONG", c.do(t, "PING"))
+	reply = c.do(t, "GET")
+	assert.Equal(t, errors.New("ERR wrong number of arguments for 'get' command"), reply)
+}
+
+func TestServer_TTL(t *testing.T) {
+	_, c := startTestServer(t)
+
+	assert.Equal(t, int64(-2), c.do(t, "TTL", "k"))
+	assert.Equal(t, "OK", c.do(t, "SET", "k", "v"))
+	assert.Equal(t, int64(-1), c.do(t, "TTL", "k"))
+	assert.Equal(t, int64(1), c.do(t, "EXPIRE", "k", "100"))
+	assert.Equal(t, int64(100), c.do(t, "TTL", "k"))
+	assert.Equal(t, int64(1), c.do(t, "PERSIST", "k"))
+	assert.Equal(t, int64(-1), c.do(t, "TTL", "k"))
+
+	assert.Equal(t, "OK", c.do(t, "SET", "k2", "v", "EX", "10"))
+	ttl := c.do(t, "PTTL", "k2").(int64)
+	assert.True(t, ttl > 9000 && ttl <= 10000)
+
+	// 非正数的过期时间直接删除key
+	assert.Equal(t, int64(1), c.do(t, "EXPIRE", "k2", "0"))
+	assert.Nil(t, c.do(t, "GET", "k2"))
+}
+
+func TestServer_MultiExec(t *testing.T) {
+	_, c := startTestServer(t)
+
+	assert.Equal(t, "OK", c.do(t, "SET", "k", "old"))
+	assert.Equal(t, "OK", c.do(t, "MULTI"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "k", "new"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "k2", "v2"))
+	assert.Equal(t, "QUEUED", c.do(t, "GET", "k"))
+	// 读取的是 EXEC 之前已提交的数据
+	assert.Equal(t, []any{"OK", "OK", []byte("old")}, c.do(t, "EXEC"))
+	assert.Equal(t, []byte("new"), c.do(t, "GET", "k"))
+	assert.Equal(t, []byte("v2"), c.do(t, "GET", "k2"))
+
+	// 入队失败后 EXEC 放弃整个事务
+	assert.Equal(t, "OK", c.do(t, "MULTI"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "k3", "v3"))
+	_, ok := c.do(t, "GET").(error)
+	assert.True(t, ok)
+	_, ok = c.do(t, "EXEC").(error)
+	assert.True(t, ok)
+	assert.Nil(t, c.do(t, "GET", "k3"))
+
+	assert.Equal(t, "OK", c.do(t, "MULTI"))
+	assert.Equal(t, "QUEUED", c.do(t, "SET", "k3", "v3"))
+	assert.Equal(t, "OK", c.do(t, "DISCARD"))
+	assert.Nil(t, c.do(t, "GET", "k3"))
+}
+
+func TestServer_Scan(t *testing.T) {
+	_, c := startTestServer(t)
+
+	for i := range 25 {
+		c.do(t, "SET", "user:"+string(rune('a'+i)), "v")
+	}
+	c.do(t, "SET", "order:1", "v")
+
+	var keys []any
+	cursor := "0"
+	for {
+		reply := c.do(t, "SCAN", cursor, "MATCH", "user:*", "COUNT", "10").([]any)
+		keys = append(keys, reply[1].([]any)...)
+		cursor = string(reply[0].([]byte))
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 25, len(keys))
+	assert.Equal(t, 25, len(c.do(t, "KEYS", "user:*").([]any)))
+	assert.Equal(t, 26, len(c.do(t, "KEYS", "*").([]any)))
+}
+
+func TestServer_Hello(t *testing.T) {
+	_, c := startTestServer(t)
+
+	reply := c.do(t, "HELLO", "3").([]any)
+	assert.Equal(t, []byte("proto"), reply[4])
+	assert.Equal(t, int64(3), reply[5])
+
+	// RESP3 下空值使用 null 类型
+	c.writer.WriteCommand([]byte("GET"), []byte("missing"))
+	assert.Nil(t, c.writer.Flush())
+	line, err := c.reader.readLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "_", string(line))
+
+	_, ok := c.do(t, "HELLO", "4").(error)
+	assert.True(t, ok)
+}
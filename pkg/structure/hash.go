@@ -0,0 +1,116 @@
+package structure
+
+import (
+	"errors"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// HSet 设置hash中field的值，field是新增的返回true
+func (ds *DataStructure) HSet(key, field, value []byte) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, Hash)
+	if err != nil {
+		return false, err
+	}
+
+	fieldKey := subKey(key, meta.version, field)
+	exist, err := ds.exists(meta, fieldKey)
+	if err != nil {
+		return false, err
+	}
+
+	wb := ds.newWriteBatch()
+	if !exist {
+		meta.size++
+		if err := saveMetadata(wb, key, meta); err != nil {
+			return false, err
+		}
+	}
+	if err := wb.Put(fieldKey, value); err != nil {
+		return false, err
+	}
+	if err := wb.Commit(); err != nil {
+		return false, err
+	}
+	return !exist, nil
+}
+
+// HGet 获取hash中field的值
+func (ds *DataStructure) HGet(key, field []byte) ([]byte, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, Hash)
+	if err != nil {
+		return nil, err
+	}
+	if meta.size == 0 {
+		return nil, errs.ErrKeyNotFound
+	}
+	return ds.db.Get(subKey(key, meta.version, field))
+}
+
+// HDel 删除hash中的field，field存在时返回true
+func (ds *DataStructure) HDel(key, field []byte) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, Hash)
+	if err != nil {
+		return false, err
+	}
+
+	fieldKey := subKey(key, meta.version, field)
+	exist, err := ds.exists(meta, fieldKey)
+	if err != nil || !exist {
+		return false, err
+	}
+
+	wb := ds.newWriteBatch()
+	meta.size--
+	if err := saveMetadata(wb, key, meta); err != nil {
+		return false, err
+	}
+	if err := wb.Delete(fieldKey); err != nil {
+		return false, err
+	}
+	if err := wb.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HLen 获取hash中field的数量
+func (ds *DataStructure) HLen(key []byte) (uint32, error) {
+	return ds.size(key, Hash)
+}
+
+// exists 判断子key是否存在，新创建的结构没有任何子key
+func (ds *DataStructure) exists(meta *metadata, subKey []byte) (bool, error) {
+	if meta.size == 0 {
+		return false, nil
+	}
+	_, err := ds.db.Get(subKey)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, errs.ErrKeyNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// size 获取数据结构中元素的数量
+func (ds *DataStructure) size(key []byte, dataType DataType) (uint32, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, dataType)
+	if err != nil {
+		return 0, err
+	}
+	return meta.size, nil
+}
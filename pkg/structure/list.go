@@ -0,0 +1,145 @@
+package structure
+
+import (
+	"encoding/binary"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+)
+
+// LPush 从list头部插入元素，返回插入后list的长度
+func (ds *DataStructure) LPush(key, element []byte) (uint32, error) {
+	return ds.pushInner(key, element, true)
+}
+
+// RPush 从list尾部插入元素，返回插入后list的长度
+func (ds *DataStructure) RPush(key, element []byte) (uint32, error) {
+	return ds.pushInner(key, element, false)
+}
+
+// LPop 弹出list头部的元素
+func (ds *DataStructure) LPop(key []byte) ([]byte, error) {
+	return ds.popInner(key, true)
+}
+
+// RPop 弹出list尾部的元素
+func (ds *DataStructure) RPop(key []byte) ([]byte, error) {
+	return ds.popInner(key, false)
+}
+
+// LRange 获取list中 [start, stop] 范围内的元素，负数表示从尾部开始计数
+func (ds *DataStructure) LRange(key []byte, start, stop int) ([][]byte, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, List)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(meta.size)
+	if start < 0 {
+		start = max(size+start, 0)
+	}
+	if stop < 0 {
+		stop = size + stop
+	}
+	stop = min(stop, size-1)
+	if start > stop {
+		return [][]byte{}, nil
+	}
+
+	elements := make([][]byte, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		element, err := ds.db.Get(listElementKey(key, meta.version, meta.head+uint64(i)))
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// LLen 获取list的长度
+func (ds *DataStructure) LLen(key []byte) (uint32, error) {
+	return ds.size(key, List)
+}
+
+func (ds *DataStructure) pushInner(key, element []byte, isLeft bool) (uint32, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, List)
+	if err != nil {
+		return 0, err
+	}
+
+	var index uint64
+	if isLeft {
+		meta.head--
+		index = meta.head
+	} else {
+		index = meta.tail
+		meta.tail++
+	}
+	meta.size++
+
+	wb := ds.newWriteBatch()
+	if err := saveMetadata(wb, key, meta); err != nil {
+		return 0, err
+	}
+	if err := wb.Put(listElementKey(key, meta.version, index), element); err != nil {
+		return 0, err
+	}
+	if err := wb.Commit(); err != nil {
+		return 0, err
+	}
+	return meta.size, nil
+}
+
+func (ds *DataStructure) popInner(key []byte, isLeft bool) ([]byte, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, List)
+	if err != nil {
+		return nil, err
+	}
+	if meta.size == 0 {
+		return nil, errs.ErrKeyNotFound
+	}
+
+	var index uint64
+	if isLeft {
+		index = meta.head
+		meta.head++
+	} else {
+		meta.tail--
+		index = meta.tail
+	}
+	meta.size--
+
+	elementKey := listElementKey(key, meta.version, index)
+	element, err := ds.db.Get(elementKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wb := ds.newWriteBatch()
+	if err := saveMetadata(wb, key, meta); err != nil {
+		return nil, err
+	}
+	if err := wb.Delete(elementKey); err != nil {
+		return nil, err
+	}
+	if err := wb.Commit(); err != nil {
+		return nil, err
+	}
+	return element, nil
+}
+
+// listElementKey 元素的位置使用大端序编码
+func listElementKey(key []byte, version uint64, index uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	return subKey(key, version, buf)
+}
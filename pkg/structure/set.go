@@ -0,0 +1,78 @@
+package structure
+
+// SAdd 向set中添加成员，成员是新增的返回true
+func (ds *DataStructure) SAdd(key, member []byte) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, Set)
+	if err != nil {
+		return false, err
+	}
+
+	memberKey := subKey(key, meta.version, member)
+	exist, err := ds.exists(meta, memberKey)
+	if err != nil || exist {
+		return false, err
+	}
+
+	wb := ds.newWriteBatch()
+	meta.size++
+	if err := saveMetadata(wb, key, meta); err != nil {
+		return false, err
+	}
+	if err := wb.Put(memberKey, nil); err != nil {
+		return false, err
+	}
+	if err := wb.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SIsMember 判断成员是否在set中
+func (ds *DataStructure) SIsMember(key, member []byte) (bool, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, Set)
+	if err != nil {
+		return false, err
+	}
+	return ds.exists(meta, subKey(key, meta.version, member))
+}
+
+// SRem 从set中删除成员，成员存在时返回true
+func (ds *DataStructure) SRem(key, member []byte) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, Set)
+	if err != nil {
+		return false, err
+	}
+
+	memberKey := subKey(key, meta.version, member)
+	exist, err := ds.exists(meta, memberKey)
+	if err != nil || !exist {
+		return false, err
+	}
+
+	wb := ds.newWriteBatch()
+	meta.size--
+	if err := saveMetadata(wb, key, meta); err != nil {
+		return false, err
+	}
+	if err := wb.Delete(memberKey); err != nil {
+		return false, err
+	}
+	if err := wb.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SCard 获取set中成员的数量
+func (ds *DataStructure) SCard(key []byte) (uint32, error) {
+	return ds.size(key, Set)
+}
@@ -0,0 +1,235 @@
+package structure
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+// DataType 数据结构类型
+type DataType = byte
+
+const (
+	Hash DataType = iota + 1
+	Set
+	List
+	ZSet
+)
+
+// 元数据最大长度 type + version + size + head + tail
+const maxMetadataSize = 1 + binary.MaxVarintLen64*4
+
+// List 的头尾从中间开始，两端都可以继续扩展
+const initialListMark = uint64(1) << 63
+
+// versionKey 保存已分配的最大版本号，是保留的key，不能用作数据结构的key
+// 子key以key的长度开头，空key不是合法的key，因此以0开头的key不会与子key冲突
+var versionKey = []byte("\x00structure-version")
+
+// DataStructure 在 kv.DB 之上实现 Hash、Set、List、ZSet
+// 每个key对应一条元数据，元素以子key的形式单独存储，修改单个元素时无需重写整个结构
+// 多个key的修改通过 WriteBatch 原子提交
+type DataStructure struct {
+	db          *kv.DB
+	lock        *sync.RWMutex // 串行化读取元数据再写入的过程
+	versionLock *sync.Mutex   // 读取元数据时也会分配版本号，单独加锁
+	version     uint64        // 已分配的最大版本号，0 表示还未从存储中读取
+}
+
+func NewDataStructure(db *kv.DB) *DataStructure {
+	return &DataStructure{
+		db:          db,
+		lock:        &sync.RWMutex{},
+		versionLock: &sync.Mutex{},
+	}
+}
+
+// metadata 数据结构的元数据，存储在用户key上
+type metadata struct {
+	dataType DataType
+	version  uint64 // 重新创建时版本号变化，旧版本的子key不再可见
+	size     uint32
+	head     uint64 // List 专用，元素的范围为 [head, tail)
+	tail     uint64
+	created  bool // 新创建的元数据，保存时需要一起保存分配的版本号
+}
+
+func encodeMetadata(meta *metadata) []byte {
+	buf := make([]byte, maxMetadataSize)
+	buf[0] = meta.dataType
+	index := 1
+	index += binary.PutUvarint(buf[index:], meta.version)
+	index += binary.PutUvarint(buf[index:], uint64(meta.size))
+	if meta.dataType == List {
+		index += binary.PutUvarint(buf[index:], meta.head)
+		index += binary.PutUvarint(buf[index:], meta.tail)
+	}
+	return buf[:index]
+}
+
+func decodeMetadata(buf []byte) (*metadata, error) {
+	if len(buf) == 0 || buf[0] < Hash || buf[0] > ZSet {
+		return nil, errs.ErrWrongType
+	}
+	meta := &metadata{dataType: buf[0]}
+	index := 1
+	readUvarint := func() uint64 {
+		if index < 0 {
+			return 0
+		}
+		v, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			index = -1
+			return 0
+		}
+		index += n
+		return v
+	}
+	meta.version = readUvarint()
+	meta.size = uint32(readUvarint())
+	if meta.dataType == List {
+		meta.head = readUvarint()
+		meta.tail = readUvarint()
+	}
+	if index < 0 {
+		return nil, errs.ErrWrongType
+	}
+	return meta, nil
+}
+
+// findMetadata 获取key的元数据，key不存在时返回一个新的元数据
+func (ds *DataStructure) findMetadata(key []byte, dataType DataType) (*metadata, error) {
+	buf, err := ds.db.Get(key)
+	if err != nil && !errors.Is(err, errs.ErrKeyNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		meta, err := decodeMetadata(buf)
+		if err != nil {
+			return nil, err
+		}
+		if meta.dataType != dataType {
+			return nil, errs.ErrWrongType
+		}
+		return meta, nil
+	}
+
+	version, err := ds.nextVersion()
+	if err != nil {
+		return nil, err
+	}
+	meta := &metadata{
+		dataType: dataType,
+		version:  version,
+		created:  true,
+	}
+	if dataType == List {
+		meta.head = initialListMark
+		meta.tail = initialListMark
+	}
+	return meta, nil
+}
+
+// nextVersion 分配新的版本号，版本号单调递增，不受系统时间变化的影响
+func (ds *DataStructure) nextVersion() (uint64, error) {
+	ds.versionLock.Lock()
+	defer ds.versionLock.Unlock()
+
+	if ds.version == 0 {
+		buf, err := ds.db.Get(versionKey)
+		if err != nil && !errors.Is(err, errs.ErrKeyNotFound) {
+			return 0, err
+		}
+		if err == nil {
+			version, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return 0, errs.ErrDataDirCorrupted
+			}
+			ds.version = version
+		}
+	}
+	ds.version++
+	return ds.version, nil
+}
+
+// saveMetadata 将元数据写入批量写，元素为空时删除key
+// 新创建的元数据与分配的版本号在同一个批量中保存，写入串行执行，保存的版本号不会变小
+func saveMetadata(wb *kv.WriteBatch, key []byte, meta *metadata) error {
+	if meta.size == 0 {
+		return wb.Delete(key)
+	}
+	if meta.created {
+		if err := wb.Put(versionKey, binary.AppendUvarint(nil, meta.version)); err != nil {
+			return err
+		}
+	}
+	return wb.Put(key, encodeMetadata(meta))
+}
+
+// Type 获取key的数据结构类型
+func (ds *DataStructure) Type(key []byte) (DataType, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	buf, err := ds.db.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	meta, err := decodeMetadata(buf)
+	if err != nil {
+		return 0, err
+	}
+	return meta.dataType, nil
+}
+
+// Del 删除整个数据结构，元数据与所有子key在同一个批量中删除
+// 子key只写入一条范围删除记录，不需要逐个删除
+func (ds *DataStructure) Del(key []byte) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	buf, err := ds.db.Get(key)
+	if errors.Is(err, errs.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	wb := ds.newWriteBatch()
+	// 不是数据结构的key没有子key
+	if meta, err := decodeMetadata(buf); err == nil {
+		if err := wb.DeletePrefix(subKeyPrefix(key, meta.version)); err != nil {
+			return err
+		}
+	}
+	if err := wb.Delete(key); err != nil {
+		return err
+	}
+	return wb.Commit()
+}
+
+func (ds *DataStructure) newWriteBatch() *kv.WriteBatch {
+	return ds.db.NewWriteBatch(kv.GetDefaultWriteBatchOptions())
+}
+
+// subKeyPrefix 子key的公共前缀 keySize | key | version
+// key长度编码在最前面，避免一个key是另一个key前缀时子key混淆
+func subKeyPrefix(key []byte, version uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+len(key)+8)
+	index := binary.PutUvarint(buf, uint64(len(key)))
+	index += copy(buf[index:], key)
+	binary.BigEndian.PutUint64(buf[index:], version)
+	return buf[:index+8]
+}
+
+// subKey 前缀之后拼接若干部分
+func subKey(key []byte, version uint64, parts ...[]byte) []byte {
+	buf := subKeyPrefix(key, version)
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
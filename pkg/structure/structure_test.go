@@ -0,0 +1,210 @@
+package structure
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDataStructure(t *testing.T) *DataStructure {
+	opts := kv.GetDBDefaultOptions()
+	dir, _ := os.MkdirTemp("", "hifidb-structure")
+	opts.DirPath = dir
+	db, err := kv.Open(opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return NewDataStructure(db)
+}
+
+func TestDataStructure_Hash(t *testing.T) {
+	ds := openTestDataStructure(t)
+
+	ok, err := ds.HSet([]byte("h"), []byte("f1"), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ds.HSet([]byte("h"), []byte("f1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = ds.HSet([]byte("h"), []byte("f2"), []byte("v3"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	val, err := ds.HGet([]byte("h"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = ds.HGet([]byte("h"), []byte("f3"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	size, err := ds.HLen([]byte("h"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), size)
+
+	ok, err = ds.HDel([]byte("h"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ds.HDel([]byte("h"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 删除最后一个field后key也被删除
+	ok, err = ds.HDel([]byte("h"), []byte("f2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = ds.Type([]byte("h"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+}
+
+func TestDataStructure_Set(t *testing.T) {
+	ds := openTestDataStructure(t)
+
+	ok, err := ds.SAdd([]byte("s"), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ds.SAdd([]byte("s"), []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, _ = ds.SAdd([]byte("s"), []byte("b"))
+
+	ok, err = ds.SIsMember([]byte("s"), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ds.SIsMember([]byte("s"), []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = ds.SRem([]byte("s"), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = ds.SIsMember([]byte("s"), []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	size, err := ds.SCard([]byte("s"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), size)
+
+	// 类型不匹配
+	_, err = ds.HSet([]byte("s"), []byte("f"), []byte("v"))
+	assert.Equal(t, errs.ErrWrongType, err)
+}
+
+func TestDataStructure_List(t *testing.T) {
+	ds := openTestDataStructure(t)
+
+	for _, e := range []string{"b", "a"} {
+		_, err := ds.LPush([]byte("l"), []byte(e))
+		assert.Nil(t, err)
+	}
+	size, err := ds.RPush([]byte("l"), []byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), size)
+
+	elements, err := ds.LRange([]byte("l"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, elements)
+	elements, err = ds.LRange([]byte("l"), -2, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, elements)
+	elements, err = ds.LRange([]byte("l"), 2, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(elements))
+
+	val, err := ds.RPop([]byte("l"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), val)
+	val, err = ds.LPop([]byte("l"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), val)
+	val, err = ds.RPop([]byte("l"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+	_, err = ds.RPop([]byte("l"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+}
+
+func TestDataStructure_ZSet(t *testing.T) {
+	ds := openTestDataStructure(t)
+
+	for member, score := range map[string]float64{"a": 3, "b": -1.5, "c": 10, "d": 0} {
+		ok, err := ds.ZAdd([]byte("z"), score, []byte(member))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+	ok, err := ds.ZAdd([]byte("z"), 20, []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	score, err := ds.ZScore([]byte("z"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(20), score)
+
+	members, err := ds.ZRangeByScore([]byte("z"), -2, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []ZMember{
+		{Member: []byte("b"), Score: -1.5},
+		{Member: []byte("d"), Score: 0},
+		{Member: []byte("c"), Score: 10},
+	}, members)
+
+	rank, err := ds.ZRank([]byte("z"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, rank)
+	rank, err = ds.ZRank([]byte("z"), []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rank)
+	_, err = ds.ZRank([]byte("z"), []byte("x"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+
+	ok, err = ds.ZRem([]byte("z"), []byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	rank, err = ds.ZRank([]byte("z"), []byte("d"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rank)
+	size, err := ds.ZCard([]byte("z"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), size)
+}
+
+func TestDataStructure_Recreate(t *testing.T) {
+	ds := openTestDataStructure(t)
+
+	_, _ = ds.HSet([]byte("h"), []byte("f1"), []byte("v1"))
+	_, _ = ds.ZAdd([]byte("z"), 1, []byte("a"))
+	_, _ = ds.ZAdd([]byte("z"), 2, []byte("b"))
+	assert.Nil(t, ds.Del([]byte("h")))
+	assert.Nil(t, ds.Del([]byte("z")))
+	assert.Nil(t, ds.Del([]byte("missing")))
+
+	// 元数据与子key一起删除，只剩下保存的版本号
+	assert.Equal(t, [][]byte{versionKey}, ds.db.ListKeys())
+
+	// 重新创建后旧版本的field不可见
+	_, _ = ds.HSet([]byte("h"), []byte("f2"), []byte("v2"))
+	_, err := ds.HGet([]byte("h"), []byte("f1"))
+	assert.Equal(t, errs.ErrKeyNotFound, err)
+	size, err := ds.HLen([]byte("h"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), size)
+
+	// 版本号持久化，重新创建的实例继续递增
+	meta, err := ds.findMetadata([]byte("h"), Hash)
+	assert.Nil(t, err)
+	ds2 := NewDataStructure(ds.db)
+	meta2, err := ds2.findMetadata([]byte("h2"), Hash)
+	assert.Nil(t, err)
+	assert.Greater(t, meta2.version, meta.version)
+}
+
+func TestScoreEncoding(t *testing.T) {
+	scores := []float64{-1e10, -2.5, -0.1, 0, 0.1, 1, 1e10}
+	for i := 1; i < len(scores); i++ {
+		assert.Equal(t, -1, bytes.Compare(encodeScore(scores[i-1]), encodeScore(scores[i])))
+		assert.Equal(t, scores[i], decodeScore(encodeScore(scores[i])))
+	}
+}
@@ -0,0 +1,232 @@
+package structure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/kamijoucen/hifidb/pkg/errs"
+	"github.com/kamijoucen/hifidb/pkg/kv"
+)
+
+// zset 的每个成员有两个子key
+// 成员key prefix | 'm' | member 存储分数，用于按成员查找
+// 分数key prefix | 's' | score | member 值为空，按分数有序，用于范围查询与排名
+const (
+	zsetMemberTag byte = 'm'
+	zsetScoreTag  byte = 's'
+)
+
+// ZMember zset 中的成员与分数
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+// ZAdd 向zset中添加成员或更新成员的分数，成员是新增的返回true
+func (ds *DataStructure) ZAdd(key []byte, score float64, member []byte) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, ZSet)
+	if err != nil {
+		return false, err
+	}
+
+	oldScore, exist, err := ds.zscore(key, meta, member)
+	if err != nil {
+		return false, err
+	}
+	if exist && oldScore == score {
+		return false, nil
+	}
+
+	wb := ds.newWriteBatch()
+	if exist {
+		// 删除旧分数对应的分数key
+		if err := wb.Delete(zsetScoreKey(key, meta.version, oldScore, member)); err != nil {
+			return false, err
+		}
+	} else {
+		meta.size++
+		if err := saveMetadata(wb, key, meta); err != nil {
+			return false, err
+		}
+	}
+	if err := wb.Put(zsetMemberKey(key, meta.version, member), encodeScore(score)); err != nil {
+		return false, err
+	}
+	if err := wb.Put(zsetScoreKey(key, meta.version, score, member), nil); err != nil {
+		return false, err
+	}
+	if err := wb.Commit(); err != nil {
+		return false, err
+	}
+	return !exist, nil
+}
+
+// ZScore 获取成员的分数
+func (ds *DataStructure) ZScore(key, member []byte) (float64, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, ZSet)
+	if err != nil {
+		return 0, err
+	}
+	score, exist, err := ds.zscore(key, meta, member)
+	if err != nil {
+		return 0, err
+	}
+	if !exist {
+		return 0, errs.ErrKeyNotFound
+	}
+	return score, nil
+}
+
+// ZRem 从zset中删除成员，成员存在时返回true
+func (ds *DataStructure) ZRem(key, member []byte) (bool, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	meta, err := ds.findMetadata(key, ZSet)
+	if err != nil {
+		return false, err
+	}
+	score, exist, err := ds.zscore(key, meta, member)
+	if err != nil || !exist {
+		return false, err
+	}
+
+	wb := ds.newWriteBatch()
+	meta.size--
+	if err := saveMetadata(wb, key, meta); err != nil {
+		return false, err
+	}
+	if err := wb.Delete(zsetMemberKey(key, meta.version, member)); err != nil {
+		return false, err
+	}
+	if err := wb.Delete(zsetScoreKey(key, meta.version, score, member)); err != nil {
+		return false, err
+	}
+	if err := wb.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ZRangeByScore 按分数从小到大获取分数在 [min, max] 范围内的成员
+func (ds *DataStructure) ZRangeByScore(key []byte, min, max float64) ([]ZMember, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, ZSet)
+	if err != nil {
+		return nil, err
+	}
+	members := []ZMember{}
+	if meta.size == 0 || min > max {
+		return members, nil
+	}
+
+	prefix := subKey(key, meta.version, []byte{zsetScoreTag})
+	iterOpts := kv.GetDefaultIteratorOptions()
+	iterOpts.Prefix = prefix
+	iter := ds.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	for iter.Seek(append(prefix, encodeScore(min)...)); iter.Valid(); iter.Next() {
+		score, member := parseZSetScoreKey(iter.Key(), len(prefix))
+		if score > max {
+			break
+		}
+		members = append(members, ZMember{Member: member, Score: score})
+	}
+	return members, nil
+}
+
+// ZRank 获取成员按分数从小到大的排名，从0开始
+func (ds *DataStructure) ZRank(key, member []byte) (int, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	meta, err := ds.findMetadata(key, ZSet)
+	if err != nil {
+		return 0, err
+	}
+	score, exist, err := ds.zscore(key, meta, member)
+	if err != nil {
+		return 0, err
+	}
+	if !exist {
+		return 0, errs.ErrKeyNotFound
+	}
+
+	// 统计分数key排在该成员之前的数量
+	target := zsetScoreKey(key, meta.version, score, member)
+	iterOpts := kv.GetDefaultIteratorOptions()
+	iterOpts.Prefix = subKey(key, meta.version, []byte{zsetScoreTag})
+	iter := ds.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	rank := 0
+	for iter.Rewind(); iter.Valid() && bytes.Compare(iter.Key(), target) < 0; iter.Next() {
+		rank++
+	}
+	return rank, nil
+}
+
+// ZCard 获取zset中成员的数量
+func (ds *DataStructure) ZCard(key []byte) (uint32, error) {
+	return ds.size(key, ZSet)
+}
+
+func (ds *DataStructure) zscore(key []byte, meta *metadata, member []byte) (float64, bool, error) {
+	memberKey := zsetMemberKey(key, meta.version, member)
+	exist, err := ds.exists(meta, memberKey)
+	if err != nil || !exist {
+		return 0, false, err
+	}
+	buf, err := ds.db.Get(memberKey)
+	if err != nil {
+		return 0, false, err
+	}
+	return decodeScore(buf), true, nil
+}
+
+func zsetMemberKey(key []byte, version uint64, member []byte) []byte {
+	return subKey(key, version, []byte{zsetMemberTag}, member)
+}
+
+func zsetScoreKey(key []byte, version uint64, score float64, member []byte) []byte {
+	return subKey(key, version, []byte{zsetScoreTag}, encodeScore(score), member)
+}
+
+func parseZSetScoreKey(scoreKey []byte, prefixLen int) (float64, []byte) {
+	score := decodeScore(scoreKey[prefixLen : prefixLen+8])
+	return score, scoreKey[prefixLen+8:]
+}
+
+// encodeScore 将分数编码为按字节序与数值顺序一致的8字节
+// 正数翻转符号位，负数翻转所有位
+func encodeScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, bits)
+	return buf
+}
+
+func decodeScore(buf []byte) float64 {
+	bits := binary.BigEndian.Uint64(buf)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}